@@ -166,7 +166,7 @@ func main() {
 	fileRepo := &repo.FileRepository{DB: db, S3Config: s3Config, QueueRepo: queueRepo,
 		ObjectRepo: objectRepo, ObjectCleanupRepo: objectCleanupRepo,
 		ObjectCopiesRepo: objectCopiesRepo, UsageRepo: usageRepo}
-	fileDataRepo := &fileDataRepo.Repository{DB: db}
+	fileDataRepo := &fileDataRepo.Repository{DB: db, InstanceID: viper.GetString("replication.instance-id")}
 	familyRepo := &repo.FamilyRepository{DB: db}
 	trashRepo := &repo.TrashRepository{DB: db, ObjectRepo: objectRepo, FileRepo: fileRepo, QueueRepo: queueRepo}
 	publicCollectionRepo := repo.NewPublicCollectionRepository(db, viper.GetString("apps.public-albums"))
@@ -394,7 +394,8 @@ func main() {
 	publicCollectionAPI.Use(rateLimiter.GlobalRateLimiter(), accessTokenMiddleware.AccessTokenAuthMiddleware(urlSanitizer))
 
 	healthCheckHandler := &api.HealthCheckHandler{
-		DB: db,
+		DB:           db,
+		FileDataCtrl: fileDataCtrl,
 	}
 	publicAPI.GET("/ping", timeout.New(
 		timeout.WithTimeout(5*time.Second),
@@ -402,6 +403,12 @@ func main() {
 		timeout.WithResponse(timeOutResponse),
 	))
 
+	publicAPI.GET("/health/replication", timeout.New(
+		timeout.WithTimeout(5*time.Second),
+		timeout.WithHandler(healthCheckHandler.ReplicationHealth),
+		timeout.WithResponse(timeOutResponse),
+	))
+
 	publicAPI.GET("/fire/db-m-ping", timeout.New(
 		timeout.WithTimeout(5*time.Second),
 		timeout.WithHandler(healthCheckHandler.PingDBStats),
@@ -678,6 +685,7 @@ func main() {
 		HashingKey:              hashingKeyBytes,
 		PasskeyController:       passkeyCtrl,
 		StorageBonusCtl:         storageBonusCtrl,
+		FileDataCtrl:            fileDataCtrl,
 	}
 	adminAPI.POST("/mail", adminHandler.SendMail)
 	adminAPI.POST("/mail/subscribe", adminHandler.SubscribeMail)
@@ -701,6 +709,36 @@ func main() {
 	adminAPI.POST("/queue/re-queue", adminHandler.ReQueueItem)
 	adminAPI.POST("/user/bonus", adminHandler.UpdateBonus)
 	adminAPI.POST("/job/clear-orphan-objects", adminHandler.ClearOrphanObjects)
+	adminAPI.GET("/filedata/replication/status", adminHandler.GetFileDataReplicationStatus)
+	adminAPI.GET("/filedata/replication/pending-report", adminHandler.GetFileDataPendingReport)
+	adminAPI.GET("/filedata/replication/dry-run", adminHandler.GetFileDataDryRunReport)
+	adminAPI.DELETE("/filedata/replication/dry-run", adminHandler.ClearFileDataDryRunReport)
+	adminAPI.POST("/filedata/replication/replicate-now", adminHandler.ReplicateFileDataNow)
+	adminAPI.PUT("/filedata/replication/override", adminHandler.SetFileDataReplicaOverride)
+	adminAPI.DELETE("/filedata/replication/override", adminHandler.ClearFileDataReplicaOverride)
+	adminAPI.POST("/filedata/replication/pause", adminHandler.PauseFileDataReplication)
+	adminAPI.POST("/filedata/replication/resume", adminHandler.ResumeFileDataReplication)
+	adminAPI.POST("/filedata/replication/maintenance", adminHandler.EnterFileDataMaintenance)
+	adminAPI.DELETE("/filedata/replication/maintenance", adminHandler.LeaveFileDataMaintenance)
+	adminAPI.GET("/filedata/replication/maintenance", adminHandler.GetFileDataMaintenanceStatus)
+	adminAPI.PUT("/filedata/replication/created-after", adminHandler.SetFileDataCreatedAfter)
+	adminAPI.GET("/filedata/replication/workers", adminHandler.GetFileDataReplicationWorkers)
+	adminAPI.GET("/filedata/replication/reconcile", adminHandler.GetFileDataReconciliationReport)
+	adminAPI.POST("/filedata/replication/backfill", adminHandler.StartFileDataBackfill)
+	adminAPI.GET("/filedata/replication/backfill", adminHandler.GetFileDataBackfills)
+	adminAPI.POST("/filedata/replication/drain", adminHandler.StartFileDataDrain)
+	adminAPI.GET("/filedata/replication/drain", adminHandler.GetFileDataDrains)
+	adminAPI.POST("/filedata/replication/promotion-check", adminHandler.StartFileDataPromotionCheck)
+	adminAPI.GET("/filedata/replication/promotion-check", adminHandler.GetFileDataPromotionChecks)
+	adminAPI.GET("/filedata/replication/promotion-check/:id", adminHandler.GetFileDataPromotionCheck)
+	adminAPI.GET("/filedata/replication/disabled-buckets", adminHandler.GetDisabledFileDataBuckets)
+	adminAPI.POST("/filedata/replication/disabled-buckets", adminHandler.DisableFileDataBucket)
+	adminAPI.DELETE("/filedata/replication/disabled-buckets/:bucket", adminHandler.EnableFileDataBucket)
+	adminAPI.GET("/filedata/replication/dead-letters", adminHandler.GetFileDataDeadLetters)
+	adminAPI.POST("/filedata/replication/dead-letters/requeue", adminHandler.RequeueFailedFileData)
+	adminAPI.GET("/filedata/replication/usage", adminHandler.GetFileDataReplicationUsage)
+	adminAPI.POST("/filedata/replication/audit", adminHandler.AuditFileDataBuckets)
+	adminAPI.GET("/filedata/replication/:fileID/:type", adminHandler.InspectFileDataReplication)
 
 	userEntityController := &userEntityCtrl.Controller{Repo: userEntityRepo}
 	userEntityHandler := &api.UserEntityHandler{Controller: userEntityController}
@@ -753,7 +791,9 @@ func main() {
 	publicAPI.GET("/offers/black-friday", offerHandler.GetBlackFridayOffers)
 
 	setKnownAPIs(server.Routes())
-	setupAndStartBackgroundJobs(objectCleanupController, replicationController3, fileDataCtrl)
+	replicationCtx, stopReplication := context.WithCancel(context.Background())
+	replicationDone := setupAndStartBackgroundJobs(replicationCtx, objectCleanupController, replicationController3, fileDataCtrl)
+	go reloadReplicationConfigOnSighup(environment, fileDataCtrl)
 	setupAndStartCrons(
 		userAuthRepo, publicCollectionRepo, twoFactorRepo, passkeysRepo, fileController, taskLockingRepo, emailNotificationCtrl,
 		trashController, pushController, objectController, dataCleanupController, storageBonusCtrl,
@@ -774,9 +814,53 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
+	stopReplication()
+	waitForReplicationToDrain(replicationDone)
 	discordController.NotifyShutdown()
 }
 
+// reloadReplicationConfigOnSighup reads the config again whenever museum
+// receives a SIGHUP, and applies the runtime adjustable replication settings.
+// The config is read into a new instance, as the global one is being read by
+// everything else meanwhile.
+func reloadReplicationConfigOnSighup(environment string, fileDataCtrl *filedata.Controller) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Info("Received SIGHUP, reloading replication config")
+		reloaded, err := config.ReadViper(environment)
+		if err != nil {
+			log.WithError(err).Error("Could not reload config")
+			continue
+		}
+		if !viper.GetBool("replication.enabled") {
+			continue
+		}
+		if err := fileDataCtrl.ReloadConfig(reloaded); err != nil {
+			log.WithError(err).Error("Could not update file data replication worker count")
+		}
+	}
+}
+
+// replicationShutdownTimeout bounds how long shutdown waits for the file data
+// replication workers. It is kept under the 30 seconds that the orchestrator
+// gives us before a hard kill.
+const replicationShutdownTimeout = 25 * time.Second
+
+// waitForReplicationToDrain blocks until the file data replication workers have
+// stopped, or until replicationShutdownTimeout elapses, whichever comes first.
+func waitForReplicationToDrain(replicationDone <-chan struct{}) {
+	if replicationDone == nil {
+		return
+	}
+	select {
+	case <-replicationDone:
+		log.Println("File data replication drained")
+	case <-time.After(replicationShutdownTimeout):
+		log.Warn("Timed out waiting for file data replication to drain")
+	}
+}
+
 func runServer(environment string, server *gin.Engine) {
 	useTLS := viper.GetBool("http.use-tls")
 	if useTLS {
@@ -804,17 +888,30 @@ func setupLogger(environment string) {
 		return funcName, fmt.Sprintf("%s:%d", path.Base(f.File), f.Line)
 	}
 	logFile := viper.GetString("log-file")
-	if environment == "local" && logFile == "" {
+	local := environment == "local" && logFile == ""
+	format := viper.GetString("log-format")
+	if format == "" {
+		format = "json"
+		if local {
+			format = "text"
+		}
+	}
+	switch format {
+	case "text":
 		log.SetFormatter(&log.TextFormatter{
 			CallerPrettyfier: callerPrettyfier,
 			DisableQuote:     true,
-			ForceColors:      true,
+			ForceColors:      local,
 		})
-	} else {
+	case "json":
 		log.SetFormatter(&log.JSONFormatter{
 			CallerPrettyfier: callerPrettyfier,
 			PrettyPrint:      false,
 		})
+	default:
+		log.Fatalf("Unknown log-format %q, it must be json or text", format)
+	}
+	if !local {
 		log.SetOutput(&lumberjack.Logger{
 			Filename: logFile,
 			MaxSize:  100,
@@ -860,21 +957,32 @@ func setupDatabase() *sql.DB {
 	return db
 }
 
+// setupAndStartBackgroundJobs starts the background jobs. It returns a channel
+// that is closed once the file data replication (if it was started) has
+// stopped after replicationCtx has been cancelled, and nil otherwise.
 func setupAndStartBackgroundJobs(
+	replicationCtx context.Context,
 	objectCleanupController *controller.ObjectCleanupController,
 	replicationController3 *controller.ReplicationController3,
 	fileDataCtrl *filedata.Controller,
-) {
+) <-chan struct{} {
+	var replicationDone <-chan struct{}
 	isReplicationEnabled := viper.GetBool("replication.enabled")
 	if isReplicationEnabled {
 		err := replicationController3.StartReplication()
 		if err != nil {
 			log.Warnf("Could not start replication v3: %s", err)
 		}
-		err = fileDataCtrl.StartReplication()
+		replicationDone, err = fileDataCtrl.StartReplication(replicationCtx)
 		if err != nil {
 			log.Warnf("Could not start fileData replication: %s", err)
 		}
+		if err := fileDataCtrl.StartReconciliation(replicationCtx); err != nil {
+			log.Warnf("Could not start fileData reconciliation: %s", err)
+		}
+		if err := fileDataCtrl.StartVerification(replicationCtx); err != nil {
+			log.Warnf("Could not start fileData verification: %s", err)
+		}
 	} else {
 		log.Info("Skipping Replication as replication is disabled")
 	}
@@ -882,6 +990,7 @@ func setupAndStartBackgroundJobs(
 	fileDataCtrl.StartDataDeletion() // Start data deletion for file data;
 	objectCleanupController.StartRemovingUnreportedObjects()
 	objectCleanupController.StartClearingOrphanObjects()
+	return replicationDone
 }
 
 func setupAndStartCrons(userAuthRepo *repo.UserAuthRepository, publicCollectionRepo *repo.PublicCollectionRepository,
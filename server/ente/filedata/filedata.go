@@ -1,10 +1,17 @@
 package filedata
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/ente-io/museum/ente"
+	"strings"
 )
 
+// LockTokenSeparator separates the ID of the instance that took a lock on a row
+// from the random part of the lock's token.
+const LockTokenSeparator = "/"
+
 type Entity struct {
 	FileID           int64           `json:"fileID"`
 	Type             ente.ObjectType `json:"type"`
@@ -69,6 +76,20 @@ type S3FileMetadata struct {
 	EncryptedData    string `json:"encryptedData"`
 	DecryptionHeader string `json:"header"`
 	Client           string `json:"client"`
+	// Checksum is the ContentChecksum of the object when it was uploaded.
+	// Objects uploaded before checksums were embedded don't have one.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ContentChecksum returns the hex encoded SHA-256 of the decryption header and
+// the encrypted data.
+func (m S3FileMetadata) ContentChecksum() string {
+	h := sha256.New()
+	h.Write([]byte(m.DecryptionHeader))
+	// Both are base64, so a NUL separates them unambiguously
+	h.Write([]byte{0})
+	h.Write([]byte(m.EncryptedData))
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 type GetPreviewURLRequest struct {
@@ -111,6 +132,36 @@ type Row struct {
 	SyncLockedTill    int64
 	CreatedAt         int64
 	UpdatedAt         int64
+	// Checksum is the hex encoded SHA-256 of the metadata object. It is nil for
+	// rows that were written before checksums were recorded.
+	Checksum *string
+	// CompressedBuckets are the buckets in which the metadata object is stored
+	// gzip compressed. Size is always the logical (uncompressed) size.
+	CompressedBuckets []string
+	// AttemptCount is the number of consecutive failed replication attempts
+	AttemptCount int
+	// IsDeadLettered is true if replication was given up after too many failed
+	// attempts. Such rows are not replicated until they are requeued.
+	IsDeadLettered bool
+	// LockToken identifies the current holder of the sync lock. Rows returned
+	// by the methods that lock them carry the token of the new lock. It starts
+	// with the ID of the instance that took the lock, see LockHolder.
+	LockToken *string
+	// LockHeartbeatAt is when (epoch microseconds) the holder of the sync lock
+	// last sent a heartbeat. It is nil if the lock was never taken, or was
+	// released by its holder, so a row whose lock has expired with it set was
+	// abandoned by its holder.
+	LockHeartbeatAt *int64
+	// ReplicaOverride, if not nil, are the buckets that the row should be
+	// replicated to instead of the replicas configured for its type. It is
+	// empty, but not nil, if the row should not be replicated anywhere.
+	ReplicaOverride []string
+	// ReplicatedSideObjects are the side objects (see SideObjectKeys) that
+	// have been copied to a replica bucket, as "<bucket>:<object key>"
+	ReplicatedSideObjects []string
+	// ReplicaVersions are the versions of the metadata object that have been
+	// written to versioned buckets, as "<bucket>:<version id>"
+	ReplicaVersions []string
 }
 
 // S3FileMetadataObjectKey returns the object key for the metadata stored in the S3 bucket.
@@ -124,6 +175,29 @@ func (r *Row) S3FileMetadataObjectKey() string {
 	panic(fmt.Sprintf("S3FileMetadata should not be written for %s type", r.Type))
 }
 
+// SideObjectKeys returns the keys of the objects that belong to the row besides
+// its metadata object, and are replicated along with it.
+func (r *Row) SideObjectKeys() []string {
+	if r.Type == ente.PreviewVideo {
+		return []string{previewVideoPath(r.FileID, r.UserID)}
+	}
+	return nil
+}
+
+// LockHolder returns the ID of the instance that took the row's current (or
+// last) sync lock, or "" if it isn't known, e.g. for the tokens of the locks
+// taken before the instance IDs were recorded in them.
+func (r *Row) LockHolder() string {
+	if r.LockToken == nil {
+		return ""
+	}
+	i := strings.LastIndex(*r.LockToken, LockTokenSeparator)
+	if i < 0 {
+		return ""
+	}
+	return (*r.LockToken)[:i]
+}
+
 // GetS3FileObjectKey returns the object key for the file data stored in the S3 bucket.
 func (r *Row) GetS3FileObjectKey() string {
 	if r.Type == ente.PreviewVideo {
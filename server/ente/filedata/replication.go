@@ -0,0 +1,600 @@
+package filedata
+
+import "github.com/ente-io/museum/ente"
+
+// ReplicationStatus is the admin facing summary of how far behind file data
+// replication is.
+type ReplicationStatus struct {
+	Types []TypeReplicationStatus `json:"types"`
+	// Buckets breaks the backlog down further by destination bucket
+	Buckets []BucketReplicationStatus `json:"buckets"`
+	// Circuits is the state of the per destination bucket circuit breakers of
+	// the instance that served the request
+	Circuits []BucketCircuitStatus `json:"circuits"`
+	// Pause is whether replication has been paused on the instance that
+	// served the request
+	Pause ReplicationPauseStatus `json:"pause"`
+	// CatchUp is whether the instance that served the request is replicating
+	// with its catch-up concurrency
+	CatchUp ReplicationCatchUpStatus `json:"catchUp"`
+	// Oversized is the backlog of rows over the maximum object size, if one
+	// is configured
+	Oversized *ReplicationOversizedStatus `json:"oversized,omitempty"`
+	// BestEffort is the outstanding work for each best-effort bucket, which
+	// isn't part of Buckets
+	BestEffort []BestEffortReplicationStatus `json:"bestEffort"`
+	// Window is the time of day window that replication is limited to, if
+	// one is configured
+	Window *ReplicationWindowStatus `json:"window,omitempty"`
+	// Maintenance is whether the instance that served the request is in
+	// maintenance mode, and whether its in-flight work has drained
+	Maintenance ReplicationMaintenanceStatus `json:"maintenance"`
+	// CreatedAfter is the cutoff (epoch microseconds) before which the rows
+	// are left alone by the workers, as last refreshed by the instance that
+	// served the request, 0 if there is none
+	CreatedAfter int64 `json:"createdAfter,omitempty"`
+	// NoReplicaConfigured are the types that have no replica buckets
+	// configured, whose rows are only stored in their primary bucket
+	NoReplicaConfigured []ente.ObjectType `json:"noReplicaConfigured,omitempty"`
+}
+
+// CreatedAfterRequest limits the rows that the workers replicate to those
+// created after CreatedAfter (epoch microseconds), or lifts the limit if it is
+// 0.
+type CreatedAfterRequest struct {
+	CreatedAfter int64 `json:"createdAfter"`
+}
+
+// ReplicationWindowStatus is whether the replication window is open. Outside
+// the window only the urgent rows are replicated.
+type ReplicationWindowStatus struct {
+	// Start and End are the time of day (HH:MM) in Timezone that the window
+	// opens and closes at
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+	Open     bool   `json:"open"`
+	// NextChange is when (epoch microseconds) the window next opens or
+	// closes
+	NextChange int64 `json:"nextChange"`
+}
+
+// BestEffortReplicationStatus is the number of rows of a type that have been
+// replicated to their required buckets, but are yet to be copied to a
+// best-effort bucket.
+type BestEffortReplicationStatus struct {
+	Type        ente.ObjectType `json:"type"`
+	Bucket      string          `json:"bucket"`
+	Outstanding int64           `json:"outstanding"`
+}
+
+// ReplicationOversizedStatus is the backlog of rows that are too large for the
+// replication workers to handle inline.
+type ReplicationOversizedStatus struct {
+	MaxSize int64 `json:"maxSize"`
+	// Action is what is done with the oversized rows, either "skip" or "route"
+	Action string `json:"action"`
+	// Pending and PendingSize are the number and total size of the oversized
+	// rows waiting to be replicated
+	Pending     int64 `json:"pending"`
+	PendingSize int64 `json:"pendingSize"`
+}
+
+// ReplicationCatchUpStatus is whether replication is in catch-up mode because
+// of a large backlog.
+type ReplicationCatchUpStatus struct {
+	Active bool `json:"active"`
+	// Since is when (epoch microseconds) catch-up mode was entered
+	Since int64 `json:"since,omitempty"`
+	// Pending is the backlog when it was last checked for catch-up mode
+	Pending int64 `json:"pending"`
+}
+
+// ReplicationMaintenanceStatus is whether replication is in maintenance mode,
+// in which no new rows are picked up while the in-flight work is let finish.
+type ReplicationMaintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+	// Since is when (epoch microseconds) maintenance mode was entered
+	Since int64 `json:"since,omitempty"`
+	// InFlight is the number of workers still finishing their rows
+	InFlight int `json:"inFlight"`
+	// Drained is true once all the in-flight work is done, after which the
+	// instance can be stopped without leaving any rows locked
+	Drained bool `json:"drained"`
+	// DrainedAt is when (epoch microseconds) the in-flight work was done
+	DrainedAt int64 `json:"drainedAt,omitempty"`
+}
+
+// ReplicationPauseStatus is whether replication has been paused by an admin.
+type ReplicationPauseStatus struct {
+	Paused bool `json:"paused"`
+	// Since is when (epoch microseconds) replication was paused
+	Since int64 `json:"since,omitempty"`
+}
+
+// BucketReplicationStatus is the replication backlog of a single object type
+// for a single destination bucket.
+type BucketReplicationStatus struct {
+	Type   ente.ObjectType `json:"type"`
+	Bucket string          `json:"bucket"`
+	// Pending is the number of live rows that still need to be copied to the
+	// bucket
+	Pending int64 `json:"pending"`
+	// InFlight is the number of those pending rows that are currently being
+	// uploaded to the bucket
+	InFlight int64 `json:"inFlight"`
+}
+
+// TypeReplicationStatus summarizes replication for a single object type.
+type TypeReplicationStatus struct {
+	Type ente.ObjectType `json:"type"`
+	// Pending is the number of live rows that still need to be replicated
+	Pending int64 `json:"pending"`
+	// InFlight is the number of pending rows that are currently locked by a
+	// worker. Freshly uploaded rows are also locked for a few minutes before
+	// they become eligible for replication, and are counted here.
+	InFlight int64 `json:"inFlight"`
+	// CompletedLastHour is the number of rows that finished replicating in the
+	// last hour
+	CompletedLastHour int64 `json:"completedLastHour"`
+	// OldestPendingAt is the updated_at (epoch microseconds) of the oldest
+	// pending row, or 0 if nothing is pending
+	OldestPendingAt int64 `json:"oldestPendingAt"`
+}
+
+// BucketCircuitStatus is the state of the circuit breaker for uploads to a
+// destination bucket.
+type BucketCircuitStatus struct {
+	Bucket string `json:"bucket"`
+	// State is one of closed, open or half-open
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	// OpenUntil is the time (epoch microseconds) after which a probe upload will
+	// be let through, set only when the circuit is open
+	OpenUntil int64 `json:"openUntil,omitempty"`
+}
+
+// DryRunDiscrepancy is the number of rows (and their total size) of a type that
+// a dry run found missing from a bucket.
+type DryRunDiscrepancy struct {
+	Type   ente.ObjectType `json:"type"`
+	Bucket string          `json:"bucket"`
+	Rows   int64           `json:"rows"`
+	Bytes  int64           `json:"bytes"`
+}
+
+// ReplicationEvent is emitted when a file data row finishes replicating.
+type ReplicationEvent struct {
+	ID     int64           `json:"id"`
+	FileID int64           `json:"fileID"`
+	Type   ente.ObjectType `json:"type"`
+	UserID int64           `json:"userID"`
+	Size   int64           `json:"size"`
+	// Buckets are the destination buckets that the row was replicated to
+	Buckets []string `json:"buckets"`
+	// ReplicatedAt is the epoch microseconds at which replication completed
+	ReplicatedAt int64 `json:"replicatedAt"`
+}
+
+// ReplicateNowRequest asks for a file's data to be replicated immediately.
+type ReplicateNowRequest struct {
+	FileID int64           `json:"fileID" binding:"required"`
+	Type   ente.ObjectType `json:"type" binding:"required"`
+}
+
+// ReplicaOverrideRequest asks for a file's data to be replicated to Buckets
+// instead of the replica buckets configured for its type. An empty list of
+// buckets keeps the data only in its primary bucket.
+type ReplicaOverrideRequest struct {
+	FileID  int64           `json:"fileID" binding:"required"`
+	Type    ente.ObjectType `json:"type" binding:"required"`
+	Buckets []string        `json:"buckets"`
+}
+
+// ClearReplicaOverrideRequest asks for a file's data to be replicated to the
+// replica buckets configured for its type again.
+type ClearReplicaOverrideRequest struct {
+	FileID int64           `form:"fileID" binding:"required"`
+	Type   ente.ObjectType `form:"type" binding:"required"`
+}
+
+// ReplicateNowResponse is the outcome of a successful ReplicateNowRequest.
+type ReplicateNowResponse struct {
+	FileID int64           `json:"fileID"`
+	Type   ente.ObjectType `json:"type"`
+	// Buckets are the buckets that the data was replicated to, empty if it
+	// was already in all the buckets it should be in
+	Buckets []string `json:"buckets"`
+}
+
+// WorkerStatus is the state of a single replication worker.
+type WorkerStatus struct {
+	Pool string `json:"pool"`
+	ID   int    `json:"id"`
+	// State is one of idle, downloading, uploading or sleeping
+	State string `json:"state"`
+	// FileID is the file being replicated, if any
+	FileID int64 `json:"fileID,omitempty"`
+	// StateSince is when (epoch microseconds) the worker entered State
+	StateSince int64 `json:"stateSince"`
+	// LastHeartbeat is when (epoch microseconds) the worker last made progress
+	LastHeartbeat int64 `json:"lastHeartbeat"`
+}
+
+// ReconciliationCorrection is a change made to a row by a reconciliation run to
+// make it match what is actually in the buckets.
+type ReconciliationCorrection struct {
+	FileID int64           `json:"fileID"`
+	Type   ente.ObjectType `json:"type"`
+	Bucket string          `json:"bucket"`
+	// Action is "recorded" for a copy that was present but not recorded in
+	// the row, "requeued" for a recorded copy that was missing, and
+	// "source-missing" when the object is absent from the latest bucket (this
+	// can't be fixed automatically and needs investigation).
+	Action string `json:"action"`
+}
+
+// ReconciliationReport is the outcome of a reconciliation run.
+type ReconciliationReport struct {
+	// StartedAt and FinishedAt are epoch microseconds
+	StartedAt  int64 `json:"startedAt"`
+	FinishedAt int64 `json:"finishedAt"`
+	// Strategy is "head" if the rows were checked one HEAD request at a time,
+	// or "list" if they were checked against the bucket listings
+	Strategy string `json:"strategy"`
+	// ObjectsListed is the number of objects of the reconciled types found in
+	// the listings, with the "list" strategy
+	ObjectsListed int `json:"objectsListed,omitempty"`
+	RowsChecked   int `json:"rowsChecked"`
+	// RowsSkipped are rows that were locked, e.g. by a replication worker
+	RowsSkipped int                        `json:"rowsSkipped"`
+	Errors      int                        `json:"errors"`
+	Corrections []ReconciliationCorrection `json:"corrections"`
+}
+
+// AuditRequest asks for the objects of a type in its buckets to be compared
+// against its rows. Without a Bucket, all the buckets that the type is
+// configured to be in are audited one after the other.
+//
+// An audit processes up to MaxPages pages of the bucket listing at a time. To
+// continue it, repeat the request with the ContinuationToken of its report.
+type AuditRequest struct {
+	Type              ente.ObjectType `json:"type" binding:"required"`
+	Bucket            string          `json:"bucket"`
+	ContinuationToken string          `json:"continuationToken"`
+	MaxPages          int             `json:"maxPages"`
+}
+
+// AuditReport is the outcome of (a part of) an audit.
+type AuditReport struct {
+	Type ente.ObjectType `json:"type"`
+	// Buckets are the buckets that were audited, in order
+	Buckets []string `json:"buckets"`
+	// ObjectsListed are the objects of the type found in the listings, and
+	// RowsChecked the rows that said they are in the listed ranges
+	ObjectsListed int `json:"objectsListed"`
+	RowsChecked   int `json:"rowsChecked"`
+	// Orphans are objects that have no live row, Unrecorded are objects
+	// whose row doesn't know about the bucket, and Gaps are rows that say
+	// they are in a bucket that doesn't have their object
+	Orphans    int `json:"orphans"`
+	Unrecorded int `json:"unrecorded"`
+	Gaps       int `json:"gaps"`
+	// Findings lists (up to a limit) the individual orphans, unrecorded
+	// objects and gaps
+	Findings []AuditFinding `json:"findings"`
+	// ContinuationToken continues the audit, it is empty once the audit is
+	// complete
+	ContinuationToken string `json:"continuationToken,omitempty"`
+}
+
+// AuditFinding is a single discrepancy found by an audit.
+type AuditFinding struct {
+	Bucket string `json:"bucket"`
+	// Kind is one of "orphan", "unrecorded" or "gap"
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	FileID int64  `json:"fileID"`
+	UserID int64  `json:"userID"`
+}
+
+// BackfillRequest asks for the existing rows of a type to be copied to a bucket
+// that has been added to the type's replicas.
+type BackfillRequest struct {
+	Type   ente.ObjectType `json:"type" binding:"required"`
+	Bucket string          `json:"bucket" binding:"required"`
+	// CreatedAfter, if set, limits the backfill to the rows created after it
+	// (epoch microseconds), e.g. to recover those affected by a bug
+	CreatedAfter int64 `json:"createdAfter,omitempty"`
+}
+
+// BackfillJob is the progress of a backfill.
+type BackfillJob struct {
+	ID     int64           `json:"id"`
+	Type   ente.ObjectType `json:"type"`
+	Bucket string          `json:"bucket"`
+	// Status is either running or completed
+	Status string `json:"status"`
+	// LastFileID is the file ID up to which the rows have been re-queued
+	LastFileID int64 `json:"lastFileID"`
+	// Total is the number of rows of the type (created after the cutoff, if
+	// any) when the backfill started
+	Total int64 `json:"total"`
+	// Scanned rows are those that have been looked at so far, and Requeued
+	// the ones among them that were re-queued for replication
+	Scanned  int64 `json:"scanned"`
+	Requeued int64 `json:"requeued"`
+	// CreatedAfter is the cutoff of the backfill, 0 if it has none
+	CreatedAfter int64 `json:"createdAfter,omitempty"`
+	CreatedAt    int64 `json:"createdAt"`
+	UpdatedAt    int64 `json:"updatedAt"`
+}
+
+// DrainRequest asks for all the file data to be moved off a bucket that is
+// being retired.
+type DrainRequest struct {
+	Bucket string `json:"bucket" binding:"required"`
+}
+
+// DrainJob is the progress of a drain.
+type DrainJob struct {
+	ID     int64  `json:"id"`
+	Bucket string `json:"bucket"`
+	// Status is either running or completed. A drain is only completed once
+	// no live row lists the bucket anymore.
+	Status string `json:"status"`
+	// LastFileID and LastType are the position that the current pass has
+	// reached
+	LastFileID int64           `json:"lastFileID"`
+	LastType   ente.ObjectType `json:"lastType"`
+	// Total is the number of rows listing the bucket when the drain started
+	Total int64 `json:"total"`
+	// Drained rows are those that the bucket has been removed from, and
+	// Requeued counts the times rows were queued for replication to their
+	// other buckets first
+	Drained  int64 `json:"drained"`
+	Requeued int64 `json:"requeued"`
+	// Unconfirmed is the number of rows in the current pass whose copies
+	// could not be confirmed in the other buckets, and that the bucket was
+	// therefore left in
+	Unconfirmed int64 `json:"unconfirmed"`
+	// Remaining is the number of rows still listing the bucket at the end of
+	// the last pass
+	Remaining int64 `json:"remaining"`
+	Passes    int64 `json:"passes"`
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+// PromotionCheckRequest asks for the rows of a type to be confirmed to be in a
+// bucket that is to become the type's primary.
+type PromotionCheckRequest struct {
+	Type   ente.ObjectType `json:"type" binding:"required"`
+	Bucket string          `json:"bucket" binding:"required"`
+}
+
+// PromotionCheck is the progress of a check that every row of a type is in a
+// bucket before it is promoted to the type's primary.
+type PromotionCheck struct {
+	ID     int64           `json:"id"`
+	Type   ente.ObjectType `json:"type"`
+	Bucket string          `json:"bucket"`
+	// Status is either running or ready. A check is only ready once a pass
+	// ends with every row that it covers recorded in the bucket.
+	Status string `json:"status"`
+	// Ready is true if the bucket is safe to promote, i.e. Status is ready
+	Ready bool `json:"ready"`
+	// LastFileID is the position that the current pass has reached
+	LastFileID int64 `json:"lastFileID"`
+	// Total is the number of rows of the type when the check started. Rows
+	// written after that are covered too.
+	Total int64 `json:"total"`
+	// Requeued counts the times rows were queued for replication to the
+	// bucket
+	Requeued int64 `json:"requeued"`
+	// Waiting is the number of rows in the current pass that were already
+	// queued, or being replicated
+	Waiting int64 `json:"waiting"`
+	// Unconfirmed is the number of rows in the current pass that can't be
+	// replicated to the bucket, e.g. because of their replica override
+	Unconfirmed int64 `json:"unconfirmed"`
+	// Remaining is the number of rows not in the bucket at the end of the
+	// last pass, the gaps left before the bucket can be promoted
+	Remaining int64 `json:"remaining"`
+	Passes    int64 `json:"passes"`
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+// DisableBucketRequest asks for replication to a bucket to be paused.
+type DisableBucketRequest struct {
+	Bucket string `json:"bucket" binding:"required"`
+	// For is how long the bucket stays disabled, e.g. "2h". The configured
+	// default is used if it is empty.
+	For    string `json:"for"`
+	Reason string `json:"reason"`
+}
+
+// DisabledBucket is a bucket that replication is paused for.
+type DisabledBucket struct {
+	Bucket string `json:"bucket"`
+	// DisabledUntil is the time (epoch microseconds) at which replication to
+	// the bucket resumes on its own
+	DisabledUntil int64   `json:"disabledUntil"`
+	Reason        *string `json:"reason"`
+	CreatedAt     int64   `json:"createdAt"`
+}
+
+// ReplicationHealth tells whether replication on an instance is making forward
+// progress.
+type ReplicationHealth struct {
+	// Healthy is false if rows that could be replicated are pending sync but
+	// none has been replicated by the instance within Window
+	Healthy bool `json:"healthy"`
+	// DryRun is true if the instance only reports what it would replicate, in
+	// which case it replicates nothing and is always healthy
+	DryRun bool `json:"dryRun,omitempty"`
+	// Running is false on instances that don't replicate, which are always
+	// healthy
+	Running bool   `json:"running"`
+	Window  string `json:"window"`
+	// LastSuccessAt is when (epoch microseconds) the instance last finished
+	// replicating a row, or started replicating if it hasn't done so yet
+	LastSuccessAt int64 `json:"lastSuccessAt,omitempty"`
+	// Pending is true if there are live rows pending sync
+	Pending bool `json:"pending"`
+	// Parked is true if all the rows pending sync are intentionally held
+	// back: after a failure, over the maximum object size, or only pending
+	// for buckets that are disabled or whose circuit is open
+	Parked bool `json:"parked,omitempty"`
+	// ActiveWorkers is the number of replication workers that are running
+	ActiveWorkers int `json:"activeWorkers"`
+}
+
+// ReplicationRecord describes a completed replication of a row.
+type ReplicationRecord struct {
+	FileID       int64
+	Type         ente.ObjectType
+	SourceBucket string
+	DestBuckets  []string
+	// CopiedBuckets are the destinations that the object was copied to server
+	// side, without passing through museum
+	CopiedBuckets []string
+	// Routes are the bytes copied from each source bucket to each destination
+	Routes []RouteTransfer
+	// Bytes is the number of bytes transferred, downloads and uploads
+	Bytes int64
+	// DurationMs is the wall clock time that the replication took
+	DurationMs int64
+	// Attempts is the attempt that completed the replication, starting at 1
+	Attempts int
+	// ReplicatedAt is the epoch microseconds at which replication completed
+	ReplicatedAt int64
+}
+
+// RouteTransfer is the number of bytes copied from a source bucket to a
+// destination bucket.
+type RouteTransfer struct {
+	Source      string
+	Destination string
+	Bytes       int64
+}
+
+// RowReplicationState is everything that is known about the replication of a
+// single file data row, for investigating it.
+type RowReplicationState struct {
+	FileID            int64           `json:"fileID"`
+	UserID            int64           `json:"userID"`
+	Type              ente.ObjectType `json:"type"`
+	Size              int64           `json:"size"`
+	LatestBucket      string          `json:"latestBucket"`
+	ReplicatedBuckets []string        `json:"replicatedBuckets"`
+	InflightReplicas  []string        `json:"inflightReplicas"`
+	DeleteFromBuckets []string        `json:"deleteFromBuckets"`
+	CompressedBuckets []string        `json:"compressedBuckets"`
+	// ReplicaOverride are the replica buckets set for the row, overriding
+	// those of its type
+	ReplicaOverride []string `json:"replicaOverride,omitempty"`
+	PendingSync     bool     `json:"pendingSync"`
+	IsDeleted       bool     `json:"isDeleted"`
+	IsDeadLettered  bool     `json:"isDeadLettered"`
+	AttemptCount    int      `json:"attemptCount"`
+	// LastError is the error of the most recent failed attempt since the row
+	// was last replicated, and LastErrorAt when (epoch microseconds) it
+	// happened
+	LastError   *string `json:"lastError,omitempty"`
+	LastErrorAt *int64  `json:"lastErrorAt,omitempty"`
+	// SyncLockedTill is the lock expiry (epoch microseconds), Locked is true
+	// if that is in the future, and LockHolder the ID of the instance that
+	// took the lock, if known
+	SyncLockedTill int64  `json:"syncLockedTill"`
+	Locked         bool   `json:"locked"`
+	LockHolder     string `json:"lockHolder,omitempty"`
+	CreatedAt      int64  `json:"createdAt"`
+	UpdatedAt      int64  `json:"updatedAt"`
+	// WantedBuckets are the buckets that the row should be in, and
+	// PendingBuckets those of them that it still needs to be replicated to
+	WantedBuckets  []string `json:"wantedBuckets"`
+	PendingBuckets []string `json:"pendingBuckets"`
+	// Objects is what a HEAD of the row's object found in each of the buckets
+	// that the row refers to or should be in
+	Objects []BucketObjectState `json:"objects"`
+}
+
+// RequeueFailedRequest asks for all the rows of a type whose replication has
+// failed to be put back into the replication queue.
+type RequeueFailedRequest struct {
+	Type ente.ObjectType `json:"type" binding:"required"`
+	// ErrorContains, if not empty, only requeues the rows whose last error
+	// contains it
+	ErrorContains string `json:"errorContains"`
+	// FailedSince and FailedUntil (epoch microseconds), if set, only requeue
+	// the rows whose last failure happened in between
+	FailedSince int64 `json:"failedSince"`
+	FailedUntil int64 `json:"failedUntil"`
+}
+
+// DeadLetteredRow is a file data row whose replication has been given up on
+// after too many failed attempts.
+type DeadLetteredRow struct {
+	FileID            int64           `json:"fileID"`
+	UserID            int64           `json:"userID"`
+	Type              ente.ObjectType `json:"type"`
+	Size              int64           `json:"size"`
+	LatestBucket      string          `json:"latestBucket"`
+	ReplicatedBuckets []string        `json:"replicatedBuckets"`
+	AttemptCount      int             `json:"attemptCount"`
+	UpdatedAt         int64           `json:"updatedAt"`
+	// LastError is the error of the attempt after which the row was dead
+	// lettered, and LastErrorAt when (epoch microseconds) it happened
+	LastError   *string `json:"lastError,omitempty"`
+	LastErrorAt *int64  `json:"lastErrorAt,omitempty"`
+}
+
+// PendingReportRow is a file data row that is pending replication, as listed in
+// the pending replication report.
+type PendingReportRow struct {
+	FileID       int64           `json:"fileID"`
+	UserID       int64           `json:"userID"`
+	Type         ente.ObjectType `json:"type"`
+	Size         int64           `json:"size"`
+	LatestBucket string          `json:"latestBucket"`
+	// MissingBuckets are the buckets that the row should be in but hasn't
+	// been replicated to yet, and InflightBuckets those of them that a copy
+	// is being made to. Both are sorted.
+	MissingBuckets  []string `json:"missingBuckets"`
+	InflightBuckets []string `json:"inflightBuckets"`
+	AttemptCount    int      `json:"attemptCount"`
+	IsDeadLettered  bool     `json:"isDeadLettered"`
+	CreatedAt       int64    `json:"createdAt"`
+	UpdatedAt       int64    `json:"updatedAt"`
+	// AgeSeconds is how long the row has been pending for, since it was last
+	// updated, as of when the report was started
+	AgeSeconds int64 `json:"ageSeconds"`
+}
+
+// BucketObjectState is the result of checking for an object in a bucket.
+type BucketObjectState struct {
+	Bucket  string `json:"bucket"`
+	Present bool   `json:"present"`
+	Size    int64  `json:"size,omitempty"`
+	ETag    string `json:"etag,omitempty"`
+	// VersionID is the version of the object that replication wrote, in a
+	// versioned bucket
+	VersionID string `json:"versionID,omitempty"`
+	// Error is set if the bucket could not be checked
+	Error string `json:"error,omitempty"`
+}
+
+// UserReplicationUsage is the replication work done on behalf of a user over a
+// window of time.
+type UserReplicationUsage struct {
+	UserID int64 `json:"userID"`
+	// Bytes downloaded and uploaded while replicating the user's rows
+	Bytes int64 `json:"bytes"`
+	// Objects is the number of objects copied to a bucket
+	Objects int64 `json:"objects"`
+	// OverQuota is whether the user's rows are currently replicated after
+	// everyone else's, because the user is above the soft per-user limit
+	OverQuota bool `json:"overQuota"`
+}
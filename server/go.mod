@@ -40,6 +40,7 @@ require (
 	golang.org/x/crypto v0.21.0
 	golang.org/x/sync v0.8.0
 	golang.org/x/text v0.17.0
+	golang.org/x/time v0.1.0
 	google.golang.org/api v0.114.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
@@ -61,7 +62,6 @@ require (
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/arch v0.3.0 // indirect
-	golang.org/x/time v0.1.0 // indirect
 )
 
 require (
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_file_data_last_verified_at;
+
+ALTER TABLE file_data DROP COLUMN IF EXISTS last_verified_at;
@@ -0,0 +1,7 @@
+-- last_verified_at is the time at which the replicated copies of the row were
+-- last re-verified. Together with replicated_at, it is used to pick the rows
+-- that are due for verification.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS last_verified_at BIGINT;
+
+CREATE INDEX IF NOT EXISTS idx_file_data_last_verified_at ON file_data ((COALESCE(last_verified_at, replicated_at, 0)))
+    WHERE is_deleted = false AND pending_sync = false;
@@ -0,0 +1,22 @@
+-- Jobs that re-queue the existing rows of a type for replication, so that they
+-- get copied to a bucket that was newly added to the replicas of that type.
+--
+-- The job walks the rows in file_id order, last_file_id being the position
+-- that it has reached, which allows it to be resumed if museum restarts.
+CREATE TABLE IF NOT EXISTS file_data_backfill
+(
+    id           BIGSERIAL PRIMARY KEY,
+    data_type    OBJECT_TYPE NOT NULL,
+    bucket       s3region    NOT NULL,
+--  one of running or completed
+    status       TEXT        NOT NULL DEFAULT 'running',
+    last_file_id BIGINT      NOT NULL DEFAULT -1,
+--  number of live rows of the type when the job was created
+    total        BIGINT      NOT NULL DEFAULT 0,
+    scanned      BIGINT      NOT NULL DEFAULT 0,
+    requeued     BIGINT      NOT NULL DEFAULT 0,
+    created_at   BIGINT      NOT NULL DEFAULT now_utc_micro_seconds(),
+    updated_at   BIGINT      NOT NULL DEFAULT now_utc_micro_seconds()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_file_data_backfill_running ON file_data_backfill (data_type, bucket) WHERE status = 'running';
@@ -0,0 +1,5 @@
+-- lock_token identifies the holder of the row's sync lock. It is replaced each
+-- time the row is locked, and the updates made on behalf of a lock holder are
+-- conditional on it, so that a worker whose lock has expired and been taken
+-- over can't modify the row anymore.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS lock_token TEXT;
@@ -0,0 +1,10 @@
+-- Buckets that file data replication temporarily doesn't copy objects to, e.g.
+-- during maintenance. Rows pending for such a bucket remain pending until
+-- disabled_until has passed or the bucket is re-enabled.
+CREATE TABLE IF NOT EXISTS file_data_disabled_buckets
+(
+    bucket         s3region PRIMARY KEY,
+    disabled_until BIGINT   NOT NULL,
+    reason         TEXT,
+    created_at     BIGINT   NOT NULL DEFAULT now_utc_micro_seconds()
+);
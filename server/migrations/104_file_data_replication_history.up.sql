@@ -0,0 +1,19 @@
+-- One row per completed replication of a file data row, for analysing where
+-- replication time and egress go. Rows older than the configured retention are
+-- pruned.
+CREATE TABLE IF NOT EXISTS file_data_replication_history
+(
+    id            BIGSERIAL PRIMARY KEY,
+    file_id       BIGINT      NOT NULL,
+    data_type     OBJECT_TYPE NOT NULL,
+    source_bucket s3region    NOT NULL,
+    dest_buckets  s3region[]  NOT NULL DEFAULT '{}',
+--  bytes downloaded and uploaded, including any verification read backs
+    bytes         BIGINT      NOT NULL,
+    duration_ms   BIGINT      NOT NULL,
+--  the attempt (starting at 1) that completed the replication
+    attempts      INTEGER     NOT NULL,
+    replicated_at BIGINT      NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_data_replication_history_replicated_at ON file_data_replication_history (replicated_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_file_data_lock_token;
+ALTER TABLE file_data DROP COLUMN IF EXISTS lock_heartbeat_at;
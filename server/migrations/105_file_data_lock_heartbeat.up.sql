@@ -0,0 +1,6 @@
+-- lock_heartbeat_at is when the holder of the row's sync lock last reported
+-- that it is still working on the row. A row whose lock is held but whose
+-- heartbeat has gone stale is considered abandoned, and can be reclaimed by
+-- another worker before the lock expires.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS lock_heartbeat_at BIGINT;
+CREATE INDEX IF NOT EXISTS idx_file_data_lock_token ON file_data (lock_token) WHERE pending_sync = true;
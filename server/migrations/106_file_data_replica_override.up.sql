@@ -0,0 +1,4 @@
+-- replica_buckets_override, when set, replaces the replica buckets configured
+-- for the row's data type. An empty array means that the row should not be
+-- replicated at all.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS replica_buckets_override s3region[];
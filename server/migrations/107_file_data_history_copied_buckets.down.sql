@@ -0,0 +1 @@
+ALTER TABLE file_data_replication_history DROP COLUMN IF EXISTS copied_buckets;
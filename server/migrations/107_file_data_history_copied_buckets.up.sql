@@ -0,0 +1,3 @@
+-- copied_buckets are the destinations that the object was copied to server
+-- side, without being downloaded and uploaded by museum
+ALTER TABLE file_data_replication_history ADD COLUMN IF NOT EXISTS copied_buckets s3region[] NOT NULL DEFAULT '{}';
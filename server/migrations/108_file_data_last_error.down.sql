@@ -0,0 +1,2 @@
+ALTER TABLE file_data DROP COLUMN IF EXISTS last_error_at;
+ALTER TABLE file_data DROP COLUMN IF EXISTS last_error;
@@ -0,0 +1,4 @@
+-- The error of the most recent failed replication attempt of the row, kept
+-- till the row is next replicated to help investigate it.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS last_error TEXT;
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS last_error_at BIGINT;
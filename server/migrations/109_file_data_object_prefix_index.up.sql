@@ -0,0 +1,6 @@
+-- Lets the rows of a type be walked in the (byte-wise) order of their object
+-- keys, which is the order in which buckets list them, for auditing buckets
+-- against the rows. The expression is filedata.BasePrefix.
+CREATE INDEX IF NOT EXISTS idx_file_data_object_prefix
+    ON file_data (data_type, (user_id::text || '/file-data/' || file_id::text || '/') COLLATE "C")
+    WHERE is_deleted = false;
@@ -0,0 +1,5 @@
+-- replicated_side_objects lists the side objects of the row (the objects that
+-- belong to it besides its metadata object, e.g. the video of a video preview)
+-- that have been copied to a replica bucket, as "<bucket>:<object key>", so
+-- that a retry doesn't copy them again.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS replicated_side_objects TEXT[] NOT NULL DEFAULT '{}';
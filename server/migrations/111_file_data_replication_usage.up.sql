@@ -0,0 +1,16 @@
+-- The replication work done on behalf of each user, in hourly buckets (hour is
+-- the start of the hour in epoch microseconds), for accounting and for the
+-- soft per-user replication limits. Buckets older than the configured retention
+-- are pruned.
+CREATE TABLE IF NOT EXISTS file_data_replication_usage
+(
+    user_id BIGINT NOT NULL,
+    hour    BIGINT NOT NULL,
+--  bytes downloaded and uploaded
+    bytes   BIGINT NOT NULL DEFAULT 0,
+--  number of objects copied to a bucket
+    objects BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, hour)
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_data_replication_usage_hour ON file_data_replication_usage (hour);
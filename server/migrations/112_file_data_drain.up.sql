@@ -0,0 +1,34 @@
+-- Jobs that move all the file data off a bucket that is being retired, by
+-- making sure that each row listing the bucket has verified copies in its other
+-- buckets, and then removing the bucket from the row.
+--
+-- The job walks the live rows listing the bucket in (file_id, data_type)
+-- order, last_file_id and last_type being the position that the current pass
+-- has reached. Rows that couldn't be drained yet are retried by the next pass,
+-- and the job is only completed once no row lists the bucket anymore.
+CREATE TABLE IF NOT EXISTS file_data_drain
+(
+    id           BIGSERIAL PRIMARY KEY,
+    bucket       s3region NOT NULL,
+--  one of running or completed
+    status       TEXT     NOT NULL DEFAULT 'running',
+    last_file_id BIGINT   NOT NULL DEFAULT 0,
+    last_type    TEXT     NOT NULL DEFAULT '',
+--  number of live rows listing the bucket when the job was created
+    total        BIGINT   NOT NULL DEFAULT 0,
+--  rows that the bucket has been removed from
+    drained      BIGINT   NOT NULL DEFAULT 0,
+--  times that rows were queued for replication to their other buckets
+    requeued     BIGINT   NOT NULL DEFAULT 0,
+--  rows in the current pass whose copies couldn't be confirmed elsewhere
+    unconfirmed  BIGINT   NOT NULL DEFAULT 0,
+--  live rows still listing the bucket at the end of the last pass
+    remaining    BIGINT   NOT NULL DEFAULT 0,
+    passes       BIGINT   NOT NULL DEFAULT 0,
+--  the instance running a batch of the job holds it till then
+    locked_till  BIGINT   NOT NULL DEFAULT 0,
+    created_at   BIGINT   NOT NULL DEFAULT now_utc_micro_seconds(),
+    updated_at   BIGINT   NOT NULL DEFAULT now_utc_micro_seconds()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_file_data_drain_running ON file_data_drain (bucket) WHERE status = 'running';
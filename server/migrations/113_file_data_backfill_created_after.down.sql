@@ -0,0 +1 @@
+ALTER TABLE file_data_backfill DROP COLUMN IF EXISTS created_after;
@@ -0,0 +1,3 @@
+-- created_after limits a backfill job to the rows created after it (epoch
+-- microseconds), 0 for all the rows.
+ALTER TABLE file_data_backfill ADD COLUMN IF NOT EXISTS created_after BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- replica_versions lists the version that replication wrote to each versioned
+-- bucket the row has been replicated to (see s3.<dc>.versioned), as
+-- "<bucket>:<version id>", so that the copy can be verified and referenced by
+-- its exact version.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS replica_versions TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,3 @@
+ALTER TABLE file_data_replication_history DROP COLUMN IF EXISTS route_bytes;
+ALTER TABLE file_data_replication_history DROP COLUMN IF EXISTS route_destinations;
+ALTER TABLE file_data_replication_history DROP COLUMN IF EXISTS route_sources;
@@ -0,0 +1,6 @@
+-- The bytes moved along each route (source bucket to destination bucket) of a
+-- replication, as parallel arrays: route_bytes[i] bytes were copied from
+-- route_sources[i] to route_destinations[i]
+ALTER TABLE file_data_replication_history ADD COLUMN IF NOT EXISTS route_sources s3region[] NOT NULL DEFAULT '{}';
+ALTER TABLE file_data_replication_history ADD COLUMN IF NOT EXISTS route_destinations s3region[] NOT NULL DEFAULT '{}';
+ALTER TABLE file_data_replication_history ADD COLUMN IF NOT EXISTS route_bytes BIGINT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,33 @@
+-- Jobs that confirm that every row of a type is in a bucket that is to become
+-- the type's primary, queueing the rows that aren't for replication to it.
+--
+-- The job walks the live rows of the type that were updated before it was
+-- created and aren't recorded in the bucket, in file_id order, last_file_id
+-- being the position that the current pass has reached. The job is ready once
+-- a pass ends with none of them left.
+CREATE TABLE IF NOT EXISTS file_data_promotion_check
+(
+    id           BIGSERIAL   PRIMARY KEY,
+    data_type    OBJECT_TYPE NOT NULL,
+    bucket       s3region    NOT NULL,
+--  one of running or ready
+    status       TEXT        NOT NULL DEFAULT 'running',
+    last_file_id BIGINT      NOT NULL DEFAULT 0,
+--  number of live rows of the type when the job was created
+    total        BIGINT      NOT NULL DEFAULT 0,
+--  rows queued for replication to the bucket
+    requeued     BIGINT      NOT NULL DEFAULT 0,
+--  rows in the current pass that were already queued, or being replicated
+    waiting      BIGINT      NOT NULL DEFAULT 0,
+--  rows in the current pass that can't be replicated to the bucket
+    unconfirmed  BIGINT      NOT NULL DEFAULT 0,
+--  rows not recorded in the bucket at the end of the last pass
+    remaining    BIGINT      NOT NULL DEFAULT 0,
+    passes       BIGINT      NOT NULL DEFAULT 0,
+--  the instance running a batch of the job holds it till then
+    locked_till  BIGINT      NOT NULL DEFAULT 0,
+    created_at   BIGINT      NOT NULL DEFAULT now_utc_micro_seconds(),
+    updated_at   BIGINT      NOT NULL DEFAULT now_utc_micro_seconds()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_file_data_promotion_check_running ON file_data_promotion_check (data_type, bucket) WHERE status = 'running';
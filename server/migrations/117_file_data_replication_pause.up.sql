@@ -0,0 +1,7 @@
+-- Whether file data replication has been paused by an admin, on all the
+-- instances. The table has a row while replication is paused.
+CREATE TABLE IF NOT EXISTS file_data_replication_pause
+(
+    id        BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    paused_at BIGINT  NOT NULL DEFAULT now_utc_micro_seconds()
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS file_data_replication_created_after;
@@ -0,0 +1,8 @@
+-- The cutoff that an admin has limited file data replication to, on all the
+-- instances: only the rows created after it are replicated. The table has a row
+-- while replication is limited.
+CREATE TABLE IF NOT EXISTS file_data_replication_created_after
+(
+    id            BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    created_after BIGINT  NOT NULL
+);
@@ -0,0 +1,3 @@
+-- The buckets named by the replica overrides of a type are looked up by the
+-- audits and the reconciliation by listing, which also list these buckets.
+CREATE INDEX IF NOT EXISTS idx_file_data_replica_override ON file_data (data_type) WHERE replica_buckets_override IS NOT NULL;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_file_data_pending_updated_at;
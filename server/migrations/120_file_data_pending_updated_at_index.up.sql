@@ -0,0 +1,3 @@
+-- Pending rows are picked in the order of their updates (see the replication
+-- order), with the rows of the deprioritized users in a pass of their own.
+CREATE INDEX IF NOT EXISTS idx_file_data_pending_updated_at ON file_data (is_deleted, updated_at) WHERE pending_sync = true;
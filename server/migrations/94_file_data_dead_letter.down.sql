@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_file_data_dead_lettered;
+
+ALTER TABLE file_data
+    DROP COLUMN IF EXISTS attempt_count,
+    DROP COLUMN IF EXISTS is_dead_lettered;
@@ -0,0 +1,9 @@
+-- attempt_count tracks the number of consecutive failed replication attempts
+-- for the row. Once it reaches the configured maximum, the row is moved to the
+-- dead letter state and is no longer picked up for replication until it is
+-- requeued manually.
+ALTER TABLE file_data
+    ADD COLUMN IF NOT EXISTS attempt_count    INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS is_dead_lettered BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_file_data_dead_lettered ON file_data (updated_at) WHERE is_dead_lettered = true;
@@ -0,0 +1 @@
+ALTER TABLE file_data DROP COLUMN IF EXISTS checksum;
@@ -0,0 +1,4 @@
+-- checksum is the hex encoded SHA-256 of the metadata object for the row. It is
+-- used to verify the object after it is replicated (or later, during audits)
+-- without having to re-download it from the latest bucket.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS checksum TEXT;
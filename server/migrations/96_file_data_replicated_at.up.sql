@@ -0,0 +1,5 @@
+-- replicated_at is the time at which the row was last fully replicated. It is
+-- used for reporting replication throughput.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS replicated_at BIGINT;
+
+CREATE INDEX IF NOT EXISTS idx_file_data_replicated_at ON file_data (replicated_at) WHERE replicated_at IS NOT NULL;
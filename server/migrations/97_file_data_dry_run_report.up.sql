@@ -0,0 +1,15 @@
+-- Rows that a dry run of file data replication found to be out of sync, along
+-- with what replication would have done for them.
+CREATE TABLE IF NOT EXISTS file_data_dry_run_report
+(
+    file_id         BIGINT      NOT NULL,
+    data_type       OBJECT_TYPE NOT NULL,
+    user_id         BIGINT      NOT NULL,
+    source_bucket   s3region    NOT NULL,
+    missing_buckets s3region[]  NOT NULL DEFAULT '{}',
+    size            BIGINT      NOT NULL,
+--  updated_at of the file_data row when it was scanned, so that the row is scanned again if it changes
+    row_updated_at  BIGINT      NOT NULL,
+    created_at      BIGINT      NOT NULL DEFAULT now_utc_micro_seconds(),
+    PRIMARY KEY (file_id, data_type)
+);
@@ -0,0 +1,20 @@
+-- Outbox of events emitted when a file data row finishes replicating. Events
+-- are written in the same transaction that marks the row as replicated, and are
+-- then relayed to the configured sink. A relayer claims a batch of events till
+-- claimed_till before publishing them, and published_at is set once the sink
+-- accepts the event.
+CREATE TABLE IF NOT EXISTS file_data_replication_events
+(
+    id            BIGSERIAL PRIMARY KEY,
+    file_id       BIGINT      NOT NULL,
+    data_type     OBJECT_TYPE NOT NULL,
+    user_id       BIGINT      NOT NULL,
+    size          BIGINT      NOT NULL,
+    buckets       s3region[]  NOT NULL DEFAULT '{}',
+    replicated_at BIGINT      NOT NULL DEFAULT now_utc_micro_seconds(),
+    attempts      INTEGER     NOT NULL DEFAULT 0,
+    claimed_till  BIGINT      NOT NULL DEFAULT 0,
+    published_at  BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_data_replication_events_unpublished ON file_data_replication_events (id) WHERE published_at IS NULL;
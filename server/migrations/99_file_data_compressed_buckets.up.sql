@@ -0,0 +1,3 @@
+-- compressed_buckets lists the buckets in which the metadata object of the row
+-- is stored gzip compressed.
+ALTER TABLE file_data ADD COLUMN IF NOT EXISTS compressed_buckets s3region[] NOT NULL DEFAULT '{}';
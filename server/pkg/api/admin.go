@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/ente-io/museum/pkg/controller/emergency"
+	"github.com/ente-io/museum/pkg/controller/filedata"
 	"github.com/ente-io/museum/pkg/controller/remotestore"
 	"github.com/ente-io/museum/pkg/repo/authenticator"
 	"net/http"
@@ -57,6 +58,7 @@ type AdminHandler struct {
 	HashingKey              []byte
 	PasskeyController       *controller.PasskeyController
 	StorageBonusCtl         *storagebonusCtrl.Controller
+	FileDataCtrl            *filedata.Controller
 }
 
 // Duration for which an admin's token is considered valid
@@ -0,0 +1,427 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	fileData "github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/handler"
+	"github.com/ente-io/stacktrace"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// GetFileDataReplicationStatus returns the file data replication backlog per
+// object type.
+func (h *AdminHandler) GetFileDataReplicationStatus(c *gin.Context) {
+	status, err := h.FileDataCtrl.GetReplicationStatus(c)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// GetFileDataPendingReport streams a report of every file data row that is
+// pending replication, along with the buckets that it is missing from, as a
+// downloadable CSV (the default) or JSON file, depending on format.
+func (h *AdminHandler) GetFileDataPendingReport(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	contentType := "text/csv"
+	if format == "json" {
+		contentType = "application/json"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=file-data-pending-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format))
+	if err := h.FileDataCtrl.WritePendingReport(c, format, c.Writer); err != nil {
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Disposition")
+			handler.Error(c, stacktrace.Propagate(err, ""))
+			return
+		}
+		// Too late to report the error, the report is cut short instead
+		logrus.WithError(err).Error("Could not write the file data pending replication report")
+		c.Abort()
+	}
+}
+
+// GetFileDataDryRunReport returns the discrepancies found by file data
+// replication dry runs, per object type and missing bucket.
+func (h *AdminHandler) GetFileDataDryRunReport(c *gin.Context) {
+	summary, err := h.FileDataCtrl.GetDryRunSummary(c)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"discrepancies": summary})
+}
+
+// ClearFileDataDryRunReport discards the file data replication dry run report.
+func (h *AdminHandler) ClearFileDataDryRunReport(c *gin.Context) {
+	if err := h.FileDataCtrl.ClearDryRunReport(c); err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// PauseFileDataReplication pauses file data replication on all the instances.
+func (h *AdminHandler) PauseFileDataReplication(c *gin.Context) {
+	if err := h.FileDataCtrl.Pause(c); err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, h.FileDataCtrl.GetPauseStatus())
+}
+
+// ResumeFileDataReplication resumes file data replication on all the
+// instances.
+func (h *AdminHandler) ResumeFileDataReplication(c *gin.Context) {
+	if err := h.FileDataCtrl.Resume(c); err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, h.FileDataCtrl.GetPauseStatus())
+}
+
+// EnterFileDataMaintenance puts file data replication on the instance that
+// serves the request in maintenance mode, in which in-flight work is drained.
+func (h *AdminHandler) EnterFileDataMaintenance(c *gin.Context) {
+	h.FileDataCtrl.EnterMaintenance()
+	c.JSON(http.StatusOK, h.FileDataCtrl.GetMaintenanceStatus())
+}
+
+// LeaveFileDataMaintenance takes file data replication on the instance that
+// serves the request out of maintenance mode.
+func (h *AdminHandler) LeaveFileDataMaintenance(c *gin.Context) {
+	h.FileDataCtrl.LeaveMaintenance()
+	c.JSON(http.StatusOK, h.FileDataCtrl.GetMaintenanceStatus())
+}
+
+// GetFileDataMaintenanceStatus returns whether file data replication on the
+// instance that serves the request is in maintenance mode and has drained. With
+// wait (a duration), it first waits up to that long for it to drain.
+func (h *AdminHandler) GetFileDataMaintenanceStatus(c *gin.Context) {
+	if v := c.Query("wait"); v != "" {
+		wait, err := time.ParseDuration(v)
+		if err != nil {
+			handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid wait"), ""))
+			return
+		}
+		ctx, cancel := context.WithTimeout(c, wait)
+		h.FileDataCtrl.WaitUntilDrained(ctx)
+		cancel()
+	}
+	c.JSON(http.StatusOK, h.FileDataCtrl.GetMaintenanceStatus())
+}
+
+// SetFileDataCreatedAfter limits the rows that the workers of all the instances
+// replicate to those created after a cutoff, or lifts the limit with a cutoff
+// of 0.
+func (h *AdminHandler) SetFileDataCreatedAfter(c *gin.Context) {
+	var req fileData.CreatedAfterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	if err := h.FileDataCtrl.SetCreatedAfter(c, req.CreatedAfter); err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, req)
+}
+
+// ReplicateFileDataNow replicates a single file's data synchronously.
+func (h *AdminHandler) ReplicateFileDataNow(c *gin.Context) {
+	var req fileData.ReplicateNowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	resp, err := h.FileDataCtrl.ReplicateNow(c, req.FileID, req.Type)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// SetFileDataReplicaOverride sets the buckets that a single file's data is
+// replicated to, overriding the replicas configured for its type.
+func (h *AdminHandler) SetFileDataReplicaOverride(c *gin.Context) {
+	var req fileData.ReplicaOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	if err := h.FileDataCtrl.SetReplicaOverride(c, req); err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// ClearFileDataReplicaOverride makes a single file's data replicate to the
+// replicas configured for its type again.
+func (h *AdminHandler) ClearFileDataReplicaOverride(c *gin.Context) {
+	var req fileData.ClearReplicaOverrideRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	if err := h.FileDataCtrl.ClearReplicaOverride(c, req.FileID, req.Type); err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// InspectFileDataReplication returns the replication state of a single file's
+// data, along with what each of the relevant buckets has.
+func (h *AdminHandler) InspectFileDataReplication(c *gin.Context) {
+	fileID, err := strconv.ParseInt(c.Param("fileID"), 10, 64)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid fileID"), ""))
+		return
+	}
+	state, err := h.FileDataCtrl.InspectRow(c, fileID, ente.ObjectType(c.Param("type")))
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
+
+// GetFileDataDeadLetters lists the file data rows whose replication has been
+// given up on, along with the error that they last failed with.
+func (h *AdminHandler) GetFileDataDeadLetters(c *gin.Context) {
+	limit := 0
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid limit"), ""))
+			return
+		}
+	}
+	rows, err := h.FileDataCtrl.GetDeadLetteredRows(c, limit)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rows": rows})
+}
+
+// RequeueFailedFileData puts the file data rows of a type whose replication has
+// failed back into the replication queue, and reports how many were requeued.
+func (h *AdminHandler) RequeueFailedFileData(c *gin.Context) {
+	var req fileData.RequeueFailedRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	requeued, err := h.FileDataCtrl.RequeueFailed(c, req)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requeued": requeued})
+}
+
+// GetFileDataReplicationUsage lists the users with the most file data
+// replication work over the last window (24h by default), or just the user
+// given by userID.
+func (h *AdminHandler) GetFileDataReplicationUsage(c *gin.Context) {
+	var window time.Duration
+	if v := c.Query("window"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil {
+			handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid window"), ""))
+			return
+		}
+	}
+	var userID *int64
+	if v := c.Query("userID"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid userID"), ""))
+			return
+		}
+		userID = &id
+	}
+	limit := 0
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid limit"), ""))
+			return
+		}
+	}
+	usage, err := h.FileDataCtrl.GetReplicationUsage(c, window, userID, limit)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": usage})
+}
+
+// AuditFileDataBuckets compares the objects of a type in its buckets against
+// its rows, a part at a time, see filedata.AuditRequest.
+func (h *AdminHandler) AuditFileDataBuckets(c *gin.Context) {
+	var req fileData.AuditRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	report, err := h.FileDataCtrl.Audit(c, req)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// GetFileDataReplicationWorkers returns the state of the file data replication
+// workers of the instance that serves the request.
+func (h *AdminHandler) GetFileDataReplicationWorkers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"workers": h.FileDataCtrl.GetWorkerStatus()})
+}
+
+// GetFileDataReconciliationReport returns the corrections made by the last file
+// data reconciliation run on the instance that serves the request.
+func (h *AdminHandler) GetFileDataReconciliationReport(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"report": h.FileDataCtrl.GetReconciliationReport()})
+}
+
+// StartFileDataBackfill starts copying the existing file data of a type to a
+// bucket that has been newly added to its replicas.
+func (h *AdminHandler) StartFileDataBackfill(c *gin.Context) {
+	var req fileData.BackfillRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	job, err := h.FileDataCtrl.StartBackfill(c, req)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// GetFileDataBackfills returns the progress of the file data backfills.
+func (h *AdminHandler) GetFileDataBackfills(c *gin.Context) {
+	jobs, err := h.FileDataCtrl.GetBackfills(c)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"backfills": jobs})
+}
+
+// StartFileDataDrain starts moving all the file data off a bucket that is being
+// retired.
+func (h *AdminHandler) StartFileDataDrain(c *gin.Context) {
+	var req fileData.DrainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	job, err := h.FileDataCtrl.StartDrain(c, req)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// GetFileDataDrains returns the progress of the file data drains.
+func (h *AdminHandler) GetFileDataDrains(c *gin.Context) {
+	jobs, err := h.FileDataCtrl.GetDrains(c)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"drains": jobs})
+}
+
+// StartFileDataPromotionCheck starts confirming that all the file data of a
+// type is in a bucket that is to become the type's primary.
+func (h *AdminHandler) StartFileDataPromotionCheck(c *gin.Context) {
+	var req fileData.PromotionCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	check, err := h.FileDataCtrl.StartPromotionCheck(c, req)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, check)
+}
+
+// GetFileDataPromotionChecks returns the progress of the file data promotion
+// checks.
+func (h *AdminHandler) GetFileDataPromotionChecks(c *gin.Context) {
+	checks, err := h.FileDataCtrl.GetPromotionChecks(c)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"checks": checks})
+}
+
+// GetFileDataPromotionCheck returns the progress of a file data promotion
+// check, and whether its bucket is safe to promote.
+func (h *AdminHandler) GetFileDataPromotionCheck(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid id"), ""))
+		return
+	}
+	check, err := h.FileDataCtrl.GetPromotionCheck(c, id)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, check)
+}
+
+// DisableFileDataBucket temporarily pauses file data replication to a bucket.
+func (h *AdminHandler) DisableFileDataBucket(c *gin.Context) {
+	var req fileData.DisableBucketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		handler.Error(c, stacktrace.Propagate(ente.NewBadRequestWithMessage(err.Error()), ""))
+		return
+	}
+	disabled, err := h.FileDataCtrl.DisableBucket(c, req)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, disabled)
+}
+
+// EnableFileDataBucket resumes file data replication to a disabled bucket.
+func (h *AdminHandler) EnableFileDataBucket(c *gin.Context) {
+	if err := h.FileDataCtrl.EnableBucket(c, c.Param("bucket")); err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// GetDisabledFileDataBuckets returns the buckets that file data replication is
+// currently paused for.
+func (h *AdminHandler) GetDisabledFileDataBuckets(c *gin.Context) {
+	buckets, err := h.FileDataCtrl.GetDisabledBuckets(c)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"buckets": buckets})
+}
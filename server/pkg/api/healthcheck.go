@@ -12,13 +12,15 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
+	"github.com/ente-io/museum/pkg/controller/filedata"
 	"github.com/ente-io/museum/pkg/utils/config"
 	"github.com/ente-io/museum/pkg/utils/handler"
 	"github.com/gin-gonic/gin"
 )
 
 type HealthCheckHandler struct {
-	DB *sql.DB
+	DB           *sql.DB
+	FileDataCtrl *filedata.Controller
 }
 
 func (h *HealthCheckHandler) Ping(c *gin.Context) {
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ente-io/museum/pkg/utils/handler"
+	"github.com/ente-io/stacktrace"
+	"github.com/gin-gonic/gin"
+)
+
+// ReplicationHealth responds with 503 if file data replication on this instance
+// is not making forward progress even though rows are pending, and with 200
+// otherwise (including on instances that don't replicate).
+func (h *HealthCheckHandler) ReplicationHealth(c *gin.Context) {
+	health, err := h.FileDataCtrl.GetReplicationHealth(c)
+	if err != nil {
+		handler.Error(c, stacktrace.Propagate(err, ""))
+		return
+	}
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, health)
+}
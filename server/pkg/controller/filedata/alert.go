@@ -0,0 +1,157 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultAlertInterval = 1 * time.Minute
+	defaultAlertChecks   = 3
+	// watcherLockIntervals is how many intervals the lock of a watcher is
+	// claimed for, after which another instance takes over if the one that
+	// claimed it has stopped
+	watcherLockIntervals = 3
+)
+
+// backlogAlert debounces the backlog checks. The alert fires once the backlog
+// has been over a threshold for checks consecutive checks, and recovers once it
+// has been under all the thresholds for as many checks, so a backlog hovering
+// around a threshold doesn't cause a flurry of notifications.
+type backlogAlert struct {
+	checks int
+	firing bool
+	// number of consecutive checks that disagree with firing
+	streak int
+}
+
+// observe records the outcome of a check, and returns true if the alert has
+// changed state (fired or recovered) because of it.
+func (a *backlogAlert) observe(breached bool) bool {
+	if breached == a.firing {
+		a.streak = 0
+		return false
+	}
+	a.streak++
+	if a.streak < a.checks {
+		return false
+	}
+	a.firing = breached
+	a.streak = 0
+	return true
+}
+
+// claimWatcher reports whether the instance is the one that runs the watcher
+// with the given name, claiming its lock for a few intervals. Only one of the
+// instances that share the database runs each watcher, so that the checks are
+// made, and their alerts sent, once.
+func (c *Controller) claimWatcher(ctx context.Context, name string, interval time.Duration) bool {
+	claimed, err := c.Repo.ClaimTaskLock(ctx, "file-data-"+name, time.Now().Add(watcherLockIntervals*interval).UnixMicro())
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).Warnf("Could not claim the file data %s watcher", name)
+		}
+		return false
+	}
+	return claimed
+}
+
+// watchBacklog periodically checks the replication backlog, and notifies
+// replication.file-data.alert.webhook-url when either the number of pending rows
+// exceeds max-pending or the oldest pending row is older than max-age, and again
+// when the backlog has recovered. It returns immediately if no webhook is
+// configured, or neither threshold is set. Only the instance that claims the
+// watcher (see claimWatcher) checks the backlog.
+func (c *Controller) watchBacklog(ctx context.Context) {
+	url := viper.GetString("replication.file-data.alert.webhook-url")
+	maxPending := viper.GetInt64("replication.file-data.alert.max-pending")
+	maxAge := viper.GetDuration("replication.file-data.alert.max-age")
+	if url == "" || (maxPending <= 0 && maxAge <= 0) {
+		return
+	}
+	interval := viper.GetDuration("replication.file-data.alert.interval")
+	if interval <= 0 {
+		interval = defaultAlertInterval
+	}
+	checks := viper.GetInt("replication.file-data.alert.checks")
+	if checks <= 0 {
+		checks = defaultAlertChecks
+	}
+	alert := &backlogAlert{checks: checks}
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !c.claimWatcher(ctx, "backlog-alert", interval) {
+			// Start afresh if this instance takes over again
+			alert = &backlogAlert{checks: checks}
+			continue
+		}
+		status, err := c.GetReplicationStatus(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("Could not check file data replication backlog")
+			}
+			continue
+		}
+		var pending int64
+		var oldest time.Duration
+		for _, t := range status.Types {
+			pending += t.Pending
+			if t.OldestPendingAt > 0 {
+				oldest = max(oldest, time.Since(time.UnixMicro(t.OldestPendingAt)))
+			}
+		}
+		breached := (maxPending > 0 && pending > maxPending) || (maxAge > 0 && oldest > maxAge)
+		if !alert.observe(breached) {
+			continue
+		}
+		host, _ := os.Hostname()
+		var text string
+		if alert.firing {
+			text = fmt.Sprintf(":warning: File data replication is falling behind on %s: %d rows pending, oldest pending for %s", host, pending, oldest.Round(time.Second))
+		} else {
+			text = fmt.Sprintf(":white_check_mark: File data replication has caught up on %s: %d rows pending", host, pending)
+		}
+		log.Warn(text)
+		if err := postAlert(ctx, client, url, text); err != nil {
+			log.WithError(err).Error("Could not send file data replication backlog alert")
+		}
+	}
+}
+
+// postAlert posts text to a Slack compatible incoming webhook.
+func postAlert(ctx context.Context, client *http.Client, url string, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordAliasedBuckets records the pending buckets that are backed by the same
+// physical store as the row's latest bucket as replicated, since the object is
+// already there. It returns the pending buckets that still need a copy.
+//
+// Uploading to such a bucket would at best copy the object onto itself, and at
+// worst overwrite the source with a compressed or encrypted copy.
+func (c *Controller) recordAliasedBuckets(ctx context.Context, row filedata.Row, pending map[string]bool) (map[string]bool, error) {
+	remaining := make(map[string]bool, len(pending))
+	for bucketID := range pending {
+		if !c.S3Config.SharesBackend(row.LatestBucket, bucketID) {
+			remaining[bucketID] = true
+			continue
+		}
+		if _, warned := c.aliasWarnings.LoadOrStore(row.LatestBucket+"/"+bucketID, true); !warned {
+			rowLogger(row).WithFields(log.Fields{
+				logSourceBucket: row.LatestBucket,
+				logDestBucket:   bucketID,
+				"backend":       c.S3Config.GetStoreIdentity(bucketID),
+			}).Warn("Replica bucket is backed by the same store as the source, not copying file data to it. Please fix the configuration.")
+		}
+		if err := c.recordAsReplicated(ctx, row, bucketID); err != nil {
+			return nil, stacktrace.Propagate(err, "could not record aliased bucket %s", bucketID)
+		}
+	}
+	return remaining, nil
+}
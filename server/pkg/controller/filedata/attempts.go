@@ -0,0 +1,245 @@
+package filedata
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// attemptRateInterval is how often the rates of attempt registrations and
+	// failures are measured
+	attemptRateInterval = 10 * time.Second
+
+	defaultCoalesceFailuresPerSecond = 50
+	defaultCoalesceWindow            = time.Minute
+	// maxCoalescedRows caps the number of rows whose last failure is
+	// remembered while coalescing, past which failures are recorded as usual
+	maxCoalescedRows = 100000
+)
+
+// attemptBudget protects the database from the writes of replication attempts
+// during an incident, when everything is failing at once.
+//
+// The registrations of attempts (see RegisterReplicationAttempt) are capped at
+// replication.file-data.attempts.registrations-per-second, if set, making the
+// workers wait for their turn. And once failures come in faster than
+// attempts.coalesce.failures-per-second, the failures of a row with the same
+// class of error as the failure recorded for it within the last
+// attempts.coalesce.window are not recorded again, until the failure rate is
+// back under the threshold. These only delay the dead lettering of the row,
+// as their attempts aren't counted; permanent failures are always recorded.
+// When the rows last failed is still recorded, in a single write every
+// attemptRateInterval.
+type attemptBudget struct {
+	mu      sync.Mutex
+	limiter *rate.Limiter
+	// the last failure recorded for each row while coalescing
+	failures map[rowKey]recordedFailure
+	// when each row last failed without the failure being recorded, see
+	// flushCoalescedFailures
+	coalesced map[rowKey]time.Time
+
+	registrations atomic.Int64
+	failed        atomic.Int64
+	coalescing    atomic.Bool
+}
+
+type recordedFailure struct {
+	at    time.Time
+	class ReplicationErrorClass
+}
+
+// coalesceFailuresPerSecond returns
+// replication.file-data.attempts.coalesce.failures-per-second, the failure rate
+// above which redundant failures are coalesced. A negative value disables this.
+func coalesceFailuresPerSecond() float64 {
+	if viper.IsSet("replication.file-data.attempts.coalesce.failures-per-second") {
+		return viper.GetFloat64("replication.file-data.attempts.coalesce.failures-per-second")
+	}
+	return defaultCoalesceFailuresPerSecond
+}
+
+func coalesceWindow() time.Duration {
+	if d := viper.GetDuration("replication.file-data.attempts.coalesce.window"); d > 0 {
+		return d
+	}
+	return defaultCoalesceWindow
+}
+
+type reservedAttemptCtxKey struct{}
+
+// isRegistered reports whether the attempt to replicate the row to dstBucketID
+// is already registered, and doesn't need a write.
+func isRegistered(row filedata.Row, dstBucketID string) bool {
+	return slices.Contains(row.InflightReplicas, dstBucketID) && !slices.Contains(row.DeleteFromBuckets, dstBucketID)
+}
+
+// registerAttempt registers the attempt to replicate the row to dstBucketID,
+// once the cap on registrations allows it, unless reserveAttempt already
+// waited for that. Attempts that are already registered don't need a write,
+// only a check of the lock, and aren't held back.
+func (c *Controller) registerAttempt(ctx context.Context, row filedata.Row, dstBucketID string) error {
+	if !isRegistered(row, dstBucketID) {
+		if reserved, _ := ctx.Value(reservedAttemptCtxKey{}).(string); reserved != dstBucketID {
+			if err := c.attempts.wait(ctx); err != nil {
+				return stacktrace.Propagate(err, "")
+			}
+		}
+	}
+	return stacktrace.Propagate(c.Repo.RegisterReplicationAttempt(ctx, row, dstBucketID), "")
+}
+
+// reserveAttempt waits for the cap on registrations to allow registering the
+// attempt to replicate the row to dstBucketID, before the attempt is timed,
+// and returns ctx marked so that registerAttempt doesn't wait again.
+func (c *Controller) reserveAttempt(ctx context.Context, row filedata.Row, dstBucketID string) (context.Context, error) {
+	if isRegistered(row, dstBucketID) {
+		return ctx, nil
+	}
+	if err := c.attempts.wait(ctx); err != nil {
+		return nil, stacktrace.Propagate(err, "could not register replication attempt")
+	}
+	return context.WithValue(ctx, reservedAttemptCtxKey{}, dstBucketID), nil
+}
+
+// wait blocks until the cap on registrations allows one more, and counts it.
+func (b *attemptBudget) wait(ctx context.Context) error {
+	perSecond := viper.GetFloat64("replication.file-data.attempts.registrations-per-second")
+	if perSecond > 0 {
+		if err := b.limiterFor(perSecond).Wait(ctx); err != nil {
+			return err
+		}
+	}
+	b.registrations.Add(1)
+	return nil
+}
+
+// limiterFor returns the limiter of the registrations, updated to perSecond if
+// the configuration has changed since it was created. Bursts of up to a
+// second's worth of registrations are allowed.
+func (b *attemptBudget) limiterFor(perSecond float64) *rate.Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	burst := max(1, int(perSecond))
+	if b.limiter == nil {
+		b.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	} else if b.limiter.Limit() != rate.Limit(perSecond) {
+		b.limiter.SetLimit(rate.Limit(perSecond))
+		b.limiter.SetBurst(burst)
+	}
+	return b.limiter
+}
+
+// shouldRecordFailure counts a failure of the row, and reports whether it
+// needs to be recorded, i.e. whether it isn't redundant with the failure last
+// recorded for the row while coalescing.
+func (b *attemptBudget) shouldRecordFailure(row filedata.Row, class ReplicationErrorClass, now time.Time) bool {
+	b.failed.Add(1)
+	if !b.coalescing.Load() || class.permanent() {
+		return true
+	}
+	window := coalesceWindow()
+	key := rowKey{row.FileID, row.Type}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if last, ok := b.failures[key]; ok && last.class == class && now.Sub(last.at) < window {
+		if b.coalesced == nil {
+			b.coalesced = map[rowKey]time.Time{}
+		}
+		b.coalesced[key] = now
+		return false
+	}
+	if b.failures == nil {
+		b.failures = map[rowKey]recordedFailure{}
+	}
+	if len(b.failures) < maxCoalescedRows {
+		b.failures[key] = recordedFailure{at: now, class: class}
+	}
+	return true
+}
+
+// measure updates the metrics of the rates of registrations and failures over
+// the last interval, and starts or stops coalescing failures depending on the
+// failure rate.
+func (b *attemptBudget) measure(interval time.Duration) {
+	registrationRate := float64(b.registrations.Swap(0)) / interval.Seconds()
+	failureRate := float64(b.failed.Swap(0)) / interval.Seconds()
+	mAttemptRegistrationRate.Set(registrationRate)
+	mAttemptFailureRate.Set(failureRate)
+	threshold := coalesceFailuresPerSecond()
+	coalesce := threshold >= 0 && failureRate > threshold
+	if b.coalescing.Swap(coalesce) == coalesce {
+		if coalesce {
+			b.prune(time.Now())
+		}
+		return
+	}
+	if coalesce {
+		mAttemptCoalescing.Set(1)
+		log.WithField("failures_per_second", failureRate).Warn("File data replication is failing fast, coalescing redundant failures")
+		return
+	}
+	mAttemptCoalescing.Set(0)
+	log.WithField("failures_per_second", failureRate).Info("File data replication failures are back under the threshold, recording all of them")
+	b.mu.Lock()
+	b.failures = nil
+	b.mu.Unlock()
+}
+
+// prune forgets the failures that are too old to be coalesced with anymore.
+func (b *attemptBudget) prune(now time.Time) {
+	window := coalesceWindow()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, last := range b.failures {
+		if now.Sub(last.at) >= window {
+			delete(b.failures, key)
+		}
+	}
+}
+
+// takeCoalesced returns the rows whose failures were coalesced since the last
+// call, and when each last failed.
+func (b *attemptBudget) takeCoalesced() map[rowKey]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	coalesced := b.coalesced
+	b.coalesced = nil
+	return coalesced
+}
+
+// measureAttempts measures the rates of attempt registrations and failures
+// every attemptRateInterval until ctx is cancelled.
+func (c *Controller) measureAttempts(ctx context.Context) {
+	for sleepWithContext(ctx, attemptRateInterval) {
+		c.attempts.measure(attemptRateInterval)
+		c.flushCoalescedFailures(ctx)
+	}
+}
+
+// flushCoalescedFailures records when the rows whose failures were coalesced
+// last failed, so that their last_error_at doesn't go stale while coalescing.
+// This takes a single write for all of them, and doesn't count the attempts.
+func (c *Controller) flushCoalescedFailures(ctx context.Context) {
+	coalesced := c.attempts.takeCoalesced()
+	if len(coalesced) == 0 {
+		return
+	}
+	failures := make([]fileDataRepo.CoalescedFailure, 0, len(coalesced))
+	for key, at := range coalesced {
+		failures = append(failures, fileDataRepo.CoalescedFailure{FileID: key.fileID, Type: key.oType, FailedAt: at.UnixMicro()})
+	}
+	if err := c.Repo.TouchReplicationFailures(ctx, failures); err != nil && ctx.Err() == nil {
+		log.WithError(err).Warnf("Could not record when %d rows whose failures were coalesced last failed", len(failures))
+	}
+}
@@ -0,0 +1,416 @@
+package filedata
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultAuditPageSize       = 1000
+	defaultAuditPagesPerSecond = 2
+	defaultAuditMaxPages       = 20
+	// maxAuditFindings caps the findings listed in a report, the rest are
+	// only counted
+	maxAuditFindings = 1000
+)
+
+const (
+	auditOrphan     = "orphan"
+	auditUnrecorded = "unrecorded"
+	auditGap        = "gap"
+)
+
+// auditPosition is where an audit stopped, it is handed out as an opaque
+// continuation token.
+type auditPosition struct {
+	Type   ente.ObjectType `json:"t"`
+	Bucket string          `json:"b"`
+	// After is the last key of the bucket that has been audited
+	After string `json:"a"`
+}
+
+func (p auditPosition) token() string {
+	data, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseAuditToken(token string) (auditPosition, error) {
+	var p auditPosition
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &p)
+	}
+	return p, err
+}
+
+// auditedObject is an object of the audited type found in a bucket listing.
+type auditedObject struct {
+	key    string
+	userID int64
+	fileID int64
+}
+
+// auditRun is the state of an audit while it goes through the bucket listings.
+type auditRun struct {
+	// job is the background job that the run is part of, jobAudit or
+	// jobReconcile
+	job    string
+	oType  ente.ObjectType
+	suffix string
+	// pageSize is the number of keys listed, and rows fetched, at a time
+	pageSize int
+	limiter  *jobLimiter
+	report   *filedata.AuditReport
+	// onFinding, if set, is called with every finding, including those that
+	// don't fit in the report
+	onFinding func(f filedata.AuditFinding)
+	// onRowChecked, if set, is called with every row that is compared with
+	// the listing, instead of counting it in the report
+	onRowChecked func(row filedata.Row)
+}
+
+func newAuditRun(oType ente.ObjectType, pageSize int, limiter *jobLimiter) *auditRun {
+	return &auditRun{
+		job:      limiter.job,
+		oType:    oType,
+		suffix:   strings.TrimPrefix((&filedata.Row{Type: oType}).S3FileMetadataObjectKey(), filedata.BasePrefix(0, 0)),
+		pageSize: pageSize,
+		limiter:  limiter,
+		report:   &filedata.AuditReport{Type: oType, Buckets: make([]string, 0), Findings: make([]filedata.AuditFinding, 0)},
+	}
+}
+
+// Audit compares the objects of a type in its buckets against the rows of that
+// type, reporting the objects that have no live row (orphans), the objects
+// whose row doesn't know that they are in the bucket (unrecorded), and the rows
+// that say they are in a bucket that doesn't have their object (gaps).
+//
+// It streams through the bucket listing a page at a time, comparing each page
+// against the rows that say they are in the same range of keys, which works
+// because the rows can be fetched in the order in which buckets list their
+// objects. The listing and the database queries are rate limited to
+// replication.file-data.audit.pages-per-second, less while the object stores
+// are distressed (see jobLimiter), and at most audit.concurrency audits run at
+// the same time. Nothing is corrected, the reconciliation job does that for the
+// rows that it checks.
+func (c *Controller) Audit(ctx context.Context, req filedata.AuditRequest) (*filedata.AuditReport, error) {
+	if !isReplicatedType(req.Type) {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("unsupported type "+string(req.Type)), "")
+	}
+	buckets := []string{req.Bucket}
+	if req.Bucket == "" {
+		var err error
+		if buckets, err = c.listedBuckets(ctx, req.Type); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+	}
+	listers := make(map[string]objectstore.Lister, len(buckets))
+	for _, bucketID := range buckets {
+		lister, ok := c.S3Config.GetObjectStore(bucketID).(objectstore.Lister)
+		if !ok {
+			return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("bucket "+bucketID+" can't be listed"), "")
+		}
+		listers[bucketID] = lister
+	}
+	pos := auditPosition{Type: req.Type, Bucket: buckets[0]}
+	if req.ContinuationToken != "" {
+		var err error
+		pos, err = parseAuditToken(req.ContinuationToken)
+		if err != nil || pos.Type != req.Type || !array.StringInList(pos.Bucket, buckets) {
+			return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid continuation token"), "")
+		}
+	}
+	maxPages := req.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultAuditMaxPages
+	}
+	pageSize := viper.GetInt("replication.file-data.audit.page-size")
+	if pageSize <= 0 {
+		pageSize = defaultAuditPageSize
+	}
+	pagesPerSecond := viper.GetFloat64("replication.file-data.audit.pages-per-second")
+	if pagesPerSecond <= 0 {
+		pagesPerSecond = defaultAuditPagesPerSecond
+	}
+	if err := c.jobSlots.acquire(jobAudit, auditConcurrency()); err != nil {
+		return nil, err
+	}
+	defer c.jobSlots.release(jobAudit)
+	run := newAuditRun(req.Type, pageSize, c.newJobLimiter(jobAudit, pagesPerSecond))
+
+	pages := 0
+	started := false
+	for _, bucketID := range buckets {
+		if !started && bucketID != pos.Bucket {
+			continue
+		}
+		after := ""
+		if !started {
+			after = pos.After
+			started = true
+		}
+		run.report.Buckets = append(run.report.Buckets, bucketID)
+		for more := true; more; pages++ {
+			if pages >= maxPages {
+				run.report.ContinuationToken = auditPosition{Type: req.Type, Bucket: bucketID, After: after}.token()
+				return run.report, nil
+			}
+			var err error
+			after, more, err = c.auditPage(ctx, run, bucketID, listers[bucketID], after)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "audit of %s failed after %q", bucketID, after)
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"type":           req.Type,
+		"objects_listed": run.report.ObjectsListed,
+		"orphans":        run.report.Orphans,
+		"unrecorded":     run.report.Unrecorded,
+		"gaps":           run.report.Gaps,
+	}).Info("File data audit finished")
+	return run.report, nil
+}
+
+// listedBuckets returns the buckets that the rows of the type may be in, in the
+// order in which they are listed: the wanted buckets of the type, along with
+// those that some of its rows replicate to instead, see SetReplicaOverride.
+func (c *Controller) listedBuckets(ctx context.Context, oType ente.ObjectType) ([]string, error) {
+	buckets := c.wantedBuckets(oType)
+	overridden, err := c.Repo.GetReplicaOverrideBuckets(ctx, oType)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	for _, bucketID := range overridden {
+		if c.S3Config.IsBucketActive(bucketID) {
+			buckets[bucketID] = true
+		}
+	}
+	return sortedKeys(buckets), nil
+}
+
+// auditPage audits the next page of the listing of the bucket, after the given
+// key. It returns the last key that it audited, and whether there are more
+// keys after it.
+func (c *Controller) auditPage(ctx context.Context, run *auditRun, bucketID string, lister objectstore.Lister, after string) (string, bool, error) {
+	if err := run.limiter.Wait(ctx); err != nil {
+		return after, false, err
+	}
+	keys, more, err := lister.List(ctx, after, run.pageSize)
+	if err != nil {
+		return after, false, stacktrace.Propagate(err, "")
+	}
+	// The last page covers everything after the previous one
+	more = more && len(keys) > 0
+	upto := ""
+	if more {
+		upto = keys[len(keys)-1]
+	}
+	listed := make(map[string]bool)
+	var objects []auditedObject
+	for _, key := range keys {
+		if obj, ok := run.parseKey(key); ok {
+			listed[key] = true
+			objects = append(objects, obj)
+		}
+	}
+	run.report.ObjectsListed += len(objects)
+	mJobObjectsListed.WithLabelValues(run.job, bucketID).Add(float64(len(objects)))
+
+	// The rows that say that they are in this part of the listing
+	recorded := make(map[string]bool)
+	prefixes := prefixRange(after, upto, run.suffix)
+	for {
+		if err := run.limiter.Wait(ctx); err != nil {
+			return after, false, err
+		}
+		rows, err := c.Repo.GetLiveRowsInBucket(ctx, run.oType, bucketID, prefixes, run.pageSize)
+		if err != nil {
+			return after, false, stacktrace.Propagate(err, "")
+		}
+		for _, row := range rows {
+			key := row.S3FileMetadataObjectKey()
+			recorded[key] = true
+			if run.onRowChecked != nil {
+				run.onRowChecked(row)
+			} else {
+				run.report.RowsChecked++
+				mJobRowsChecked.WithLabelValues(run.job).Inc()
+			}
+			if listed[key] {
+				continue
+			}
+			// The object may have been uploaded after the page was listed
+			missing, err := c.confirmMissing(ctx, run, key, bucketID)
+			if err != nil {
+				return after, false, err
+			}
+			if missing {
+				run.addFinding(filedata.AuditFinding{Bucket: bucketID, Kind: auditGap, Key: key, FileID: row.FileID, UserID: row.UserID})
+			}
+		}
+		if len(rows) < run.pageSize {
+			break
+		}
+		last := rows[len(rows)-1]
+		prefixes.From, prefixes.FromInclusive = filedata.BasePrefix(last.FileID, last.UserID), false
+	}
+
+	// The objects that no row says are in the bucket
+	var unrecorded []auditedObject
+	var fileIDs []int64
+	for _, obj := range objects {
+		if !recorded[obj.key] {
+			unrecorded = append(unrecorded, obj)
+			fileIDs = append(fileIDs, obj.fileID)
+		}
+	}
+	if len(unrecorded) > 0 {
+		if err := run.limiter.Wait(ctx); err != nil {
+			return after, false, err
+		}
+		rows, err := c.Repo.GetFilesData(ctx, run.oType, fileIDs)
+		if err != nil {
+			return after, false, stacktrace.Propagate(err, "")
+		}
+		byFileID := make(map[int64]filedata.Row, len(rows))
+		for _, row := range rows {
+			byFileID[row.FileID] = row
+		}
+		for _, obj := range unrecorded {
+			finding := filedata.AuditFinding{Bucket: bucketID, Key: obj.key, FileID: obj.fileID, UserID: obj.userID}
+			row, ok := byFileID[obj.fileID]
+			switch {
+			case !ok || row.UserID != obj.userID:
+				finding.Kind = auditOrphan
+			case row.IsDeleted:
+				if array.StringInList(bucketID, row.DeleteFromBuckets) {
+					// Will be deleted by the deletion workers
+					continue
+				}
+				finding.Kind = auditOrphan
+			case row.LatestBucket == bucketID || array.StringInList(bucketID, row.ReplicatedBuckets) || array.StringInList(bucketID, row.InflightReplicas):
+				// Recorded meanwhile, or being replicated right now
+				continue
+			case !c.rowBuckets(row)[bucketID]:
+				// Left in a bucket that the row no longer replicates to, see
+				// SetReplicaOverride
+				continue
+			default:
+				finding.Kind = auditUnrecorded
+			}
+			run.addFinding(finding)
+		}
+	}
+	if len(keys) > 0 {
+		after = keys[len(keys)-1]
+	}
+	return after, more, nil
+}
+
+// confirmMissing returns true if the object is not in the bucket.
+func (c *Controller) confirmMissing(ctx context.Context, run *auditRun, key string, bucketID string) (bool, error) {
+	if err := run.limiter.Wait(ctx); err != nil {
+		return false, err
+	}
+	_, _, err := c.headObject(ctx, key, bucketID)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return true, nil
+	}
+	return false, err
+}
+
+func (run *auditRun) addFinding(f filedata.AuditFinding) {
+	switch f.Kind {
+	case auditOrphan:
+		run.report.Orphans++
+	case auditUnrecorded:
+		run.report.Unrecorded++
+	case auditGap:
+		run.report.Gaps++
+	}
+	if run.onFinding != nil {
+		run.onFinding(f)
+	}
+	if len(run.report.Findings) < maxAuditFindings {
+		run.report.Findings = append(run.report.Findings, f)
+	}
+}
+
+// parseKey returns the object that the key is for, if it is the key of an object
+// of the audited type (see filedata.Row.S3FileMetadataObjectKey).
+func (run *auditRun) parseKey(key string) (auditedObject, bool) {
+	prefix, rest, ok := splitObjectPrefix(key)
+	if !ok || rest != run.suffix {
+		return auditedObject{}, false
+	}
+	parts := strings.Split(prefix, "/")
+	userID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return auditedObject{}, false
+	}
+	fileID, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return auditedObject{}, false
+	}
+	return auditedObject{key: key, userID: userID, fileID: fileID}, true
+}
+
+// splitObjectPrefix splits the key into the file data prefix that it starts
+// with (see filedata.BasePrefix) and the rest of the key.
+func splitObjectPrefix(key string) (string, string, bool) {
+	parts := strings.SplitN(key, "/", 4)
+	if len(parts) < 4 || parts[1] != "file-data" || !isDigits(parts[0]) || !isDigits(parts[2]) {
+		return "", "", false
+	}
+	n := len(parts[0]) + len("/file-data/") + len(parts[2]) + 1
+	return key[:n], key[n:], true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixRange returns the range of object prefixes of the rows whose object keys,
+// which are their prefix followed by suffix, are after the key after and not
+// after the key upto. An empty upto leaves the range open ended.
+//
+// Since no prefix is a prefix of another, a row's key and its prefix compare
+// the same way against any key that doesn't start with the row's prefix. Only
+// for the one row whose prefix the bound starts with, if any, does the suffix
+// decide.
+func prefixRange(after, upto string, suffix string) fileDataRepo.PrefixRange {
+	r := fileDataRepo.PrefixRange{From: after}
+	if prefix, rest, ok := splitObjectPrefix(after); ok && suffix > rest {
+		r.From, r.FromInclusive = prefix, true
+	}
+	if upto == "" {
+		return r
+	}
+	r.To, r.ToInclusive = upto, true
+	if prefix, rest, ok := splitObjectPrefix(upto); ok && suffix > rest {
+		r.To, r.ToInclusive = prefix, false
+	}
+	return r
+}
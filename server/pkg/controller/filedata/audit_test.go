@@ -0,0 +1,44 @@
+package filedata
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrefixRange(t *testing.T) {
+	const suffix = "mldata"
+	prefixes := []string{"1/file-data/1/", "1/file-data/12/", "1/file-data/2/", "10/file-data/1/", "2/file-data/3/"}
+	bounds := []string{"", "1/file-data/1/", "1/file-data/1/mldata", "1/file-data/1/mldatb", "1/file-data/1/a",
+		"1/file-data/12", "1/file-data/12/zzz", "1-other", "10/", "2/file-data/3/mldata", "3"}
+	inRange := func(prefix string, from string, fromInclusive bool, to string, toInclusive bool) bool {
+		if prefix < from || (prefix == from && !fromInclusive) {
+			return false
+		}
+		return to == "" || prefix < to || (prefix == to && toInclusive)
+	}
+	for _, after := range bounds {
+		for _, upto := range bounds {
+			r := prefixRange(after, upto, suffix)
+			for _, prefix := range prefixes {
+				key := prefix + suffix
+				want := key > after && (upto == "" || key <= upto)
+				if got := inRange(prefix, r.From, r.FromInclusive, r.To, r.ToInclusive); got != want {
+					t.Errorf("prefixRange(%q, %q) = %+v, includes %s = %v, want %v", after, upto, r, key, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestAuditParseKey(t *testing.T) {
+	run := &auditRun{suffix: "mldata"}
+	obj, ok := run.parseKey("12/file-data/345/mldata")
+	if !ok || obj.userID != 12 || obj.fileID != 345 {
+		t.Errorf("parseKey() = %+v, %v", obj, ok)
+	}
+	for _, key := range []string{"12/file-data/345/vid_preview", "12/345/mldata", "a/file-data/345/mldata", "12/file-data/345/mldata/x", strings.Repeat("9", 30) + "/file-data/1/mldata"} {
+		if _, ok := run.parseKey(key); ok {
+			t.Errorf("parseKey(%q) accepted the key", key)
+		}
+	}
+}
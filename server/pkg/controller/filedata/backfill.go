@@ -0,0 +1,133 @@
+package filedata
+
+import (
+	"context"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultBackfillBatchSize  = 1000
+	defaultBackfillInterval   = 10 * time.Second
+	defaultBackfillMaxPending = 10000
+)
+
+// StartBackfill creates a job that re-queues the existing rows of the given
+// type, so that the replication workers copy them to bucketID, a bucket that
+// has been newly added to the type's replicas. With CreatedAfter, only the rows
+// created after it are re-queued, e.g. for a targeted recovery of the rows
+// affected by a bug, see also SetCreatedAfter.
+//
+// The job itself is run in the background by the instances that replicate,
+// see runBackfills.
+func (c *Controller) StartBackfill(ctx context.Context, req filedata.BackfillRequest) (*filedata.BackfillJob, error) {
+	if !c.S3Config.IsBucketActive(req.Bucket) {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("unknown bucket "+req.Bucket), "")
+	}
+	if req.Bucket != c.S3Config.GetBucketID(req.Type) && !array.StringInList(req.Bucket, c.S3Config.GetReplicatedBuckets(req.Type)) {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage(req.Bucket+" is not configured as a bucket for "+string(req.Type)), "")
+	}
+	if req.CreatedAfter < 0 {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid createdAfter"), "")
+	}
+	job, err := c.Repo.CreateBackfill(ctx, req.Type, req.Bucket, req.CreatedAfter)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	log.WithFields(log.Fields{
+		"id":            job.ID,
+		"type":          job.Type,
+		"bucket":        job.Bucket,
+		"total":         job.Total,
+		"created_after": job.CreatedAfter,
+	}).Info("Created file data backfill")
+	return job, nil
+}
+
+// GetBackfills returns the progress of all the backfill jobs.
+func (c *Controller) GetBackfills(ctx context.Context) ([]filedata.BackfillJob, error) {
+	return c.Repo.GetBackfills(ctx)
+}
+
+// runBackfills advances the running backfill jobs by a batch every
+// replication.file-data.backfill.interval until ctx is cancelled.
+//
+// The progress of a job is kept in the database, so jobs interrupted by a
+// restart are resumed. To not flood the queue, no batch is re-queued while
+// there are replication.file-data.backfill.max-pending rows pending sync.
+func (c *Controller) runBackfills(ctx context.Context) {
+	interval := viper.GetDuration("replication.file-data.backfill.interval")
+	if interval <= 0 {
+		interval = defaultBackfillInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.runBackfillBatches(ctx)
+	}
+}
+
+func (c *Controller) runBackfillBatches(ctx context.Context) {
+	ids, err := c.Repo.GetRunningBackfillIDs(ctx)
+	if err != nil || len(ids) == 0 {
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("Could not fetch file data backfills")
+		}
+		return
+	}
+	maxPending := viper.GetInt("replication.file-data.backfill.max-pending")
+	if maxPending <= 0 {
+		maxPending = defaultBackfillMaxPending
+	}
+	pending, err := c.Repo.CountPendingSync(ctx, maxPending)
+	if err != nil {
+		log.WithError(err).Error("Could not count file data pending sync")
+		return
+	}
+	if pending >= maxPending {
+		log.Infof("Pausing file data backfills while %d or more rows are pending sync", maxPending)
+		return
+	}
+	batchSize := viper.GetInt("replication.file-data.backfill.batch-size")
+	if batchSize <= 0 {
+		batchSize = defaultBackfillBatchSize
+	}
+	for _, id := range ids {
+		job, err := c.Repo.RunBackfillBatch(ctx, id, batchSize)
+		if err != nil {
+			log.WithField("id", id).WithError(err).Error("Could not run file data backfill batch")
+			continue
+		}
+		if job == nil {
+			// Being run by another instance
+			continue
+		}
+		c.wakeIdleWorkers(batchSize)
+		logger := log.WithFields(log.Fields{
+			"id":          job.ID,
+			"type":        job.Type,
+			"bucket":      job.Bucket,
+			"scanned":     job.Scanned,
+			"total":       job.Total,
+			"requeued":    job.Requeued,
+			"last_fileID": job.LastFileID,
+		})
+		if job.Status == fileDataRepo.BackfillCompleted {
+			logger.Info("Completed file data backfill")
+		} else {
+			logger.Debug("File data backfill progress")
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package filedata
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultBackoffBase      = 1 * time.Minute
+	defaultBackoffMax       = 30 * time.Minute
+	defaultIdlePollInterval = 5 * time.Second
+	defaultStartupStagger   = 1 * time.Second
+)
+
+// backoff computes exponentially growing delays between consecutive failures
+// of a replication worker.
+//
+// The delay doubles with each failure, up to max, and a random jitter of up to
+// half the delay is applied so that workers failing together don't all retry
+// at the same instant. Call reset once an attempt succeeds.
+type backoff struct {
+	base     time.Duration
+	max      time.Duration
+	failures int
+}
+
+func newReplicationBackoff() *backoff {
+	base := viper.GetDuration("replication.file-data.backoff.base")
+	if base <= 0 {
+		base = defaultBackoffBase
+	}
+	maxDelay := viper.GetDuration("replication.file-data.backoff.max")
+	if maxDelay <= 0 {
+		maxDelay = defaultBackoffMax
+	}
+	if maxDelay < base {
+		maxDelay = base
+	}
+	return &backoff{base: base, max: maxDelay}
+}
+
+// next records a failure and returns how long to wait before the next attempt.
+func (b *backoff) next() time.Duration {
+	b.failures++
+	d := b.max
+	// Guard the shift against overflowing for a long streak of failures.
+	if b.failures < 32 {
+		if exp := b.base << (b.failures - 1); exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (b *backoff) reset() {
+	b.failures = 0
+}
+
+// failureDelay returns how long a worker waits after failing to replicate a
+// row with err.
+func failureDelay(b *backoff, err error) time.Duration {
+	var re *ReplicationError
+	if !errors.As(err, &re) {
+		return b.next()
+	}
+	switch {
+	case re.Class.permanent():
+		// The row has been dead lettered, and there's no reason for the next
+		// one to fail too
+		return 0
+	case re.Class == ErrPermission:
+		// This needs the credentials or the bucket policy to be fixed, so
+		// there is no point in retrying soon
+		b.failures++
+		return b.max
+	default:
+		return b.next()
+	}
+}
+
+// idlePollInterval is how long a worker waits before checking again when there
+// was nothing to replicate, unless it is woken up earlier, see wakeIdleWorkers.
+func idlePollInterval() time.Duration {
+	interval := viper.GetDuration("replication.file-data.idle-poll-interval")
+	if interval <= 0 {
+		return defaultIdlePollInterval
+	}
+	return interval
+}
+
+// startDelay returns how long the i-th of a batch of workers that are started
+// together waits before its first poll. Consecutive workers are spaced out by
+// (2i+1) times replication.file-data.startup-stagger, which can be set to 0 to
+// start all the workers right away.
+func startDelay(i int) time.Duration {
+	stagger := defaultStartupStagger
+	if viper.IsSet("replication.file-data.startup-stagger") {
+		stagger = viper.GetDuration("replication.file-data.startup-stagger")
+	}
+	if stagger <= 0 {
+		return 0
+	}
+	return time.Duration(i*i) * stagger
+}
@@ -0,0 +1,134 @@
+package filedata
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+// bandwidthChunkSize is the largest number of bytes for which tokens are
+// requested at once. It is also the burst size of the limiter, so that a single
+// worker can't grab more than this in one go.
+const bandwidthChunkSize = 64 * 1024
+
+// bandwidthLimiter is a token bucket shared by all the replication workers of
+// the controller, capping the aggregate number of bytes per second that they
+// download and upload.
+type bandwidthLimiter struct {
+	mu      sync.Mutex
+	limiter *rate.Limiter
+	// bytesPerSec is the currently applied limit, 0 means unlimited
+	bytesPerSec int64
+}
+
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	l := &bandwidthLimiter{limiter: rate.NewLimiter(rate.Inf, bandwidthChunkSize)}
+	l.setLimit(bytesPerSec)
+	return l
+}
+
+// setLimit updates the limit. It takes effect immediately, including for
+// transfers that are already in progress.
+func (l *bandwidthLimiter) setLimit(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bytesPerSec <= 0 {
+		l.limiter.SetLimit(rate.Inf)
+		l.bytesPerSec = 0
+		return
+	}
+	l.limiter.SetLimit(rate.Limit(bytesPerSec))
+	l.bytesPerSec = bytesPerSec
+}
+
+func (l *bandwidthLimiter) limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bytesPerSec
+}
+
+// wait blocks until n bytes worth of tokens are available, or ctx is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	for n > 0 {
+		chunk := n
+		if chunk > bandwidthChunkSize {
+			chunk = bandwidthChunkSize
+		}
+		if err := l.limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// throttledReader paces reads from the underlying reader to the limiter. The
+// pacing doesn't count against the work budget of the reads, see workBudget.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *bandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+	n, err := t.r.Read(p)
+	workerHeartbeat(t.ctx)
+	if n > 0 {
+		resume := waitOutsideBudget(t.ctx)
+		waitErr := t.l.wait(t.ctx, n)
+		resume()
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type throttleCtxKey struct{}
+
+// withBandwidthLimit marks ctx so that object transfers made with it are subject
+// to the replication bandwidth limit. Transfers on behalf of user requests are
+// not marked, and so are never throttled.
+func withBandwidthLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, throttleCtxKey{}, true)
+}
+
+func isBandwidthLimited(ctx context.Context) bool {
+	limited, _ := ctx.Value(throttleCtxKey{}).(bool)
+	return limited
+}
+
+// throttleReader wraps r with the bandwidth limit if ctx asks for it.
+func (c *Controller) throttleReader(ctx context.Context, r io.Reader) io.Reader {
+	if !isBandwidthLimited(ctx) {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, l: c.bandwidth}
+}
+
+// SetMaxBandwidth sets the aggregate number of bytes per second that the
+// replication workers may transfer. A value of 0 removes the limit.
+func (c *Controller) SetMaxBandwidth(bytesPerSec int64) {
+	previous := c.bandwidth.limit()
+	c.bandwidth.setLimit(bytesPerSec)
+	if previous != c.bandwidth.limit() {
+		log.Infof("File data replication bandwidth limit changed from %d to %d bytes/sec", previous, c.bandwidth.limit())
+	}
+}
+
+// ReloadMaxBandwidth re-reads replication.file-data.max-bandwidth-bytes (or, in
+// catch-up mode, catch-up.max-bandwidth-bytes) from the config and applies it.
+func (c *Controller) ReloadMaxBandwidth() {
+	c.SetMaxBandwidth(c.maxBandwidth())
+}
+
+func configuredMaxBandwidth(v *viper.Viper) int64 {
+	return v.GetInt64("replication.file-data.max-bandwidth-bytes")
+}
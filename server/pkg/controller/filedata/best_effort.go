@@ -0,0 +1,151 @@
+package filedata
+
+import (
+	"context"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultBestEffortInterval  = 1 * time.Minute
+	defaultBestEffortBatchSize = 50
+)
+
+// bestEffortBuckets returns replication.file-data.best-effort-buckets, the
+// replicas that rows don't wait for before being marked as replicated.
+func bestEffortBuckets() []string {
+	return viper.GetStringSlice("replication.file-data.best-effort-buckets")
+}
+
+// isBestEffort reports whether bucketID is a best-effort bucket for the type.
+// The primary bucket of a type is always required.
+func (c *Controller) isBestEffort(oType ente.ObjectType, bucketID string) bool {
+	return bucketID != c.S3Config.GetBucketID(oType) && array.StringInList(bucketID, bestEffortBuckets())
+}
+
+// deferBestEffortBuckets removes the best-effort buckets from dstBucketIDs, so
+// that the row doesn't wait for them.
+func (c *Controller) deferBestEffortBuckets(row filedata.Row, dstBucketIDs map[string]bool) {
+	for bucketID := range dstBucketIDs {
+		if c.isBestEffort(row.Type, bucketID) {
+			delete(dstBucketIDs, bucketID)
+		}
+	}
+}
+
+// runBestEffort copies the rows that have been replicated to their required
+// buckets to the best-effort buckets that they are missing from, every
+// replication.file-data.best-effort.interval until ctx is cancelled.
+//
+// Each round goes through the next best-effort.batch-size rows of each type and
+// bucket, starting over once it gets to the last one, so the rows that keep
+// failing don't hold up the others. Nothing is copied while replication is
+// paused, or to disabled buckets.
+func (c *Controller) runBestEffort(ctx context.Context) {
+	if len(bestEffortBuckets()) == 0 {
+		return
+	}
+	interval := viper.GetDuration("replication.file-data.best-effort.interval")
+	if interval <= 0 {
+		interval = defaultBestEffortInterval
+	}
+	cursors := map[string]int64{}
+	for sleepWithContext(ctx, interval) {
+		if c.dryRun || c.pause.status().Paused {
+			continue
+		}
+		for _, oType := range replicatedTypes {
+			for _, bucketID := range bestEffortBuckets() {
+				if !c.isBestEffort(oType, bucketID) || c.disabledBuckets.isDisabled(bucketID) {
+					continue
+				}
+				key := string(oType) + "/" + bucketID
+				cursors[key] = c.runBestEffortBatch(ctx, oType, bucketID, cursors[key])
+			}
+		}
+	}
+}
+
+// runBestEffortBatch copies the batch of rows after afterFileID to bucketID,
+// and returns where the next batch starts.
+func (c *Controller) runBestEffortBatch(ctx context.Context, oType ente.ObjectType, bucketID string, afterFileID int64) int64 {
+	batchSize := viper.GetInt("replication.file-data.best-effort.batch-size")
+	if batchSize <= 0 {
+		batchSize = defaultBestEffortBatchSize
+	}
+	isReplica := array.StringInList(bucketID, c.S3Config.GetReplicatedBuckets(oType))
+	rows, err := c.Repo.GetRowsMissingBestEffortBucket(ctx, oType, bucketID, isReplica, afterFileID, batchSize)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).WithField(logDestBucket, bucketID).Error("Could not fetch file data missing from best-effort bucket")
+		}
+		return afterFileID
+	}
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			return afterFileID
+		}
+		c.replicateBestEffort(ctx, row, bucketID)
+		afterFileID = row.FileID
+	}
+	if len(rows) < batchSize {
+		return 0
+	}
+	return afterFileID
+}
+
+// replicateBestEffort copies a replicated row to the best-effort bucket. Rows
+// that are locked, e.g. because they are being replicated again, are left for
+// a later round, and so are the ones that fail.
+func (c *Controller) replicateBestEffort(ctx context.Context, row filedata.Row, bucketID string) {
+	logger := rowLogger(row).WithField(logDestBucket, bucketID)
+	policy := newLockPolicy()
+	lock := policy.durationFor(row.Size)
+	locked, err := c.withBorrowedLock(ctx, row, lock, func(row filedata.Row) error {
+		// The row may have changed since it was listed
+		if row.PendingSync || c.isRecordedIn(row, bucketID) {
+			return nil
+		}
+		// The borrowed lock is not renewed
+		workCtx, cancel := withWorkBudget(withBandwidthLimit(ctx), min(policy.workTimeout(row.Size, lock), lock/2), lock/2)
+		defer cancel()
+		return c.replicateToBuckets(workCtx, row, map[string]bool{bucketID: true})
+	})
+	switch {
+	case err != nil:
+		mBestEffortReplications.WithLabelValues(bucketID, "failed").Inc()
+		logger.WithError(err).Warn("Could not replicate file data to best-effort bucket, will retry")
+	case locked:
+		mBestEffortReplications.WithLabelValues(bucketID, "locked").Inc()
+	default:
+		mBestEffortReplications.WithLabelValues(bucketID, "replicated").Inc()
+	}
+}
+
+// getBestEffortStatus returns the number of rows that are yet to be copied to
+// each best-effort bucket, for each type.
+func (c *Controller) getBestEffortStatus(ctx context.Context) ([]filedata.BestEffortReplicationStatus, error) {
+	result := make([]filedata.BestEffortReplicationStatus, 0)
+	for _, oType := range replicatedTypes {
+		for _, bucketID := range bestEffortBuckets() {
+			if !c.isBestEffort(oType, bucketID) {
+				continue
+			}
+			isReplica := array.StringInList(bucketID, c.S3Config.GetReplicatedBuckets(oType))
+			outstanding, err := c.Repo.CountRowsMissingBestEffortBucket(ctx, oType, bucketID, isReplica)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "")
+			}
+			if outstanding > 0 {
+				result = append(result, filedata.BestEffortReplicationStatus{Type: oType, Bucket: bucketID, Outstanding: outstanding})
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,201 @@
+package filedata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultCatchUpInterval = time.Minute
+
+// catchUpMode is whether replication is burning through a large backlog, e.g.
+// after an outage, with the catch-up concurrency instead of the steady state
+// one.
+//
+// It is entered once the backlog is above the high-water mark, and left once it
+// is below the low-water mark. The gap between the two keeps it from flapping
+// while the backlog hovers around a single threshold.
+type catchUpMode struct {
+	mu     sync.Mutex
+	active bool
+	since  time.Time
+	// pending is the backlog when it was last checked
+	pending int64
+}
+
+// observe records the backlog, and returns whether catch-up mode was entered
+// or left because of it.
+func (m *catchUpMode) observe(pending int64, high int64, low int64) (entered bool, left bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = pending
+	switch {
+	case !m.active && pending > high:
+		m.active = true
+		m.since = time.Now()
+		return true, false
+	case m.active && pending < low:
+		m.active = false
+		m.since = time.Time{}
+		return false, true
+	}
+	return false, false
+}
+
+func (m *catchUpMode) isActive() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+func (m *catchUpMode) status() filedata.ReplicationCatchUpStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.active {
+		return filedata.ReplicationCatchUpStatus{Pending: m.pending}
+	}
+	return filedata.ReplicationCatchUpStatus{Active: true, Since: m.since.UnixMicro(), Pending: m.pending}
+}
+
+// watchCatchUp checks the backlog every replication.file-data.catch-up.interval,
+// and switches the worker count, the download concurrency and the bandwidth
+// limit of the instance to their catch-up values while the backlog is above
+// high-water, and back once it drops below low-water. It returns immediately if
+// no high-water mark is configured.
+func (c *Controller) watchCatchUp(ctx context.Context) {
+	high := viper.GetInt64("replication.file-data.catch-up.high-water")
+	if high <= 0 {
+		return
+	}
+	low := viper.GetInt64("replication.file-data.catch-up.low-water")
+	if low <= 0 || low >= high {
+		low = high / 2
+	}
+	interval := viper.GetDuration("replication.file-data.catch-up.interval")
+	if interval <= 0 {
+		interval = defaultCatchUpInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pending, err := c.catchUpBacklog(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("Could not check file data replication backlog for catch-up mode")
+			}
+			continue
+		}
+		entered, left := c.catchUp.observe(pending, high, low)
+		switch {
+		case entered:
+			log.Warnf("File data replication backlog of %d rows is above %d, switching to catch-up mode", pending, high)
+			mCatchUpActive.Set(1)
+		case left:
+			log.Infof("File data replication backlog of %d rows is below %d, leaving catch-up mode", pending, low)
+			mCatchUpActive.Set(0)
+		default:
+			continue
+		}
+		c.applyConcurrency()
+	}
+}
+
+// catchUpBacklog returns the number of rows that are pending replication, and
+// that the workers would pick up: while replication is limited to the rows
+// created after a cutoff (see SetCreatedAfter), the older rows don't count.
+func (c *Controller) catchUpBacklog(ctx context.Context) (int64, error) {
+	if createdAfter := c.createdAfter.Load(); createdAfter > 0 {
+		return c.Repo.CountPendingCreatedAfter(ctx, createdAfter)
+	}
+	types, err := c.Repo.GetReplicationStatus(ctx, time.Now().UnixMicro())
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	var pending int64
+	for _, t := range types {
+		pending += t.Pending
+	}
+	return pending, nil
+}
+
+// applyConcurrency resizes the worker pools, the download limiter and the
+// bandwidth limit to what the config asks for in the current mode.
+func (c *Controller) applyConcurrency() {
+	if err := c.ReloadWorkerCount(); err != nil {
+		log.WithError(err).Error("Could not update file data replication worker count")
+	}
+	if n := c.maxConcurrentDownloads(); n != c.downloads.getLimit() {
+		log.Infof("File data replication download limit changed from %d to %d", c.downloads.getLimit(), n)
+		c.downloads.setLimit(n)
+	}
+	c.ReloadMaxBandwidth()
+}
+
+// workerCounts returns the number of workers for each pool. In catch-up mode
+// the pools that have a catch-up worker count get that many instead, unless
+// they are configured with more workers anyway.
+func (c *Controller) workerCounts() map[string]int {
+	v := c.runtimeConfig()
+	counts := configuredWorkerCounts(v)
+	if !c.catchUp.isActive() {
+		return counts
+	}
+	for name, n := range catchUpWorkerCounts(v) {
+		if current, ok := counts[name]; ok && n > current {
+			counts[name] = n
+		}
+	}
+	return counts
+}
+
+// catchUpWorkerCounts returns the number of workers for each pool in catch-up
+// mode, from replication.file-data.catch-up.worker-count. Like worker-count,
+// it is either the size of the shared pool or a map from pool to size.
+func catchUpWorkerCounts(v *viper.Viper) map[string]int {
+	const key = "replication.file-data.catch-up.worker-count"
+	perType := v.GetStringMap(key)
+	if len(perType) == 0 {
+		return map[string]int{sharedPoolName: v.GetInt(key)}
+	}
+	counts := make(map[string]int, len(perType))
+	for name := range perType {
+		counts[name] = v.GetInt(key + "." + name)
+	}
+	return counts
+}
+
+// maxConcurrentDownloads returns the number of source downloads allowed at the
+// same time in the current mode. It is only ever raised in catch-up mode.
+func (c *Controller) maxConcurrentDownloads() int {
+	n := configuredMaxConcurrentDownloads()
+	if c.catchUp.isActive() {
+		n = max(n, viper.GetInt("replication.file-data.catch-up.max-concurrent-downloads"))
+	}
+	return n
+}
+
+// maxBandwidth returns the bandwidth limit in the current mode. It is only
+// ever raised (or removed, with a catch-up value of 0) in catch-up mode.
+func (c *Controller) maxBandwidth() int64 {
+	v := c.runtimeConfig()
+	limit := configuredMaxBandwidth(v)
+	const key = "replication.file-data.catch-up.max-bandwidth-bytes"
+	if limit == 0 || !c.catchUp.isActive() || !v.IsSet(key) {
+		return limit
+	}
+	catchUp := v.GetInt64(key)
+	if catchUp <= 0 {
+		return 0
+	}
+	return max(limit, catchUp)
+}
@@ -0,0 +1,81 @@
+package filedata
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCatchUpMode(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("replication.file-data.worker-count", 4)
+	viper.Set("replication.file-data.max-bandwidth-bytes", 1000)
+	viper.Set("replication.file-data.catch-up.worker-count", 16)
+	viper.Set("replication.file-data.catch-up.max-bandwidth-bytes", 0)
+	c := &Controller{}
+
+	for _, step := range []struct {
+		pending int64
+		active  bool
+	}{
+		{500, false},
+		{1500, true},
+		// Stays in catch-up mode till the backlog is below the low-water mark
+		{800, true},
+		{400, false},
+		{800, false},
+	} {
+		c.catchUp.observe(step.pending, 1000, 500)
+		if got := c.catchUp.isActive(); got != step.active {
+			t.Fatalf("catch-up mode with a backlog of %d is %v, want %v", step.pending, got, step.active)
+		}
+		workers, bandwidth := 4, int64(1000)
+		if step.active {
+			workers, bandwidth = 16, 0
+		}
+		if got := c.workerCounts()[sharedPoolName]; got != workers {
+			t.Errorf("worker count with a backlog of %d is %d, want %d", step.pending, got, workers)
+		}
+		if got := c.maxBandwidth(); got != bandwidth {
+			t.Errorf("bandwidth limit with a backlog of %d is %d, want %d", step.pending, got, bandwidth)
+		}
+	}
+}
+
+// TestReloadConfig reloads the runtime adjustable settings from a config of
+// their own, which they are then read from in either mode, while the global
+// config is left alone.
+func TestReloadConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("replication.file-data.worker-count", 4)
+	viper.Set("replication.file-data.max-bandwidth-bytes", 1000)
+	c := New(nil, nil, nil, nil, nil, nil)
+
+	reloaded := viper.New()
+	reloaded.Set("replication.file-data.worker-count", 8)
+	reloaded.Set("replication.file-data.max-bandwidth-bytes", 2000)
+	reloaded.Set("replication.file-data.catch-up.worker-count", 16)
+	reloaded.Set("replication.file-data.max-concurrent-requests.b5", 2)
+	// The pools haven't been started, so they can't be resized
+	if err := c.ReloadConfig(reloaded); err == nil {
+		t.Error("ReloadConfig() resized the pools of a controller that hasn't started replicating")
+	}
+	if got := c.bandwidth.limit(); got != 2000 {
+		t.Errorf("bandwidth limit after the reload is %d, want 2000", got)
+	}
+	if got := c.requests.maxConcurrentRequests("b5"); got != 2 {
+		t.Errorf("request cap of b5 after the reload is %d, want 2", got)
+	}
+	if got := c.workerCounts()[sharedPoolName]; got != 8 {
+		t.Errorf("worker count after the reload is %d, want 8", got)
+	}
+	c.catchUp.observe(1500, 1000, 500)
+	if got := c.workerCounts()[sharedPoolName]; got != 16 {
+		t.Errorf("catch-up worker count after the reload is %d, want 16", got)
+	}
+	if got := viper.GetInt("replication.file-data.worker-count"); got != 4 {
+		t.Errorf("global worker count after the reload is %d, want it left at 4", got)
+	}
+}
@@ -0,0 +1,99 @@
+package filedata
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+)
+
+// checksumOf returns the hex encoded SHA-256 of data. This is the checksum that
+// is stored alongside the file data row.
+func checksumOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkContentChecksum checks the contents of the metadata object against the
+// checksum embedded in it when it was uploaded. Objects without one pass.
+func checkContentChecksum(obj filedata.S3FileMetadata) error {
+	if obj.Checksum == "" {
+		return nil
+	}
+	if got := obj.ContentChecksum(); got != obj.Checksum {
+		return fmt.Errorf("metadata content checksum %s does not match embedded checksum %s: %w", got, obj.Checksum, ErrIntegrity)
+	}
+	return nil
+}
+
+// verifyEmbeddedChecksum is checkContentChecksum for the serialized object. It is
+// the only check that can be made on the contents of rows that predate the
+// checksums recorded in file_data, before the checksum of what was downloaded
+// is recorded for them.
+func verifyEmbeddedChecksum(data []byte) error {
+	var obj filedata.S3FileMetadata
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return fmt.Errorf("metadata object can't be parsed (%s): %w", err, ErrIntegrity)
+	}
+	return checkContentChecksum(obj)
+}
+
+// verifyUploadedObject confirms that the object stored at objectKey in dc has
+// the same contents as stored, the (possibly compressed) bytes that were
+// uploaded. checksum is that of the logical, uncompressed, object.
+//
+// uploaded is the size and ETag that the store reported for the object once
+// the upload completed. When it is a plain MD5 ETag (single part uploads
+// without SSE-KMS), that is enough. Otherwise, e.g. for multipart uploads where
+// the ETag is an MD5 of the part MD5s, we read the object back and compare its
+// SHA-256 with the expected checksum. Objects in buckets whose storage class
+// doesn't allow reading them right away can only be verified by their ETag.
+func (c *Controller) verifyUploadedObject(ctx context.Context, stored []byte, checksum string, uploaded objectstore.ObjectInfo, objectKey string, dc string) error {
+	size, etag := uploaded.Size, uploaded.ETag
+	if size != int64(len(stored)) {
+		return fmt.Errorf("uploaded metadata size %d does not match expected size %d: %w", size, len(stored), ErrIntegrity)
+	}
+	if md5Hex, ok := plainMD5ETag(etag); ok {
+		sum := md5.Sum(stored)
+		if md5Hex != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("uploaded metadata etag %s does not match expected md5: %w", etag, ErrIntegrity)
+		}
+		return nil
+	}
+	if !c.S3Config.IsReadable(dc) {
+		return stacktrace.NewError("uploaded object in %s has etag %s, and can't be read back to verify it because of its storage class", dc, etag)
+	}
+	var readBack []byte
+	err := awaitVisible(ctx, "read back of "+objectKey+" from "+dc, dc, func() error {
+		var err error
+		readBack, err = c.downloadVersion(ctx, objectKey, dc, c.readBackVersion(dc, uploaded))
+		return err
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to read back uploaded object")
+	}
+	if got := checksumOf(readBack); got != checksum {
+		return fmt.Errorf("uploaded metadata checksum %s does not match expected checksum %s: %w", got, checksum, ErrIntegrity)
+	}
+	return nil
+}
+
+// plainMD5ETag returns the lowercased ETag if it looks like the MD5 of the object
+// contents, i.e. it is 32 hex characters and not a multipart ("<md5>-<parts>") ETag.
+func plainMD5ETag(etag string) (string, bool) {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	if len(etag) != 2*md5.Size {
+		return "", false
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return "", false
+	}
+	return etag, true
+}
@@ -0,0 +1,35 @@
+package filedata
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/ente-io/museum/ente/filedata"
+)
+
+func TestVerifyEmbeddedChecksum(t *testing.T) {
+	obj := filedata.S3FileMetadata{Version: 1, EncryptedData: "ZW5jcnlwdGVk", DecryptionHeader: "aGVhZGVy"}
+	marshal := func(obj filedata.S3FileMetadata) []byte {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	if err := verifyEmbeddedChecksum(marshal(obj)); err != nil {
+		t.Fatalf("object without a checksum failed verification: %s", err)
+	}
+	obj.Checksum = obj.ContentChecksum()
+	if err := verifyEmbeddedChecksum(marshal(obj)); err != nil {
+		t.Fatalf("intact object failed verification: %s", err)
+	}
+	obj.EncryptedData = "Y29ycnVwdGVk"
+	if err := verifyEmbeddedChecksum(marshal(obj)); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("corrupt object returned %v, want an integrity error", err)
+	}
+	if err := verifyEmbeddedChecksum([]byte("{trunc")); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("truncated object returned %v, want an integrity error", err)
+	}
+}
@@ -0,0 +1,161 @@
+package filedata
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultCircuitThreshold = 5
+	defaultCircuitCooldown  = 5 * time.Minute
+)
+
+// errCircuitOpen is returned for destination buckets that were skipped because
+// their circuit is open.
+var errCircuitOpen = errors.New("circuit open for destination bucket")
+
+type circuitState string
+
+const (
+	circuitClosed   circuitState = "closed"
+	circuitOpen     circuitState = "open"
+	circuitHalfOpen circuitState = "half-open"
+)
+
+type bucketCircuit struct {
+	state               circuitState
+	consecutiveFailures int
+	openedAt            time.Time
+	// probing is true while the single half-open probe upload is in flight
+	probing bool
+}
+
+// circuitBreaker tracks consecutive upload failures per destination bucket.
+//
+// After replication.file-data.circuit-breaker.threshold consecutive failures
+// the circuit for the bucket opens and uploads to it are skipped for the
+// cooldown period. Once the cooldown has elapsed the circuit is half-open, and a
+// single probe upload is let through: if it succeeds the circuit closes,
+// otherwise it opens again for another cooldown.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	circuits map[string]*bucketCircuit
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{circuits: map[string]*bucketCircuit{}}
+}
+
+func (cb *circuitBreaker) get(bucketID string) *bucketCircuit {
+	bc, ok := cb.circuits[bucketID]
+	if !ok {
+		bc = &bucketCircuit{state: circuitClosed}
+		cb.circuits[bucketID] = bc
+	}
+	return bc
+}
+
+// allow returns true if an upload to bucketID should be attempted.
+func (cb *circuitBreaker) allow(bucketID string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	bc := cb.get(bucketID)
+	switch bc.state {
+	case circuitOpen:
+		if time.Since(bc.openedAt) < circuitCooldown() {
+			return false
+		}
+		cb.transition(bucketID, bc, circuitHalfOpen)
+		bc.probing = true
+		return true
+	case circuitHalfOpen:
+		if bc.probing {
+			return false
+		}
+		bc.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the circuit for bucketID with the outcome of an upload that
+// was allowed by allow.
+func (cb *circuitBreaker) record(bucketID string, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	bc := cb.get(bucketID)
+	bc.probing = false
+	if err == nil {
+		bc.consecutiveFailures = 0
+		if bc.state != circuitClosed {
+			cb.transition(bucketID, bc, circuitClosed)
+		}
+		return
+	}
+	bc.consecutiveFailures++
+	if bc.state == circuitHalfOpen || bc.consecutiveFailures >= circuitThreshold() {
+		bc.openedAt = time.Now()
+		if bc.state != circuitOpen {
+			cb.transition(bucketID, bc, circuitOpen)
+		}
+	}
+}
+
+// release gives up an upload allowed by allow without recording its outcome,
+// e.g. because it was cancelled.
+func (cb *circuitBreaker) release(bucketID string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.get(bucketID).probing = false
+}
+
+func (cb *circuitBreaker) transition(bucketID string, bc *bucketCircuit, to circuitState) {
+	log.WithFields(log.Fields{
+		"bucket":               bucketID,
+		"from":                 bc.state,
+		"to":                   to,
+		"consecutive_failures": bc.consecutiveFailures,
+	}).Warn("File data replication circuit state changed")
+	bc.state = to
+}
+
+// status returns the current state of all the circuits that have seen uploads.
+func (cb *circuitBreaker) status() []filedata.BucketCircuitStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	result := make([]filedata.BucketCircuitStatus, 0, len(cb.circuits))
+	for bucketID, bc := range cb.circuits {
+		s := filedata.BucketCircuitStatus{
+			Bucket:              bucketID,
+			State:               string(bc.state),
+			ConsecutiveFailures: bc.consecutiveFailures,
+		}
+		if bc.state == circuitOpen {
+			s.OpenUntil = bc.openedAt.Add(circuitCooldown()).UnixMicro()
+		}
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Bucket < result[j].Bucket })
+	return result
+}
+
+func circuitThreshold() int {
+	if n := viper.GetInt("replication.file-data.circuit-breaker.threshold"); n > 0 {
+		return n
+	}
+	return defaultCircuitThreshold
+}
+
+func circuitCooldown() time.Duration {
+	if d := viper.GetDuration("replication.file-data.circuit-breaker.cooldown"); d > 0 {
+		return d
+	}
+	return defaultCircuitCooldown
+}
@@ -0,0 +1,108 @@
+package filedata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+
+	"github.com/ente-io/stacktrace"
+)
+
+// gzipMagic are the first bytes of any gzip stream. Metadata objects are JSON,
+// and so never start with these, which lets readers tell compressed objects
+// apart without consulting the row.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// encodeForBucket returns the bytes to store in bucketID for the (logical)
+// metadata object data, compressing it if the bucket is configured with
+// s3.<bucket>.compress, and then encrypting it if the bucket is configured with
+// s3.<bucket>.encryption-key. It also returns whether the bytes are compressed.
+func (c *Controller) encodeForBucket(ctx context.Context, bucketID string, data []byte) ([]byte, bool, error) {
+	compressed := c.S3Config.IsCompressedBucket(bucketID)
+	if compressed {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, false, stacktrace.Propagate(err, "")
+		}
+		if err := w.Close(); err != nil {
+			return nil, false, stacktrace.Propagate(err, "")
+		}
+		data = buf.Bytes()
+	}
+	data, err := c.encryptForBucket(ctx, bucketID, data)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, compressed, nil
+}
+
+// storedAsIs reports whether the objects in the bucket are stored exactly as
+// their logical contents, so that their sizes and MD5s can be compared with
+// those of the source.
+func (c *Controller) storedAsIs(bucketID string) bool {
+	return !c.S3Config.IsCompressedBucket(bucketID) && c.S3Config.GetEncryptionKeyID(bucketID) == ""
+}
+
+// decodeStored returns the logical metadata object for the bytes read from a
+// bucket, decrypting and decompressing them if needed.
+func (c *Controller) decodeStored(ctx context.Context, stored []byte) ([]byte, error) {
+	stored, err := c.decrypt(ctx, stored)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(stored, gzipMagic) {
+		return stored, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to decompress object")
+	}
+	return data, nil
+}
+
+// decodeStoredFrom is decodeStored for bytes read from r. Compressed objects
+// are decompressed as they are read, so that only the logical object is held in
+// memory.
+func (c *Controller) decodeStoredFrom(ctx context.Context, r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(gzipMagic)); !bytes.Equal(head, gzipMagic) {
+		stored, err := io.ReadAll(br)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		return c.decodeStored(ctx, stored)
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to decompress object")
+	}
+	return data, nil
+}
+
+// downloadLogicalObject downloads the object and returns its logical contents,
+// i.e. after undoing any encryption and compression.
+func (c *Controller) downloadLogicalObject(ctx context.Context, objectKey string, dc string) ([]byte, error) {
+	var data []byte
+	err := c.downloadRawObject(ctx, objectKey, dc, func(stored io.Reader) error {
+		var err error
+		data, err = c.decodeStoredFrom(ctx, stored)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -2,10 +2,8 @@ package filedata
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/ente-io/museum/ente"
 	fileData "github.com/ente-io/museum/ente/filedata"
 	"github.com/ente-io/museum/pkg/controller"
@@ -14,13 +12,17 @@ import (
 	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
 	"github.com/ente-io/museum/pkg/utils/array"
 	"github.com/ente-io/museum/pkg/utils/auth"
+	"github.com/ente-io/museum/pkg/utils/envelope"
 	"github.com/ente-io/museum/pkg/utils/network"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
 	"github.com/ente-io/museum/pkg/utils/s3config"
 	"github.com/ente-io/stacktrace"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"strings"
 	"sync"
+	"sync/atomic"
 	gTime "time"
 )
 
@@ -47,9 +49,75 @@ type Controller struct {
 	S3Config                *s3config.S3Config
 	FileRepo                *repo.FileRepository
 	CollectionRepo          *repo.CollectionRepository
-	downloadManagerCache    map[string]*s3manager.Downloader
+	// wraps the data keys of the objects stored in encrypted buckets
+	KeyProvider envelope.KeyProvider
 	// for downloading objects from s3 for replication
 	workerURL string
+	// skips the worker for a while after its repeated failures
+	workerFallback workerFallback
+	// pools of replication workers keyed by name, set once replication has
+	// been started
+	pools  map[string]*replicationPool
+	poolMu sync.Mutex
+	// caps the bytes per second transferred by the replication workers
+	bandwidth *bandwidthLimiter
+	// caps the concurrent source downloads of the replication workers
+	downloads *downloadLimiter
+	// trips per destination bucket after repeated upload failures
+	circuits *circuitBreaker
+	// limits the running workers while the object stores are distressed
+	throttle *adaptiveThrottle
+	// makes object store operations fail on purpose, in test and staging
+	faults *faultInjector
+	// buckets that replication has been paused for by an admin
+	disabledBuckets *disabledBuckets
+	// lets an admin pause all replication on this instance
+	pause pauseGate
+	// whether the workers are burning through a large backlog
+	catchUp catchUpMode
+	// caps the concurrent requests to each bucket
+	requests requestLimiter
+	// the config as reloaded on SIGHUP, see runtimeConfig
+	reloaded atomic.Pointer[viper.Viper]
+	// wakes up the workers waiting for rows to show up, see wakeIdleWorkers
+	wake chan struct{}
+	// pairs of buckets that have been found to share a backend, and have
+	// been warned about
+	aliasWarnings sync.Map
+	// types that have been found to have no replica buckets, and have been
+	// warned about, see checkReplicasConfigured
+	noReplicaWarnings sync.Map
+	// if true, replication only reports what it would do, see dryRunRow
+	dryRun bool
+	// set when the dry run report has changed since its summary was last logged
+	dryRunDirty atomic.Bool
+	// if true, replication events are recorded when rows finish replicating
+	eventsEnabled bool
+	// the sink that recorded replication events are relayed to, if any
+	eventSink EventSink
+	// state of the periodic reconciliation between the rows and the buckets
+	reconciler *reconciler
+	// set while a pass re-verifying the replicated copies is running
+	verifying atomic.Bool
+	// the rows replicated within the dedup window, see recentReplications
+	recent recentReplications
+	// caps the writes of replication attempts, see attemptBudget
+	attempts attemptBudget
+	// logs the changes of the replication window, see applyWindow
+	window windowGate
+	// stops the workers from picking up new rows, see EnterMaintenance
+	maintenance maintenanceGate
+	// the runs of the background jobs in progress, see jobSlots
+	jobSlots jobSlots
+	// the rows created before this (epoch microseconds) are left alone by
+	// the workers, see SetCreatedAfter
+	createdAfter atomic.Int64
+	// when (epoch microseconds) a row was last replicated by this instance
+	lastReplicatedAt atomic.Int64
+	// buffers the history of completed replications, nil if it is disabled
+	history *historyRecorder
+	// adds up the replication work done for each user, nil if it is disabled
+	usage *usageRecorder
 }
 
 func New(repo *fileDataRepo.Repository,
@@ -58,21 +126,25 @@ func New(repo *fileDataRepo.Repository,
 	s3Config *s3config.S3Config,
 	fileRepo *repo.FileRepository,
 	collectionRepo *repo.CollectionRepository) *Controller {
-	embeddingDcs := []string{s3Config.GetHotBackblazeDC(), s3Config.GetHotWasabiDC(), s3Config.GetWasabiDerivedDC(), s3Config.GetDerivedStorageDataCenter(), "b5"}
-	cache := make(map[string]*s3manager.Downloader, len(embeddingDcs))
-	for i := range embeddingDcs {
-		s3Client := s3Config.GetS3Client(embeddingDcs[i])
-		cache[embeddingDcs[i]] = s3manager.NewDownloaderWithClient(&s3Client)
-	}
-	return &Controller{
+	c := &Controller{
 		Repo:                    repo,
 		AccessCtrl:              accessCtrl,
 		ObjectCleanupController: objectCleanupController,
 		S3Config:                s3Config,
 		FileRepo:                fileRepo,
 		CollectionRepo:          collectionRepo,
-		downloadManagerCache:    cache,
+		bandwidth:               newBandwidthLimiter(configuredMaxBandwidth(viper.GetViper())),
+		downloads:               newDownloadLimiter(),
+		circuits:                newCircuitBreaker(),
+		throttle:                newAdaptiveThrottle(),
+		faults:                  newFaultInjector(),
+		disabledBuckets:         &disabledBuckets{},
+		reconciler:              &reconciler{},
+		wake:                    make(chan struct{}),
+		KeyProvider:             configuredKeyProvider(),
 	}
+	c.requests.config = c.runtimeConfig
+	return c
 }
 
 func (c *Controller) InsertOrUpdate(ctx *gin.Context, req *fileData.PutFileDataRequest) error {
@@ -94,7 +166,7 @@ func (c *Controller) InsertOrUpdate(ctx *gin.Context, req *fileData.PutFileDataR
 		if !strings.Contains(*req.ObjectKey, fileObjectKey) {
 			return stacktrace.Propagate(ente.NewBadRequestWithMessage("objectKey should contain the file object key"), "")
 		}
-		err = c.copyObject(*req.ObjectKey, fileObjectKey, bucketID)
+		err = c.copyObject(ctx, *req.ObjectKey, fileObjectKey, bucketID)
 		if err != nil {
 			return err
 		}
@@ -106,26 +178,47 @@ func (c *Controller) InsertOrUpdate(ctx *gin.Context, req *fileData.PutFileDataR
 		DecryptionHeader: *req.DecryptionHeader,
 		Client:           network.GetClientInfo(ctx),
 	}
-	// Start a goroutine to handle the upload and insert operations
-	go func() {
-		logger := log.WithField("objectKey", objectKey).WithField("fileID", req.FileID).WithField("type", req.Type)
-		size, uploadErr := c.uploadObject(obj, objectKey, bucketID)
+	obj.Checksum = obj.ContentChecksum()
+	logger := log.WithField("objectKey", objectKey).WithField("fileID", req.FileID).WithField("type", req.Type)
+	store := func(ctx context.Context) (*fileData.Row, error) {
+		data, _ := json.Marshal(obj)
+		_, uploadErr := c.uploadObject(ctx, data, objectKey, bucketID, objectstore.ObjectMetadata{})
 		if uploadErr != nil {
-			logger.WithError(uploadErr).Error("upload failed")
-			return
+			return nil, stacktrace.Propagate(uploadErr, "upload failed")
 		}
+		checksum := checksumOf(data)
 
 		row := fileData.Row{
 			FileID:       req.FileID,
 			Type:         req.Type,
 			UserID:       fileOwnerID,
-			Size:         size,
+			Size:         int64(len(data)),
 			LatestBucket: bucketID,
+			Checksum:     &checksum,
 		}
-		dbInsertErr := c.Repo.InsertOrUpdate(context.Background(), row)
+		dbInsertErr := c.Repo.InsertOrUpdate(ctx, row)
 		if dbInsertErr != nil {
-			logger.WithError(dbInsertErr).Error("insert or update failed")
-			return
+			return nil, stacktrace.Propagate(dbInsertErr, "insert or update failed")
+		}
+		c.wakeIdleWorkers(1)
+		return &row, nil
+	}
+	// Uploads of the types that are replicated inline are only acknowledged
+	// once they are in enough replicas
+	if inlineReplicated(req.Type) {
+		row, err := store(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := c.ReplicateInline(ctx, *row, inlineMinReplicas()); err != nil {
+			return stacktrace.Propagate(ente.NewInternalError("file data could not be replicated in time"), "inline replication failed: %s", err)
+		}
+		return nil
+	}
+	// Start a goroutine to handle the upload and insert operations
+	go func() {
+		if _, err := store(context.Background()); err != nil {
+			logger.WithError(err).Error("could not store file data")
 		}
 	}()
 	return nil
@@ -270,10 +363,8 @@ func (c *Controller) fetchS3FileMetadata(ctx context.Context, row fileData.Row,
 				ctxLogger.Error("Fetch timed out or cancelled: ", fetchCtx.Err())
 			} else {
 				// check if the error is due to object not found
-				if s3Err, ok := err.(awserr.RequestFailure); ok {
-					if s3Err.Code() == s3.ErrCodeNoSuchKey {
-						return nil, stacktrace.Propagate(errors.New("object not found"), "")
-					}
+				if errors.Is(err, objectstore.ErrNotFound) {
+					return nil, stacktrace.Propagate(errors.New("object not found"), "")
 				}
 				ctxLogger.Error("Failed to fetch object: ", err)
 			}
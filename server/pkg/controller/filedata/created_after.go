@@ -0,0 +1,75 @@
+package filedata
+
+import (
+	"context"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetCreatedAfter makes the workers only pick up the pending rows created after
+// createdAfter (epoch microseconds), leaving the older ones pending and
+// untouched. This allows a targeted recovery, e.g. of the rows uploaded after a
+// bug was deployed, without working through the whole backlog first. It
+// applies on top of the types of each pool and of the priority order, and the
+// backlog that catch-up mode goes by is limited to the same rows. A
+// createdAfter of 0 lifts the limit.
+//
+// Like pausing, the cutoff is recorded in the database, so that it applies to
+// this instance right away, and to the others once they refresh their copy of
+// it (every pauseRefreshInterval), also after a restart.
+func (c *Controller) SetCreatedAfter(ctx context.Context, createdAfter int64) error {
+	if createdAfter < 0 {
+		return stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid createdAfter"), "")
+	}
+	if err := c.Repo.SetReplicationCreatedAfter(ctx, createdAfter); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	c.storeCreatedAfter(createdAfter, "")
+	return nil
+}
+
+// storeCreatedAfter updates this instance's copy of the cutoff, logging the
+// change, if any, with the given reason.
+func (c *Controller) storeCreatedAfter(createdAfter int64, reason string) {
+	if c.createdAfter.Swap(createdAfter) == createdAfter {
+		return
+	}
+	if createdAfter == 0 {
+		log.Info("File data replication is no longer limited by creation time" + reason)
+	} else {
+		log.Warnf("Limiting file data replication to the rows created after %s%s", time.UnixMicro(createdAfter).UTC().Format(time.RFC3339), reason)
+	}
+}
+
+// refreshCreatedAfter keeps the instance's copy of the cutoff up to date with
+// the one recorded in the database until ctx is cancelled.
+func (c *Controller) refreshCreatedAfter(ctx context.Context) {
+	ticker := time.NewTicker(pauseRefreshInterval)
+	defer ticker.Stop()
+	for {
+		createdAfter, err := c.Repo.GetReplicationCreatedAfter(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("Could not fetch the creation time that file data replication is limited to: %s", err)
+			}
+		} else {
+			c.storeCreatedAfter(createdAfter, ", as set through another instance")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyCreatedAfter limits filter to the rows created after the cutoff set
+// with SetCreatedAfter, if any.
+func (c *Controller) applyCreatedAfter(filter fileDataRepo.PendingSyncFilter) fileDataRepo.PendingSyncFilter {
+	filter.CreatedAfter = c.createdAfter.Load()
+	return filter
+}
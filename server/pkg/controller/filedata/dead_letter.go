@@ -0,0 +1,65 @@
+package filedata
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDeadLetterListLimit = 100
+	maxDeadLetterListLimit     = 1000
+)
+
+// GetDeadLetteredRows returns up to limit of the rows whose replication has
+// been given up on, most recently updated first, with the error that each of
+// them last failed with. A limit of 0 returns the default number of rows.
+func (c *Controller) GetDeadLetteredRows(ctx context.Context, limit int) ([]filedata.DeadLetteredRow, error) {
+	if limit <= 0 {
+		limit = defaultDeadLetterListLimit
+	}
+	if limit > maxDeadLetterListLimit {
+		limit = maxDeadLetterListLimit
+	}
+	rows, err := c.Repo.GetDeadLetteredRows(ctx, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return rows, nil
+}
+
+// RequeueFailed puts all the rows of the requested type whose replication has
+// failed, including the dead lettered ones, back into the replication queue
+// with a fresh attempt count, and returns how many rows were requeued. It is
+// meant for re-driving the rows that failed during an incident once its cause
+// has been fixed.
+//
+// Rows that a worker is retrying at the moment are not touched.
+func (c *Controller) RequeueFailed(ctx context.Context, req filedata.RequeueFailedRequest) (int64, error) {
+	if !slices.Contains(replicatedTypes, req.Type) {
+		return 0, stacktrace.Propagate(ente.NewBadRequestWithMessage("unknown type "+string(req.Type)), "")
+	}
+	if req.FailedSince > 0 && req.FailedUntil > 0 && req.FailedSince > req.FailedUntil {
+		return 0, stacktrace.Propagate(ente.NewBadRequestWithMessage("failedSince is after failedUntil"), "")
+	}
+	policy := newLockPolicy()
+	activeSince := time.Now().Add(-minimumHeartbeatsMissed * policy.heartbeatEvery).UnixMicro()
+	requeued, err := c.Repo.RequeueFailed(ctx, req.Type, req.ErrorContains, req.FailedSince, req.FailedUntil, activeSince)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	log.WithFields(log.Fields{
+		"type":           req.Type,
+		"error_contains": req.ErrorContains,
+		"failed_since":   req.FailedSince,
+		"failed_until":   req.FailedUntil,
+		"requeued":       requeued,
+	}).Info("Requeued failed file data rows")
+	c.wakeIdleWorkers(int(requeued))
+	return requeued, nil
+}
@@ -0,0 +1,116 @@
+package filedata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultDedupWindow = 1 * time.Minute
+
+type rowKey struct {
+	fileID int64
+	oType  ente.ObjectType
+}
+
+// recentReplication is a row that this instance has replicated successfully.
+type recentReplication struct {
+	at       time.Time
+	size     int64
+	checksum string
+}
+
+// recentReplications remembers, for replication.file-data.dedup-window, the
+// rows that any of the workers of this instance have replicated, so that a row
+// that is enqueued again with the same contents right after (e.g. because the
+// upload that enqueued it was retried) is replicated once more only when the
+// window has passed, however many times it was enqueued in the meantime. Rows
+// with different contents, and rows whose last replication failed, are not
+// held back. A window of 0 disables this.
+type recentReplications struct {
+	mu         sync.Mutex
+	rows       map[rowKey]recentReplication
+	lastPruned time.Time
+}
+
+func dedupWindow() time.Duration {
+	if viper.IsSet("replication.file-data.dedup-window") {
+		return viper.GetDuration("replication.file-data.dedup-window")
+	}
+	return defaultDedupWindow
+}
+
+// recordSuccess remembers that the row has just been replicated.
+func (r *recentReplications) recordSuccess(row filedata.Row) {
+	window := dedupWindow()
+	if window <= 0 || row.Checksum == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.rows == nil {
+		r.rows = map[rowKey]recentReplication{}
+	}
+	if now.Sub(r.lastPruned) > window {
+		for key, recent := range r.rows {
+			if now.Sub(recent.at) > window {
+				delete(r.rows, key)
+			}
+		}
+		r.lastPruned = now
+	}
+	r.rows[rowKey{row.FileID, row.Type}] = recentReplication{at: now, size: row.Size, checksum: *row.Checksum}
+}
+
+// forget drops the row, so that its retries aren't held back.
+func (r *recentReplications) forget(row filedata.Row) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.rows, rowKey{row.FileID, row.Type})
+}
+
+// heldBackUntil returns when the row may be replicated again, and true if that
+// is still in the future because the row has been replicated with the same
+// contents within the window.
+func (r *recentReplications) heldBackUntil(row filedata.Row) (time.Time, bool) {
+	window := dedupWindow()
+	if window <= 0 || row.Checksum == nil {
+		return time.Time{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recent, ok := r.rows[rowKey{row.FileID, row.Type}]
+	if !ok || recent.size != row.Size || recent.checksum != *row.Checksum {
+		return time.Time{}, false
+	}
+	until := recent.at.Add(window)
+	return until, time.Now().Before(until)
+}
+
+// holdBackDuplicate releases the lock of a row that was locked till heldLockTill
+// if the row has just been replicated with the same contents, so that it is
+// picked up again once the dedup window has passed. It returns false, without
+// doing anything, for the other rows.
+func (c *Controller) holdBackDuplicate(ctx context.Context, row filedata.Row, heldLockTill int64) bool {
+	until, ok := c.recent.heldBackUntil(row)
+	if !ok {
+		return false
+	}
+	if err := c.Repo.ReleaseSyncLock(context.WithoutCancel(ctx), row, heldLockTill, until.UnixMicro()); err != nil {
+		log.WithField("file_id", row.FileID).WithField("type", row.Type).Warnf("Could not hold back recently replicated row: %s", err)
+		return false
+	}
+	mDeduplicated.WithLabelValues(string(row.Type)).Inc()
+	log.WithFields(log.Fields{
+		"file_id": row.FileID,
+		"type":    row.Type,
+		"until":   until.Format(time.RFC3339),
+	}).Info("File data was enqueued again with the same contents right after being replicated, holding it back")
+	return true
+}
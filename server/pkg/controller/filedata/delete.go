@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"github.com/ente-io/museum/ente/filedata"
 	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
 	enteTime "github.com/ente-io/museum/pkg/utils/time"
+	"github.com/ente-io/stacktrace"
 
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"time"
 )
 
@@ -49,23 +52,34 @@ func (c *Controller) delete(i int) {
 }
 
 func (c *Controller) tryDelete() error {
+	ctx := context.Background()
 	newLockTime := enteTime.MicrosecondsAfterMinutes(10)
-	row, err := c.Repo.GetPendingSyncDataAndExtendLock(context.Background(), newLockTime, true)
+	row, err := c.Repo.GetPendingDeletionAndExtendLock(ctx, newLockTime)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			log.Errorf("Could not fetch row for deletion: %s", err)
 		}
 		return err
 	}
-	err = c.deleteFileRow(*row)
+	err = c.deleteFileRow(ctx, *row)
 	if err != nil {
+		// The row stays locked till the lock expires, after which the deletion
+		// is retried from scratch
 		log.Errorf("Could not delete file data: %s", err)
 		return err
 	}
 	return nil
 }
 
-func (c *Controller) deleteFileRow(fileDataRow filedata.Row) error {
+// deleteFileRow removes the objects of a deleted row from every bucket that
+// may contain them, and then removes the row itself.
+//
+// Each step can be safely repeated, so a deletion that fails midway is simply
+// retried once the row's lock expires. If a replication worker that had the
+// row locked before it was deleted records a new bucket in the meantime, the
+// final DeleteFileData fails (it requires all bucket columns to be empty) and
+// the new bucket is cleaned up in the next attempt.
+func (c *Controller) deleteFileRow(ctx context.Context, fileDataRow filedata.Row) error {
 	if !fileDataRow.IsDeleted {
 		return fmt.Errorf("file %d is not marked as deleted", fileDataRow.FileID)
 	}
@@ -78,17 +92,23 @@ func (c *Controller) deleteFileRow(fileDataRow filedata.Row) error {
 		// this should never happen
 		panic(fmt.Sprintf("file %d does not belong to user %d", fileID, ownerID))
 	}
-	ctxLogger := log.WithField("file_id", fileDataRow.DeleteFromBuckets).WithField("type", fileDataRow.Type).WithField("user_id", fileDataRow.UserID)
+	ctxLogger := log.WithField("file_id", fileDataRow.FileID).WithField("type", fileDataRow.Type).WithField("user_id", fileDataRow.UserID)
 	objectKeys := filedata.AllObjects(fileID, ownerID, fileDataRow.Type)
-	bucketColumnMap, err := getMapOfBucketItToColumn(fileDataRow)
+	buckets, err := deletionOrder(fileDataRow)
 	if err != nil {
 		ctxLogger.WithError(err).Error("Failed to get bucketColumnMap")
 		return err
 	}
 	// Delete objects and remove buckets
-	for bucketID, columnName := range bucketColumnMap {
-		for _, objectKey := range objectKeys {
-			err := c.ObjectCleanupController.DeleteObjectFromDataCenter(objectKey, bucketID)
+	for _, bucket := range buckets {
+		bucketID, columnName := bucket.bucketID, bucket.column
+		keys := objectKeys
+		if bucketID == fileDataRow.LatestBucket || c.S3Config.SharesBackend(fileDataRow.LatestBucket, bucketID) {
+			// The same objects as the latest copy, deleted along with it, last
+			keys = nil
+		}
+		for _, objectKey := range keys {
+			err := c.deleteAndVerify(ctx, objectKey, bucketID)
 			if err != nil {
 				ctxLogger.WithError(err).WithFields(log.Fields{
 					"bucketID":  bucketID,
@@ -110,20 +130,79 @@ func (c *Controller) deleteFileRow(fileDataRow filedata.Row) error {
 	}
 	// Delete from Latest bucket
 	for k := range objectKeys {
-		err = c.ObjectCleanupController.DeleteObjectFromDataCenter(objectKeys[k], fileDataRow.LatestBucket)
+		err = c.deleteAndVerify(ctx, objectKeys[k], fileDataRow.LatestBucket)
 		if err != nil {
 			ctxLogger.WithError(err).Error("Failed to delete object from datacenter")
 			return err
 		}
 	}
-	dbErr := c.Repo.DeleteFileData(context.Background(), fileDataRow)
+	dbErr := c.Repo.DeleteFileData(ctx, fileDataRow)
 	if dbErr != nil {
 		ctxLogger.WithError(dbErr).Error("Failed to remove from db")
-		return err
+		return dbErr
 	}
 	return nil
 }
 
+// deleteAndVerify deletes the object from the bucket, and then checks with a
+// HEAD that it is indeed gone. Deleting an object that is already absent
+// succeeds.
+func (c *Controller) deleteAndVerify(ctx context.Context, objectKey string, bucketID string) error {
+	log.Info("Deleting " + objectKey + " from " + bucketID)
+	store := c.S3Config.GetObjectStore(bucketID)
+	err := withS3Retry(ctx, "delete from "+bucketID, func() error {
+		return store.Delete(ctx, objectKey)
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	_, _, err = c.headObject(ctx, objectKey, bucketID)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to verify deletion")
+	}
+	return stacktrace.NewError(fmt.Sprintf("%s still present in %s after deletion", objectKey, bucketID))
+}
+
+// bucketColumn is a bucket that a row's objects are to be deleted from, along
+// with the column of the row that records it.
+type bucketColumn struct {
+	bucketID string
+	column   string
+}
+
+// deletionOrder returns the buckets that the objects of a deleted row are to be
+// deleted from, besides its latest bucket, which is always deleted from last:
+// first the stale copies, then the in-flight ones, and the replicated
+// copies last, each in the order of their IDs. A deletion that is cut short
+// thus leaves the most complete copies to the end, with the latest bucket still
+// recorded, so that a retry (or a restore of the file) finds them where the row
+// says they are.
+func deletionOrder(row filedata.Row) ([]bucketColumn, error) {
+	bucketColumnMap, err := getMapOfBucketItToColumn(row)
+	if err != nil {
+		return nil, err
+	}
+	rank := map[string]int{
+		fileDataRepo.DeletionColumn:    0,
+		fileDataRepo.InflightRepColumn: 1,
+		fileDataRepo.ReplicationColumn: 2,
+	}
+	buckets := make([]bucketColumn, 0, len(bucketColumnMap))
+	for bucketID, column := range bucketColumnMap {
+		buckets = append(buckets, bucketColumn{bucketID: bucketID, column: column})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if rank[buckets[i].column] != rank[buckets[j].column] {
+			return rank[buckets[i].column] < rank[buckets[j].column]
+		}
+		return buckets[i].bucketID < buckets[j].bucketID
+	})
+	return buckets, nil
+}
+
 func getMapOfBucketItToColumn(row filedata.Row) (map[string]string, error) {
 	bucketColumnMap := make(map[string]string)
 	for _, bucketID := range row.DeleteFromBuckets {
@@ -0,0 +1,170 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultDisableBucketFor        = time.Hour
+	defaultMaxDisableBucketFor     = 24 * time.Hour
+	disabledBucketsRefreshInterval = 30 * time.Second
+)
+
+// errBucketDisabled is returned when rows could not be fully replicated because
+// some of their destination buckets are disabled.
+var errBucketDisabled = errors.New("destination bucket is disabled")
+
+// disabledBuckets is this instance's copy of the buckets that replication is
+// paused for, mapped to the time at which they get re-enabled.
+//
+// The source of truth is the file_data_disabled_buckets table, which the copy
+// is refreshed from every disabledBucketsRefreshInterval, so that disabling a
+// bucket through any instance takes effect on all of them.
+type disabledBuckets struct {
+	mu    sync.RWMutex
+	until map[string]time.Time
+}
+
+func (d *disabledBuckets) set(buckets []filedata.DisabledBucket) {
+	until := make(map[string]time.Time, len(buckets))
+	for _, b := range buckets {
+		until[b.Bucket] = time.UnixMicro(b.DisabledUntil)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.until = until
+}
+
+func (d *disabledBuckets) add(bucketID string, until time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.until == nil {
+		d.until = map[string]time.Time{}
+	}
+	d.until[bucketID] = until
+}
+
+func (d *disabledBuckets) remove(bucketID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.until, bucketID)
+}
+
+// list returns the buckets that are disabled right now.
+func (d *disabledBuckets) list() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var buckets []string
+	for bucketID, until := range d.until {
+		if time.Now().Before(until) {
+			buckets = append(buckets, bucketID)
+		}
+	}
+	return buckets
+}
+
+func (d *disabledBuckets) isDisabled(bucketID string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	until, ok := d.until[bucketID]
+	return ok && time.Now().Before(until)
+}
+
+// DisableBucket pauses replication to a bucket, e.g. while it is under
+// maintenance. Rows pending for the bucket stay pending, and are copied to it
+// once it is re-enabled, which happens on its own after req.For (capped at
+// replication.file-data.disabled-buckets.max-for).
+func (c *Controller) DisableBucket(ctx context.Context, req filedata.DisableBucketRequest) (*filedata.DisabledBucket, error) {
+	if !c.S3Config.IsBucketActive(req.Bucket) {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("unknown bucket "+req.Bucket), "")
+	}
+	duration := viper.GetDuration("replication.file-data.disabled-buckets.default-for")
+	if duration <= 0 {
+		duration = defaultDisableBucketFor
+	}
+	if req.For != "" {
+		d, err := time.ParseDuration(req.For)
+		if err != nil || d <= 0 {
+			return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("invalid duration "+req.For), "")
+		}
+		duration = d
+	}
+	maxDuration := viper.GetDuration("replication.file-data.disabled-buckets.max-for")
+	if maxDuration <= 0 {
+		maxDuration = defaultMaxDisableBucketFor
+	}
+	if duration > maxDuration {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("a bucket can be disabled for at most "+maxDuration.String()), "")
+	}
+	until := time.Now().Add(duration)
+	disabled, err := c.Repo.DisableBucket(ctx, req.Bucket, until.UnixMicro(), req.Reason)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	c.disabledBuckets.add(req.Bucket, until)
+	log.WithFields(log.Fields{
+		"bucket": req.Bucket,
+		"until":  until,
+		"reason": req.Reason,
+	}).Warn("Disabled file data replication to bucket")
+	return disabled, nil
+}
+
+// EnableBucket resumes replication to a bucket that was disabled.
+func (c *Controller) EnableBucket(ctx context.Context, bucketID string) error {
+	if err := c.Repo.EnableBucket(ctx, bucketID); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	c.disabledBuckets.remove(bucketID)
+	log.WithField("bucket", bucketID).Info("Enabled file data replication to bucket")
+	return nil
+}
+
+// GetDisabledBuckets returns the buckets that replication is currently paused
+// for.
+func (c *Controller) GetDisabledBuckets(ctx context.Context) ([]filedata.DisabledBucket, error) {
+	return c.Repo.GetDisabledBuckets(ctx)
+}
+
+// refreshDisabledBuckets keeps the instance's copy of the disabled buckets up
+// to date until ctx is cancelled.
+func (c *Controller) refreshDisabledBuckets(ctx context.Context) {
+	ticker := time.NewTicker(disabledBucketsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		buckets, err := c.Repo.GetDisabledBuckets(ctx)
+		if err != nil {
+			log.WithError(err).Error("Could not fetch the disabled file data buckets")
+		} else {
+			c.disabledBuckets.set(buckets)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// skipDisabledBuckets removes the buckets that are disabled from dstBucketIDs,
+// and returns the ones that were removed.
+func (c *Controller) skipDisabledBuckets(row filedata.Row, dstBucketIDs map[string]bool) []string {
+	var skipped []string
+	for bucketID := range dstBucketIDs {
+		if c.disabledBuckets.isDisabled(bucketID) {
+			delete(dstBucketIDs, bucketID)
+			skipped = append(skipped, bucketID)
+			rowLogger(row).WithField(logDestBucket, bucketID).Info("Skipping replication to disabled bucket")
+		}
+	}
+	return skipped
+}
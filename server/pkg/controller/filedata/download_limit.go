@@ -0,0 +1,101 @@
+package filedata
+
+import (
+	"context"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// downloadLimiter caps the number of source downloads that the replication
+// workers of an instance, across all pools and types, make at the same time.
+// This keeps the source bucket from being overwhelmed when there are many
+// workers, most of which spend their time uploading.
+//
+// A nil limiter doesn't limit anything.
+type downloadLimiter struct {
+	mu    sync.Mutex
+	limit int
+	inUse int
+	// changed is closed, and replaced, whenever a slot may have become free
+	changed chan struct{}
+}
+
+// newDownloadLimiter returns a limiter for the configured
+// replication.file-data.max-concurrent-downloads, or nil if it is not set.
+func newDownloadLimiter() *downloadLimiter {
+	n := configuredMaxConcurrentDownloads()
+	if n <= 0 {
+		return nil
+	}
+	return &downloadLimiter{limit: n, changed: make(chan struct{})}
+}
+
+// acquire waits for a download slot, giving up if ctx is done first. Every
+// successful acquire must be followed by a release. The wait doesn't count
+// against the work budget of ctx, see workBudget.
+func (l *downloadLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.inUse >= l.limit {
+		defer waitOutsideBudget(ctx)()
+	}
+	for l.inUse >= l.limit {
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	l.inUse++
+	l.mu.Unlock()
+	mSourceDownloadsInflight.Inc()
+	return nil
+}
+
+func (l *downloadLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.inUse--
+	l.notify()
+	l.mu.Unlock()
+	mSourceDownloadsInflight.Dec()
+}
+
+// setLimit changes the number of slots. Downloads in progress are not affected
+// by a lower limit, but no new download starts until enough of them finish.
+func (l *downloadLimiter) setLimit(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = n
+	l.notify()
+}
+
+func (l *downloadLimiter) getLimit() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// notify wakes up the waiting downloads. It must be called with l.mu held.
+func (l *downloadLimiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func configuredMaxConcurrentDownloads() int {
+	return viper.GetInt("replication.file-data.max-concurrent-downloads")
+}
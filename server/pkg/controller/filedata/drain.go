@@ -0,0 +1,353 @@
+package filedata
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultDrainInterval          = 10 * time.Second
+	defaultDrainBatchSize         = 100
+	defaultDrainRequestsPerSecond = 10
+	drainLockDuration             = 10 * time.Minute
+)
+
+type drainOutcome int
+
+const (
+	// the bucket was removed from the row
+	drainOutcomeDrained drainOutcome = iota
+	// the row was queued for replication to its other buckets
+	drainOutcomeRequeued
+	// the row is already queued, or is being replicated
+	drainOutcomeWaiting
+	// the row's copies couldn't be confirmed in its other buckets
+	drainOutcomeUnconfirmed
+)
+
+// StartDrain creates a job that moves all the file data off bucketID, a bucket
+// that is being retired.
+//
+// The bucket must already have been removed from the buckets configured for
+// each type, so that nothing is replicated to it anymore, but still be known
+// so that it can be read from. The job itself is run in the background by the
+// instances that replicate, see runDrains.
+func (c *Controller) StartDrain(ctx context.Context, req filedata.DrainRequest) (*filedata.DrainJob, error) {
+	if !c.S3Config.IsBucketActive(req.Bucket) {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("unknown bucket "+req.Bucket), "")
+	}
+	for _, oType := range replicatedTypes {
+		if c.wantedBuckets(oType)[req.Bucket] {
+			return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage(
+				fmt.Sprintf("%s is still configured as a bucket for %s, remove it from s3.file-data-config first", req.Bucket, oType)), "")
+		}
+	}
+	job, err := c.Repo.CreateDrain(ctx, req.Bucket)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	log.WithFields(log.Fields{
+		"id":     job.ID,
+		"bucket": job.Bucket,
+		"total":  job.Total,
+	}).Info("Created file data drain")
+	return job, nil
+}
+
+// GetDrains returns the progress of all the drain jobs.
+func (c *Controller) GetDrains(ctx context.Context) ([]filedata.DrainJob, error) {
+	return c.Repo.GetDrains(ctx)
+}
+
+// runDrains advances the running drain jobs by a batch every
+// replication.file-data.drain.interval until ctx is cancelled.
+//
+// The progress of a job is kept in the database, so jobs interrupted by a
+// restart are resumed.
+func (c *Controller) runDrains(ctx context.Context) {
+	interval := viper.GetDuration("replication.file-data.drain.interval")
+	if interval <= 0 {
+		interval = defaultDrainInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ids, err := c.Repo.GetRunningDrainIDs(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("Could not fetch file data drains")
+			}
+			continue
+		}
+		for _, id := range ids {
+			if err := c.runDrainBatch(ctx, id); err != nil {
+				log.WithField("id", id).WithError(err).Error("Could not run file data drain batch")
+			}
+		}
+	}
+}
+
+// runDrainBatch drains the next replication.file-data.drain.batch-size rows
+// of the job, unless another instance is running the job at the moment.
+func (c *Controller) runDrainBatch(ctx context.Context, id int64) error {
+	batchSize := viper.GetInt("replication.file-data.drain.batch-size")
+	if batchSize <= 0 {
+		batchSize = defaultDrainBatchSize
+	}
+	requestsPerSecond := viper.GetFloat64("replication.file-data.drain.requests-per-second")
+	if requestsPerSecond <= 0 {
+		requestsPerSecond = defaultDrainRequestsPerSecond
+	}
+	limiter := rate.NewLimiter(rate.Limit(requestsPerSecond), 1)
+
+	lockTill := time.Now().Add(drainLockDuration).UnixMicro()
+	job, err := c.Repo.ClaimDrain(ctx, id, lockTill)
+	if err != nil || job == nil {
+		return err
+	}
+	batch := fileDataRepo.DrainBatch{LastFileID: job.LastFileID, LastType: job.LastType}
+	rows, err := c.Repo.GetRowsListingBucket(ctx, job.Bucket, job.LastFileID, job.LastType, batchSize)
+	if err == nil {
+		batch.PassEnded = len(rows) < batchSize
+		for _, row := range rows {
+			if ctx.Err() != nil {
+				batch.PassEnded = false
+				break
+			}
+			switch c.drainRow(ctx, row, job.Bucket, limiter) {
+			case drainOutcomeDrained:
+				batch.Drained++
+			case drainOutcomeRequeued:
+				batch.Requeued++
+			case drainOutcomeUnconfirmed:
+				batch.Unconfirmed++
+			}
+			batch.LastFileID, batch.LastType = row.FileID, row.Type
+		}
+		if batch.Requeued > 0 {
+			c.wakeIdleWorkers(int(batch.Requeued))
+		}
+		if batch.PassEnded {
+			batch.Remaining, err = c.Repo.CountRowsListingBucket(ctx, job.Bucket)
+			if err != nil {
+				batch.PassEnded = false
+			}
+		}
+	}
+	// Record what was done even if the batch was cut short, so that the next
+	// batch continues from there
+	job, finishErr := c.Repo.FinishDrainBatch(context.WithoutCancel(ctx), id, lockTill, batch)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if finishErr != nil {
+		return stacktrace.Propagate(finishErr, "")
+	}
+	logger := log.WithFields(log.Fields{
+		"id":          job.ID,
+		"bucket":      job.Bucket,
+		"total":       job.Total,
+		"drained":     job.Drained,
+		"requeued":    job.Requeued,
+		"unconfirmed": job.Unconfirmed,
+		"remaining":   job.Remaining,
+		"passes":      job.Passes,
+	})
+	switch {
+	case job.Status == fileDataRepo.DrainCompleted:
+		logger.Info("Completed file data drain, no live row lists the bucket anymore")
+	case batch.PassEnded:
+		logger.Warnf("File data drain pass ended with %d rows still listing the bucket, starting over", job.Remaining)
+	default:
+		logger.Debug("File data drain progress")
+	}
+	return nil
+}
+
+// drainRow removes bucketID from the row if the row's objects are confirmed to
+// be in all of its other buckets. Otherwise the row is queued for replication
+// to the buckets missing them, and left for a later pass.
+func (c *Controller) drainRow(ctx context.Context, row filedata.Row, bucketID string, limiter *rate.Limiter) drainOutcome {
+	outcome := drainOutcomeWaiting
+	logger := rowLogger(row).WithField(logSourceBucket, bucketID)
+	locked, err := c.withBorrowedLock(ctx, row, drainLockDuration, func(row filedata.Row) error {
+		var err error
+		outcome, err = c.drainLockedRow(ctx, row, bucketID, limiter)
+		return err
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Could not drain file data")
+		return drainOutcomeUnconfirmed
+	}
+	if locked {
+		// Being replicated, it will be picked up by a later pass
+		return drainOutcomeWaiting
+	}
+	return outcome
+}
+
+func (c *Controller) drainLockedRow(ctx context.Context, row filedata.Row, bucketID string, limiter *rate.Limiter) (drainOutcome, error) {
+	if array.StringInList(bucketID, row.ReplicaOverride) {
+		return drainOutcomeUnconfirmed, fmt.Errorf("the row's replica override still includes %s", bucketID)
+	}
+	others := c.drainTargets(row, bucketID)
+	missing := make([]string, 0)
+	for _, other := range others {
+		if !c.isRecordedIn(row, other) {
+			missing = append(missing, other)
+		}
+	}
+	if len(missing) > 0 {
+		if row.PendingSync && !row.IsDeadLettered {
+			return drainOutcomeWaiting, nil
+		}
+		return c.requeueForDrain(ctx, row, missing)
+	}
+
+	// Read the latest copy to establish what the others should contain
+	objectKey := row.S3FileMetadataObjectKey()
+	if err := limiter.Wait(ctx); err != nil {
+		return drainOutcomeUnconfirmed, err
+	}
+	data, err := c.downloadLogicalObject(ctx, objectKey, row.LatestBucket)
+	if err != nil {
+		return drainOutcomeUnconfirmed, stacktrace.Propagate(err, "failed to read latest copy from %s", row.LatestBucket)
+	}
+	checksum := checksumOf(data)
+	if row.Checksum == nil {
+		if err := verifyEmbeddedChecksum(data); err != nil {
+			return drainOutcomeUnconfirmed, stacktrace.Propagate(err, "latest copy in %s is corrupt", row.LatestBucket)
+		}
+	} else if *row.Checksum != checksum {
+		return drainOutcomeUnconfirmed, fmt.Errorf("latest copy in %s does not match the recorded checksum", row.LatestBucket)
+	}
+	md5Sum := md5.Sum(data)
+	plainMD5 := hex.EncodeToString(md5Sum[:])
+	for _, other := range others {
+		if other == row.LatestBucket {
+			continue
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return drainOutcomeUnconfirmed, err
+		}
+		ok, err := c.verifyReplica(ctx, objectKey, other, replicaVersion(row, other), int64(len(data)), plainMD5, checksum)
+		if err != nil {
+			return drainOutcomeUnconfirmed, stacktrace.Propagate(err, "could not verify copy in %s", other)
+		}
+		if !ok {
+			missing = append(missing, other)
+			continue
+		}
+		for _, sideKey := range row.SideObjectKeys() {
+			if err := limiter.Wait(ctx); err != nil {
+				return drainOutcomeUnconfirmed, err
+			}
+			_, _, err := c.headObject(ctx, sideKey, other)
+			if errors.Is(err, objectstore.ErrNotFound) {
+				missing = append(missing, other)
+				break
+			}
+			if err != nil {
+				return drainOutcomeUnconfirmed, stacktrace.Propagate(err, "could not check %s in %s", sideKey, other)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		log.WithFields(log.Fields{
+			"file_id": row.FileID,
+			"type":    row.Type,
+			"buckets": missing,
+		}).Warn("File data copies recorded as replicated are missing or corrupt, requeueing them before draining")
+		return c.requeueForDrain(ctx, row, missing)
+	}
+
+	latestBucket := row.LatestBucket
+	if latestBucket == bucketID {
+		latestBucket = c.drainedLatestBucket(row, others)
+		if latestBucket == "" {
+			return drainOutcomeUnconfirmed, fmt.Errorf("none of %v stores the objects as is, to be served from", others)
+		}
+	}
+	if err := c.Repo.RemoveDrainedBucket(ctx, row, bucketID, latestBucket); err != nil {
+		return drainOutcomeUnconfirmed, stacktrace.Propagate(err, "")
+	}
+	rowLogger(row).WithFields(log.Fields{
+		logSourceBucket: bucketID,
+		"latest":        latestBucket,
+	}).Debug("Drained file data")
+	return drainOutcomeDrained, nil
+}
+
+// drainTargets returns the buckets other than bucketID that the row should be
+// in, sorted.
+func (c *Controller) drainTargets(row filedata.Row, bucketID string) []string {
+	wanted := map[string]bool{c.S3Config.GetBucketID(row.Type): true}
+	for _, bucket := range c.replicaBuckets(row) {
+		wanted[bucket] = true
+	}
+	delete(wanted, bucketID)
+	return sortedKeys(wanted)
+}
+
+// isRecordedIn reports whether the row records all of its objects as being in
+// bucketID: its latest bucket has them all, and the replicated buckets need
+// its side objects recorded as well.
+func (c *Controller) isRecordedIn(row filedata.Row, bucketID string) bool {
+	if bucketID == row.LatestBucket {
+		return true
+	}
+	if !array.StringInList(bucketID, row.ReplicatedBuckets) || array.StringInList(bucketID, row.InflightReplicas) {
+		return false
+	}
+	for _, key := range row.SideObjectKeys() {
+		if !c.hasSideObject(row, bucketID, key) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Controller) requeueForDrain(ctx context.Context, row filedata.Row, buckets []string) (drainOutcome, error) {
+	for _, bucket := range buckets {
+		if err := c.Repo.RequeueMissingReplica(ctx, row, bucket); err != nil {
+			return drainOutcomeUnconfirmed, stacktrace.Propagate(err, "")
+		}
+	}
+	return drainOutcomeRequeued, nil
+}
+
+// drainedLatestBucket returns the bucket that replaces the drained bucket as
+// the row's latest bucket: the primary bucket of the row's type if possible,
+// otherwise the first of the others. Since clients are sent to the latest
+// bucket, only a bucket that stores the objects as is will do. It returns ""
+// if there is none.
+func (c *Controller) drainedLatestBucket(row filedata.Row, others []string) string {
+	if primary := c.S3Config.GetBucketID(row.Type); array.StringInList(primary, others) && c.storedAsIs(primary) {
+		return primary
+	}
+	for _, bucket := range others {
+		if c.storedAsIs(bucket) {
+			return bucket
+		}
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package filedata
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// dryRunRow records what replication would do for the row without copying
+// anything, and then puts back the lock the row had before it was picked up so
+// that the scan leaves the row exactly as it found it.
+//
+// Rows that already have an up to date entry in the report are skipped when
+// picking rows during a dry run, so the scan makes progress and repeating it is
+// a no-op until the rows change.
+func (c *Controller) dryRunRow(ctx context.Context, row filedata.Row, heldLockTill int64) error {
+	missing := make([]string, 0)
+	for bucketID := range c.pendingBuckets(row) {
+		missing = append(missing, bucketID)
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		log.WithFields(log.Fields{
+			"file_id":         row.FileID,
+			"type":            row.Type,
+			"size":            row.Size,
+			"source_bucket":   row.LatestBucket,
+			"missing_buckets": missing,
+		}).Info("[dry-run] would replicate file data")
+	}
+	if err := c.Repo.UpsertDryRunReport(ctx, row, row.LatestBucket, missing); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	c.dryRunDirty.Store(true)
+	return c.Repo.ReleaseSyncLock(ctx, row, heldLockTill, row.SyncLockedTill)
+}
+
+// logDryRunSummary logs the discrepancies found by the dry run, once each time
+// the scan runs out of rows after having found something new.
+func (c *Controller) logDryRunSummary(ctx context.Context) {
+	if !c.dryRunDirty.CompareAndSwap(true, false) {
+		return
+	}
+	summary, err := c.Repo.GetDryRunSummary(ctx)
+	if err != nil {
+		log.WithError(err).Error("Could not summarize file data replication dry run")
+		return
+	}
+	if len(summary) == 0 {
+		log.Info("[dry-run] file data replication found no discrepancies")
+		return
+	}
+	for _, d := range summary {
+		log.WithFields(log.Fields{
+			"type":   d.Type,
+			"bucket": d.Bucket,
+			"rows":   d.Rows,
+			"bytes":  d.Bytes,
+		}).Info("[dry-run] file data missing from bucket")
+	}
+}
+
+// GetDryRunSummary returns the discrepancies recorded by dry runs so far.
+func (c *Controller) GetDryRunSummary(ctx context.Context) ([]filedata.DryRunDiscrepancy, error) {
+	return c.Repo.GetDryRunSummary(ctx)
+}
+
+// ClearDryRunReport discards the dry run report so that the next dry run scans
+// all pending rows afresh.
+func (c *Controller) ClearDryRunReport(ctx context.Context) error {
+	return c.Repo.ClearDryRunReport(ctx)
+}
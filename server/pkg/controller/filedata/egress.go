@@ -0,0 +1,85 @@
+package filedata
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/spf13/viper"
+)
+
+// bytesPerGB is the unit that egress is priced in.
+const bytesPerGB = 1 << 30
+
+// countRoute records that n bytes of an object were copied from the bucket
+// source to the bucket destination, whether through museum or server side. The
+// bytes are counted per route in mRouteBytes, along with the cost that they
+// are estimated to have incurred, see egressCostPerGB, and added to the stats
+// of ctx, if any.
+//
+// source must be the bucket that the object was actually read from, which
+// isn't necessarily the row's latest bucket, see downloadSourceObject.
+func countRoute(ctx context.Context, source string, destination string, n int64) {
+	mRouteBytes.WithLabelValues(source, destination).Add(float64(n))
+	if cost := egressCostPerGB(source, destination); cost > 0 {
+		mRouteEstimatedCost.WithLabelValues(source, destination).Add(cost * float64(n) / bytesPerGB)
+	}
+	if stats, ok := ctx.Value(transferCtxKey{}).(*transferStats); ok {
+		stats.mu.Lock()
+		defer stats.mu.Unlock()
+		if stats.routes == nil {
+			stats.routes = make(map[transferRoute]int64)
+		}
+		stats.routes[transferRoute{source: source, destination: destination}] += n
+	}
+}
+
+// noteSource records in the stats of ctx, if any, that the object was read
+// from the bucket source.
+func noteSource(ctx context.Context, source string) {
+	if stats, ok := ctx.Value(transferCtxKey{}).(*transferStats); ok {
+		stats.mu.Lock()
+		stats.source = source
+		stats.mu.Unlock()
+	}
+}
+
+// egressCostPerGB returns the cost of copying a GB (2^30 bytes) from source to
+// destination, as set in replication.file-data.egress-cost-per-gb. Routes that
+// aren't listed cost nothing.
+func egressCostPerGB(source string, destination string) float64 {
+	return viper.GetFloat64("replication.file-data.egress-cost-per-gb." + source + "." + destination)
+}
+
+type transferRoute struct {
+	source      string
+	destination string
+}
+
+// routeTransfers returns the bytes copied along each route, sorted by route.
+func (s *transferStats) routeTransfers() []filedata.RouteTransfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfers := make([]filedata.RouteTransfer, 0, len(s.routes))
+	for route, n := range s.routes {
+		transfers = append(transfers, filedata.RouteTransfer{Source: route.source, Destination: route.destination, Bytes: n})
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].Source != transfers[j].Source {
+			return transfers[i].Source < transfers[j].Source
+		}
+		return transfers[i].Destination < transfers[j].Destination
+	})
+	return transfers
+}
+
+// sourceBucket returns the bucket that the object was read from, or fallback if
+// it wasn't read (e.g. because it was only copied server side).
+func (s *transferStats) sourceBucket(fallback string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.source == "" {
+		return fallback
+	}
+	return s.source
+}
@@ -0,0 +1,59 @@
+package filedata
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/ente-io/museum/pkg/utils/envelope"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// configuredKeyProvider returns a key provider for the key encryption keys in
+// replication.file-data.encryption.keys, which maps key IDs to base64 encoded
+// 32 byte keys.
+func configuredKeyProvider() envelope.KeyProvider {
+	keys := map[string][]byte{}
+	for id, encoded := range viper.GetStringMapString("replication.file-data.encryption.keys") {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			log.Fatalf("Invalid file data encryption key %s: %s", id, err)
+		}
+		keys[id] = key
+	}
+	provider, err := envelope.NewStaticKeyProvider(keys)
+	if err != nil {
+		log.Fatalf("Invalid file data encryption keys: %s", err)
+	}
+	return provider
+}
+
+// encryptForBucket encrypts the data to be stored in bucketID with a new data
+// key wrapped by the bucket's s3.<bucket>.encryption-key. Data for buckets
+// without an encryption key is returned as is.
+func (c *Controller) encryptForBucket(ctx context.Context, bucketID string, data []byte) ([]byte, error) {
+	keyID := c.S3Config.GetEncryptionKeyID(bucketID)
+	if keyID == "" {
+		return data, nil
+	}
+	sealed, err := envelope.Seal(ctx, c.KeyProvider, keyID, data)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to encrypt object for %s", bucketID)
+	}
+	return sealed, nil
+}
+
+// decrypt decrypts the bytes read from a bucket if they are encrypted. Each
+// encrypted object records the key that it was encrypted with, so this doesn't
+// depend on the bucket's current configuration.
+func (c *Controller) decrypt(ctx context.Context, stored []byte) ([]byte, error) {
+	if !envelope.IsSealed(stored) {
+		return stored, nil
+	}
+	data, err := envelope.Open(ctx, c.KeyProvider, stored)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to decrypt object")
+	}
+	return data, nil
+}
@@ -0,0 +1,107 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+)
+
+// ReplicationErrorClass says why the replication of a row failed, which decides
+// how the failure is retried.
+//
+// Each class is also an error, so errors.Is(err, ErrIntegrity) reports whether
+// err was classified as an integrity failure.
+type ReplicationErrorClass string
+
+const (
+	// ErrSourceMissing is for rows whose object is not in the latest bucket.
+	ErrSourceMissing ReplicationErrorClass = "source_missing"
+	// ErrPermission is for requests that a bucket rejected, e.g. because of
+	// expired credentials or a bucket policy.
+	ErrPermission ReplicationErrorClass = "permission"
+	// ErrIntegrity is for objects whose size or checksum is not what the row
+	// says it should be. Failures of the copies in the destination buckets,
+	// e.g. a bad upload or a short read back, are of this class, and are
+	// retried like the transient ones.
+	ErrIntegrity ReplicationErrorClass = "integrity"
+	// ErrSourceIntegrity is for rows whose source object itself fails its
+	// integrity checks, see sourceIntegrityError. Such errors also match
+	// ErrIntegrity.
+	ErrSourceIntegrity ReplicationErrorClass = "source_integrity"
+	// ErrTransient is for everything else, network and server errors, which
+	// are expected to go away on their own.
+	ErrTransient ReplicationErrorClass = "transient"
+	// ErrTimeout is for rows that could not be replicated within the time
+	// their lock allowed.
+	ErrTimeout ReplicationErrorClass = "timeout"
+)
+
+func (c ReplicationErrorClass) Error() string {
+	return "replication failed: " + string(c)
+}
+
+// permanent reports whether retrying is unlikely to help. Rows that fail with a
+// permanent error are dead lettered right away.
+func (c ReplicationErrorClass) permanent() bool {
+	return c == ErrSourceMissing || c == ErrSourceIntegrity
+}
+
+// sourceIntegrityError classifies err, a failed integrity check of the source
+// object, as ErrSourceIntegrity. Other errors are returned as they are.
+func sourceIntegrityError(err error) error {
+	if !errors.Is(err, ErrIntegrity) {
+		return err
+	}
+	return &ReplicationError{Class: ErrSourceIntegrity, Err: err}
+}
+
+// ReplicationError is a replication failure along with its class.
+type ReplicationError struct {
+	Class ReplicationErrorClass
+	Err   error
+}
+
+func (e *ReplicationError) Error() string {
+	return string(e.Class) + ": " + e.Err.Error()
+}
+
+func (e *ReplicationError) Unwrap() []error {
+	return []error{e.Err, e.Class}
+}
+
+// classifyReplicationError wraps err in a ReplicationError. ctx is the context
+// that the failed work was done with, a failure after its deadline has passed
+// is a timeout whatever the error says.
+func classifyReplicationError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	var re *ReplicationError
+	if errors.As(err, &re) {
+		return err
+	}
+	return &ReplicationError{Class: replicationErrorClass(ctx, err), Err: err}
+}
+
+func replicationErrorClass(ctx context.Context, err error) ReplicationErrorClass {
+	var re *ReplicationError
+	if errors.As(err, &re) {
+		return re.Class
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	case errors.Is(err, ErrIntegrity):
+		return ErrIntegrity
+	case errors.Is(err, objectstore.ErrAccessDenied), errors.Is(err, fs.ErrPermission):
+		return ErrPermission
+	default:
+		return ErrTransient
+	}
+}
@@ -0,0 +1,157 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultEventPublishInterval = 10 * time.Second
+	eventPublishBatchSize       = 100
+	// eventClaimDuration is how long a batch of events is claimed for. It
+	// leaves the time for each event of the batch to time out, after which
+	// the events that are still unpublished can be claimed again.
+	eventClaimDuration = eventPublishBatchSize*webhookTimeout + time.Minute
+	webhookTimeout     = 10 * time.Second
+)
+
+// EventSink receives the events emitted when file data rows finish replicating.
+//
+// Events are first written to an outbox table in the same transaction that
+// marks the row as replicated, and are then relayed to the sink. An event is
+// retried until the sink accepts it, so sinks must tolerate duplicates (the
+// event ID can be used to deduplicate).
+type EventSink interface {
+	Publish(ctx context.Context, event filedata.ReplicationEvent) error
+}
+
+// webhookSink POSTs each event as JSON to a URL.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Publish(ctx context.Context, event filedata.ReplicationEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SetEventSink sets the sink that replication events are relayed to. It must
+// be called before replication is started.
+func (c *Controller) SetEventSink(sink EventSink) {
+	c.eventSink = sink
+}
+
+// configureEvents reads replication.file-data.events. With the "outbox" sink,
+// events are only written to the outbox table for consumers to read from
+// there. With the "webhook" sink, they are also relayed to webhook-url, which
+// must be an http or https URL; otherwise the error is logged, and events are
+// only written to the outbox.
+func (c *Controller) configureEvents() {
+	c.eventsEnabled = viper.GetBool("replication.file-data.events.enabled")
+	if !c.eventsEnabled || c.eventSink != nil {
+		return
+	}
+	switch sink := viper.GetString("replication.file-data.events.sink"); sink {
+	case "", "outbox":
+	case "webhook":
+		webhookURL := viper.GetString("replication.file-data.events.webhook-url")
+		if u, err := url.Parse(webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Errorf("Invalid file data replication event webhook-url %q, events will only be written to the outbox", webhookURL)
+			return
+		}
+		c.eventSink = &webhookSink{
+			url:    webhookURL,
+			client: &http.Client{Timeout: webhookTimeout},
+		}
+	default:
+		log.Errorf("Unknown file data replication event sink %s, events will only be written to the outbox", sink)
+	}
+}
+
+// markReplicationAsDone marks the row as replicated, also recording a
+// replication event for it if events are enabled.
+func (c *Controller) markReplicationAsDone(ctx context.Context, row filedata.Row, buckets []string) error {
+	if !c.eventsEnabled {
+		return c.Repo.MarkReplicationAsDone(ctx, row)
+	}
+	return c.Repo.MarkReplicationAsDoneWithEvent(ctx, row, buckets)
+}
+
+// relayEvents publishes the events in the outbox to the event sink until ctx is
+// cancelled. Publishing failures are logged and retried on the next round; they
+// never affect replication itself.
+func (c *Controller) relayEvents(ctx context.Context) {
+	interval := viper.GetDuration("replication.file-data.events.publish-interval")
+	if interval <= 0 {
+		interval = defaultEventPublishInterval
+	}
+	for sleepWithContext(ctx, interval) {
+		for {
+			claimed, err := c.publishEvents(ctx)
+			if err != nil {
+				log.WithError(err).Error("Could not relay file data replication events")
+			}
+			if err != nil || claimed < eventPublishBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// publishEvents claims a batch of events from the outbox, publishes them to
+// the event sink, and then records which of them were published. No
+// transaction is held open while publishing. It returns the number of events
+// that were claimed.
+func (c *Controller) publishEvents(ctx context.Context) (int, error) {
+	claimTill := time.Now().Add(eventClaimDuration).UnixMicro()
+	events, err := c.Repo.ClaimPendingEvents(ctx, eventPublishBatchSize, claimTill)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	var published, failed []int64
+	for _, e := range events {
+		// The rest of the batch is claimed again once the claim expires
+		if ctx.Err() != nil || time.Now().UnixMicro() >= claimTill {
+			break
+		}
+		if err := c.eventSink.Publish(ctx, e); err != nil {
+			log.WithError(err).WithField("event_id", e.ID).Warn("Could not publish file data replication event")
+			failed = append(failed, e.ID)
+			continue
+		}
+		published = append(published, e.ID)
+	}
+	// Record the outcome even if ctx was cancelled meanwhile, so that the
+	// published events aren't published again
+	if err := c.Repo.FinishClaimedEvents(context.WithoutCancel(ctx), claimTill, published, failed); err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return len(events), nil
+}
@@ -0,0 +1,31 @@
+package filedata
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfigureEvents(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("replication.file-data.events.enabled", true)
+	viper.Set("replication.file-data.events.sink", "webhook")
+	for webhookURL, valid := range map[string]bool{
+		"":                          false,
+		"example.org/events":        false,
+		"ftp://example.org/events":  false,
+		"https://":                  false,
+		"https://example.org/event": true,
+		"http://localhost:8080":     true,
+	} {
+		c := &Controller{}
+		viper.Set("replication.file-data.events.webhook-url", webhookURL)
+		c.configureEvents()
+		if !c.eventsEnabled {
+			t.Fatalf("events were disabled for webhook-url %q", webhookURL)
+		}
+		if got := c.eventSink != nil; got != valid {
+			t.Fatalf("webhook-url %q: relaying enabled %v, want %v", webhookURL, got, valid)
+		}
+	}
+}
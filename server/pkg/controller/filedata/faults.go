@@ -0,0 +1,185 @@
+package filedata
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// faultEnvironments are the environments (the ENVIRONMENT that museum is
+// started with) in which faults may be injected. Museum runs as local when
+// ENVIRONMENT isn't set, which is how most self-hosted instances run, so only
+// the environments that are set explicitly are allowed.
+var faultEnvironments = map[string]bool{"test": true, "staging": true}
+
+const (
+	faultOpUpload   = "upload"
+	faultOpDownload = "download"
+)
+
+// faultInjector makes uploads to and downloads from the object stores fail, or
+// take longer, on purpose. It is meant for exercising the retries, the circuit
+// breakers, the dead letter queue and the alerts in test and staging.
+//
+// It is configured with replication.file-data.faults, and is never enabled in
+// any other environment, see faultEnvironments. A nil injector doesn't inject
+// anything.
+type faultInjector struct {
+	// ratio is the fraction of the operations against any bucket that fail
+	ratio float64
+	// buckets are the buckets against which every operation fails
+	buckets map[string]bool
+	// ops are the operations that faults are injected into
+	ops map[string]bool
+	// latency is added to every operation
+	latency time.Duration
+	// class is the kind of error that injected failures return
+	class string
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// newFaultInjector returns an injector if replication.file-data.faults.enabled
+// is turned on, and the environment allows it.
+func newFaultInjector() *faultInjector {
+	if !viper.GetBool("replication.file-data.faults.enabled") {
+		return nil
+	}
+	environment := os.Getenv("ENVIRONMENT")
+	if !faultEnvironments[environment] {
+		log.Errorf("Ignoring replication.file-data.faults, fault injection can't be enabled in the %s environment", environment)
+		return nil
+	}
+	f, err := configuredFaultInjector()
+	if err != nil {
+		log.WithError(err).Error("Ignoring replication.file-data.faults")
+		return nil
+	}
+	log.Warnf("Injecting faults into file data replication (ratio %.2f, buckets %v, latency %s, error %s)",
+		f.ratio, viper.GetStringSlice("replication.file-data.faults.buckets"), f.latency, f.class)
+	return f
+}
+
+func configuredFaultInjector() (*faultInjector, error) {
+	f := &faultInjector{
+		ratio:   viper.GetFloat64("replication.file-data.faults.ratio"),
+		buckets: map[string]bool{},
+		ops:     map[string]bool{},
+		latency: viper.GetDuration("replication.file-data.faults.latency"),
+		class:   viper.GetString("replication.file-data.faults.error"),
+	}
+	if f.ratio < 0 || f.ratio > 1 {
+		return nil, fmt.Errorf("ratio %v is not between 0 and 1", f.ratio)
+	}
+	if f.latency < 0 {
+		return nil, fmt.Errorf("latency %s is negative", f.latency)
+	}
+	if f.class == "" {
+		f.class = faultTransient
+	}
+	if injectedError(f.class) == nil {
+		return nil, fmt.Errorf("unknown error %q", f.class)
+	}
+	for _, bucketID := range viper.GetStringSlice("replication.file-data.faults.buckets") {
+		f.buckets[bucketID] = true
+	}
+	ops := viper.GetStringSlice("replication.file-data.faults.operations")
+	if len(ops) == 0 {
+		ops = []string{faultOpUpload, faultOpDownload}
+	}
+	for _, op := range ops {
+		if op != faultOpUpload && op != faultOpDownload {
+			return nil, fmt.Errorf("unknown operation %q", op)
+		}
+		f.ops[op] = true
+	}
+	var seed uint64
+	if viper.IsSet("replication.file-data.faults.seed") {
+		seed = viper.GetUint64("replication.file-data.faults.seed")
+	} else {
+		seed = rand.Uint64()
+	}
+	f.rnd = rand.New(rand.NewPCG(seed, seed))
+	return f, nil
+}
+
+// inject is called before each attempt of op against bucketID. It waits for
+// the injected latency, and then returns the injected error if the attempt
+// should fail. Only the operations of replication (see forReplication) are
+// affected, those made on behalf of user requests never are.
+func (f *faultInjector) inject(ctx context.Context, op string, bucketID string) error {
+	if f == nil || !f.ops[op] || !isReplication(ctx) {
+		return nil
+	}
+	if f.latency > 0 {
+		timer := time.NewTimer(f.latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if !f.buckets[bucketID] && !f.roll() {
+		return nil
+	}
+	mInjectedFaults.WithLabelValues(op, bucketID).Inc()
+	return fmt.Errorf("injected %s failure in %s: %w", op, bucketID, injectedError(f.class))
+}
+
+func (f *faultInjector) roll() bool {
+	if f.ratio <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rnd.Float64() < f.ratio
+}
+
+// The kinds of errors that can be injected, with replication.file-data.faults.error
+const (
+	faultTransient  = "transient"
+	faultThrottled  = "throttled"
+	faultTimeout    = "timeout"
+	faultPermission = "permission"
+	faultNotFound   = "not-found"
+	faultIntegrity  = "integrity"
+)
+
+// injectedError returns an error of the given kind that looks like what the
+// object stores return, so that it is retried and classified like the real
+// thing. It returns nil for unknown kinds.
+func injectedError(class string) error {
+	switch class {
+	case faultTransient:
+		return awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "injected fault", nil), http.StatusServiceUnavailable, "")
+	case faultThrottled:
+		return awserr.NewRequestFailure(awserr.New("SlowDown", "injected fault", nil), http.StatusServiceUnavailable, "")
+	case faultTimeout:
+		return injectedTimeout{}
+	case faultPermission:
+		return objectstore.ErrAccessDenied
+	case faultNotFound:
+		return objectstore.ErrNotFound
+	case faultIntegrity:
+		return ErrIntegrity
+	}
+	return nil
+}
+
+// injectedTimeout is a net.Error that timed out
+type injectedTimeout struct{}
+
+func (injectedTimeout) Error() string   { return "injected timeout" }
+func (injectedTimeout) Timeout() bool   { return true }
+func (injectedTimeout) Temporary() bool { return true }
@@ -0,0 +1,83 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/spf13/viper"
+)
+
+func TestFaultInjector(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("replication.file-data.faults.enabled", true)
+	viper.Set("replication.file-data.faults.buckets", []string{"broken"})
+	viper.Set("replication.file-data.faults.operations", []string{faultOpUpload})
+	viper.Set("replication.file-data.faults.error", faultNotFound)
+	ctx := forReplication(context.Background())
+
+	for _, environment := range []string{"production", "local", ""} {
+		t.Setenv("ENVIRONMENT", environment)
+		if f := newFaultInjector(); f != nil {
+			t.Fatalf("faults were enabled in the %q environment", environment)
+		}
+	}
+
+	t.Setenv("ENVIRONMENT", "staging")
+	f := newFaultInjector()
+	if f == nil {
+		t.Fatal("faults were not enabled in staging")
+	}
+	if err := f.inject(ctx, faultOpUpload, "broken"); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Fatalf("upload to the broken bucket returned %v, want a not found error", err)
+	}
+	if err := f.inject(ctx, faultOpDownload, "broken"); err != nil {
+		t.Fatalf("download from the broken bucket returned %v, want no error", err)
+	}
+	if err := f.inject(ctx, faultOpUpload, "healthy"); err != nil {
+		t.Fatalf("upload to a healthy bucket returned %v, want no error", err)
+	}
+	if err := f.inject(context.Background(), faultOpUpload, "broken"); err != nil {
+		t.Fatalf("upload of a user to the broken bucket returned %v, want no error", err)
+	}
+
+	viper.Set("replication.file-data.faults.ratio", 0.5)
+	viper.Set("replication.file-data.faults.seed", 7)
+	failures := func() int {
+		f := newFaultInjector()
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if f.inject(ctx, faultOpUpload, "healthy") != nil {
+				n++
+			}
+		}
+		return n
+	}
+	n := failures()
+	if n < 400 || n > 600 {
+		t.Fatalf("%d of 1000 uploads failed with a ratio of 0.5", n)
+	}
+	if again := failures(); again != n {
+		t.Fatalf("%d uploads failed with the same seed, want %d", again, n)
+	}
+}
+
+func TestInjectedErrorClasses(t *testing.T) {
+	ctx := context.Background()
+	for class, want := range map[string]ReplicationErrorClass{
+		faultTransient:  ErrTransient,
+		faultThrottled:  ErrTransient,
+		faultTimeout:    ErrTimeout,
+		faultPermission: ErrPermission,
+		faultIntegrity:  ErrIntegrity,
+	} {
+		if got := replicationErrorClass(ctx, injectedError(class)); got != want {
+			t.Errorf("injected %s error is classified as %s, want %s", class, got, want)
+		}
+	}
+	if !isRetryableS3Error(injectedError(faultThrottled)) {
+		t.Error("injected throttled error is not retried")
+	}
+}
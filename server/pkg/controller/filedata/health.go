@@ -0,0 +1,81 @@
+package filedata
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	"github.com/spf13/viper"
+)
+
+const defaultHealthWindow = time.Hour
+
+// GetReplicationHealth reports whether replication on this instance is making
+// forward progress, i.e. whether a row has been replicated within
+// replication.file-data.health.window while rows are pending sync. A queue that
+// is empty, or only has rows that are intentionally parked (see
+// HasActionablePending), is healthy however long ago the last row was
+// replicated, and so is an instance in dry run mode.
+func (c *Controller) GetReplicationHealth(ctx context.Context) (*filedata.ReplicationHealth, error) {
+	window := viper.GetDuration("replication.file-data.health.window")
+	if window <= 0 {
+		window = defaultHealthWindow
+	}
+	health := &filedata.ReplicationHealth{Healthy: true, Window: window.String()}
+	c.poolMu.Lock()
+	pools := c.pools
+	c.poolMu.Unlock()
+	if pools == nil {
+		return health, nil
+	}
+	for _, pool := range pools {
+		health.ActiveWorkers += len(pool.snapshot())
+	}
+	health.Running = true
+	health.LastSuccessAt = c.lastReplicatedAt.Load()
+	pending, err := c.Repo.CountPendingSync(ctx, 1)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	health.Pending = pending > 0
+	if c.dryRun {
+		health.DryRun = true
+		return health, nil
+	}
+	if !health.Pending || time.Since(time.UnixMicro(health.LastSuccessAt)) <= window {
+		return health, nil
+	}
+	actionable, err := c.hasActionablePending(ctx)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	health.Parked = !actionable
+	health.Healthy = !actionable
+	return health, nil
+}
+
+// hasActionablePending reports whether any of the rows pending sync could be
+// replicated by the instance right now.
+func (c *Controller) hasActionablePending(ctx context.Context) (bool, error) {
+	parked := c.disabledBuckets.list()
+	for _, circuit := range c.circuits.status() {
+		if circuit.State == string(circuitOpen) && !slices.Contains(parked, circuit.Bucket) {
+			parked = append(parked, circuit.Bucket)
+		}
+	}
+	var maxSize int64
+	if oversizedAction() == oversizedSkip {
+		maxSize = maxObjectSize()
+	}
+	for _, oType := range replicatedTypes {
+		wanted := slices.Sorted(maps.Keys(c.wantedBuckets(oType)))
+		found, err := c.Repo.HasActionablePending(ctx, oType, c.S3Config.GetBucketID(oType), wanted, parked, maxSize)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,150 @@
+package filedata
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type workerState string
+
+const (
+	workerIdle        workerState = "idle"
+	workerDownloading workerState = "downloading"
+	workerUploading   workerState = "uploading"
+	workerSleeping    workerState = "sleeping"
+	workerPaused      workerState = "paused"
+	workerThrottled   workerState = "throttled"
+	workerMaintenance workerState = "maintenance"
+)
+
+const (
+	defaultWatchdogThreshold = 30 * time.Minute
+	watchdogInterval         = 1 * time.Minute
+)
+
+// workerHealth is what a replication worker is doing, and when it last made
+// progress.
+type workerHealth struct {
+	mu            sync.Mutex
+	state         workerState
+	fileID        int64
+	stateSince    time.Time
+	lastHeartbeat time.Time
+}
+
+func (h *workerHealth) set(state workerState, fileID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if h.state != state {
+		h.stateSince = now
+	}
+	h.state = state
+	h.fileID = fileID
+	h.lastHeartbeat = now
+}
+
+func (h *workerHealth) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastHeartbeat = time.Now()
+}
+
+type workerCtxKey struct{}
+
+func withWorker(ctx context.Context, w *replicationWorker) context.Context {
+	return context.WithValue(ctx, workerCtxKey{}, w)
+}
+
+// setWorkerState records the state of the worker that ctx belongs to. It is a
+// no-op for work that isn't done by a replication worker.
+func setWorkerState(ctx context.Context, state workerState, fileID int64) {
+	if w, ok := ctx.Value(workerCtxKey{}).(*replicationWorker); ok {
+		w.health.set(state, fileID)
+	}
+}
+
+// workerHeartbeat records that the worker that ctx belongs to is making
+// progress, without changing its state.
+func workerHeartbeat(ctx context.Context) {
+	if w, ok := ctx.Value(workerCtxKey{}).(*replicationWorker); ok {
+		w.health.beat()
+	}
+}
+
+// GetWorkerStatus returns the state of each of the replication workers.
+func (c *Controller) GetWorkerStatus() []filedata.WorkerStatus {
+	c.poolMu.Lock()
+	pools := c.pools
+	c.poolMu.Unlock()
+	result := make([]filedata.WorkerStatus, 0)
+	for _, pool := range pools {
+		for _, w := range pool.snapshot() {
+			w.health.mu.Lock()
+			result = append(result, filedata.WorkerStatus{
+				Pool:          pool.name,
+				ID:            w.id,
+				State:         string(w.health.state),
+				FileID:        w.health.fileID,
+				StateSince:    w.health.stateSince.UnixMicro(),
+				LastHeartbeat: w.health.lastHeartbeat.UnixMicro(),
+			})
+			w.health.mu.Unlock()
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Pool != result[j].Pool {
+			return result[i].Pool < result[j].Pool
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// watchWorkers periodically looks for workers that haven't made progress in
+// replication.file-data.watchdog.threshold and logs a warning for them. If
+// replication.file-data.watchdog.respawn is set, such workers are also
+// cancelled and replaced with fresh ones.
+//
+// Sleeping workers are never considered stuck, since their sleeps are bounded
+// by the backoff, and neither are the workers waiting for replication to be
+// resumed or for the throttle to let them run.
+func (c *Controller) watchWorkers(ctx context.Context) {
+	for sleepWithContext(ctx, watchdogInterval) {
+		threshold := viper.GetDuration("replication.file-data.watchdog.threshold")
+		if threshold <= 0 {
+			threshold = defaultWatchdogThreshold
+		}
+		respawn := viper.GetBool("replication.file-data.watchdog.respawn")
+		c.poolMu.Lock()
+		pools := c.pools
+		c.poolMu.Unlock()
+		for _, pool := range pools {
+			for _, w := range pool.snapshot() {
+				w.health.mu.Lock()
+				state, fileID, since := w.health.state, w.health.fileID, time.Since(w.health.lastHeartbeat)
+				w.health.mu.Unlock()
+				if state == workerSleeping || state == workerPaused || state == workerThrottled || state == workerMaintenance || since < threshold {
+					continue
+				}
+				logger := log.WithFields(log.Fields{
+					"pool":    pool.name,
+					"worker":  w.id,
+					"state":   state,
+					"file_id": fileID,
+				})
+				logger.Warnf("File data replication worker has not made progress in %s", since.Round(time.Second))
+				if respawn {
+					logger.Warn("Replacing wedged file data replication worker")
+					pool.replace(w, c.replicate)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package filedata
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultHistoryFlushInterval = 10 * time.Second
+	defaultHistoryRetention     = 30 * 24 * time.Hour
+	historyBufferSize           = 1000
+	historyFlushBatchSize       = 500
+	historyPruneInterval        = time.Hour
+	historyPruneBatchSize       = 10000
+)
+
+type transferCtxKey struct{}
+
+// transferStats are the object transfers made while replicating a row.
+type transferStats struct {
+	// bytes downloaded and uploaded
+	bytes atomic.Int64
+	mu    sync.Mutex
+	// buckets that the object was copied to server side
+	copied []string
+	// bucket that the object was read from, if it was downloaded
+	source string
+	// bytes copied along each route
+	routes map[transferRoute]int64
+}
+
+// withTransferCount returns a context that records the object transfers made
+// with it into the returned stats.
+func withTransferCount(ctx context.Context) (context.Context, *transferStats) {
+	stats := new(transferStats)
+	return context.WithValue(ctx, transferCtxKey{}, stats), stats
+}
+
+// countTransfer adds n bytes to the stats of ctx, if any.
+func countTransfer(ctx context.Context, n int) {
+	if stats, ok := ctx.Value(transferCtxKey{}).(*transferStats); ok {
+		stats.bytes.Add(int64(n))
+	}
+}
+
+// countServerSideCopy records in the stats of ctx, if any, that the object was
+// copied to bucketID server side.
+func countServerSideCopy(ctx context.Context, bucketID string) {
+	if stats, ok := ctx.Value(transferCtxKey{}).(*transferStats); ok {
+		stats.mu.Lock()
+		stats.copied = append(stats.copied, bucketID)
+		stats.mu.Unlock()
+	}
+}
+
+func (s *transferStats) copiedBuckets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := append([]string{}, s.copied...)
+	sort.Strings(copied)
+	return copied
+}
+
+// historyRecorder buffers the records of completed replications, which are
+// written to the history table in batches by run, so that the workers never
+// wait for them. Records are dropped if the buffer is full.
+type historyRecorder struct {
+	records chan filedata.ReplicationRecord
+}
+
+// configureHistory enables the replication history if
+// replication.file-data.history.enabled is set.
+func (c *Controller) configureHistory() {
+	if viper.GetBool("replication.file-data.history.enabled") {
+		c.history = &historyRecorder{records: make(chan filedata.ReplicationRecord, historyBufferSize)}
+	}
+}
+
+// recordHistory queues the record of a completed replication, if the history is
+// enabled.
+func (c *Controller) recordHistory(row filedata.Row, buckets []string, stats *transferStats, start time.Time) {
+	if c.history == nil {
+		return
+	}
+	rec := filedata.ReplicationRecord{
+		FileID:        row.FileID,
+		Type:          row.Type,
+		SourceBucket:  stats.sourceBucket(row.LatestBucket),
+		DestBuckets:   buckets,
+		CopiedBuckets: stats.copiedBuckets(),
+		Routes:        stats.routeTransfers(),
+		Bytes:         stats.bytes.Load(),
+		DurationMs:    time.Since(start).Milliseconds(),
+		Attempts:      row.AttemptCount + 1,
+		ReplicatedAt:  time.Now().UnixMicro(),
+	}
+	select {
+	case c.history.records <- rec:
+	default:
+		mHistoryDropped.Inc()
+	}
+}
+
+// writeHistory writes the queued records every
+// replication.file-data.history.flush-interval, and prunes the records older
+// than replication.file-data.history.retention, until ctx is cancelled.
+func (c *Controller) writeHistory(ctx context.Context) {
+	interval := viper.GetDuration("replication.file-data.history.flush-interval")
+	if interval <= 0 {
+		interval = defaultHistoryFlushInterval
+	}
+	retention := viper.GetDuration("replication.file-data.history.retention")
+	if retention <= 0 {
+		retention = defaultHistoryRetention
+	}
+	flushTicker := time.NewTicker(interval)
+	defer flushTicker.Stop()
+	pruneTicker := time.NewTicker(historyPruneInterval)
+	defer pruneTicker.Stop()
+	batch := make([]filedata.ReplicationRecord, 0, historyFlushBatchSize)
+	flush := func(ctx context.Context) {
+		if err := c.Repo.InsertReplicationHistory(ctx, batch); err != nil {
+			log.Errorf("Could not write %d file data replication history records: %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// Write what has been buffered so far before stopping
+			for len(c.history.records) > 0 && len(batch) < historyFlushBatchSize {
+				batch = append(batch, <-c.history.records)
+			}
+			flush(context.WithoutCancel(ctx))
+			return
+		case rec := <-c.history.records:
+			batch = append(batch, rec)
+			if len(batch) >= historyFlushBatchSize {
+				flush(ctx)
+			}
+		case <-flushTicker.C:
+			flush(ctx)
+		case <-pruneTicker.C:
+			before := time.Now().Add(-retention).UnixMicro()
+			if n, err := c.Repo.PruneReplicationHistory(ctx, before, historyPruneBatchSize); err != nil {
+				log.Errorf("Could not prune file data replication history: %s", err)
+			} else if n > 0 {
+				log.Infof("Pruned %d file data replication history records", n)
+			}
+		}
+	}
+}
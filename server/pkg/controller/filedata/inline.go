@@ -0,0 +1,200 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultInlineMinReplicas = 1
+	defaultInlineTimeout     = 10 * time.Second
+)
+
+// Outcomes of an inline replication, as counted in mInlineReplications.
+const (
+	inlineMet   = "met"
+	inlineUnmet = "unmet"
+)
+
+// errInlineReplicasUnmet is returned by ReplicateInline when the object
+// couldn't be copied to the required number of replicas in time.
+var errInlineReplicasUnmet = errors.New("required replicas not met")
+
+// inlineReplicated reports whether the uploads of the type are replicated
+// inline, i.e. whether the type is listed in replication.file-data.inline.types.
+func inlineReplicated(oType ente.ObjectType) bool {
+	return array.StringInList(string(oType), viper.GetStringSlice("replication.file-data.inline.types"))
+}
+
+// inlineMinReplicas returns replication.file-data.inline.min-replicas, the
+// number of replicas that an upload of an inline type must be in before it is
+// acknowledged.
+func inlineMinReplicas() int {
+	if n := viper.GetInt("replication.file-data.inline.min-replicas"); n > 0 {
+		return n
+	}
+	return defaultInlineMinReplicas
+}
+
+// inlineTimeout returns replication.file-data.inline.timeout, how long an
+// upload of an inline type may wait for its replicas.
+func inlineTimeout() time.Duration {
+	if d := viper.GetDuration("replication.file-data.inline.timeout"); d > 0 {
+		return d
+	}
+	return defaultInlineTimeout
+}
+
+// ReplicateInline copies the object of a row that has just been uploaded to
+// minReplicas of its replica buckets before returning, for uploads that must
+// not be acknowledged until they are durable in more than one place. It gives up
+// after replication.file-data.inline.timeout.
+//
+// The row is locked the same way the workers lock it, taking over the delay
+// that InsertOrUpdate puts on new rows, and the buckets are copied to with the
+// same per bucket logic as replicateRowData, in the order of the replicas of
+// the type. Once minReplicas of them succeed, or the attempt gives up, the row
+// is handed back to the queue, where the workers pick it up right away for the
+// remaining buckets (unless it is already in all of them).
+//
+// It returns the buckets that the row was replicated to, and an error wrapping
+// errInlineReplicasUnmet if those are fewer than minReplicas. The row stays
+// pending either way, so an unmet minimum only delays the copies.
+func (c *Controller) ReplicateInline(ctx context.Context, row filedata.Row, minReplicas int) ([]string, error) {
+	if c.pause.status().Paused {
+		return nil, stacktrace.Propagate(ente.NewConflictError("file data replication is paused"), "")
+	}
+	timeout := inlineTimeout()
+	newLockTime := time.Now().Add(max(newLockPolicy().min, timeout)).UnixMicro()
+	locked, err := c.Repo.LockUploadedForReplication(ctx, row.FileID, row.Type, newLockTime)
+	if err != nil {
+		if isLockConflict(err) {
+			mLockContention.WithLabelValues(lockOpLock).Inc()
+		}
+		return nil, stacktrace.Propagate(err, "")
+	}
+	workCtx, cancel := context.WithTimeout(forReplication(ctx), timeout)
+	defer cancel()
+	replicated, done, err := c.replicateInline(workCtx, *locked, minReplicas)
+	outcome := inlineMet
+	if err != nil {
+		outcome = inlineUnmet
+	}
+	mInlineReplications.WithLabelValues(string(row.Type), outcome).Inc()
+	logger := log.WithFields(log.Fields{
+		"file_id": row.FileID,
+		"type":    row.Type,
+		"buckets": replicated,
+	})
+	if done {
+		c.resetLockAfterSuccess(ctx, *locked, newLockTime)
+	} else if lockErr := c.Repo.ReleaseSyncLock(context.WithoutCancel(ctx), *locked, newLockTime, time.Now().UnixMicro()); lockErr != nil {
+		logger.WithError(lockErr).Warn("Could not hand inline replicated file data back to the queue, it will be picked up once its lock expires")
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Inline replication did not reach the required replicas")
+		return replicated, err
+	}
+	logger.Info("Replicated file data inline")
+	return replicated, nil
+}
+
+// replicateInline copies the row to its pending buckets until it is in
+// minReplicas of them, a few at a time so that a failed bucket is replaced by
+// the next one. It returns the wanted buckets that the row is in, other than
+// its latest bucket, and whether the row was marked as replicated because none
+// were left.
+func (c *Controller) replicateInline(ctx context.Context, row filedata.Row, minReplicas int) ([]string, bool, error) {
+	candidates := c.inlineCandidates(row)
+	replicated := c.replicatedCopies(row)
+	var errs []error
+	for len(replicated) < minReplicas && len(candidates) > 0 && ctx.Err() == nil {
+		n := min(minReplicas-len(replicated), len(candidates))
+		batch := map[string]bool{}
+		for _, bucketID := range candidates[:n] {
+			batch[bucketID] = true
+		}
+		candidates = candidates[n:]
+		if err := c.replicateToBuckets(ctx, row, batch); err != nil {
+			errs = append(errs, err)
+		}
+		var err error
+		row, err = c.loadProgress(ctx, row)
+		if err != nil {
+			return replicated, false, stacktrace.Propagate(err, "")
+		}
+		replicated = c.replicatedCopies(row)
+	}
+	if len(replicated) < minReplicas {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+		}
+		return replicated, false, stacktrace.Propagate(fmt.Errorf("replicated to %d of %d required replicas: %w (%w)",
+			len(replicated), minReplicas, errInlineReplicasUnmet, errors.Join(errs...)), "")
+	}
+	if len(c.pendingBuckets(row)) > 0 {
+		return replicated, false, nil
+	}
+	if err := c.markReplicationAsDone(ctx, row, replicated); err != nil {
+		// The copies are there regardless, the workers mark the row later
+		log.WithError(err).WithField("file_id", row.FileID).Warn("Could not mark inline replicated file data as replicated")
+		return replicated, false, nil
+	}
+	c.lastReplicatedAt.Store(time.Now().UnixMicro())
+	return replicated, true, nil
+}
+
+// inlineCandidates returns the buckets that the row is pending in, except the
+// best-effort and disabled ones, in the order of the replicas of its type, with
+// the primary bucket last.
+func (c *Controller) inlineCandidates(row filedata.Row) []string {
+	pending := c.pendingBuckets(row)
+	c.deferBestEffortBuckets(row, pending)
+	for bucketID := range pending {
+		if c.disabledBuckets.isDisabled(bucketID) {
+			delete(pending, bucketID)
+		}
+	}
+	var candidates []string
+	for _, bucketID := range c.replicaBuckets(row) {
+		if pending[bucketID] && !slices.Contains(candidates, bucketID) {
+			candidates = append(candidates, bucketID)
+		}
+	}
+	var rest []string
+	for bucketID := range pending {
+		if !slices.Contains(candidates, bucketID) {
+			rest = append(rest, bucketID)
+		}
+	}
+	sort.Strings(rest)
+	return append(candidates, rest...)
+}
+
+// replicatedCopies returns the buckets that the row should be in and has been
+// replicated to, other than its latest bucket.
+func (c *Controller) replicatedCopies(row filedata.Row) []string {
+	wanted := map[string]bool{c.S3Config.GetBucketID(row.Type): true}
+	for _, bucketID := range c.replicaBuckets(row) {
+		wanted[bucketID] = true
+	}
+	var copies []string
+	for _, bucketID := range row.ReplicatedBuckets {
+		if wanted[bucketID] && bucketID != row.LatestBucket && !slices.Contains(copies, bucketID) {
+			copies = append(copies, bucketID)
+		}
+	}
+	sort.Strings(copies)
+	return copies
+}
@@ -0,0 +1,89 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+)
+
+// InspectRow returns everything that is known about the replication of a
+// single file's data of the given type: the row as it is in the database, the
+// buckets that replication wants it in, and what each relevant bucket
+// actually has.
+func (c *Controller) InspectRow(ctx context.Context, fileID int64, oType ente.ObjectType) (*filedata.RowReplicationState, error) {
+	if !isReplicatedType(oType) {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("unsupported type "+string(oType)), "")
+	}
+	rows, err := c.Repo.GetFilesData(ctx, oType, []int64{fileID})
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	if len(rows) == 0 {
+		return nil, stacktrace.Propagate(ente.ErrNotFound, "no file data for file %d and type %s", fileID, oType)
+	}
+	row := rows[0]
+	lastError, lastErrorAt, err := c.Repo.GetLastReplicationError(ctx, fileID, oType)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	wanted := c.rowBuckets(row)
+	state := &filedata.RowReplicationState{
+		FileID:            row.FileID,
+		UserID:            row.UserID,
+		Type:              row.Type,
+		Size:              row.Size,
+		LatestBucket:      row.LatestBucket,
+		ReplicatedBuckets: row.ReplicatedBuckets,
+		InflightReplicas:  row.InflightReplicas,
+		DeleteFromBuckets: row.DeleteFromBuckets,
+		CompressedBuckets: row.CompressedBuckets,
+		ReplicaOverride:   row.ReplicaOverride,
+		PendingSync:       row.PendingSync,
+		IsDeleted:         row.IsDeleted,
+		IsDeadLettered:    row.IsDeadLettered,
+		AttemptCount:      row.AttemptCount,
+		LastError:         lastError,
+		LastErrorAt:       lastErrorAt,
+		SyncLockedTill:    row.SyncLockedTill,
+		Locked:            row.SyncLockedTill > time.Now().UnixMicro(),
+		LockHolder:        row.LockHolder(),
+		CreatedAt:         row.CreatedAt,
+		UpdatedAt:         row.UpdatedAt,
+		WantedBuckets:     sortedKeys(wanted),
+		PendingBuckets:    sortedKeys(c.pendingBuckets(row)),
+	}
+	relevant := map[string]bool{row.LatestBucket: true}
+	for _, buckets := range [][]string{state.WantedBuckets, row.ReplicatedBuckets, row.InflightReplicas, row.DeleteFromBuckets} {
+		for _, bucketID := range buckets {
+			relevant[bucketID] = true
+		}
+	}
+	objectKey := row.S3FileMetadataObjectKey()
+	for _, bucketID := range sortedKeys(relevant) {
+		object := filedata.BucketObjectState{Bucket: bucketID}
+		info, err := c.headVersion(ctx, objectKey, bucketID, replicaVersion(row, bucketID))
+		switch {
+		case err == nil:
+			object.Present, object.Size, object.ETag, object.VersionID = true, info.Size, info.ETag, info.VersionID
+		case !errors.Is(err, objectstore.ErrNotFound):
+			object.Error = err.Error()
+		}
+		state.Objects = append(state.Objects, object)
+	}
+	return state, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
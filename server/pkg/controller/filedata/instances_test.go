@@ -0,0 +1,161 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+)
+
+// openTestDatabase connects to the test database (like the repo tests, see
+// pkg/repo/storagebonus), and brings it up to date with the migrations.
+func openTestDatabase(tb testing.TB) *sql.DB {
+	db, err := sql.Open("postgres", "user=test_user password=test_pass host=localhost dbname=ente_test_db sslmode=disable")
+	if err != nil {
+		tb.Fatalf("error connecting to test database: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		tb.Fatalf("error creating postgres driver: %v", err)
+	}
+	cwd, _ := os.Getwd()
+	cwd = strings.Split(cwd, "/pkg/")[0]
+	mig, err := migrate.NewWithDatabaseInstance("file://"+filepath.Join(cwd, "migrations"), "ente_test_db", driver)
+	if err != nil {
+		tb.Fatalf("error creating migrations: %v", err)
+	}
+	if err := mig.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		tb.Fatalf("error running migrations: %v", err)
+	}
+	return db
+}
+
+func TestLockHolder(t *testing.T) {
+	token := func(s string) *string { return &s }
+	tests := []struct {
+		token *string
+		want  string
+	}{
+		{nil, ""},
+		// Taken before the instance IDs were recorded
+		{token("5b7f1c1e-7a8e-4a53-9d0c-9e1f6b2d3c4a"), ""},
+		{token("museum-1-0a1b2c3d/5b7f1c1e-7a8e-4a53-9d0c-9e1f6b2d3c4a"), "museum-1-0a1b2c3d"},
+	}
+	for _, tt := range tests {
+		row := filedata.Row{LockToken: tt.token}
+		if got := row.LockHolder(); got != tt.want {
+			t.Errorf("LockHolder() of %v = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
+
+// TestInstancesReplicateOnce has two instances, each with its own copy of the
+// buckets in memory, replicate the same rows from one database, so that a row
+// that both replicated would end up in the replicas of both.
+func TestInstancesReplicateOnce(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	instanceIDs := []string{"instance-a", "instance-b"}
+	instances := make(map[string]*Controller, len(instanceIDs))
+	for _, id := range instanceIDs {
+		c := newTestController(t)
+		instances[id] = New(&fileDataRepo.Repository{DB: db, InstanceID: id}, nil, nil, c.S3Config, nil, nil)
+	}
+	const count = 50
+	// New file IDs in every run, away from the other test data
+	first := int64(3)<<40 + time.Now().UnixMicro()%(1<<39)
+	var rows []filedata.Row
+	for i := int64(0); i < count; i++ {
+		row := filedata.Row{FileID: first + i, UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+		obj := filedata.S3FileMetadata{Version: 1, EncryptedData: fmt.Sprintf("data of %d", i), DecryptionHeader: "header"}
+		obj.Checksum = obj.ContentChecksum()
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range instances {
+			source := c.S3Config.GetObjectStore(row.LatestBucket)
+			if _, err := source.Put(ctx, row.S3FileMetadataObjectKey(), bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checksum := checksumOf(data)
+		row.Size = int64(len(data))
+		row.Checksum = &checksum
+		if err := instances[instanceIDs[0]].Repo.InsertOrUpdate(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	// Rows are inserted locked for a few minutes, see InsertOrUpdate
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0 WHERE file_id >= $1 AND file_id < $2`, first, first+count); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}}
+	var wg sync.WaitGroup
+	for _, c := range instances {
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					err := c.tryReplicate(ctx, filter)
+					if !errors.Is(err, sql.ErrNoRows) {
+						continue
+					}
+					var pending int
+					if err := db.QueryRowContext(ctx, `SELECT count(*) FROM file_data WHERE pending_sync = true AND file_id >= $1 AND file_id < $2`,
+						first, first+count).Scan(&pending); err != nil || pending == 0 {
+						return
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		t.Fatal("rows were still pending after a minute")
+	}
+
+	for _, row := range rows {
+		var token string
+		if err := db.QueryRowContext(ctx, `SELECT lock_token FROM file_data WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type)).Scan(&token); err != nil {
+			t.Fatal(err)
+		}
+		row.LockToken = &token
+		for _, dst := range []string{"b5", "b6"} {
+			var replicatedBy []string
+			for _, id := range instanceIDs {
+				if _, err := instances[id].S3Config.GetObjectStore(dst).Head(ctx, row.S3FileMetadataObjectKey()); err == nil {
+					replicatedBy = append(replicatedBy, id)
+				}
+			}
+			if len(replicatedBy) != 1 || replicatedBy[0] != row.LockHolder() {
+				t.Errorf("file %d was replicated to %s by %v, want only the lock holder %s", row.FileID, dst, replicatedBy, row.LockHolder())
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package filedata
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+// The background jobs whose object store and database requests are limited
+// separately from replication, see jobLimiter.
+const (
+	jobAudit     = "audit"
+	jobReconcile = "reconcile"
+)
+
+const defaultAuditConcurrency = 1
+
+// jobLimiter limits the requests of a run of a background job to perSecond,
+// with no bursts, so that the job doesn't eat into the request budget that the
+// object stores have for live replication.
+//
+// While the adaptive throttle is limiting the replication workers, because the
+// object stores look distressed, the rate is scaled down by the same share, so
+// that the job yields to replication until the stores recover.
+type jobLimiter struct {
+	job       string
+	perSecond rate.Limit
+	limiter   *rate.Limiter
+	throttle  *adaptiveThrottle
+}
+
+func (c *Controller) newJobLimiter(job string, perSecond float64) *jobLimiter {
+	mJobRequestRate.WithLabelValues(job).Set(perSecond)
+	return &jobLimiter{
+		job:       job,
+		perSecond: rate.Limit(perSecond),
+		limiter:   rate.NewLimiter(rate.Limit(perSecond), 1),
+		throttle:  c.throttle,
+	}
+}
+
+// Wait blocks until the job may make its next request, or ctx is done.
+func (l *jobLimiter) Wait(ctx context.Context) error {
+	limit := l.perSecond * rate.Limit(l.throttle.share())
+	if limit != l.limiter.Limit() {
+		if limit < l.limiter.Limit() {
+			log.Infof("Object stores look distressed, slowing file data %s down to %.2f requests per second", l.job, float64(limit))
+		}
+		l.limiter.SetLimit(limit)
+		mJobRequestRate.WithLabelValues(l.job).Set(float64(limit))
+	}
+	if err := l.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	mJobRequests.WithLabelValues(l.job).Inc()
+	return nil
+}
+
+// jobSlots caps the number of runs of each background job that may be in
+// progress at the same time on this instance.
+type jobSlots struct {
+	mu      sync.Mutex
+	running map[string]int
+}
+
+// acquire takes a slot for a run of the job, failing with a conflict if limit
+// runs are already in progress. Every successful acquire must be followed by
+// a release.
+func (s *jobSlots) acquire(job string, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == nil {
+		s.running = map[string]int{}
+	}
+	if s.running[job] >= limit {
+		return stacktrace.Propagate(ente.NewConflictError("too many file data "+job+" runs in progress, try again later"), "")
+	}
+	s.running[job]++
+	return nil
+}
+
+func (s *jobSlots) release(job string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[job]--
+}
+
+// auditConcurrency returns replication.file-data.audit.concurrency, the number
+// of audits that may run at the same time on this instance.
+func auditConcurrency() int {
+	if n := viper.GetInt("replication.file-data.audit.concurrency"); n > 0 {
+		return n
+	}
+	return defaultAuditConcurrency
+}
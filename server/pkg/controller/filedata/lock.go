@@ -0,0 +1,575 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultLockMin    = 30 * time.Minute
+	defaultLockMax    = 240 * time.Minute
+	defaultLockPerMiB = 1 * time.Minute
+	// defaultReclaimAfter is how long a locked row may go without a heartbeat
+	// from its lock holder before it is considered abandoned, plus
+	// defaultReclaimPerMiB for each MiB of the row's size.
+	defaultReclaimAfter       = 15 * time.Minute
+	defaultReclaimPerMiB      = 15 * time.Second
+	defaultLockHeartbeatEvery = 1 * time.Minute
+	// minimumHeartbeatsMissed is the number of heartbeats that must be missed
+	// before a row can be reclaimed, so that a slow database doesn't make a
+	// live worker look dead.
+	minimumHeartbeatsMissed = 3
+	// minimumLock is the smallest lock we take, GetPendingSyncDataAndExtendLock
+	// requires the lock to be at least 5 minutes in the future.
+	minimumLock = 10 * time.Minute
+	// defaultTimeoutMin and defaultTimeoutMax clamp the time that replicating
+	// a row may take, which is otherwise its size divided by
+	// defaultExpectedThroughput.
+	defaultTimeoutMin         = 2 * time.Minute
+	defaultTimeoutMax         = 120 * time.Minute
+	defaultExpectedThroughput = 1024 * 1024 // bytes per second
+	// defaultDestinationTimeoutMin and defaultDestinationTimeoutMax clamp the
+	// time that uploading a row to a single destination bucket may take
+	defaultDestinationTimeoutMin = 1 * time.Minute
+	defaultDestinationTimeoutMax = 30 * time.Minute
+	// lockResetAttempts is how many times the lock of a replicated row is
+	// tried to be reset, lockResetRetryDelay apart (doubling each time)
+	lockResetAttempts   = 4
+	lockResetRetryDelay = 5 * time.Second
+	// defaultHoldAfterTransientFailure is how long a row that failed with a
+	// transient error stays locked, while rows that failed with any other
+	// error that they will be retried after are held for as long as the
+	// worker backs off, see holdAfterFailure
+	defaultHoldAfterTransientFailure = 2 * time.Minute
+)
+
+// lockPolicy decides how long a row stays locked by the worker replicating it.
+//
+// The lock is proportional to the size of the row, min plus per-mib for each
+// MiB, capped at max. A short lock lets another worker pick the row up soon if
+// the worker replicating it dies, while a long enough lock ensures that a slow
+// upload of a large object is not raced by another worker.
+//
+// The holder of a lock also sends a heartbeat every heartbeatEvery. If the
+// holder dies, the row is reclaimed by another worker once the heartbeat is
+// older than reclaimAfter plus reclaimPerMiB for each MiB, without waiting for
+// the rest of the lock to run out. A reclaimAfter of 0 disables this.
+//
+// The work on a row is given the time it takes to transfer the row at
+// expectedThroughput, clamped to timeoutMin and timeoutMax, so that a small
+// object stuck on a hung connection fails fast and is retried. The upload to
+// each destination bucket is in turn given that time clamped to
+// destinationTimeoutMin and destinationTimeoutMax, see destinationTimeout, so
+// that one slow bucket doesn't use up the time of the others.
+//
+// Once the work on a row fails, its lock is shortened to what the kind of
+// failure calls for, see holdAfterFailure, instead of being kept till it runs
+// out.
+//
+// If renew is set, the lock of the row being worked on is extended by its
+// duration every quarter of it (with some jitter), so that the work on a row
+// isn't limited by the lock, which still runs out soon after its holder dies.
+type lockPolicy struct {
+	min    time.Duration
+	max    time.Duration
+	perMiB time.Duration
+
+	heartbeatEvery time.Duration
+	reclaimAfter   time.Duration
+	reclaimPerMiB  time.Duration
+
+	timeoutMin         time.Duration
+	timeoutMax         time.Duration
+	expectedThroughput int64
+
+	destinationTimeoutMin time.Duration
+	destinationTimeoutMax time.Duration
+
+	holdAfterTransient  time.Duration
+	holdAfterOther      time.Duration
+	holdAfterPermission time.Duration
+
+	// renew extends the lock of the row being replicated while the work on it
+	// is in progress, see renewLock
+	renew bool
+}
+
+func newLockPolicy() lockPolicy {
+	p := lockPolicy{
+		min:    viper.GetDuration("replication.file-data.lock.min"),
+		max:    viper.GetDuration("replication.file-data.lock.max"),
+		perMiB: viper.GetDuration("replication.file-data.lock.per-mib"),
+	}
+	if p.min <= 0 {
+		p.min = defaultLockMin
+	}
+	if p.min < minimumLock {
+		p.min = minimumLock
+	}
+	if p.max <= 0 {
+		p.max = defaultLockMax
+	}
+	if p.max < p.min {
+		p.max = p.min
+	}
+	if p.perMiB <= 0 {
+		p.perMiB = defaultLockPerMiB
+	}
+	p.heartbeatEvery = viper.GetDuration("replication.file-data.lock.heartbeat-interval")
+	if p.heartbeatEvery <= 0 {
+		p.heartbeatEvery = defaultLockHeartbeatEvery
+	}
+	p.timeoutMin = viper.GetDuration("replication.file-data.timeout.min")
+	if p.timeoutMin <= 0 {
+		p.timeoutMin = defaultTimeoutMin
+	}
+	p.timeoutMax = viper.GetDuration("replication.file-data.timeout.max")
+	if p.timeoutMax <= 0 {
+		p.timeoutMax = defaultTimeoutMax
+	}
+	if p.timeoutMax < p.timeoutMin {
+		p.timeoutMax = p.timeoutMin
+	}
+	p.expectedThroughput = viper.GetInt64("replication.file-data.timeout.expected-throughput-bytes")
+	if p.expectedThroughput <= 0 {
+		p.expectedThroughput = defaultExpectedThroughput
+	}
+	p.destinationTimeoutMin = viper.GetDuration("replication.file-data.timeout.destination-min")
+	if p.destinationTimeoutMin <= 0 {
+		p.destinationTimeoutMin = defaultDestinationTimeoutMin
+	}
+	p.destinationTimeoutMax = viper.GetDuration("replication.file-data.timeout.destination-max")
+	if p.destinationTimeoutMax <= 0 {
+		p.destinationTimeoutMax = defaultDestinationTimeoutMax
+	}
+	if p.destinationTimeoutMax < p.destinationTimeoutMin {
+		p.destinationTimeoutMax = p.destinationTimeoutMin
+	}
+	p.holdAfterTransient = defaultHoldAfterTransientFailure
+	if viper.IsSet("replication.file-data.lock.hold-after-transient-failure") {
+		p.holdAfterTransient = max(viper.GetDuration("replication.file-data.lock.hold-after-transient-failure"), 0)
+	}
+	b := newReplicationBackoff()
+	p.holdAfterOther, p.holdAfterPermission = b.base, b.max
+	if viper.IsSet("replication.file-data.lock.hold-after-failure") {
+		p.holdAfterOther = max(viper.GetDuration("replication.file-data.lock.hold-after-failure"), 0)
+		p.holdAfterPermission = p.holdAfterOther
+	}
+	p.renew = !viper.IsSet("replication.file-data.lock.renew") || viper.GetBool("replication.file-data.lock.renew")
+	if viper.IsSet("replication.file-data.lock.reclaim") && !viper.GetBool("replication.file-data.lock.reclaim") {
+		return p
+	}
+	p.reclaimAfter = viper.GetDuration("replication.file-data.lock.reclaim-after")
+	if p.reclaimAfter <= 0 {
+		p.reclaimAfter = defaultReclaimAfter
+	}
+	if p.reclaimAfter < minimumHeartbeatsMissed*p.heartbeatEvery {
+		p.reclaimAfter = minimumHeartbeatsMissed * p.heartbeatEvery
+	}
+	p.reclaimPerMiB = viper.GetDuration("replication.file-data.lock.reclaim-per-mib")
+	if p.reclaimPerMiB <= 0 {
+		p.reclaimPerMiB = defaultReclaimPerMiB
+	}
+	return p
+}
+
+// withReclaim makes filter also pick up rows that the policy considers
+// abandoned by their lock holder.
+func (p lockPolicy) withReclaim(filter fileDataRepo.PendingSyncFilter) fileDataRepo.PendingSyncFilter {
+	filter.ReclaimAfter = p.reclaimAfter
+	filter.ReclaimPerMiB = p.reclaimPerMiB
+	return filter
+}
+
+// durationFor returns the lock duration for a row of the given size.
+func (p lockPolicy) durationFor(size int64) time.Duration {
+	mib := size / (1024 * 1024)
+	if mib > int64(p.max/p.perMiB) {
+		return p.max
+	}
+	d := p.min + time.Duration(mib)*p.perMiB
+	if d > p.max {
+		return p.max
+	}
+	return d
+}
+
+// workTimeout is how long replicating a row of the given size may take when it
+// is locked for lock. It is the time to transfer the row at the expected
+// throughput, clamped to the policy's timeout bounds. Unless the lock is
+// renewed while the work is in progress, it is never more than half of the
+// lock either, so that the work is always abandoned well before the lock
+// expires and another worker can pick the row up.
+func (p lockPolicy) workTimeout(size int64, lock time.Duration) time.Duration {
+	d := p.timeoutMax
+	if seconds := size / p.expectedThroughput; seconds < int64(p.timeoutMax/time.Second) {
+		d = max(time.Duration(seconds)*time.Second, p.timeoutMin)
+	}
+	if p.renew {
+		return d
+	}
+	return min(d, lock/2)
+}
+
+// workContext returns the context that the work on a row of the given size,
+// locked for lock, is done in. It is done once the workTimeout has been spent
+// on the work, not counting the waits for the limits of the instance (see
+// workBudget), which don't take the work past half of the lock either unless
+// the lock is renewed.
+func (p lockPolicy) workContext(ctx context.Context, size int64, lock time.Duration) (context.Context, context.CancelFunc) {
+	limit := lock / 2
+	if p.renew {
+		limit = 0
+	}
+	return withWorkBudget(ctx, p.workTimeout(size, lock), limit)
+}
+
+// destinationTimeout is how long uploading a row of the given size to a single
+// destination bucket may take, when the work on the whole row has to be done by
+// deadline (if ok). It is the time to transfer the row at the expected
+// throughput, clamped to the policy's destination timeout bounds, and always
+// less than what is left till the deadline, so that a destination that is too
+// slow fails on its own instead of the whole row timing out.
+func (p lockPolicy) destinationTimeout(size int64, deadline time.Time, ok bool) time.Duration {
+	d := p.destinationTimeoutMax
+	if seconds := size / p.expectedThroughput; seconds < int64(p.destinationTimeoutMax/time.Second) {
+		d = max(time.Duration(seconds)*time.Second, p.destinationTimeoutMin)
+	}
+	if ok {
+		left := time.Until(deadline)
+		d = min(d, left-left/10)
+	}
+	return d
+}
+
+// extendLockForRow extends the lock on row, currently held till heldLockTill, to
+// the duration that the policy gives for the row's size. It returns the new
+// lock time along with the lock duration.
+func (c *Controller) extendLockForRow(ctx context.Context, policy lockPolicy, row filedata.Row, heldLockTill int64) (int64, time.Duration, error) {
+	lock := policy.durationFor(row.Size)
+	if lock <= policy.min {
+		return heldLockTill, policy.min, nil
+	}
+	extendedLockTime := time.Now().Add(lock).UnixMicro()
+	if err := c.Repo.UpdateSyncLock(ctx, row, heldLockTill, extendedLockTime); err != nil {
+		mLockContention.WithLabelValues(lockOpExtend).Inc()
+		return 0, 0, stacktrace.Propagate(err, "failed to extend lock")
+	}
+	return extendedLockTime, lock, nil
+}
+
+// holdAfterFailure returns how long a row that failed with class stays locked.
+//
+// A transient failure, e.g. a store that is briefly unavailable, is likely to
+// recur if the row is retried right away, so its lock is kept for a little
+// while. The rows that failed otherwise are held as long as failureDelay has
+// the worker back off after them, unless replication.file-data.lock.hold-after-failure
+// is set: the base delay, or the maximum one after a permission failure, which
+// needs someone to fix the credentials. A row that has been dead lettered
+// won't be picked up anyway, so it is released right away.
+func (p lockPolicy) holdAfterFailure(class ReplicationErrorClass) time.Duration {
+	switch {
+	case class.permanent():
+		return 0
+	case class == ErrTransient:
+		return p.holdAfterTransient
+	case class == ErrPermission:
+		return p.holdAfterPermission
+	default:
+		return p.holdAfterOther
+	}
+}
+
+// releaseLockAfterFailure shortens the lock of a row whose replication failed
+// with class, held till heldLockTill, see holdAfterFailure. If that fails, the
+// lock just runs out on its own.
+func (c *Controller) releaseLockAfterFailure(ctx context.Context, policy lockPolicy, row filedata.Row, heldLockTill int64, class ReplicationErrorClass) {
+	// A lock that the hold would outlast is kept as it is, but still released
+	newLockTill := min(time.Now().Add(policy.holdAfterFailure(class)).UnixMicro(), heldLockTill)
+	if err := c.Repo.ReleaseSyncLock(context.WithoutCancel(ctx), row, heldLockTill, newLockTill); err != nil {
+		log.WithFields(log.Fields{
+			"file_id": row.FileID,
+			"type":    row.Type,
+		}).WithError(err).Warn("Could not release the lock of file data after a failed replication, it will expire on its own")
+	}
+}
+
+// resetLockAfterSuccess resets the lock of a row that has been replicated, held
+// till heldLockTill, so that the row can be picked up again right away if it is
+// changed. A failure to do so is not a failure of the replication: the reset
+// is retried in the background (except during a ReplicateOnce call), and if
+// that doesn't work out either the lock just expires on its own. The retries
+// of a worker's reset count as the work of its pool, which shutdown waits for,
+// and are given up once the pool is shutting down.
+func (c *Controller) resetLockAfterSuccess(ctx context.Context, row filedata.Row, heldLockTill int64) {
+	err := c.Repo.ResetSyncLock(ctx, row, heldLockTill)
+	if err == nil {
+		mLockResets.WithLabelValues(string(row.Type)).Inc()
+		return
+	}
+	mLockResetFailures.WithLabelValues(string(row.Type)).Inc()
+	logger := log.WithFields(log.Fields{
+		"file_id": row.FileID,
+		"type":    row.Type,
+	})
+	if isSynchronous(ctx) {
+		logger.WithError(err).Warn("Could not reset the lock of replicated file data, it will expire on its own")
+		return
+	}
+	logger.WithError(err).Warn("Could not reset the lock of replicated file data, retrying")
+	// Once the worker is done with the row its context is cancelled, so the
+	// retries are stopped by that of its pool instead
+	var stopped <-chan struct{}
+	w, ok := ctx.Value(workerCtxKey{}).(*replicationWorker)
+	if ok {
+		w.pool.wg.Add(1)
+		stopped = w.pool.ctx.Done()
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if ok {
+			defer w.pool.wg.Done()
+		}
+		delay := lockResetRetryDelay
+		for attempt := 2; attempt <= lockResetAttempts; attempt++ {
+			select {
+			case <-time.After(delay):
+			case <-stopped:
+				logger.Warn("Giving up on resetting the lock of replicated file data on shutdown, it will expire on its own")
+				return
+			}
+			delay *= 2
+			if time.Now().UnixMicro() >= heldLockTill {
+				// Expired on its own meanwhile
+				return
+			}
+			if err := c.Repo.ResetSyncLock(ctx, row, heldLockTill); err != nil {
+				mLockResetFailures.WithLabelValues(string(row.Type)).Inc()
+				logger.WithError(err).Warnf("Could not reset the lock of replicated file data (attempt %d/%d)", attempt, lockResetAttempts)
+				continue
+			}
+			mLockResets.WithLabelValues(string(row.Type)).Inc()
+			return
+		}
+		logger.Warn("Giving up on resetting the lock of replicated file data, it will expire on its own")
+	}()
+}
+
+// keepLockAlive sends a heartbeat every policy.heartbeatEvery for the rows
+// locked with lockToken, till the returned function is called (except during
+// a ReplicateOnce call, which sends none). If the lock has been lost, e.g.
+// because the rows were reclaimed by another worker after the database was
+// unreachable for a while, the returned context is cancelled with ErrLockLost
+// as the cause, so that the work on the rows is abandoned.
+func (c *Controller) keepLockAlive(ctx context.Context, policy lockPolicy, lockToken *string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if lockToken == nil || isSynchronous(ctx) {
+		return ctx, func() { cancel(nil) }
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(policy.heartbeatEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := c.Repo.TouchSyncLock(ctx, *lockToken)
+				if errors.Is(err, fileDataRepo.ErrLockLost) {
+					mLockContention.WithLabelValues(lockOpHeartbeat).Inc()
+					cancel(err)
+					return
+				}
+				if err != nil && ctx.Err() == nil {
+					log.WithError(err).Warn("Could not send heartbeat for file data lock")
+				}
+			}
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		cancel(nil)
+	}
+}
+
+// lockRenewal extends the lock of a single row in the background, see renewLock.
+type lockRenewal struct {
+	// till is the time (epoch microseconds) that the row is currently locked
+	// till
+	till    atomic.Int64
+	done    chan struct{}
+	stopped chan struct{}
+	cancel  context.CancelCauseFunc
+}
+
+// renewLock extends the lock on row, currently held till heldLockTill, to lock
+// from now, every quarter of lock give or take a fifth, until stop is called.
+// Nothing is renewed if the policy doesn't ask for it, or during a
+// ReplicateOnce call.
+//
+// If the lock has been lost, the returned context is cancelled with ErrLockLost
+// as the cause, so that the work on the row is abandoned. The caller must call
+// close once it is done with the context.
+func (c *Controller) renewLock(ctx context.Context, policy lockPolicy, row filedata.Row, heldLockTill int64, lock time.Duration) (context.Context, *lockRenewal) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	r := &lockRenewal{done: make(chan struct{}), stopped: make(chan struct{}), cancel: cancel}
+	r.till.Store(heldLockTill)
+	if !policy.renew || isSynchronous(ctx) {
+		close(r.stopped)
+		return ctx, r
+	}
+	go func() {
+		defer close(r.stopped)
+		for {
+			interval := lock / 4
+			interval += time.Duration(rand.Int63n(int64(interval/5)*2+1)) - interval/5
+			timer := time.NewTimer(interval)
+			select {
+			case <-r.done:
+				timer.Stop()
+				return
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			newLockTill := time.Now().Add(lock).UnixMicro()
+			err := c.Repo.RenewSyncLock(ctx, row, r.till.Load(), newLockTill)
+			if errors.Is(err, fileDataRepo.ErrLockLost) {
+				mLockContention.WithLabelValues(lockOpRenew).Inc()
+				cancel(err)
+				return
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.WithFields(log.Fields{
+						"file_id": row.FileID,
+						"type":    row.Type,
+					}).WithError(err).Warn("Could not renew the lock of file data, retrying")
+				}
+				continue
+			}
+			r.till.Store(newLockTill)
+		}
+	}()
+	return ctx, r
+}
+
+// stop stops renewing the lock, and returns the time that the row is locked
+// till. Once it returns, the lock is no longer touched in the background.
+func (r *lockRenewal) stop() int64 {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	<-r.stopped
+	return r.till.Load()
+}
+
+// close stops renewing the lock, and releases the context returned by
+// renewLock.
+func (r *lockRenewal) close() {
+	r.stop()
+	r.cancel(nil)
+}
+
+// noteAbandoned counts the rows that were picked up after their previous lock
+// ran out without its holder releasing it, e.g. because the holder died or its
+// work took longer than the lock. Those are the rows whose lock still has a
+// heartbeat, see Row.LockHeartbeatAt, but has expired (the ones that haven't
+// expired yet are reclaimed, see noteReclaimed).
+func noteAbandoned(rows []filedata.Row) {
+	now := time.Now().UnixMicro()
+	for _, row := range rows {
+		if row.LockHeartbeatAt != nil && row.SyncLockedTill <= now {
+			mLocksAbandoned.WithLabelValues(string(row.Type)).Inc()
+		}
+	}
+}
+
+// Operations on a lock that can find the row held by someone else, as counted
+// in mLockContention.
+const (
+	// lockOpLock is taking the lock of a given row, e.g. to replicate it on
+	// request
+	lockOpLock = "lock"
+	// lockOpExtend is extending a lock that has just been taken to the
+	// duration that the size of the row asks for
+	lockOpExtend = "extend"
+	lockOpRenew  = "renew"
+	// lockOpHeartbeat is a heartbeat that found none of its rows held
+	lockOpHeartbeat = "heartbeat"
+	// lockOpWrite is recording the progress of a row with its lock
+	lockOpWrite = "write"
+)
+
+// noteReclaimed prepares rows that were reclaimed from a lock holder that
+// stopped sending heartbeats. The lock that such a row had is void, so it is
+// treated as expired, and the row is not locked by it again once released.
+func noteReclaimed(rows []filedata.Row) {
+	now := time.Now().UnixMicro()
+	for i := range rows {
+		if rows[i].SyncLockedTill <= now {
+			continue
+		}
+		mLocksReclaimed.WithLabelValues(string(rows[i].Type)).Inc()
+		log.WithFields(log.Fields{
+			"file_id":     rows[i].FileID,
+			"type":        rows[i].Type,
+			"size":        rows[i].Size,
+			"locked_till": time.UnixMicro(rows[i].SyncLockedTill),
+		}).Warn("Reclaimed file data whose lock holder stopped sending heartbeats")
+		rows[i].SyncLockedTill = now
+	}
+}
+
+// withBorrowedLock locks the live row for d, the same way that replication
+// locks it, and calls fn with the locked row. The lock that the row had before
+// is put back once fn returns, so that the row is left for the replication
+// workers just as it was (or as fn left it).
+//
+// It returns locked as true, without calling fn, if the row couldn't be locked
+// because someone else (e.g. a replication worker) holds it. Rows that have
+// been deleted meanwhile are silently skipped.
+func (c *Controller) withBorrowedLock(ctx context.Context, row filedata.Row, d time.Duration, fn func(row filedata.Row) error) (locked bool, err error) {
+	lockTill := time.Now().Add(d).UnixMicro()
+	lockedRow, err := c.Repo.LockForReplication(ctx, row.FileID, row.Type, lockTill)
+	if err != nil {
+		if isLockConflict(err) {
+			mLockContention.WithLabelValues(lockOpLock).Inc()
+			return true, nil
+		}
+		if errors.Is(err, ente.ErrNotFound) {
+			return false, nil
+		}
+		return false, stacktrace.Propagate(err, "")
+	}
+	defer func() {
+		if unlockErr := c.Repo.ReleaseSyncLock(context.WithoutCancel(ctx), *lockedRow, lockTill, lockedRow.SyncLockedTill); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+	return false, fn(*lockedRow)
+}
+
+// isLockConflict reports whether err is the conflict that LockForReplication
+// fails with when someone else holds the row.
+func isLockConflict(err error) bool {
+	var apiErr *ente.ApiError
+	return errors.As(err, &apiErr) && apiErr.HttpStatusCode == http.StatusConflict
+}
@@ -0,0 +1,136 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestWorkTimeout(t *testing.T) {
+	p := lockPolicy{
+		timeoutMin:         2 * time.Minute,
+		timeoutMax:         60 * time.Minute,
+		expectedThroughput: 1024 * 1024,
+	}
+	const mib = 1024 * 1024
+	tests := []struct {
+		name string
+		size int64
+		lock time.Duration
+		want time.Duration
+	}{
+		{"small object", 10 * 1024, 30 * time.Minute, 2 * time.Minute},
+		{"proportional to size", 600 * mib, 240 * time.Minute, 10 * time.Minute},
+		{"clamped to max", 10 * 1024 * mib, 240 * time.Minute, 60 * time.Minute},
+		{"half of the lock", 1200 * mib, 30 * time.Minute, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := p.workTimeout(tt.size, tt.lock); got != tt.want {
+			t.Errorf("%s: workTimeout(%d, %v) = %v, want %v", tt.name, tt.size, tt.lock, got, tt.want)
+		}
+	}
+	p.renew = true
+	if got := p.workTimeout(1200*mib, 30*time.Minute); got != 20*time.Minute {
+		t.Errorf("workTimeout() with a renewed lock = %v, want 20m", got)
+	}
+}
+
+func TestWorkBudget(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	ctx, cancel := withWorkBudget(context.Background(), timeout, 0)
+	defer cancel()
+	dstCtx, dstCancel := context.WithTimeout(ctx, time.Minute)
+	defer dstCancel()
+	// Waiting for the limits of the instance doesn't use up the budget
+	resume := waitOutsideBudget(dstCtx)
+	time.Sleep(2 * timeout)
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("Err() after waiting outside the budget = %v, want nil", err)
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("Deadline() while waiting without a limit is set, want none")
+	}
+	resume()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > timeout {
+		t.Errorf("Deadline() after the wait = %v, %v, want at most %v away", deadline, ok, timeout)
+	}
+	select {
+	case <-dstCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("budget was not spent a second after the wait")
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) || !errors.Is(dstCtx.Err(), context.DeadlineExceeded) {
+		t.Errorf("Err() once the budget is spent = %v and %v, want %v", ctx.Err(), dstCtx.Err(), context.DeadlineExceeded)
+	}
+
+	// Nor do the waits take the work past the limit
+	ctx, cancel = withWorkBudget(context.Background(), time.Minute, timeout)
+	defer cancel()
+	defer waitOutsideBudget(ctx)()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("budget was not spent a second after its limit")
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("Err() past the limit = %v, want %v", ctx.Err(), context.DeadlineExceeded)
+	}
+
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel = withWorkBudget(parent, time.Minute, 0)
+	defer cancel()
+	cancelParent()
+	<-ctx.Done()
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		t.Errorf("Err() once the parent is cancelled = %v, want %v", ctx.Err(), context.Canceled)
+	}
+}
+
+func TestDestinationTimeout(t *testing.T) {
+	p := lockPolicy{
+		destinationTimeoutMin: time.Minute,
+		destinationTimeoutMax: 30 * time.Minute,
+		expectedThroughput:    1024 * 1024,
+	}
+	const mib = 1024 * 1024
+	if got := p.destinationTimeout(10*1024, time.Time{}, false); got != time.Minute {
+		t.Errorf("destinationTimeout() of a small object = %v, want 1m", got)
+	}
+	if got := p.destinationTimeout(600*mib, time.Time{}, false); got != 10*time.Minute {
+		t.Errorf("destinationTimeout() of 600 MiB = %v, want 10m", got)
+	}
+	deadline := time.Now().Add(5 * time.Minute)
+	if got := p.destinationTimeout(600*mib, deadline, true); got >= time.Until(deadline) {
+		t.Errorf("destinationTimeout() = %v, want less than the %v left for the row", got, time.Until(deadline))
+	}
+}
+
+func TestHoldAfterFailure(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	p := newLockPolicy()
+	if got := p.holdAfterFailure(ErrTransient); got != defaultHoldAfterTransientFailure {
+		t.Errorf("hold after a transient failure = %v, want %v", got, defaultHoldAfterTransientFailure)
+	}
+	for _, class := range []ReplicationErrorClass{ErrTimeout, ErrIntegrity} {
+		if got := p.holdAfterFailure(class); got != defaultBackoffBase {
+			t.Errorf("hold after a %s failure = %v, want the backoff base %v", class, got, defaultBackoffBase)
+		}
+	}
+	if got := p.holdAfterFailure(ErrPermission); got != defaultBackoffMax {
+		t.Errorf("hold after a permission failure = %v, want the backoff max %v", got, defaultBackoffMax)
+	}
+	for _, class := range []ReplicationErrorClass{ErrSourceMissing, ErrSourceIntegrity} {
+		if got := p.holdAfterFailure(class); got != 0 {
+			t.Errorf("hold after a %s failure = %v, want the lock of the dead lettered row to be released", class, got)
+		}
+	}
+	viper.Set("replication.file-data.lock.hold-after-failure", "0s")
+	p = newLockPolicy()
+	if got := p.holdAfterFailure(ErrPermission); got != 0 {
+		t.Errorf("hold after a permission failure with hold-after-failure 0s = %v, want the lock to be released", got)
+	}
+}
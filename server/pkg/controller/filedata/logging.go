@@ -0,0 +1,54 @@
+package filedata
+
+import (
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	log "github.com/sirupsen/logrus"
+)
+
+// The fields of the log lines about the replication of a row. Every line uses
+// the same names, so that the logs (JSON outside of local runs, see
+// setupLogger) can be queried by them.
+const (
+	logFileID       = "file_id"
+	logType         = "type"
+	logSize         = "size"
+	logUserID       = "user_id"
+	logSourceBucket = "source_bucket"
+	logDestBucket   = "dest_bucket"
+	logAttempt      = "attempt"
+	logDurationMs   = "duration_ms"
+	logOutcome      = "outcome"
+	logErrorClass   = "error_class"
+	logLockHolder   = "lock_holder"
+)
+
+// Outcomes of the replication of a row, or of its copy to a bucket, as logged
+// in logOutcome.
+const (
+	logOutcomeReplicated = "replicated"
+	logOutcomeFailed     = "failed"
+	logOutcomeAbandoned  = "abandoned"
+)
+
+// rowLogger returns a log entry with the fields of the row, for the log lines
+// about its replication.
+func rowLogger(row filedata.Row) *log.Entry {
+	fields := log.Fields{
+		logFileID:  row.FileID,
+		logType:    row.Type,
+		logSize:    row.Size,
+		logUserID:  row.UserID,
+		logAttempt: row.AttemptCount + 1,
+	}
+	if holder := row.LockHolder(); holder != "" {
+		fields[logLockHolder] = holder
+	}
+	return log.WithFields(fields)
+}
+
+// sinceMs returns the milliseconds since start, for logDurationMs.
+func sinceMs(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
@@ -0,0 +1,174 @@
+package filedata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	log "github.com/sirupsen/logrus"
+)
+
+// maintenanceGate lets replication be put in maintenance mode, e.g. before the
+// instance is rotated out.
+//
+// Unlike pausing, which cancels the work in progress, maintenance mode only
+// stops the workers from picking up new rows. The workers that are working on
+// a batch finish it, resetting the locks of its rows as usual, and the gate is
+// drained once none of them is left.
+type maintenanceGate struct {
+	mu      sync.Mutex
+	enabled bool
+	since   time.Time
+	// inFlight is the number of workers that are picking up or working on rows
+	inFlight  int
+	drainedAt time.Time
+	// drained is closed once the gate is drained, left once maintenance mode
+	// is left
+	drained chan struct{}
+	left    chan struct{}
+}
+
+// enter enters maintenance mode, returning false if it was already entered.
+func (g *maintenanceGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.enabled {
+		return false
+	}
+	g.enabled = true
+	g.since = time.Now()
+	g.drainedAt = time.Time{}
+	g.drained = make(chan struct{})
+	g.left = make(chan struct{})
+	g.checkDrained()
+	return true
+}
+
+// leave leaves maintenance mode, returning false if it wasn't entered.
+func (g *maintenanceGate) leave() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.enabled {
+		return false
+	}
+	g.enabled = false
+	close(g.left)
+	return true
+}
+
+// begin registers a worker that is about to pick up rows, which must call end
+// once it is done with them. In maintenance mode it instead returns false,
+// along with a channel that is closed once maintenance mode is left.
+func (g *maintenanceGate) begin() (bool, <-chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.enabled {
+		return false, g.left
+	}
+	g.inFlight++
+	return true, nil
+}
+
+func (g *maintenanceGate) end() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inFlight--
+	g.checkDrained()
+}
+
+// checkDrained marks the gate as drained if it is. It must be called with mu
+// held.
+func (g *maintenanceGate) checkDrained() {
+	if !g.enabled || g.inFlight > 0 || !g.drainedAt.IsZero() {
+		return
+	}
+	g.drainedAt = time.Now()
+	close(g.drained)
+	log.WithField("duration", g.drainedAt.Sub(g.since).Round(time.Millisecond)).
+		Info("File data replication has drained, the instance can be stopped")
+}
+
+// drainedChan returns a channel that is closed once the gate is drained, or nil
+// if not in maintenance mode.
+func (g *maintenanceGate) drainedChan() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.enabled {
+		return nil
+	}
+	return g.drained
+}
+
+func (g *maintenanceGate) status() filedata.ReplicationMaintenanceStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.enabled {
+		return filedata.ReplicationMaintenanceStatus{InFlight: g.inFlight}
+	}
+	status := filedata.ReplicationMaintenanceStatus{
+		Enabled:  true,
+		Since:    g.since.UnixMicro(),
+		InFlight: g.inFlight,
+		Drained:  !g.drainedAt.IsZero(),
+	}
+	if status.Drained {
+		status.DrainedAt = g.drainedAt.UnixMicro()
+	}
+	return status
+}
+
+// EnterMaintenance puts file data replication on this instance in maintenance
+// mode: the workers stop picking up new rows, but finish the ones they are
+// working on. Once they all have, GetMaintenanceStatus reports replication as
+// drained, and the instance can be stopped without leaving rows locked. It is a
+// no-op if already in maintenance mode.
+//
+// Only the replication workers are drained, replication on request and the
+// background jobs (reconciliation, verification, deletion) carry on.
+func (c *Controller) EnterMaintenance() {
+	if c.maintenance.enter() {
+		log.Warn("Entered maintenance mode for file data replication, draining in-flight work")
+	}
+}
+
+// LeaveMaintenance lets the workers pick up new rows again after
+// EnterMaintenance. It is a no-op if not in maintenance mode.
+func (c *Controller) LeaveMaintenance() {
+	if c.maintenance.leave() {
+		log.Info("Left maintenance mode for file data replication")
+	}
+}
+
+// GetMaintenanceStatus returns whether replication is in maintenance mode on
+// this instance, and whether it has drained.
+func (c *Controller) GetMaintenanceStatus() filedata.ReplicationMaintenanceStatus {
+	return c.maintenance.status()
+}
+
+// WaitUntilDrained blocks until replication has drained in maintenance mode, or
+// ctx is done. It returns false right away if not in maintenance mode, and
+// false too if ctx is done first.
+func (c *Controller) WaitUntilDrained(ctx context.Context) bool {
+	drained := c.maintenance.drainedChan()
+	if drained == nil {
+		return false
+	}
+	select {
+	case <-drained:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// waitOutMaintenance blocks the worker until maintenance mode, which is
+// signalled by left being closed, is left or the worker has to exit.
+func (c *Controller) waitOutMaintenance(ctx context.Context, w *replicationWorker, left <-chan struct{}) {
+	w.health.set(workerMaintenance, 0)
+	select {
+	case <-ctx.Done():
+	case <-w.stop:
+	case <-left:
+	}
+}
@@ -0,0 +1,52 @@
+package filedata
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	"github.com/spf13/viper"
+)
+
+// sourceMetadata returns the metadata (content type, cache control and the
+// like, and user-defined metadata) of the object in bucketID, so that the
+// replicas can be stored with the same. It returns no metadata, without
+// looking, unless replication.file-data.metadata.enabled is set, since not all
+// backends support all the headers.
+func (c *Controller) sourceMetadata(ctx context.Context, objectKey string, bucketID string) (objectstore.ObjectMetadata, error) {
+	if !viper.GetBool("replication.file-data.metadata.enabled") {
+		return objectstore.ObjectMetadata{}, nil
+	}
+	store := c.S3Config.GetObjectStore(bucketID)
+	if _, ok := store.(objectstore.MetadataPutter); !ok {
+		// Doesn't keep any
+		return objectstore.ObjectMetadata{}, nil
+	}
+	var info objectstore.ObjectInfo
+	err := withS3Retry(ctx, "head in "+bucketID, func() error {
+		var err error
+		info, err = store.Head(ctx, objectKey)
+		return err
+	})
+	if err != nil {
+		return objectstore.ObjectMetadata{}, stacktrace.Propagate(err, "could not read metadata of %s in %s", objectKey, bucketID)
+	}
+	return info.Metadata, nil
+}
+
+// verifyUploadedMetadata checks that the object uploaded to dc was stored with
+// the metadata it was uploaded with, if replication.file-data.metadata.verify
+// is set. Stores that don't keep metadata are not checked.
+func (c *Controller) verifyUploadedMetadata(uploaded objectstore.ObjectInfo, metadata objectstore.ObjectMetadata, dc string) error {
+	if !viper.GetBool("replication.file-data.metadata.enabled") || !viper.GetBool("replication.file-data.metadata.verify") {
+		return nil
+	}
+	if _, ok := c.S3Config.GetObjectStore(dc).(objectstore.MetadataPutter); !ok {
+		return nil
+	}
+	if !uploaded.Metadata.Equal(metadata) {
+		return fmt.Errorf("uploaded metadata object has metadata %+v, expected %+v: %w", uploaded.Metadata, metadata, ErrIntegrity)
+	}
+	return nil
+}
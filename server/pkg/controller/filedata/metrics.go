@@ -0,0 +1,287 @@
+package filedata
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Metrics for the file data replication pipeline. These are registered with
+// the default prometheus registry, and so are served on the /metrics endpoint.
+var (
+	mReplicatedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_bytes_total",
+		Help: "Number of bytes uploaded to replica buckets during file data replication",
+	}, []string{"type", "bucket"})
+	mReplicatedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_objects_total",
+		Help: "Number of objects uploaded and verified in replica buckets (each replica is counted separately)",
+	}, []string{"type", "bucket"})
+	mServerSideCopies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_server_side_copies_total",
+		Help: "Number of objects copied to replica buckets server side, without being downloaded and uploaded",
+	}, []string{"type", "bucket"})
+	mServerSideCopyBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_server_side_copy_bytes_total",
+		Help: "Number of bytes copied to replica buckets server side, which did not pass through museum",
+	}, []string{"type", "bucket"})
+	mReplicationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_failures_total",
+		Help: "Number of failed uploads to replica buckets during file data replication",
+	}, []string{"bucket"})
+	mStrictVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_strict_verifications_total",
+		Help: "Number of replicated copies read back and compared byte for byte with what was uploaded, by outcome (match, mismatch, error, skipped)",
+	}, []string{"type", "bucket", "outcome"})
+	mJobRequestRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "museum_filedata_job_request_rate",
+		Help: "Requests per second that the last run of a file data background job (audit, reconcile) was allowed, lowered while the object stores are distressed",
+	}, []string{"job"})
+	mJobRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_job_requests_total",
+		Help: "Number of rate limited object store and database requests made by the file data background jobs",
+	}, []string{"job"})
+	mJobObjectsListed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_job_objects_listed_total",
+		Help: "Number of file data objects listed in the buckets by the file data background jobs",
+	}, []string{"job", "bucket"})
+	mJobRowsChecked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_job_rows_checked_total",
+		Help: "Number of file data rows checked against the buckets by the file data background jobs",
+	}, []string{"job"})
+	mImmutableMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_immutable_mismatches_total",
+		Help: "Number of file data objects found in an object locked bucket with other contents than those being replicated, which can't be overwritten",
+	}, []string{"bucket"})
+	mDestinationTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_destination_timeouts_total",
+		Help: "Number of uploads to a replica bucket during file data replication that ran out of their per destination timeout",
+	}, []string{"bucket"})
+	mDownloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "museum_filedata_download_duration_seconds",
+		Help:    "Time taken to download a file data object, retries included, by path (worker or direct) and outcome",
+		Buckets: []float64{0.05, 0.1, 0.5, 1, 2, 5, 10, 30, 60, 300},
+	}, []string{"bucket", "path", "outcome"})
+	mWorkerCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_worker_calls_total",
+		Help: "Number of calls to the download worker, by outcome (ok, or the kind of failure)",
+	}, []string{"bucket", "outcome"})
+	mWorkerFallbackActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_worker_fallback_active",
+		Help: "1 while downloads skip the worker because of its repeated failures, and 0 otherwise",
+	})
+	mReadAfterWriteRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_read_after_write_retries_total",
+		Help: "Number of objects that were not found right after being written, by whether they became visible (visible) or not (missing) after retrying",
+	}, []string{"bucket", "outcome"})
+	mDownloadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_download_bytes_total",
+		Help: "Number of bytes of file data objects downloaded from the object store",
+	}, []string{"bucket"})
+	mDeletedWhileReplicating = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_deleted_while_replicating_total",
+		Help: "Number of times that a replication attempt found its row deleted, before writing to the bucket or after (in which case it deleted what it wrote)",
+	}, []string{"type", "bucket"})
+	mMissingSourceRecoveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_missing_source_recoveries_total",
+		Help: "Number of file data objects missing from their latest bucket that were found in another bucket, by what was done (seed or promote)",
+	}, []string{"type", "bucket", "action"})
+	mMissingSources = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_missing_sources_total",
+		Help: "Number of file data objects that were found missing from every bucket",
+	}, []string{"type"})
+	mInlineReplications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_inline_replications_total",
+		Help: "Number of uploads of file data replicated inline, by whether they reached the required replicas in time (met or unmet)",
+	}, []string{"type", "outcome"})
+	mNoReplicaRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_no_replica_rows_total",
+		Help: "Number of file data rows picked up for replication whose type has no replica buckets configured",
+	}, []string{"type"})
+	mReplicationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_errors_total",
+		Help: "Number of file data rows that failed to replicate, by error class",
+	}, []string{"type", "class"})
+	mBucketRequestsInflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "museum_filedata_bucket_requests_inflight",
+		Help: "Number of uploads, downloads and HEAD requests of file data objects in progress to each bucket, see replication.file-data.max-concurrent-requests",
+	}, []string{"bucket"})
+	mSourceDownloadsInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_source_downloads_inflight",
+		Help: "Number of source downloads in progress, when replication.file-data.max-concurrent-downloads is set",
+	})
+	mRouteBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_route_bytes_total",
+		Help: "Number of bytes copied from each source bucket to each destination bucket during file data replication",
+	}, []string{"source", "destination"})
+	mRouteEstimatedCost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_route_estimated_cost_total",
+		Help: "Estimated egress cost of the bytes copied from each source bucket to each destination bucket, in the unit of replication.file-data.egress-cost-per-gb",
+	}, []string{"source", "destination"})
+	mHistoryDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_history_dropped_total",
+		Help: "Number of replication history records dropped because the buffer was full",
+	})
+	mDeduplicated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_deduplicated_total",
+		Help: "Number of file data rows held back because they were enqueued again with the same contents right after being replicated",
+	}, []string{"type"})
+	mDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_dead_lettered_total",
+		Help: "Number of file data rows moved to dead letter after exhausting their replication attempts",
+	}, []string{"type"})
+	mBestEffortReplications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_best_effort_replications_total",
+		Help: "Number of attempts to copy file data to best-effort buckets, by outcome",
+	}, []string{"bucket", "outcome"})
+	mVerificationMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_verification_mismatches_total",
+		Help: "Number of replicated file data copies found missing or corrupt on re-verification",
+	}, []string{"bucket"})
+	mBucketPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_pending_rows",
+		Help: "Number of file data rows that still need to be copied to the destination bucket",
+	}, []string{"type", "bucket"})
+	mBucketInflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_inflight_rows",
+		Help: "Number of file data rows that are being copied to the destination bucket",
+	}, []string{"type", "bucket"})
+	mOversizedPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_oversized_pending_rows",
+		Help: "Number of file data rows over replication.file-data.max-object-size-bytes that are skipped by replication",
+	})
+	mReplicationInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_inflight",
+		Help: "Number of file data rows currently being replicated by this instance",
+	})
+	mEffectiveConcurrency = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_effective_concurrency",
+		Help: "Number of replication workers of this instance that the adaptive throttle lets run at the same time",
+	})
+	mThrottleLimited = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_throttled",
+		Help: "1 while the adaptive throttle is limiting the replication workers because the object stores look distressed",
+	})
+	mThrottleFailureRatio = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_upload_failure_ratio",
+		Help: "Moving average of the ratio of uploads to replica buckets that failed with a transient error",
+	})
+	mThrottleUploadLatency = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_upload_latency_seconds",
+		Help: "Moving average of the latency of uploads to replica buckets",
+	})
+	mUsersOverQuota = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_users_over_quota",
+		Help: "Number of users whose file data rows are replicated last because they are over the soft per-user limit",
+	})
+	mCatchUpActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_catch_up",
+		Help: "Whether file data replication is in catch-up mode (1) or not (0)",
+	})
+	mInjectedFaults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_injected_faults_total",
+		Help: "Number of object store operations made to fail on purpose by replication.file-data.faults",
+	}, []string{"operation", "bucket"})
+	mPartialUploadCleanups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_partial_upload_cleanups_total",
+		Help: "Number of partially written objects deleted, and of stale multipart uploads aborted, in replica buckets",
+	}, []string{"kind", "bucket"})
+	mLockResetFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_lock_reset_failures_total",
+		Help: "Number of failed attempts to reset the lock of a file data row after replicating it",
+	}, []string{"type"})
+	mLockResets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_lock_resets_total",
+		Help: "Number of file data rows whose lock was reset after replicating them",
+	}, []string{"type"})
+	mLockContention = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_lock_contention_total",
+		Help: "Number of times that an operation on the lock of a file data row found the row held by someone else, by operation",
+	}, []string{"op"})
+	mLocksAbandoned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_locks_abandoned_total",
+		Help: "Number of file data rows picked up after their lock expired without its holder releasing it",
+	}, []string{"type"})
+	mLocksReclaimed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_replication_locks_reclaimed_total",
+		Help: "Number of file data rows picked up while still locked, because their lock holder stopped sending heartbeats",
+	}, []string{"type"})
+	mReplicationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "museum_filedata_replication_duration_seconds",
+		Help:    "Time taken to replicate a file data row to all the buckets it is pending in",
+		Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 300, 600, 1200},
+	}, []string{"type"})
+	mStaleCopyPurges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_stale_copy_purges_total",
+		Help: "Number of attempts to delete the stale copies of live file data rows, by outcome (purged, refused, failed, locked)",
+	}, []string{"type", "outcome"})
+	mAttemptRegistrationRate = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_attempt_registrations_per_second",
+		Help: "Rate at which replication attempts were registered by this instance over the last 10 seconds",
+	})
+	mAttemptFailureRate = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_attempt_failures_per_second",
+		Help: "Rate at which replication attempts failed on this instance over the last 10 seconds",
+	})
+	mAttemptCoalescing = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_attempt_failures_coalescing",
+		Help: "1 while redundant replication failures are not being recorded because of the failure rate, 0 otherwise",
+	})
+	mCoalescedFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "museum_filedata_coalesced_failures_total",
+		Help: "Number of replication failures that were not recorded, as redundant with the last failure recorded for the row",
+	}, []string{"type"})
+	mReplicationLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "museum_filedata_replication_lag_seconds",
+		Help: "Age of the oldest file data row that is pending replication (0 if nothing is pending)",
+	})
+)
+
+// lagUpdateInterval is how often the replication lag gauge is refreshed.
+const lagUpdateInterval = 1 * time.Minute
+
+// updateReplicationLag periodically refreshes mReplicationLag and the per bucket
+// backlog gauges until ctx is cancelled.
+func (c *Controller) updateReplicationLag(ctx context.Context) {
+	ticker := time.NewTicker(lagUpdateInterval)
+	defer ticker.Stop()
+	for {
+		oldestPending, err := c.Repo.GetOldestPendingSyncTime(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("Could not fetch oldest row pending replication")
+			}
+		} else if oldestPending == 0 {
+			mReplicationLag.Set(0)
+		} else {
+			mReplicationLag.Set(time.Since(time.UnixMicro(oldestPending)).Seconds())
+		}
+		c.updateBucketBacklog(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Controller) updateBucketBacklog(ctx context.Context) {
+	buckets, err := c.getBucketReplicationStatus(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).Error("Could not fetch file data replication backlog per bucket")
+		}
+		return
+	}
+	// Reset so that the series of buckets which have caught up are dropped
+	// instead of reporting their last backlog
+	mBucketPending.Reset()
+	mBucketInflight.Reset()
+	for _, b := range buckets {
+		mBucketPending.WithLabelValues(string(b.Type), b.Bucket).Set(float64(b.Pending))
+		mBucketInflight.WithLabelValues(string(b.Type), b.Bucket).Set(float64(b.InFlight))
+	}
+}
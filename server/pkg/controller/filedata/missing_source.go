@@ -0,0 +1,179 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// What is done when the object of a row is not in its latest bucket, but a
+// copy of it is found in another bucket, see recoverMissingSource.
+const (
+	// missingSourceSeed replicates from the copy, and uploads it to the
+	// latest bucket as well
+	missingSourceSeed = "seed"
+	// missingSourcePromote records the bucket of the copy as the row's latest
+	// bucket, after which the row is replicated from it again, including to
+	// the previous latest bucket
+	missingSourcePromote = "promote"
+)
+
+// errSourcePromoted is returned when the bucket of another copy of the object
+// has been recorded as the row's latest bucket, and the row is to be picked up
+// again with it.
+var errSourcePromoted = errors.New("latest bucket doesn't have the object, another copy was promoted")
+
+// missingSourceAction returns replication.file-data.missing-source.action.
+func missingSourceAction() string {
+	switch action := viper.GetString("replication.file-data.missing-source.action"); action {
+	case "", missingSourceSeed:
+		return missingSourceSeed
+	case missingSourcePromote:
+		return action
+	default:
+		log.Warnf("Unknown file data missing source action %q, seeding the latest bucket instead", action)
+		return missingSourceSeed
+	}
+}
+
+// seedCandidates returns the buckets, other than the latest one and those in
+// tried, that may have a copy of the row's object: the ones the row has been
+// or is to be replicated to, including those not recorded yet, as after an
+// import. Buckets that the row is to be deleted from may have an older
+// version, and are left out, as are those that can't be read right away.
+func (c *Controller) seedCandidates(row filedata.Row, tried []string) []string {
+	buckets := c.wantedBuckets(row.Type)
+	for _, bucketID := range c.replicaBuckets(row) {
+		buckets[bucketID] = true
+	}
+	for _, bucketID := range row.ReplicatedBuckets {
+		buckets[bucketID] = true
+	}
+	var candidates []string
+	for bucketID := range buckets {
+		if bucketID == row.LatestBucket || slices.Contains(tried, bucketID) ||
+			array.StringInList(bucketID, row.DeleteFromBuckets) || !c.S3Config.IsReadable(bucketID) {
+			continue
+		}
+		candidates = append(candidates, bucketID)
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// recoverMissingSource looks for the row's object in the other buckets, once it
+// has been found missing from the latest bucket (and from the fallbacks in
+// tried), e.g. because the row was recorded before the upload was committed,
+// or the data was imported into a replica.
+//
+// A copy that passes verifySourceObject is used as the source, and brought back
+// into the latest bucket as configured by missingSourceAction. If there is
+// none, the returned error wraps objectstore.ErrNotFound, which dead letters
+// the row, unless some of the buckets couldn't be checked, in which case
+// the error is a transient one.
+func (c *Controller) recoverMissingSource(ctx context.Context, row filedata.Row, objectKey string, tried []string, latestErr error) ([]byte, string, string, error) {
+	logger := log.WithFields(log.Fields{
+		"file_id": row.FileID,
+		"type":    row.Type,
+		"latest":  row.LatestBucket,
+	})
+	candidates := c.seedCandidates(row, tried)
+	var unreachable []string
+	for _, bucketID := range candidates {
+		data, err := c.downloadLogicalObject(ctx, objectKey, bucketID)
+		if errors.Is(err, objectstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			logger.WithError(err).Warnf("Could not look for the object missing from the latest bucket in %s", bucketID)
+			unreachable = append(unreachable, bucketID)
+			continue
+		}
+		checksum, err := c.verifySourceObject(ctx, row, data)
+		if err != nil {
+			logger.WithError(err).Warnf("Copy in %s of the object missing from the latest bucket doesn't match the row", bucketID)
+			continue
+		}
+		action := c.recoveryAction(ctx, row, bucketID)
+		mMissingSourceRecoveries.WithLabelValues(string(row.Type), bucketID, action).Inc()
+		if action == missingSourcePromote {
+			if err := c.Repo.SetLatestBucket(ctx, row, bucketID); err != nil {
+				return nil, "", "", stacktrace.Propagate(err, "could not promote %s to latest bucket", bucketID)
+			}
+			logger.Warnf("Object is missing from the latest bucket, promoted the copy in %s to latest bucket", bucketID)
+			return nil, "", "", fmt.Errorf("promoted %s: %w", bucketID, errSourcePromoted)
+		}
+		if err := c.seedLatestBucket(ctx, row, data, objectKey, bucketID); err != nil {
+			return nil, "", "", stacktrace.Propagate(err, "could not seed latest bucket %s from %s", row.LatestBucket, bucketID)
+		}
+		logger.Warnf("Object was missing from the latest bucket, seeded it from the copy in %s", bucketID)
+		return data, checksum, bucketID, nil
+	}
+	if len(unreachable) > 0 {
+		logger.Warnf("Object is missing from the latest bucket, and %v could not be checked for a copy, retrying later", unreachable)
+		return nil, "", "", stacktrace.NewError("object is missing from latest bucket %s, and %v could not be checked for a copy", row.LatestBucket, unreachable)
+	}
+	mMissingSources.WithLabelValues(string(row.Type)).Inc()
+	logger.Errorf("Object is missing from every bucket (latest and %v), giving up on the row", append(tried, candidates...))
+	return nil, "", "", stacktrace.Propagate(latestErr, "object is missing from every bucket")
+}
+
+// recoveryAction returns how the row's object is brought back into the latest
+// bucket from the copy in bucketID. A copy is only promoted if the bucket could
+// serve as the latest one: its objects are stored as is, and it has each of
+// the row's side objects, which are otherwise only replicated from the latest
+// bucket. Copies in the other buckets are seeded from instead.
+func (c *Controller) recoveryAction(ctx context.Context, row filedata.Row, bucketID string) string {
+	action := missingSourceAction()
+	if action != missingSourcePromote {
+		return action
+	}
+	if !c.storedAsIs(bucketID) {
+		return missingSourceSeed
+	}
+	hasSideObjects, err := c.hasSideObjects(ctx, row, bucketID)
+	if err != nil {
+		rowLogger(row).WithError(err).Warnf("Could not check the side objects in %s, seeding the latest bucket instead of promoting it", bucketID)
+		return missingSourceSeed
+	}
+	if !hasSideObjects {
+		return missingSourceSeed
+	}
+	return missingSourcePromote
+}
+
+// seedLatestBucket uploads the logical object data, read from source, to the
+// row's latest bucket, and verifies it. Nothing is recorded for the row, since
+// the latest bucket is where it is meant to be anyway.
+func (c *Controller) seedLatestBucket(ctx context.Context, row filedata.Row, data []byte, objectKey string, source string) error {
+	metadata, err := c.sourceMetadata(ctx, objectKey, source)
+	if err != nil {
+		return err
+	}
+	stored, compressed, err := c.encodeForBucket(ctx, row.LatestBucket, data)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if err := c.checkNotDeleted(ctx, row, row.LatestBucket); err != nil {
+		return err
+	}
+	uploaded, err := c.uploadObject(ctx, stored, objectKey, row.LatestBucket, metadata)
+	if err != nil {
+		return err
+	}
+	if err := c.verifyUploadedObject(ctx, stored, checksumOf(data), uploaded, objectKey, row.LatestBucket); err != nil {
+		c.cleanUpPartialUpload(ctx, objectKey, row.LatestBucket, err)
+		return err
+	}
+	countRoute(ctx, source, row.LatestBucket, int64(len(stored)))
+	return c.Repo.SetBucketCompressed(ctx, row, row.LatestBucket, compressed)
+}
@@ -0,0 +1,66 @@
+package filedata
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// errNoReplicaConfigured is returned when a row is held back because its type
+// has no replica buckets configured, see checkReplicasConfigured.
+var errNoReplicaConfigured = errors.New("no replica buckets are configured for the type")
+
+// hasNoReplicas reports whether the rows of the type have nowhere to be
+// replicated to besides their primary bucket, which is most likely a
+// misconfiguration of s3.file-data-config.
+func (c *Controller) hasNoReplicas(oType ente.ObjectType) bool {
+	for bucketID := range c.wantedBuckets(oType) {
+		if bucketID != c.S3Config.GetBucketID(oType) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkReplicasConfigured flags a row whose type has no replica buckets, which
+// would otherwise be marked as replicated without having been copied anywhere.
+// Rows with a replica override are left alone, since the override is explicit.
+//
+// The first such row of each type logs a warning, and every one of them is
+// counted in mNoReplicaRows. If replication.file-data.no-replica.hold is set,
+// the row is also kept pending by failing with errNoReplicaConfigured, so that
+// it is replicated once replicas are configured for its type.
+func (c *Controller) checkReplicasConfigured(row filedata.Row) error {
+	if row.ReplicaOverride != nil || !c.hasNoReplicas(row.Type) {
+		return nil
+	}
+	mNoReplicaRows.WithLabelValues(string(row.Type)).Inc()
+	hold := viper.GetBool("replication.file-data.no-replica.hold")
+	if _, warned := c.noReplicaWarnings.LoadOrStore(row.Type, true); !warned {
+		log.WithFields(log.Fields{
+			"type":   row.Type,
+			"bucket": c.S3Config.GetBucketID(row.Type),
+			"hold":   hold,
+		}).Warn("No replica buckets are configured for the type, its file data is only in its primary bucket")
+	}
+	if hold {
+		return fmt.Errorf("%s: %w", row.Type, errNoReplicaConfigured)
+	}
+	return nil
+}
+
+// getNoReplicaTypes returns the replicated types that have no replica buckets
+// configured.
+func (c *Controller) getNoReplicaTypes() []ente.ObjectType {
+	var types []ente.ObjectType
+	for _, oType := range replicatedTypes {
+		if c.hasNoReplicas(oType) {
+			types = append(types, oType)
+		}
+	}
+	return types
+}
@@ -0,0 +1,66 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetReplicaOverride replicates a single file's data to the requested buckets
+// instead of the replica buckets configured for its type, e.g. to keep more
+// copies of data that is particularly valuable.
+//
+// Copies that already exist in buckets that are no longer wanted are left as
+// they are.
+func (c *Controller) SetReplicaOverride(ctx context.Context, req filedata.ReplicaOverrideRequest) error {
+	if !isReplicatedType(req.Type) {
+		return stacktrace.Propagate(ente.NewBadRequestWithMessage("unsupported type "+string(req.Type)), "")
+	}
+	buckets := make([]string, 0, len(req.Buckets))
+	primary := c.S3Config.GetBucketID(req.Type)
+	for _, bucketID := range req.Buckets {
+		if !c.S3Config.IsBucketActive(bucketID) {
+			return stacktrace.Propagate(ente.NewBadRequestWithMessage("unknown bucket "+bucketID), "")
+		}
+		// The primary bucket is always wanted anyway
+		if bucketID != primary {
+			buckets = append(buckets, bucketID)
+		}
+	}
+	if err := c.Repo.SetReplicaOverride(ctx, req.FileID, req.Type, buckets); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	log.WithFields(log.Fields{
+		"file_id": req.FileID,
+		"type":    req.Type,
+		"buckets": buckets,
+	}).Info("Overrode replica buckets of file data")
+	c.wakeIdleWorkers(1)
+	return nil
+}
+
+// ClearReplicaOverride goes back to replicating a single file's data to the
+// replica buckets configured for its type.
+func (c *Controller) ClearReplicaOverride(ctx context.Context, fileID int64, oType ente.ObjectType) error {
+	if err := c.Repo.ClearReplicaOverride(ctx, fileID, oType); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	log.WithFields(log.Fields{
+		"file_id": fileID,
+		"type":    oType,
+	}).Info("Cleared replica bucket override of file data")
+	c.wakeIdleWorkers(1)
+	return nil
+}
+
+func isReplicatedType(oType ente.ObjectType) bool {
+	for _, t := range replicatedTypes {
+		if t == oType {
+			return true
+		}
+	}
+	return false
+}
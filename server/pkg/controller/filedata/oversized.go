@@ -0,0 +1,193 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// oversizedSkip leaves the rows over the maximum object size pending, and
+	// alerts about them
+	oversizedSkip = "skip"
+	// oversizedRoute replicates the rows over the maximum object size in a
+	// dedicated pool of workers
+	oversizedRoute = "route"
+)
+
+// oversizedPoolName is the name of the pool that replicates the rows over the
+// maximum object size when they are routed to it.
+const oversizedPoolName = "oversized"
+
+const defaultOversizedWorkerCount = 1
+
+// errOversized is returned when a row is too large to be replicated inline by
+// the worker that picked it up.
+var errOversized = errors.New("file data is over the maximum object size")
+
+// maxObjectSize returns replication.file-data.max-object-size-bytes, the size
+// over which rows are not replicated by the regular workers. 0 means there is
+// no limit.
+func maxObjectSize() int64 {
+	return max(viper.GetInt64("replication.file-data.max-object-size-bytes"), 0)
+}
+
+// oversizedAction returns what is done with the rows over the maximum object
+// size, either oversizedSkip (the default) or oversizedRoute.
+func oversizedAction() string {
+	if viper.GetString("replication.file-data.oversized.action") == oversizedRoute {
+		return oversizedRoute
+	}
+	return oversizedSkip
+}
+
+// oversizedWorkerCount returns the size of the pool for the oversized rows in
+// the config v, or 0 if they aren't routed to one. The limit and the action are
+// always those of the global config, which the workers go by.
+func oversizedWorkerCount(v *viper.Viper) int {
+	if maxObjectSize() == 0 || oversizedAction() != oversizedRoute {
+		return 0
+	}
+	if n := v.GetInt("replication.file-data.oversized.worker-count"); n > 0 {
+		return n
+	}
+	return defaultOversizedWorkerCount
+}
+
+// applySizeLimit restricts filter to the rows that the worker that ctx belongs
+// to may replicate: the workers of the oversized pool only pick the rows over
+// the maximum object size, and all the others only the rows under it.
+func applySizeLimit(ctx context.Context, filter fileDataRepo.PendingSyncFilter) fileDataRepo.PendingSyncFilter {
+	limit := maxObjectSize()
+	if limit == 0 {
+		return filter
+	}
+	if inOversizedPool(ctx) {
+		filter.MinSize = limit
+	} else {
+		filter.MaxSize = limit
+	}
+	return filter
+}
+
+// inOversizedPool reports whether ctx belongs to a worker of the oversized pool.
+func inOversizedPool(ctx context.Context) bool {
+	w, ok := ctx.Value(workerCtxKey{}).(*replicationWorker)
+	return ok && w.pool.name == oversizedPoolName
+}
+
+type onRequestCtxKey struct{}
+
+// onRequest marks ctx as replicating a row on request of an operator, who may
+// replicate rows of any size, and to all of their buckets at once.
+func onRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, onRequestCtxKey{}, true)
+}
+
+// isOnRequest reports whether ctx has been marked with onRequest.
+func isOnRequest(ctx context.Context) bool {
+	requested, _ := ctx.Value(onRequestCtxKey{}).(bool)
+	return requested
+}
+
+// checkObjectSize fails with errOversized if row is over the maximum object
+// size, unless ctx belongs to a worker of the oversized pool or has been marked
+// with onRequest. The rows are normally kept away from the other workers by
+// applySizeLimit, this catches those picked up before the limit changed.
+func checkObjectSize(ctx context.Context, row filedata.Row) error {
+	limit := maxObjectSize()
+	if limit == 0 || row.Size <= limit || inOversizedPool(ctx) || isOnRequest(ctx) {
+		return nil
+	}
+	return fmt.Errorf("%d bytes, over %d: %w", row.Size, limit, errOversized)
+}
+
+// getOversizedStatus returns the backlog of the rows over the maximum object
+// size, or nil if there is no limit.
+func (c *Controller) getOversizedStatus(ctx context.Context) (*filedata.ReplicationOversizedStatus, error) {
+	limit := maxObjectSize()
+	if limit == 0 {
+		return nil, nil
+	}
+	pending, size, err := c.Repo.GetOversizedPending(ctx, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &filedata.ReplicationOversizedStatus{MaxSize: limit, Action: oversizedAction(), Pending: pending, PendingSize: size}, nil
+}
+
+// watchOversized periodically checks for rows over the maximum object size that
+// are being skipped, and notifies replication.file-data.alert.webhook-url when
+// there are more of them than when last notified, and again once there are
+// none left. Without a webhook it only logs them. Only the instance that
+// claims the watcher (see claimWatcher) checks for them, and sets the
+// mOversizedPending gauge.
+func (c *Controller) watchOversized(ctx context.Context) {
+	url := viper.GetString("replication.file-data.alert.webhook-url")
+	interval := viper.GetDuration("replication.file-data.alert.interval")
+	if interval <= 0 {
+		interval = defaultAlertInterval
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var notified int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if maxObjectSize() == 0 || oversizedAction() != oversizedSkip {
+			notified = 0
+			continue
+		}
+		if !c.claimWatcher(ctx, "oversized-alert", interval) {
+			// The instance that claimed it reports them
+			notified = 0
+			mOversizedPending.Set(0)
+			continue
+		}
+		status, err := c.getOversizedStatus(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("Could not check oversized file data")
+			}
+			continue
+		}
+		mOversizedPending.Set(float64(status.Pending))
+		if status.Pending == notified {
+			continue
+		}
+		if status.Pending > 0 && status.Pending < notified {
+			// Only alert again once there are more than before
+			notified = status.Pending
+			continue
+		}
+		host, _ := os.Hostname()
+		var text string
+		if status.Pending > 0 {
+			text = fmt.Sprintf(":warning: File data replication is skipping %d rows (%d bytes) over the maximum object size of %d bytes on %s",
+				status.Pending, status.PendingSize, status.MaxSize, host)
+		} else {
+			text = fmt.Sprintf(":white_check_mark: File data replication has no rows over the maximum object size left on %s", host)
+		}
+		notified = status.Pending
+		log.Warn(text)
+		if url == "" {
+			continue
+		}
+		if err := postAlert(ctx, client, url, text); err != nil {
+			log.WithError(err).Error("Could not send oversized file data alert")
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	partialUploadCleanupTimeout   = 30 * time.Second
+	defaultMultipartSweepInterval = time.Hour
+	defaultMultipartSweepMaxAge   = 24 * time.Hour
+	// fileDataKeyMarker is in the keys of all the file data objects, see
+	// filedata.BasePrefix
+	fileDataKeyMarker = "/file-data/"
+)
+
+const (
+	cleanupKindObject    = "object"
+	cleanupKindMultipart = "multipart"
+)
+
+// cleanUpPartialUpload deletes, best effort, what a failed upload may have
+// left of the object in the bucket, so that the retry starts clean and audits
+// don't find a copy that the row doesn't record. Failures are only logged.
+//
+// Uploads in parts are aborted by the store if they can't be completed. Those
+// whose abort failed too are left to sweepMultipartUploads.
+//
+// Nothing is deleted from object locked buckets, where what is under the key
+// may be a copy that was there before the upload. Nor is anything deleted once
+// ctx has been cancelled, e.g. because the row's lock was lost (see
+// keepLockAlive), since the object may by then be the copy uploaded by the new
+// holder of the row.
+func (c *Controller) cleanUpPartialUpload(ctx context.Context, objectKey string, bucketID string, cause error) {
+	if c.S3Config.IsObjectLocked(bucketID) {
+		return
+	}
+	if errors.Is(ctx.Err(), context.Canceled) || errors.Is(context.Cause(ctx), fileDataRepo.ErrLockLost) {
+		log.WithFields(log.Fields{
+			"object":      objectKey,
+			logDestBucket: bucketID,
+		}).Infof("Not cleaning up partial upload after %s, the replication was cancelled: %s", cause, context.Cause(ctx))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), partialUploadCleanupTimeout)
+	defer cancel()
+	logger := log.WithFields(log.Fields{
+		"object":      objectKey,
+		logDestBucket: bucketID,
+	})
+	if err := c.S3Config.GetObjectStore(bucketID).Delete(ctx, objectKey); err != nil {
+		logger.WithError(err).Warnf("Could not clean up partial upload after: %s", cause)
+		return
+	}
+	mPartialUploadCleanups.WithLabelValues(cleanupKindObject, bucketID).Inc()
+	logger.Infof("Cleaned up partial upload after: %s", cause)
+}
+
+// sweepMultipartUploads aborts, every replication.file-data.multipart-sweep.interval,
+// the multipart uploads of file data objects to the replica buckets that were
+// started more than multipart-sweep.max-age ago, until ctx is cancelled.
+func (c *Controller) sweepMultipartUploads(ctx context.Context) {
+	interval := viper.GetDuration("replication.file-data.multipart-sweep.interval")
+	if interval <= 0 {
+		interval = defaultMultipartSweepInterval
+	}
+	maxAge := viper.GetDuration("replication.file-data.multipart-sweep.max-age")
+	if maxAge <= 0 {
+		maxAge = defaultMultipartSweepMaxAge
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, bucketID := range c.allReplicaBuckets() {
+			c.abortStaleMultipartUploads(ctx, bucketID, time.Now().Add(-maxAge))
+		}
+	}
+}
+
+// abortStaleMultipartUploads aborts the multipart uploads of file data objects
+// to the bucket that were started before the given time. Uploads of other
+// objects that share the bucket are left alone.
+func (c *Controller) abortStaleMultipartUploads(ctx context.Context, bucketID string, before time.Time) {
+	store, ok := c.S3Config.GetObjectStore(bucketID).(objectstore.MultipartAborter)
+	if !ok {
+		return
+	}
+	uploads, err := store.ListMultipartUploads(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).WithField(logDestBucket, bucketID).Error("Could not list multipart uploads")
+		}
+		return
+	}
+	for _, upload := range uploads {
+		if !strings.Contains(upload.Key, fileDataKeyMarker) || !upload.Initiated.Before(before) {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"object":      upload.Key,
+			logDestBucket: bucketID,
+			"upload_id":   upload.UploadID,
+		})
+		if err := store.AbortMultipartUpload(ctx, upload.Key, upload.UploadID); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			logger.WithError(err).Warn("Could not abort stale multipart upload")
+			continue
+		}
+		mPartialUploadCleanups.WithLabelValues(cleanupKindMultipart, bucketID).Inc()
+		logger.Infof("Aborted multipart upload started at %s", upload.Initiated.Format(time.RFC3339))
+	}
+}
+
+// allReplicaBuckets returns the replica buckets of all the replicated types.
+func (c *Controller) allReplicaBuckets() []string {
+	var buckets []string
+	for _, oType := range replicatedTypes {
+		for _, bucketID := range c.S3Config.GetReplicatedBuckets(oType) {
+			if !slices.Contains(buckets, bucketID) {
+				buckets = append(buckets, bucketID)
+			}
+		}
+	}
+	return buckets
+}
@@ -0,0 +1,196 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// errReplicationPaused is the cause with which the in-flight work of the
+// replication workers is cancelled when replication is paused.
+var errReplicationPaused = errors.New("file data replication is paused")
+
+// pauseRefreshInterval is how often the instances pick up a pause or resume
+// made through another instance.
+const pauseRefreshInterval = 30 * time.Second
+
+// pauseGate lets replication be paused and resumed at runtime.
+//
+// While replication is paused, the workers don't pick up any rows. Pausing
+// cancels the work in progress, and the locks of the rows that were being
+// worked on are put back.
+//
+// The gate is this instance's copy of the file_data_replication_pause table,
+// which it is refreshed from every pauseRefreshInterval, so that pausing
+// through any instance pauses all of them, also after a restart.
+type pauseGate struct {
+	mu     sync.Mutex
+	paused bool
+	since  time.Time
+	// resumed is closed once replication is resumed
+	resumed chan struct{}
+	// running is cancelled once replication is paused, it is created afresh by
+	// the first worker to start after it has been resumed
+	running     context.Context
+	stopRunning context.CancelFunc
+}
+
+// pause pauses replication as of since, returning false if it was already
+// paused.
+func (g *pauseGate) pause(since time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	g.paused = true
+	g.since = since
+	g.resumed = make(chan struct{})
+	if g.stopRunning != nil {
+		g.stopRunning()
+		g.running, g.stopRunning = nil, nil
+	}
+	return true
+}
+
+// resume resumes replication, returning false if it wasn't paused.
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return false
+	}
+	g.paused = false
+	close(g.resumed)
+	return true
+}
+
+// enter returns a context that is cancelled once replication is paused. If
+// replication is paused right now, it instead returns a channel that is closed
+// once replication is resumed.
+func (g *pauseGate) enter() (context.Context, <-chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return nil, g.resumed
+	}
+	if g.running == nil {
+		g.running, g.stopRunning = context.WithCancel(context.Background())
+	}
+	return g.running, nil
+}
+
+func (g *pauseGate) status() filedata.ReplicationPauseStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return filedata.ReplicationPauseStatus{}
+	}
+	return filedata.ReplicationPauseStatus{Paused: true, Since: g.since.UnixMicro()}
+}
+
+// Pause stops file data replication without stopping museum, on this instance
+// right away and on the others once they refresh their copy of the pause.
+//
+// The workers abandon what they are working on, putting back the locks of
+// their rows, and then go idle until Resume is called. It is a no-op if
+// replication is already paused. Deletion of replicas is not paused.
+func (c *Controller) Pause(ctx context.Context) error {
+	pausedAt, err := c.Repo.PauseReplication(ctx)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if c.pause.pause(time.UnixMicro(pausedAt)) {
+		log.Warn("Paused file data replication")
+	}
+	return nil
+}
+
+// Resume resumes file data replication that was paused with Pause. It is a
+// no-op if replication isn't paused.
+func (c *Controller) Resume(ctx context.Context) error {
+	if err := c.Repo.ResumeReplication(ctx); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if c.pause.resume() {
+		log.Info("Resumed file data replication")
+	}
+	return nil
+}
+
+// GetPauseStatus returns whether replication is paused on this instance.
+func (c *Controller) GetPauseStatus() filedata.ReplicationPauseStatus {
+	return c.pause.status()
+}
+
+// refreshPause keeps the instance's pause gate up to date with the pause
+// recorded in the database until ctx is cancelled.
+func (c *Controller) refreshPause(ctx context.Context) {
+	ticker := time.NewTicker(pauseRefreshInterval)
+	defer ticker.Stop()
+	for {
+		pausedAt, err := c.Repo.GetReplicationPause(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("Could not fetch whether file data replication is paused: %s", err)
+			}
+		} else if pausedAt != nil {
+			if c.pause.pause(time.UnixMicro(*pausedAt)) {
+				log.Warn("Paused file data replication, as paused through another instance")
+			}
+		} else if c.pause.resume() {
+			log.Info("Resumed file data replication, as resumed through another instance")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitUntilRunning blocks the worker while replication is paused. It returns
+// a context derived from ctx that is cancelled with errReplicationPaused once
+// replication is paused, along with the function to release it. It returns
+// false if the worker should exit instead.
+func (c *Controller) waitUntilRunning(ctx context.Context, w *replicationWorker) (context.Context, func(), bool) {
+	for {
+		running, resumed := c.pause.enter()
+		if running != nil {
+			runCtx, cancel := context.WithCancelCause(ctx)
+			stop := context.AfterFunc(running, func() { cancel(errReplicationPaused) })
+			return runCtx, func() {
+				stop()
+				cancel(nil)
+			}, true
+		}
+		w.health.set(workerPaused, 0)
+		select {
+		case <-ctx.Done():
+			return nil, nil, false
+		case <-w.stop:
+			return nil, nil, false
+		case <-resumed:
+		}
+	}
+}
+
+// pausedWhileWorking puts back the lock of row, held till heldLockTill, if the
+// work on it was cut short because replication has been paused. It returns
+// true if that was the case.
+func (c *Controller) pausedWhileWorking(ctx context.Context, row filedata.Row, heldLockTill int64) bool {
+	if !errors.Is(context.Cause(ctx), errReplicationPaused) {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"file_id": row.FileID,
+		"type":    row.Type,
+	}).Info("Replication paused, putting back the file data row")
+	c.releaseLocks(ctx, []filedata.Row{row}, heldLockTill)
+	return true
+}
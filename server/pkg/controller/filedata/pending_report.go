@@ -0,0 +1,187 @@
+package filedata
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// pendingReportPageSize is how many pending rows are read from the database,
+// and held in memory, at a time while writing the pending replication report.
+const pendingReportPageSize = 1000
+
+// Formats of the pending replication report.
+const (
+	PendingReportCSV  = "csv"
+	PendingReportJSON = "json"
+)
+
+// pendingReportColumns are the columns of the CSV pending replication report.
+var pendingReportColumns = []string{"file_id", "user_id", "type", "size", "latest_bucket", "missing_buckets",
+	"inflight_buckets", "attempt_count", "dead_lettered", "created_at", "updated_at", "age_seconds"}
+
+// IsPendingReportFormat reports whether format is one of the formats that the
+// pending replication report can be written in.
+func IsPendingReportFormat(format string) bool {
+	return format == PendingReportCSV || format == PendingReportJSON
+}
+
+// WritePendingReport writes every live row that is pending replication to w,
+// in the given format, along with the buckets that it is missing from (the
+// same ones that replication would copy it to). The rows are gone through a
+// page at a time, see ForEachPendingRow, and written as they are read, so the
+// report doesn't need to fit in memory. Nothing is locked, so the report
+// doesn't get in the way of replication.
+//
+// Nothing is written to w before the first page has been read, so if reading
+// it fails, the error can still be reported instead.
+func (c *Controller) WritePendingReport(ctx context.Context, format string, w io.Writer) error {
+	if !IsPendingReportFormat(format) {
+		return stacktrace.Propagate(ente.NewBadRequestWithMessage("unknown format "+format), "")
+	}
+	enc := newPendingReportEncoder(format, w)
+	now := time.Now()
+	err := c.Repo.ForEachPendingRow(ctx, pendingReportPageSize, func(rows []filedata.Row) error {
+		report := make([]filedata.PendingReportRow, len(rows))
+		for i, row := range rows {
+			report[i] = c.pendingReportRow(row, now)
+		}
+		return enc.write(report)
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return stacktrace.Propagate(enc.close(), "")
+}
+
+// pendingReportRow returns the entry of the pending replication report for the
+// row, as of now.
+func (c *Controller) pendingReportRow(row filedata.Row, now time.Time) filedata.PendingReportRow {
+	missing := sortedKeys(c.pendingBuckets(row))
+	inflight := make([]string, 0)
+	for _, bucketID := range missing {
+		if slices.Contains(row.InflightReplicas, bucketID) {
+			inflight = append(inflight, bucketID)
+		}
+	}
+	return filedata.PendingReportRow{
+		FileID:          row.FileID,
+		UserID:          row.UserID,
+		Type:            row.Type,
+		Size:            row.Size,
+		LatestBucket:    row.LatestBucket,
+		MissingBuckets:  missing,
+		InflightBuckets: inflight,
+		AttemptCount:    row.AttemptCount,
+		IsDeadLettered:  row.IsDeadLettered,
+		CreatedAt:       row.CreatedAt,
+		UpdatedAt:       row.UpdatedAt,
+		AgeSeconds:      max(0, int64(now.Sub(time.UnixMicro(row.UpdatedAt)).Seconds())),
+	}
+}
+
+// pendingReportEncoder writes the pending replication report to w a page at a
+// time, flushing w (if it can be) after each page.
+type pendingReportEncoder struct {
+	format  string
+	w       io.Writer
+	csv     *csv.Writer
+	started bool
+	written int
+}
+
+func newPendingReportEncoder(format string, w io.Writer) *pendingReportEncoder {
+	return &pendingReportEncoder{format: format, w: w, csv: csv.NewWriter(w)}
+}
+
+// begin writes the CSV header, or the start of the JSON object, the first
+// time it is called.
+func (e *pendingReportEncoder) begin() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+	if e.format == PendingReportCSV {
+		return e.csv.Write(pendingReportColumns)
+	}
+	_, err := io.WriteString(e.w, `{"rows":[`)
+	return err
+}
+
+func (e *pendingReportEncoder) write(rows []filedata.PendingReportRow) error {
+	if err := e.begin(); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := e.writeRow(row); err != nil {
+			return err
+		}
+		e.written++
+	}
+	return e.flush()
+}
+
+func (e *pendingReportEncoder) writeRow(row filedata.PendingReportRow) error {
+	if e.format == PendingReportCSV {
+		return e.csv.Write([]string{
+			strconv.FormatInt(row.FileID, 10),
+			strconv.FormatInt(row.UserID, 10),
+			string(row.Type),
+			strconv.FormatInt(row.Size, 10),
+			row.LatestBucket,
+			strings.Join(row.MissingBuckets, ";"),
+			strings.Join(row.InflightBuckets, ";"),
+			strconv.Itoa(row.AttemptCount),
+			strconv.FormatBool(row.IsDeadLettered),
+			strconv.FormatInt(row.CreatedAt, 10),
+			strconv.FormatInt(row.UpdatedAt, 10),
+			strconv.FormatInt(row.AgeSeconds, 10),
+		})
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if e.written > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *pendingReportEncoder) flush() error {
+	if e.format == PendingReportCSV {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := e.w.(interface{ Flush() }); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// close ends the report, which is complete once it returns nil.
+func (e *pendingReportEncoder) close() error {
+	if err := e.begin(); err != nil {
+		return err
+	}
+	if e.format == PendingReportJSON {
+		if _, err := io.WriteString(e.w, "]}\n"); err != nil {
+			return err
+		}
+	}
+	return e.flush()
+}
@@ -0,0 +1,315 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// defaultWorkerCount is the size of the shared pool when it isn't configured
+const defaultWorkerCount = 6
+
+// replicationWorker is the handle we keep for each running replication
+// goroutine.
+type replicationWorker struct {
+	// id is an arbitrary index of the worker, used for spacing out retries
+	// and for logging.
+	id int
+	// stop is closed to ask the worker to exit once its current iteration of
+	// tryReplicate completes. Unlike cancelling the pool's context, this does
+	// not abort any in-flight work.
+	stop chan struct{}
+	// pool is the pool that the worker belongs to
+	pool *replicationPool
+	// cancel aborts the worker's in-flight work, used by the watchdog to get
+	// rid of a wedged worker
+	cancel context.CancelFunc
+	// health is the worker's current state and heartbeat
+	health workerHealth
+	// startDelay is how long the worker waits before its first poll, so that
+	// workers started together don't all hit the database at once
+	startDelay time.Duration
+}
+
+// replicationPool tracks the replication workers so that their number can be
+// changed at runtime without restarting museum (which would drop the locks
+// held by the in-flight replications).
+//
+// There is a shared pool, and optionally a dedicated pool for each object type
+// that has its own worker count configured.
+type replicationPool struct {
+	// name is the object type of a dedicated pool, or sharedPoolName
+	name string
+	// filter restricts the rows that the workers of this pool pick up
+	filter fileDataRepo.PendingSyncFilter
+	// ctx is cancelled on shutdown, and aborts all in-flight work
+	ctx     context.Context
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	workers []*replicationWorker
+	nextID  int
+}
+
+// sharedPoolName is the name of the pool that replicates all the object types
+// that don't have a dedicated pool.
+const sharedPoolName = "default"
+
+func newReplicationPool(ctx context.Context, name string, filter fileDataRepo.PendingSyncFilter) *replicationPool {
+	return &replicationPool{ctx: ctx, name: name, filter: filter}
+}
+
+// spawn starts a new worker that runs fn until either the pool's context is
+// cancelled or the worker is asked to stop. The worker is expected to wait for
+// startDelay before doing anything.
+func (p *replicationPool) spawn(fn func(ctx context.Context, w *replicationWorker), startDelay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ctx, cancel := context.WithCancel(p.ctx)
+	w := &replicationWorker{id: p.nextID, stop: make(chan struct{}), pool: p, cancel: cancel, startDelay: startDelay}
+	w.health.set(workerIdle, 0)
+	p.nextID++
+	p.workers = append(p.workers, w)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer p.remove(w)
+		defer cancel()
+		fn(withWorker(ctx, w), w)
+	}()
+}
+
+// replace cancels the given worker and starts a new one in its place. The old
+// worker is no longer counted as part of the pool, even if its goroutine is
+// wedged and never returns.
+func (p *replicationPool) replace(w *replicationWorker, fn func(ctx context.Context, w *replicationWorker)) {
+	// The worker may have exited, or been stopped by shrinkTo, meanwhile
+	if !p.remove(w) {
+		return
+	}
+	close(w.stop)
+	w.cancel()
+	p.spawn(fn, 0)
+}
+
+// snapshot returns the workers currently in the pool.
+func (p *replicationPool) snapshot() []*replicationWorker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*replicationWorker(nil), p.workers...)
+}
+
+// shrinkTo signals the most recently started workers to exit until at most n
+// remain. It returns the number of workers that were signalled.
+func (p *replicationPool) shrinkTo(n int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stopped := 0
+	for len(p.workers) > n {
+		last := p.workers[len(p.workers)-1]
+		p.workers = p.workers[:len(p.workers)-1]
+		close(last.stop)
+		stopped++
+	}
+	return stopped
+}
+
+// remove drops w from the pool, returning false if it wasn't part of it.
+func (p *replicationPool) remove(w *replicationWorker) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.workers {
+		if p.workers[i] == w {
+			p.workers = append(p.workers[:i], p.workers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *replicationPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.workers)
+}
+
+// wait returns a channel that is closed once all the workers have exited.
+func (p *replicationPool) wait() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// newReplicationPools creates the shared pool, the pool for the rows over the
+// maximum object size, and a dedicated pool for each of the types in counts.
+// The shared pool skips the types with dedicated pools.
+func newReplicationPools(ctx context.Context, counts map[string]int) map[string]*replicationPool {
+	var dedicated []ente.ObjectType
+	pools := make(map[string]*replicationPool, len(counts)+2)
+	for name := range counts {
+		if name == sharedPoolName || name == oversizedPoolName {
+			continue
+		}
+		oType := ente.ObjectType(name)
+		dedicated = append(dedicated, oType)
+		pools[name] = newReplicationPool(ctx, name, fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{oType}})
+	}
+	pools[sharedPoolName] = newReplicationPool(ctx, sharedPoolName, fileDataRepo.PendingSyncFilter{ExcludeTypes: dedicated})
+	// The size limit is applied to all the pools on each poll, see
+	// applySizeLimit
+	pools[oversizedPoolName] = newReplicationPool(ctx, oversizedPoolName, fileDataRepo.PendingSyncFilter{})
+	return pools
+}
+
+// SetWorkerCount grows or shrinks the shared pool of replication workers to n.
+//
+// New workers start immediately. Excess workers are signalled to exit after
+// their current replication attempt completes, so no in-flight work is
+// aborted. It is safe to call concurrently.
+func (c *Controller) SetWorkerCount(n int) error {
+	return c.setPoolWorkerCount(sharedPoolName, n)
+}
+
+// SetTypeWorkerCount resizes the dedicated pool of workers for oType to n. The
+// pool must have been configured when replication was started.
+func (c *Controller) SetTypeWorkerCount(oType ente.ObjectType, n int) error {
+	return c.setPoolWorkerCount(string(oType), n)
+}
+
+func (c *Controller) setPoolWorkerCount(name string, n int) error {
+	if n < 0 {
+		return stacktrace.NewError("worker count must not be negative, got %d", n)
+	}
+	c.poolMu.Lock()
+	defer c.poolMu.Unlock()
+	if c.pools == nil {
+		return stacktrace.NewError("file data replication has not been started")
+	}
+	pool, ok := c.pools[name]
+	if !ok {
+		return stacktrace.NewError("no file data replication pool for %s, adding a pool requires a restart", name)
+	}
+	current := pool.size()
+	switch {
+	case n > current:
+		for i := current; i < n; i++ {
+			pool.spawn(c.replicate, startDelay(i-current))
+		}
+	case n < current:
+		pool.shrinkTo(n)
+	default:
+		return nil
+	}
+	log.Infof("Changed file data replication worker count for pool %s from %d to %d", name, current, n)
+	return nil
+}
+
+// ReloadWorkerCount re-reads replication.file-data.worker-count (or, in
+// catch-up mode, catch-up.worker-count) from the config and resizes the worker
+// pools accordingly.
+func (c *Controller) ReloadWorkerCount() error {
+	var errs []error
+	for name, n := range c.workerCounts() {
+		if err := c.setPoolWorkerCount(name, n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// configuredWorkerCounts returns the number of workers for each pool.
+//
+// replication.file-data.worker-count is either a number, which is the size of
+// the shared pool, or a map from object type to the number of workers for a
+// dedicated pool for that type. In the latter case the "default" key sets the
+// size of the shared pool.
+//
+// The pool for the rows over the maximum object size has
+// replication.file-data.oversized.worker-count workers if they are routed to
+// it, and none otherwise.
+func configuredWorkerCounts(v *viper.Viper) map[string]int {
+	const key = "replication.file-data.worker-count"
+	perType := v.GetStringMap(key)
+	if len(perType) == 0 {
+		workerCount := v.GetInt(key)
+		if workerCount == 0 {
+			workerCount = defaultWorkerCount
+		}
+		return map[string]int{sharedPoolName: workerCount, oversizedPoolName: oversizedWorkerCount(v)}
+	}
+	counts := map[string]int{sharedPoolName: defaultWorkerCount}
+	for name := range perType {
+		counts[name] = v.GetInt(key + "." + name)
+	}
+	counts[oversizedPoolName] = oversizedWorkerCount(v)
+	return counts
+}
+
+// sleep sleeps for d on behalf of the worker, returning early (with false) if
+// either the pool is shutting down or the worker has been asked to stop.
+func (w *replicationWorker) sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-w.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// idle waits for d, or until the worker is woken up through wake, on behalf of
+// the worker. It returns false if the pool is shutting down or the worker has
+// been asked to stop.
+func (w *replicationWorker) idle(ctx context.Context, d time.Duration, wake <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-w.stop:
+		return false
+	case <-wake:
+		return true
+	case <-timer.C:
+		return true
+	}
+}
+
+// wakeIdleWorkers makes up to n of the workers of this instance that are
+// waiting for rows to show up poll right away, for when rows have just been
+// queued. It doesn't wait for any worker to become idle, and the workers of the
+// other instances find the rows on their next poll.
+func (c *Controller) wakeIdleWorkers(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// stopped returns true if the worker should exit.
+func (w *replicationWorker) stopped(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,43 @@
+package filedata
+
+import (
+	"github.com/ente-io/museum/ente"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultFairUserWindow = 100
+
+// applyPriority sets the order in which the workers pick pending rows from
+// replication.file-data.priority.
+func applyPriority(filter fileDataRepo.PendingSyncFilter) fileDataRepo.PendingSyncFilter {
+	switch order := fileDataRepo.PendingSyncOrder(viper.GetString("replication.file-data.priority.order")); order {
+	case fileDataRepo.AnyOrder, fileDataRepo.OldestFirst, fileDataRepo.NewestFirst:
+		filter.Order = order
+	default:
+		log.Warnf("Unknown file data replication priority order %q, ignoring it", order)
+	}
+	const weightsKey = "replication.file-data.priority.type-weights"
+	weights := viper.GetStringMap(weightsKey)
+	if len(weights) > 0 {
+		filter.TypeWeights = make(map[ente.ObjectType]int, len(weights))
+		for name := range weights {
+			filter.TypeWeights[ente.ObjectType(name)] = viper.GetInt(weightsKey + "." + name)
+		}
+	}
+	if viper.GetBool("replication.file-data.priority.fair-users") {
+		filter.FairUserWindow = fairUserWindow()
+	}
+	return filter
+}
+
+// fairUserWindow returns replication.file-data.priority.fair-users-window, how
+// many of a user's pending rows are counted when interleaving the rows of
+// different users (see PendingSyncFilter.FairUserWindow).
+func fairUserWindow() int {
+	if n := viper.GetInt("replication.file-data.priority.fair-users-window"); n > 0 {
+		return n
+	}
+	return defaultFairUserWindow
+}
@@ -0,0 +1,69 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadProgress returns the row with the replication progress that has been
+// persisted for it, i.e. the buckets and side objects that it has already been
+// replicated to, in flight to, or is to be deleted from.
+//
+// Each destination is recorded as soon as it succeeds (see MoveBetweenBuckets),
+// so reloading this on every attempt, instead of relying on the row as it was
+// picked up, makes an attempt that follows one cut short by a restart, or by an
+// earlier row of the same batch taking long, resume exactly where the previous
+// one left off. It returns ErrLockLost if the row is no longer held with the
+// lock it was picked up with, and ErrRowDeleted if it has been deleted.
+func (c *Controller) loadProgress(ctx context.Context, row filedata.Row) (filedata.Row, error) {
+	rows, err := c.Repo.GetFilesData(ctx, row.Type, []int64{row.FileID})
+	if err != nil {
+		return row, stacktrace.Propagate(err, "failed to load the replication progress")
+	}
+	for _, persisted := range rows {
+		if persisted.UserID != row.UserID {
+			continue
+		}
+		if persisted.IsDeleted {
+			return row, stacktrace.Propagate(fileDataRepo.ErrRowDeleted, "")
+		}
+		if !sameLockToken(persisted.LockToken, row.LockToken) {
+			return row, stacktrace.Propagate(fileDataRepo.ErrLockLost, "")
+		}
+		resumed := withPersistedProgress(row, persisted)
+		if len(resumed.ReplicatedBuckets) > len(row.ReplicatedBuckets) {
+			log.WithFields(log.Fields{
+				"file_id": row.FileID,
+				"type":    row.Type,
+			}).Infof("Resuming replication, already replicated to %v", resumed.ReplicatedBuckets)
+		}
+		return resumed, nil
+	}
+	return row, stacktrace.Propagate(fileDataRepo.ErrRowDeleted, "row no longer exists")
+}
+
+// withPersistedProgress returns row with the replication progress of persisted,
+// the same row as currently stored. This includes the latest bucket, which may
+// have moved under the same lock (see SetLatestBucket), so that the objects are
+// copied from where they are now.
+func withPersistedProgress(row filedata.Row, persisted filedata.Row) filedata.Row {
+	row.LatestBucket = persisted.LatestBucket
+	row.ReplicatedBuckets = persisted.ReplicatedBuckets
+	row.InflightReplicas = persisted.InflightReplicas
+	row.DeleteFromBuckets = persisted.DeleteFromBuckets
+	row.CompressedBuckets = persisted.CompressedBuckets
+	row.ReplicatedSideObjects = persisted.ReplicatedSideObjects
+	row.ReplicaVersions = persisted.ReplicaVersions
+	return row
+}
+
+func sameLockToken(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
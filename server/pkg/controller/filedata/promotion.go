@@ -0,0 +1,239 @@
+package filedata
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultPromotionCheckInterval          = 10 * time.Second
+	defaultPromotionCheckBatchSize         = 1000
+	defaultPromotionCheckRequeuesPerSecond = 10
+	promotionCheckLockDuration             = 10 * time.Minute
+)
+
+type promotionOutcome int
+
+const (
+	// the row turned out to be in the bucket already
+	promotionOutcomeConfirmed promotionOutcome = iota
+	// the row was queued for replication to the bucket
+	promotionOutcomeRequeued
+	// the row is already queued, or is being replicated
+	promotionOutcomeWaiting
+	// the row can't be replicated to the bucket
+	promotionOutcomeUnconfirmed
+)
+
+// StartPromotionCheck creates a job that confirms that every row of a type is
+// in bucketID before it is promoted to the type's primary bucket, the inverse
+// of a drain: the rows that aren't recorded in it are queued for replication
+// to it, and the job is ready (the go for the promotion) once none are left.
+//
+// The bucket must already be configured as a replica of the type, so that the
+// workers replicate to it. The check covers the rows of the type written after
+// it was created too, so it isn't ready while uploads that haven't reached the
+// bucket yet keep coming in. The job itself is run in the background by the
+// instances that replicate, see runPromotionChecks.
+func (c *Controller) StartPromotionCheck(ctx context.Context, req filedata.PromotionCheckRequest) (*filedata.PromotionCheck, error) {
+	if !slices.Contains(replicatedTypes, req.Type) {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage(fmt.Sprintf("%s is not replicated", req.Type)), "")
+	}
+	if !c.S3Config.IsBucketActive(req.Bucket) {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("unknown bucket "+req.Bucket), "")
+	}
+	if !c.wantedBuckets(req.Type)[req.Bucket] {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage(
+			fmt.Sprintf("%s is not configured as a bucket for %s, add it to s3.file-data-config first", req.Bucket, req.Type)), "")
+	}
+	check, err := c.Repo.CreatePromotionCheck(ctx, req.Type, req.Bucket)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	log.WithFields(log.Fields{
+		"id":        check.ID,
+		"type":      check.Type,
+		"bucket":    check.Bucket,
+		"total":     check.Total,
+		"remaining": check.Remaining,
+	}).Info("Created file data promotion check")
+	return check, nil
+}
+
+// GetPromotionChecks returns the progress of all the promotion checks.
+func (c *Controller) GetPromotionChecks(ctx context.Context) ([]filedata.PromotionCheck, error) {
+	return c.Repo.GetPromotionChecks(ctx)
+}
+
+// GetPromotionCheck returns the progress of the promotion check, whose Ready
+// tells whether its bucket is safe to promote.
+func (c *Controller) GetPromotionCheck(ctx context.Context, id int64) (*filedata.PromotionCheck, error) {
+	return c.Repo.GetPromotionCheck(ctx, id)
+}
+
+// runPromotionChecks advances the running promotion checks by a batch every
+// replication.file-data.promotion-check.interval until ctx is cancelled.
+//
+// The progress of a check is kept in the database, so checks interrupted by a
+// restart are resumed.
+func (c *Controller) runPromotionChecks(ctx context.Context) {
+	interval := viper.GetDuration("replication.file-data.promotion-check.interval")
+	if interval <= 0 {
+		interval = defaultPromotionCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ids, err := c.Repo.GetRunningPromotionCheckIDs(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("Could not fetch file data promotion checks")
+			}
+			continue
+		}
+		for _, id := range ids {
+			if err := c.runPromotionCheckBatch(ctx, id); err != nil {
+				log.WithField("id", id).WithError(err).Error("Could not run file data promotion check batch")
+			}
+		}
+	}
+}
+
+// runPromotionCheckBatch goes through the next
+// replication.file-data.promotion-check.batch-size rows of the check that
+// aren't in its bucket, unless another instance is running the check at the
+// moment. Rows are queued for replication at most
+// promotion-check.requeues-per-second, so that the check doesn't flood the
+// queue.
+func (c *Controller) runPromotionCheckBatch(ctx context.Context, id int64) error {
+	batchSize := viper.GetInt("replication.file-data.promotion-check.batch-size")
+	if batchSize <= 0 {
+		batchSize = defaultPromotionCheckBatchSize
+	}
+	requeuesPerSecond := viper.GetFloat64("replication.file-data.promotion-check.requeues-per-second")
+	if requeuesPerSecond <= 0 {
+		requeuesPerSecond = defaultPromotionCheckRequeuesPerSecond
+	}
+	limiter := rate.NewLimiter(rate.Limit(requeuesPerSecond), 1)
+
+	lockTill := time.Now().Add(promotionCheckLockDuration).UnixMicro()
+	check, err := c.Repo.ClaimPromotionCheck(ctx, id, lockTill)
+	if err != nil || check == nil {
+		return err
+	}
+	batch := fileDataRepo.PromotionCheckBatch{LastFileID: check.LastFileID}
+	rows, err := c.Repo.GetPromotionGaps(ctx, check.Type, check.Bucket, check.LastFileID, batchSize)
+	if err == nil {
+		batch.PassEnded = len(rows) < batchSize
+		for _, row := range rows {
+			if ctx.Err() != nil {
+				batch.PassEnded = false
+				break
+			}
+			switch c.checkPromotionRow(ctx, row, check.Bucket, limiter) {
+			case promotionOutcomeRequeued:
+				batch.Requeued++
+			case promotionOutcomeWaiting:
+				batch.Waiting++
+			case promotionOutcomeUnconfirmed:
+				batch.Unconfirmed++
+			}
+			batch.LastFileID = row.FileID
+		}
+		if batch.Requeued > 0 {
+			c.wakeIdleWorkers(int(batch.Requeued))
+		}
+		if batch.PassEnded {
+			batch.Remaining, batch.Newer, err = c.Repo.CountPromotionGaps(ctx, check.Type, check.Bucket, check.CreatedAt)
+			if err != nil {
+				batch.PassEnded = false
+			}
+		}
+	}
+	// Record what was done even if the batch was cut short, so that the next
+	// batch continues from there
+	check, finishErr := c.Repo.FinishPromotionCheckBatch(context.WithoutCancel(ctx), id, lockTill, batch)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if finishErr != nil {
+		return stacktrace.Propagate(finishErr, "")
+	}
+	logger := log.WithFields(log.Fields{
+		"id":          check.ID,
+		"type":        check.Type,
+		"bucket":      check.Bucket,
+		"total":       check.Total,
+		"requeued":    check.Requeued,
+		"waiting":     check.Waiting,
+		"unconfirmed": check.Unconfirmed,
+		"remaining":   check.Remaining,
+		"passes":      check.Passes,
+	})
+	switch {
+	case check.Ready:
+		logger.Info("File data promotion check is ready, every row is in the bucket")
+	case batch.PassEnded:
+		logger.Warnf("File data promotion check pass ended with %d rows still not in the bucket (%d of them written after the check started), starting over",
+			check.Remaining, batch.Newer)
+	default:
+		logger.Debug("File data promotion check progress")
+	}
+	return nil
+}
+
+// checkPromotionRow queues the row for replication to bucketID, unless it is
+// already in it, queued, or can't be replicated to it.
+func (c *Controller) checkPromotionRow(ctx context.Context, row filedata.Row, bucketID string, limiter *rate.Limiter) promotionOutcome {
+	outcome := promotionOutcomeWaiting
+	logger := rowLogger(row).WithField(logDestBucket, bucketID)
+	locked, err := c.withBorrowedLock(ctx, row, promotionCheckLockDuration, func(row filedata.Row) error {
+		var err error
+		outcome, err = c.checkPromotionLockedRow(ctx, row, bucketID, limiter)
+		return err
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Could not check file data for promotion")
+		return promotionOutcomeUnconfirmed
+	}
+	if locked {
+		// Being replicated, it will be picked up by a later pass
+		return promotionOutcomeWaiting
+	}
+	return outcome
+}
+
+func (c *Controller) checkPromotionLockedRow(ctx context.Context, row filedata.Row, bucketID string, limiter *rate.Limiter) (promotionOutcome, error) {
+	if bucketID == row.LatestBucket || (array.StringInList(bucketID, row.ReplicatedBuckets) && !array.StringInList(bucketID, row.InflightReplicas)) {
+		return promotionOutcomeConfirmed, nil
+	}
+	if bucketID != c.S3Config.GetBucketID(row.Type) && !array.StringInList(bucketID, c.replicaBuckets(row)) {
+		return promotionOutcomeUnconfirmed, fmt.Errorf("the row's replica override excludes %s", bucketID)
+	}
+	if row.PendingSync && !row.IsDeadLettered {
+		return promotionOutcomeWaiting, nil
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return promotionOutcomeUnconfirmed, err
+	}
+	if err := c.Repo.RequeueMissingReplica(ctx, row, bucketID); err != nil {
+		return promotionOutcomeUnconfirmed, stacktrace.Propagate(err, "")
+	}
+	return promotionOutcomeRequeued, nil
+}
@@ -0,0 +1,251 @@
+package filedata
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultPurgeInterval    = 5 * time.Minute
+	defaultPurgeBatchSize   = 100
+	defaultPurgeMinReplicas = 1
+)
+
+// Outcomes of purging the stale copies of a row, as counted in
+// mStaleCopyPurges.
+const (
+	purgeOutcomePurged  = "purged"
+	purgeOutcomeRefused = "refused"
+	purgeOutcomeFailed  = "failed"
+	purgeOutcomeLocked  = "locked"
+)
+
+// errLastCopy is returned by confirmRetainedCopies when the copies that a row
+// keeps can't be confirmed, so deleting its stale copies could leave it with
+// fewer copies than it is supposed to have, or none at all.
+var errLastCopy = errors.New("refusing to delete copies before the retained ones are confirmed")
+
+// purgeMinReplicas returns replication.file-data.purge.min-replicas, the number
+// of the row's replicas (other than its latest bucket) that must be confirmed to
+// have the row before its stale copies are deleted. It is capped at the number
+// of required replicas that the row has, so that the rows of types without
+// replicas can still be purged once their latest copy is confirmed.
+func (c *Controller) purgeMinReplicas(row filedata.Row) int {
+	n := viper.GetInt("replication.file-data.purge.min-replicas")
+	if n <= 0 {
+		n = defaultPurgeMinReplicas
+	}
+	var required []string
+	for _, bucketID := range append([]string{c.S3Config.GetBucketID(row.Type)}, c.replicaBuckets(row)...) {
+		if bucketID != row.LatestBucket && !c.isBestEffort(row.Type, bucketID) &&
+			!c.S3Config.SharesBackend(row.LatestBucket, bucketID) && !slices.Contains(required, bucketID) {
+			required = append(required, bucketID)
+		}
+	}
+	return min(n, len(required))
+}
+
+// runPurge deletes the stale copies of the live rows that are done replicating,
+// every replication.file-data.purge.interval until ctx is cancelled. These are
+// the copies in the buckets that a row was in before it moved to another
+// latest bucket, which the row records in its delete_from_buckets. Deleted rows
+// are left to the delete workers.
+//
+// Like runBestEffort, each round goes through the next purge.batch-size rows of
+// each type, starting over once it gets to the last one. Nothing is deleted
+// unless replication.file-data.purge.enabled is set, in dry-run mode, or while
+// replication is paused.
+func (c *Controller) runPurge(ctx context.Context) {
+	if !viper.GetBool("replication.file-data.purge.enabled") {
+		return
+	}
+	interval := viper.GetDuration("replication.file-data.purge.interval")
+	if interval <= 0 {
+		interval = defaultPurgeInterval
+	}
+	cursors := map[ente.ObjectType]int64{}
+	for sleepWithContext(ctx, interval) {
+		if c.dryRun || c.pause.status().Paused {
+			continue
+		}
+		for _, oType := range replicatedTypes {
+			cursors[oType] = c.runPurgeBatch(ctx, oType, cursors[oType])
+		}
+	}
+}
+
+// runPurgeBatch purges the batch of rows after afterFileID, and returns where
+// the next batch starts.
+func (c *Controller) runPurgeBatch(ctx context.Context, oType ente.ObjectType, afterFileID int64) int64 {
+	batchSize := viper.GetInt("replication.file-data.purge.batch-size")
+	if batchSize <= 0 {
+		batchSize = defaultPurgeBatchSize
+	}
+	rows, err := c.Repo.GetRowsWithStaleCopies(ctx, oType, afterFileID, batchSize)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).Errorf("Could not fetch %s file data with stale copies", oType)
+		}
+		return afterFileID
+	}
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			return afterFileID
+		}
+		c.purgeRow(ctx, row)
+		afterFileID = row.FileID
+	}
+	if len(rows) < batchSize {
+		return 0
+	}
+	return afterFileID
+}
+
+// purgeRow deletes the stale copies of a row, with the row locked so that it
+// isn't replicated (or updated) meanwhile. Rows that are locked are left for a
+// later round, and so are the ones whose retained copies can't be confirmed.
+func (c *Controller) purgeRow(ctx context.Context, row filedata.Row) {
+	lock := newLockPolicy().durationFor(row.Size)
+	locked, err := c.withBorrowedLock(ctx, row, lock, func(row filedata.Row) error {
+		return c.purgeLockedRow(ctx, row)
+	})
+	switch {
+	case errors.Is(err, errLastCopy):
+		mStaleCopyPurges.WithLabelValues(string(row.Type), purgeOutcomeRefused).Inc()
+		rowLogger(row).WithError(err).Warn("Not deleting stale file data copies, the retained copies could not be confirmed")
+	case err != nil:
+		mStaleCopyPurges.WithLabelValues(string(row.Type), purgeOutcomeFailed).Inc()
+		rowLogger(row).WithError(err).Warn("Could not delete stale file data copies, will retry")
+	case locked:
+		mStaleCopyPurges.WithLabelValues(string(row.Type), purgeOutcomeLocked).Inc()
+	default:
+		mStaleCopyPurges.WithLabelValues(string(row.Type), purgeOutcomePurged).Inc()
+	}
+}
+
+// purgeLockedRow deletes the stale copies of the locked row, once its retained
+// copies have been confirmed (see confirmRetainedCopies). Each stale bucket is
+// only removed from the row after its objects are verified to be gone, so a
+// purge that is cut short is picked up where it stopped by a later round, and
+// the retained copies are confirmed again before anything else is deleted.
+func (c *Controller) purgeLockedRow(ctx context.Context, row filedata.Row) error {
+	// The row may have changed since it was listed
+	if row.IsDeleted || row.PendingSync || len(row.DeleteFromBuckets) == 0 {
+		return nil
+	}
+	if err := c.confirmRetainedCopies(ctx, row); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	stale := slices.Clone(row.DeleteFromBuckets)
+	sort.Strings(stale)
+	for _, bucketID := range stale {
+		if !c.holdsRetainedCopy(row, bucketID) {
+			for _, objectKey := range filedata.AllObjects(row.FileID, row.UserID, row.Type) {
+				if err := c.deleteAndVerify(ctx, objectKey, bucketID); err != nil {
+					return stacktrace.Propagate(err, "could not delete stale copy of %s from %s", objectKey, bucketID)
+				}
+			}
+		}
+		if err := c.Repo.RemoveBucket(row, bucketID, fileDataRepo.DeletionColumn); err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+		rowLogger(row).WithField(logDestBucket, bucketID).Info("Deleted stale file data copy")
+	}
+	return nil
+}
+
+// holdsRetainedCopy reports whether bucketID is, or is backed by the same store
+// as, a bucket that the row keeps a copy in (its latest bucket, or one that it
+// is replicated or in flight to). Deleting the row's objects from such a bucket
+// would delete the copy that is kept, so the bucket is only removed from the
+// row's stale buckets.
+func (c *Controller) holdsRetainedCopy(row filedata.Row, bucketID string) bool {
+	retained := append([]string{row.LatestBucket}, row.ReplicatedBuckets...)
+	retained = append(retained, row.InflightReplicas...)
+	for _, other := range retained {
+		if other == bucketID || c.S3Config.SharesBackend(other, bucketID) {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmRetainedCopies checks the copies that the row keeps before any of its
+// stale copies are deleted: the latest copy must match the recorded checksum,
+// and at least purgeMinReplicas of its replicated copies must match the latest
+// one, side objects included. Copies in buckets backed by the same store as the
+// latest bucket don't count, as they aren't copies of their own.
+//
+// It returns an error wrapping errLastCopy if the copies couldn't be confirmed,
+// and other errors if they couldn't be checked.
+func (c *Controller) confirmRetainedCopies(ctx context.Context, row filedata.Row) error {
+	objectKey := row.S3FileMetadataObjectKey()
+	data, err := c.downloadLogicalObject(ctx, objectKey, row.LatestBucket)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return stacktrace.Propagate(fmt.Errorf("latest copy is missing from %s: %w", row.LatestBucket, errLastCopy), "")
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to read latest copy from %s", row.LatestBucket)
+	}
+	checksum := checksumOf(data)
+	if row.Checksum == nil {
+		if err := verifyEmbeddedChecksum(data); err != nil {
+			return stacktrace.Propagate(fmt.Errorf("latest copy in %s is corrupt (%v): %w", row.LatestBucket, err, errLastCopy), "")
+		}
+	} else if *row.Checksum != checksum {
+		return stacktrace.Propagate(fmt.Errorf("latest copy in %s does not match the recorded checksum: %w", row.LatestBucket, errLastCopy), "")
+	}
+	md5Sum := md5.Sum(data)
+	plainMD5 := hex.EncodeToString(md5Sum[:])
+	confirmed := 0
+	for _, bucketID := range c.replicatedCopies(row) {
+		if c.S3Config.SharesBackend(row.LatestBucket, bucketID) {
+			continue
+		}
+		ok, err := c.verifyReplica(ctx, objectKey, bucketID, replicaVersion(row, bucketID), int64(len(data)), plainMD5, checksum)
+		if err != nil {
+			return stacktrace.Propagate(err, "could not verify copy in %s", bucketID)
+		}
+		if ok {
+			ok, err = c.hasSideObjects(ctx, row, bucketID)
+			if err != nil {
+				return stacktrace.Propagate(err, "")
+			}
+		}
+		if ok {
+			confirmed++
+		}
+	}
+	if required := c.purgeMinReplicas(row); confirmed < required {
+		return stacktrace.Propagate(fmt.Errorf("%d of the %d required replicas confirmed: %w", confirmed, required, errLastCopy), "")
+	}
+	return nil
+}
+
+// hasSideObjects reports whether each of the row's side objects is in bucketID.
+func (c *Controller) hasSideObjects(ctx context.Context, row filedata.Row, bucketID string) (bool, error) {
+	for _, sideKey := range row.SideObjectKeys() {
+		_, _, err := c.headObject(ctx, sideKey, bucketID)
+		if errors.Is(err, objectstore.ErrNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, stacktrace.Propagate(err, "could not check %s in %s", sideKey, bucketID)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,57 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// reconcileExisting checks with a HEAD request whether the metadata object is
+// already present in each of the pending buckets, e.g. because a previous run
+// uploaded it but failed before updating the row. Buckets that already have an
+// identical copy are recorded as replicated, and the buckets where the object
+// still needs to be uploaded are returned.
+//
+// A copy is considered identical only if it has the same size and the same
+// plain MD5 ETag as the object in the latest bucket. When that can't be
+// established (multipart, encrypted or compressed objects, or any error), the
+// bucket is treated as missing the object.
+func (c *Controller) reconcileExisting(ctx context.Context, row filedata.Row, pending map[string]bool) map[string]bool {
+	objectKey := row.S3FileMetadataObjectKey()
+	srcSize, srcETag, err := c.headObject(ctx, objectKey, row.LatestBucket)
+	if err != nil {
+		return pending
+	}
+	srcMD5, ok := plainMD5ETag(srcETag)
+	if !ok || srcSize != row.Size {
+		return pending
+	}
+	missing := make(map[string]bool, len(pending))
+	for bucketID := range pending {
+		size, etag, err := c.headObject(ctx, objectKey, bucketID)
+		dstMD5, ok := plainMD5ETag(etag)
+		if err != nil || !ok || size != srcSize || dstMD5 != srcMD5 {
+			missing[bucketID] = true
+			continue
+		}
+		if err := c.recordAsReplicated(ctx, row, bucketID); err != nil {
+			log.WithField("file_id", row.FileID).WithError(err).Warnf("Could not record existing copy in %s", bucketID)
+			missing[bucketID] = true
+			continue
+		}
+		log.WithField("file_id", row.FileID).Infof("Found existing copy in %s, recorded it without uploading", bucketID)
+	}
+	return missing
+}
+
+// recordAsReplicated updates the row to record that bucketID has a verified
+// copy of the object.
+func (c *Controller) recordAsReplicated(ctx context.Context, row filedata.Row, bucketID string) error {
+	if err := c.registerAttempt(ctx, row, bucketID); err != nil {
+		return stacktrace.Propagate(err, "could not register replication attempt")
+	}
+	return c.Repo.MoveBetweenBuckets(ctx, row, bucketID, fileDataRepo.InflightRepColumn, fileDataRepo.ReplicationColumn)
+}
@@ -0,0 +1,225 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultReconcileBatchSize      = 1000
+	defaultReconcileHeadsPerSecond = 10
+	reconcileLockDuration          = 10 * time.Minute
+)
+
+const (
+	correctionRecorded      = "recorded"
+	correctionRequeued      = "requeued"
+	correctionSourceMissing = "source-missing"
+)
+
+// reconciler periodically checks that the buckets recorded in the rows match
+// the objects that are actually present in them.
+//
+// Each run checks the next replication.file-data.reconcile.batch-size rows,
+// continuing from where the previous run stopped, so that consecutive runs
+// sweep through the entire table. With the "list" strategy, runs instead sweep
+// through the bucket listings, see reconcileListed.
+type reconciler struct {
+	running atomic.Bool
+	mu      sync.Mutex
+	// position of the last row checked
+	afterFileID int64
+	afterType   ente.ObjectType
+	// position in the bucket listings, when reconciling by listing
+	listPos    auditPosition
+	lastReport *filedata.ReconciliationReport
+}
+
+// StartReconciliation schedules the reconciliation job as per the cron spec in
+// replication.file-data.reconcile.schedule, till ctx is done. It does nothing
+// if no schedule is configured.
+func (c *Controller) StartReconciliation(ctx context.Context) error {
+	return scheduleJob(ctx, "reconciliation", viper.GetString("replication.file-data.reconcile.schedule"), func() {
+		c.Reconcile(ctx)
+	})
+}
+
+// Reconcile runs a single reconciliation pass, and returns its report. If a
+// pass is already running it returns nil.
+func (c *Controller) Reconcile(ctx context.Context) *filedata.ReconciliationReport {
+	r := c.reconciler
+	if !r.running.CompareAndSwap(false, true) {
+		log.Info("File data reconciliation is already running, skipping")
+		return nil
+	}
+	defer r.running.Store(false)
+
+	batchSize := viper.GetInt("replication.file-data.reconcile.batch-size")
+	if batchSize <= 0 {
+		batchSize = defaultReconcileBatchSize
+	}
+	headsPerSecond := viper.GetFloat64("replication.file-data.reconcile.heads-per-second")
+	if headsPerSecond <= 0 {
+		headsPerSecond = defaultReconcileHeadsPerSecond
+	}
+	limiter := c.newJobLimiter(jobReconcile, headsPerSecond)
+
+	report := &filedata.ReconciliationReport{StartedAt: time.Now().UnixMicro(), Strategy: reconcileStrategy(), Corrections: make([]filedata.ReconciliationCorrection, 0)}
+	if report.Strategy == reconcileByListing {
+		c.reconcileListed(ctx, report, batchSize, limiter)
+	} else {
+		c.reconcileRows(ctx, report, batchSize, limiter)
+	}
+	report.FinishedAt = time.Now().UnixMicro()
+	r.mu.Lock()
+	r.lastReport = report
+	r.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"rows_checked": report.RowsChecked,
+		"rows_skipped": report.RowsSkipped,
+		"errors":       report.Errors,
+		"corrections":  len(report.Corrections),
+		"strategy":     report.Strategy,
+	}).Info("File data reconciliation finished")
+	return report
+}
+
+// reconcileRows reconciles the next batchSize rows, one HEAD request per bucket
+// of each row.
+func (c *Controller) reconcileRows(ctx context.Context, report *filedata.ReconciliationReport, batchSize int, limiter *jobLimiter) {
+	r := c.reconciler
+	r.mu.Lock()
+	afterFileID, afterType := r.afterFileID, r.afterType
+	r.mu.Unlock()
+	rows, err := c.Repo.GetRowsForReconciliation(ctx, afterFileID, afterType, batchSize)
+	if err != nil {
+		log.WithError(err).Error("Could not fetch rows for file data reconciliation")
+		report.Errors++
+		rows = nil
+	}
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			break
+		}
+		c.reconcileIntoReport(ctx, report, row, limiter, false)
+		afterFileID, afterType = row.FileID, row.Type
+	}
+	if err == nil && len(rows) < batchSize && ctx.Err() == nil {
+		// Reached the end of the table, start over in the next run
+		afterFileID, afterType = 0, ""
+	}
+	r.mu.Lock()
+	r.afterFileID, r.afterType = afterFileID, afterType
+	r.mu.Unlock()
+}
+
+// reconcileIntoReport reconciles the row, and adds the outcome to the report. A
+// row that has been counted as checked already isn't counted again.
+func (c *Controller) reconcileIntoReport(ctx context.Context, report *filedata.ReconciliationReport, row filedata.Row, limiter *jobLimiter, counted bool) {
+	corrections, locked, err := c.reconcileRow(ctx, row, limiter)
+	switch {
+	case locked:
+		report.RowsSkipped++
+	case err != nil:
+		log.WithField("file_id", row.FileID).WithField("type", row.Type).WithError(err).Warn("Could not reconcile file data")
+		report.Errors++
+	case !counted:
+		report.RowsChecked++
+		mJobRowsChecked.WithLabelValues(jobReconcile).Inc()
+	}
+	report.Corrections = append(report.Corrections, corrections...)
+}
+
+// GetReconciliationReport returns the report of the last reconciliation run, or
+// nil if none has run yet.
+func (c *Controller) GetReconciliationReport() *filedata.ReconciliationReport {
+	c.reconciler.mu.Lock()
+	defer c.reconciler.mu.Unlock()
+	return c.reconciler.lastReport
+}
+
+// reconcileRow corrects the row to match the buckets while holding its lock.
+// It returns locked as true, and does nothing, if the row is locked by someone
+// else.
+func (c *Controller) reconcileRow(ctx context.Context, row filedata.Row, limiter *jobLimiter) (corrections []filedata.ReconciliationCorrection, locked bool, err error) {
+	locked, err = c.withBorrowedLock(ctx, row, reconcileLockDuration, func(row filedata.Row) error {
+		var err error
+		corrections, err = c.reconcileBuckets(ctx, row, limiter)
+		return err
+	})
+	return corrections, locked, err
+}
+
+// reconcileBuckets HEADs the object in the latest bucket and in each replica
+// bucket of the row, and fixes up the row where it is wrong.
+func (c *Controller) reconcileBuckets(ctx context.Context, row filedata.Row, limiter *jobLimiter) ([]filedata.ReconciliationCorrection, error) {
+	corrections := make([]filedata.ReconciliationCorrection, 0)
+	correct := func(bucketID string, action string) {
+		rowLogger(row).WithFields(log.Fields{
+			logDestBucket: bucketID,
+			"action":      action,
+		}).Info("Reconciled file data")
+		corrections = append(corrections, filedata.ReconciliationCorrection{FileID: row.FileID, Type: row.Type, Bucket: bucketID, Action: action})
+	}
+	objectKey := row.S3FileMetadataObjectKey()
+	if err := limiter.Wait(ctx); err != nil {
+		return corrections, err
+	}
+	srcSize, srcETag, err := c.headObject(ctx, objectKey, row.LatestBucket)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		correct(row.LatestBucket, correctionSourceMissing)
+		return corrections, nil
+	}
+	if err != nil {
+		return corrections, err
+	}
+	srcMD5, srcHasMD5 := plainMD5ETag(srcETag)
+	var errs []error
+	for _, bucketID := range c.replicaBuckets(row) {
+		if bucketID == row.LatestBucket {
+			continue
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return corrections, err
+		}
+		recorded := array.StringInList(bucketID, row.ReplicatedBuckets)
+		size, etag, err := c.headObject(ctx, objectKey, bucketID)
+		switch {
+		case errors.Is(err, objectstore.ErrNotFound):
+			if recorded {
+				if err := c.Repo.RequeueMissingReplica(ctx, row, bucketID); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				correct(bucketID, correctionRequeued)
+			}
+		case err != nil:
+			errs = append(errs, err)
+		case !recorded:
+			// Only record copies that are verifiably identical, the others
+			// are left for replication to overwrite (or, in object locked
+			// buckets, to check, see existingImmutableCopy)
+			dstMD5, ok := plainMD5ETag(etag)
+			if !srcHasMD5 || !ok || size != srcSize || dstMD5 != srcMD5 {
+				continue
+			}
+			if err := c.recordAsReplicated(ctx, row, bucketID); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			correct(bucketID, correctionRecorded)
+		}
+	}
+	return corrections, errors.Join(errs...)
+}
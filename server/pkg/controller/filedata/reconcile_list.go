@@ -0,0 +1,201 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Ways in which reconciliation checks the rows against the buckets.
+const (
+	reconcileByHead    = "head"
+	reconcileByListing = "list"
+)
+
+// maxListPageSize is the most keys that S3 returns in a single listing.
+const maxListPageSize = 1000
+
+// listedTypes are the types whose objects can be matched against their rows by
+// key, each of their rows having a single metadata object.
+var listedTypes = []ente.ObjectType{ente.MlData, ente.PreviewVideo}
+
+// reconcileStrategy returns replication.file-data.reconcile.strategy, "head"
+// by default.
+func reconcileStrategy() string {
+	if viper.GetString("replication.file-data.reconcile.strategy") == reconcileByListing {
+		return reconcileByListing
+	}
+	return reconcileByHead
+}
+
+// reconcileTarget is a bucket that the objects of a type are listed in.
+type reconcileTarget struct {
+	oType    ente.ObjectType
+	bucketID string
+	lister   objectstore.Lister
+}
+
+// reconcileTargets returns the buckets of each listed type (see listedBuckets),
+// in the order in which reconciliation goes through them. Buckets that can't
+// be listed are left out with a warning.
+func (c *Controller) reconcileTargets(ctx context.Context) ([]reconcileTarget, error) {
+	var targets []reconcileTarget
+	for _, oType := range listedTypes {
+		buckets, err := c.listedBuckets(ctx, oType)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		for _, bucketID := range buckets {
+			lister, ok := c.S3Config.GetObjectStore(bucketID).(objectstore.Lister)
+			if !ok {
+				log.Warnf("Bucket %s can't be listed, not reconciling %s in it", bucketID, oType)
+				continue
+			}
+			targets = append(targets, reconcileTarget{oType: oType, bucketID: bucketID, lister: lister})
+		}
+	}
+	return targets, nil
+}
+
+// reconcileListed reconciles the next pages of the bucket listings, up to
+// batchSize keys in all, continuing from where the previous run stopped.
+//
+// Each page is compared with the rows in bulk, the same way that an audit does
+// (see auditPage), and only the rows that don't match it are reconciled with
+// HEAD requests, see reconcileRow. These requests also guard against listings
+// that are not up to date, e.g. an object that was uploaded after the page was
+// listed. The listing of each page and the database queries are rate limited
+// along with the HEAD requests.
+func (c *Controller) reconcileListed(ctx context.Context, report *filedata.ReconciliationReport, batchSize int, limiter *jobLimiter) {
+	targets, err := c.reconcileTargets(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Could not look up the buckets to reconcile by listing")
+		return
+	}
+	if len(targets) == 0 {
+		return
+	}
+	c.reconcileListings(ctx, report, targets, batchSize, limiter)
+}
+
+// listedRows are the rows that a run of reconcileListed has come across. A row
+// is listed in every bucket that it is in, but it is only counted once, and
+// reconciled at most once, since reconciling a row checks all its buckets.
+type listedRows struct {
+	counted    map[rowKey]bool
+	reconciled map[rowKey]bool
+}
+
+// reconcileListings reconciles the next pages of the listings of targets, see
+// reconcileListed.
+func (c *Controller) reconcileListings(ctx context.Context, report *filedata.ReconciliationReport, targets []reconcileTarget, batchSize int, limiter *jobLimiter) {
+	r := c.reconciler
+	r.mu.Lock()
+	pos := r.listPos
+	r.mu.Unlock()
+	i := 0
+	for j, t := range targets {
+		if t.oType == pos.Type && t.bucketID == pos.Bucket {
+			i = j
+		}
+	}
+	if targets[i].oType != pos.Type || targets[i].bucketID != pos.Bucket {
+		// The buckets have changed since the last run
+		pos = auditPosition{}
+	}
+	listed := listedRows{counted: make(map[rowKey]bool), reconciled: make(map[rowKey]bool)}
+	pageSize := min(batchSize, maxListPageSize)
+	for keys := 0; keys < batchSize && ctx.Err() == nil; keys += pageSize {
+		t := targets[i]
+		var findings []filedata.AuditFinding
+		var checked []filedata.Row
+		run := newAuditRun(t.oType, pageSize, limiter)
+		run.onFinding = func(f filedata.AuditFinding) {
+			findings = append(findings, f)
+		}
+		run.onRowChecked = func(row filedata.Row) {
+			checked = append(checked, row)
+		}
+		after, more, err := c.auditPage(ctx, run, t.bucketID, t.lister, pos.After)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Errorf("Could not list %s for file data reconciliation", t.bucketID)
+				report.Errors++
+			}
+			break
+		}
+		report.ObjectsListed += run.report.ObjectsListed
+		// The rows that match the listing are checked as far as it goes, the
+		// others are counted once they are reconciled
+		mismatched := c.reconcileFindings(ctx, report, t.oType, findings, limiter, listed)
+		for _, row := range checked {
+			key := rowKey{fileID: row.FileID, oType: row.Type}
+			if !mismatched[row.FileID] && !listed.counted[key] {
+				listed.counted[key] = true
+				report.RowsChecked++
+				mJobRowsChecked.WithLabelValues(jobReconcile).Inc()
+			}
+		}
+		pos = auditPosition{Type: t.oType, Bucket: t.bucketID, After: after}
+		if !more {
+			i++
+			if i == len(targets) {
+				// Reached the end of the listings, start over in the next run
+				pos = auditPosition{}
+				break
+			}
+			pos = auditPosition{Type: targets[i].oType, Bucket: targets[i].bucketID}
+		}
+	}
+	r.mu.Lock()
+	r.listPos = pos
+	r.mu.Unlock()
+}
+
+// reconcileFindings reconciles the rows of the gaps and of the unrecorded copies
+// found in a page of a listing, unless they have been reconciled already, and
+// returns the file IDs of the rows that had findings. Orphans have no row to
+// reconcile, they are cleaned up separately.
+func (c *Controller) reconcileFindings(ctx context.Context, report *filedata.ReconciliationReport, oType ente.ObjectType, findings []filedata.AuditFinding, limiter *jobLimiter, listed listedRows) map[int64]bool {
+	var fileIDs []int64
+	mismatched := make(map[int64]bool)
+	for _, f := range findings {
+		if f.Kind == auditOrphan || mismatched[f.FileID] {
+			continue
+		}
+		mismatched[f.FileID] = true
+		if !listed.reconciled[rowKey{fileID: f.FileID, oType: oType}] {
+			fileIDs = append(fileIDs, f.FileID)
+		}
+	}
+	if len(fileIDs) == 0 {
+		return mismatched
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return mismatched
+	}
+	rows, err := c.Repo.GetFilesData(ctx, oType, fileIDs)
+	if err != nil {
+		log.WithError(err).Error("Could not fetch rows for file data reconciliation")
+		report.Errors++
+		return mismatched
+	}
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			break
+		}
+		if row.IsDeleted {
+			continue
+		}
+		key := rowKey{fileID: row.FileID, oType: row.Type}
+		listed.reconciled[key] = true
+		c.reconcileIntoReport(ctx, report, row, limiter, listed.counted[key])
+		listed.counted[key] = true
+	}
+	return mismatched
+}
@@ -0,0 +1,27 @@
+package filedata
+
+import (
+	"github.com/spf13/viper"
+)
+
+// runtimeConfig returns the config that the settings that can be changed
+// without a restart are read from: the worker counts, the bandwidth limit and
+// the caps on the concurrent requests to the buckets. It is the global config
+// until the config is reloaded, see ReloadConfig.
+func (c *Controller) runtimeConfig() *viper.Viper {
+	if v := c.reloaded.Load(); v != nil {
+		return v
+	}
+	return viper.GetViper()
+}
+
+// ReloadConfig applies the settings that can be changed without a restart from
+// v, a config that has been read again from the files (see config.ReadViper).
+// The global config is left as it is, so the other settings only change on a
+// restart.
+func (c *Controller) ReloadConfig(v *viper.Viper) error {
+	c.reloaded.Store(v)
+	err := c.ReloadWorkerCount()
+	c.ReloadMaxBandwidth()
+	return err
+}
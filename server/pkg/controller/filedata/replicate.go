@@ -5,18 +5,37 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/ente-io/museum/ente"
 	"github.com/ente-io/museum/ente/filedata"
 	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
-	enteTime "github.com/ente-io/museum/pkg/utils/time"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
 	"github.com/ente-io/stacktrace"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"golang.org/x/sync/errgroup"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// defaultMaxReplicationAttempts is the number of failed replication attempts
+// after which a row is dead lettered, unless overridden by
+// replication.file-data.max-attempts.
+const defaultMaxReplicationAttempts = 25
+
+// defaultFanOutLimit is the number of destination buckets a row is uploaded to
+// in parallel, unless overridden by replication.file-data.fan-out.
+const defaultFanOutLimit = 3
+
 // StartReplication starts the replication process for file data.
-// If
-func (c *Controller) StartReplication() error {
+//
+// The workers keep replicating until ctx is cancelled, at which point any
+// in-flight upload is aborted and the workers return. The returned channel is
+// closed once all the workers have exited, so that callers can block until
+// replication has drained during shutdown.
+func (c *Controller) StartReplication(ctx context.Context) (<-chan struct{}, error) {
+	ctx = forReplication(ctx)
 	workerURL := viper.GetString("replication.worker-url")
 	if workerURL == "" {
 		log.Infof("replication.worker-url was not defined, file data will downloaded directly during replication")
@@ -24,101 +43,677 @@ func (c *Controller) StartReplication() error {
 		log.Infof("Worker URL to download objects for file-data replication is: %s", workerURL)
 	}
 	c.workerURL = workerURL
+	c.logDownloadPaths()
+	c.dryRun = viper.GetBool("replication.file-data.dry-run")
+	// Give the workers a full health window before expecting progress
+	c.lastReplicatedAt.Store(time.Now().UnixMicro())
+	if c.dryRun {
+		log.Warn("File data replication is running in dry-run mode, nothing will be copied")
+	}
 
-	workerCount := viper.GetInt("replication.file-data.worker-count")
-	if workerCount == 0 {
-		workerCount = 6
+	c.poolMu.Lock()
+	if c.pools != nil {
+		c.poolMu.Unlock()
+		return nil, stacktrace.NewError("file data replication has already been started")
 	}
-	go c.startWorkers(workerCount)
-	return nil
+	counts := configuredWorkerCounts(c.runtimeConfig())
+	c.pools = newReplicationPools(ctx, counts)
+	pools := c.pools
+	c.poolMu.Unlock()
+
+	go c.updateReplicationLag(ctx)
+	go c.measureAttempts(ctx)
+	go c.watchWorkers(ctx)
+	go c.runBackfills(ctx)
+	go c.runDrains(ctx)
+	go c.runPromotionChecks(ctx)
+	go c.watchBacklog(ctx)
+	go c.watchOversized(ctx)
+	go c.runBestEffort(ctx)
+	go c.runPurge(ctx)
+	go c.watchCatchUp(ctx)
+	go c.refreshDisabledBuckets(ctx)
+	go c.refreshPause(ctx)
+	go c.refreshCreatedAfter(ctx)
+	go c.sweepMultipartUploads(ctx)
+	c.configureEvents()
+	c.configureHistory()
+	if c.history != nil {
+		go c.writeHistory(ctx)
+	}
+	c.configureUsage()
+	if c.usage != nil {
+		go c.writeUsage(ctx)
+	}
+	if c.eventsEnabled && c.eventSink != nil {
+		go c.relayEvents(ctx)
+	}
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for name, pool := range pools {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.startWorkers(pool, counts[name])
+				<-pool.wait()
+			}()
+		}
+		wg.Wait()
+		log.Info("All file-data replication workers have stopped")
+		close(done)
+	}()
+	return done, nil
 }
-func (c *Controller) startWorkers(n int) {
-	log.Infof("Starting %d workers for replication v3", n)
+
+// startWorkers starts n workers in the pool. They are all started right away,
+// but their first polls are staggered, see startDelay.
+func (c *Controller) startWorkers(pool *replicationPool, n int) {
+	log.Infof("Starting %d workers for replication v3 (pool %s)", n, pool.name)
 
 	for i := 0; i < n; i++ {
-		go c.replicate(i)
-		// Stagger the workers
-		time.Sleep(time.Duration(2*i+1) * time.Second)
+		pool.spawn(c.replicate, startDelay(i))
 	}
 }
 
 // Entry point for the replication worker (goroutine)
 //
-// i is an arbitrary index of the current routine.
-func (c *Controller) replicate(i int) {
-	for {
-		err := c.tryReplicate()
-		if err != nil {
-			// Sleep in proportion to the (arbitrary) index to space out the
-			// workers further.
-			time.Sleep(time.Duration(i+1) * time.Minute)
+// The worker keeps replicating until either ctx is cancelled or it is asked to
+// stop because the pool is being shrunk. It goes idle while replication is
+// paused, see Controller.Pause, or in maintenance mode, see
+// Controller.EnterMaintenance, and while the object stores are distressed it
+// may have to wait for its turn, see adaptiveThrottle.
+//
+// Failures are retried with a backoff that depends on their class (see
+// failureDelay), while an empty queue is polled again after a shorter idle
+// interval.
+func (c *Controller) replicate(ctx context.Context, w *replicationWorker) {
+	b := newReplicationBackoff()
+	if w.startDelay > 0 {
+		w.health.set(workerSleeping, 0)
+		w.sleep(ctx, w.startDelay)
+	}
+	for !w.stopped(ctx) {
+		runCtx, done, ok := c.waitUntilRunning(ctx, w)
+		if !ok {
+			break
+		}
+		if !c.throttle.acquire(runCtx, w) {
+			done()
+			continue
+		}
+		if ok, left := c.maintenance.begin(); !ok {
+			c.throttle.release()
+			done()
+			c.waitOutMaintenance(ctx, w, left)
+			continue
+		}
+		w.health.set(workerIdle, 0)
+		err := c.tryReplicate(runCtx, w.pool.filter)
+		c.maintenance.end()
+		c.throttle.release()
+		done()
+		switch {
+		case errors.Is(err, errReplicationPaused):
+			continue
+		case err == nil:
+			b.reset()
+		case errors.Is(err, sql.ErrNoRows):
+			b.reset()
+			w.health.set(workerSleeping, 0)
+			w.idle(ctx, idlePollInterval(), c.wake)
+		default:
+			delay := failureDelay(b, err)
+			if delay == 0 {
+				continue
+			}
+			log.Infof("File-data replication worker %s/%d backing off for %s", w.pool.name, w.id, delay)
+			w.health.set(workerSleeping, 0)
+			w.sleep(ctx, delay)
 		}
 	}
+	log.Infof("File-data replication worker %s/%d stopped", w.pool.name, w.id)
 }
 
-func (c *Controller) tryReplicate() error {
-	newLockTime := enteTime.MicrosecondsAfterMinutes(240)
-	ctx, cancelFun := context.WithTimeout(context.Background(), 20*time.Minute)
-	defer cancelFun()
-	row, err := c.Repo.GetPendingSyncDataAndExtendLock(ctx, newLockTime, false)
+// sleepWithContext sleeps for d, returning early if ctx gets cancelled. It
+// returns false if the sleep was cut short by the cancellation.
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// tryReplicate locks a batch of up to replication.file-data.batch-size pending
+// rows, and replicates them one after the other.
+//
+// Each row is unlocked as soon as it is done. If a row fails, or the worker is
+// shutting down, the rest of the batch is not attempted and the locks of the
+// remaining rows are put back, so that they can be picked up again right away.
+// Rows abandoned by a worker that died while holding their lock are picked up
+// too, see lockPolicy.
+func (c *Controller) tryReplicate(workerCtx context.Context, filter fileDataRepo.PendingSyncFilter) error {
+	// The rows are first locked for the minimum duration, and then, once we
+	// know the size of a row, its lock is extended to what the row needs.
+	policy := newLockPolicy()
+	newLockTime := time.Now().Add(policy.min).UnixMicro()
+	filter = applyPriority(filter)
+	filter = applySizeLimit(workerCtx, filter)
+	filter = c.applyCreatedAfter(filter)
+	if !isOnRequest(workerCtx) && !isSynchronous(workerCtx) {
+		var ok bool
+		if filter, ok = c.applyWindow(filter); !ok {
+			return sql.ErrNoRows
+		}
+		filter = applySettle(filter)
+	}
+	filter.DeprioritizedUsers = c.usage.overQuotaUsers()
+	if c.dryRun {
+		filter.SkipDryRunReported = true
+	}
+	rows, err := c.Repo.GetPendingSyncBatchAndExtendLock(workerCtx, newLockTime, policy.withReclaim(filter), replicationBatchSize())
 	if err != nil {
+		if cause := context.Cause(workerCtx); errors.Is(cause, errReplicationPaused) {
+			return cause
+		}
 		if !errors.Is(err, sql.ErrNoRows) {
-			log.Errorf("Could not fetch row for replication: %s", err)
+			log.WithError(err).Error("Could not fetch row for replication")
+		} else if c.dryRun {
+			c.logDryRunSummary(workerCtx)
 		}
 		return err
 	}
-	err = c.replicateRowData(ctx, *row)
+	noteAbandoned(rows)
+	noteReclaimed(rows)
+	// All the rows of a batch are locked with the same token
+	batchCtx, stopHeartbeat := c.keepLockAlive(workerCtx, policy, rows[0].LockToken)
+	defer stopHeartbeat()
+	for i, row := range rows {
+		rowLogger(row).WithField(logSourceBucket, row.LatestBucket).Debug("Picked file data for replication")
+		if err = context.Cause(batchCtx); err == nil {
+			if c.dryRun {
+				err = c.dryRunRow(batchCtx, row, newLockTime)
+			} else if !c.holdBackDuplicate(batchCtx, row, newLockTime) {
+				err = c.replicateLockedRow(batchCtx, policy, row, newLockTime)
+			}
+		}
+		if err != nil {
+			c.releaseLocks(workerCtx, rows[i+1:], newLockTime)
+			return err
+		}
+	}
+	return nil
+}
+
+// replicateLockedRow replicates a row that has been locked till heldLockTill.
+func (c *Controller) replicateLockedRow(workerCtx context.Context, policy lockPolicy, row filedata.Row, heldLockTill int64) error {
+	newLockTime, lock, err := c.extendLockForRow(workerCtx, policy, row, heldLockTill)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"file_id": row.FileID,
-			"type":    row.Type,
-			"size":    row.Size,
-			"userID":  row.UserID,
-		}).Errorf("Could not replicate file data: %s", err)
+		if c.pausedWhileWorking(workerCtx, row, heldLockTill) {
+			return errReplicationPaused
+		}
+		return err
+	}
+	workerCtx, renewal := c.renewLock(workerCtx, policy, row, newLockTime, lock)
+	defer renewal.close()
+	ctx, cancelFun := policy.workContext(withBandwidthLimit(workerCtx), row.Size, lock)
+	defer cancelFun()
+	ctx, transferred := withTransferCount(ctx)
+	mReplicationInflight.Inc()
+	start := time.Now()
+	logger := rowLogger(row)
+	logger.WithField(logSourceBucket, row.LatestBucket).Info("Replicating file data")
+	buckets, err := c.replicateRowData(ctx, row)
+	logger = logger.WithField(logDurationMs, sinceMs(start))
+	mReplicationInflight.Dec()
+	newLockTime = renewal.stop()
+	if err != nil && c.pausedWhileWorking(workerCtx, row, newLockTime) {
+		return errReplicationPaused
+	}
+	if err != nil && errors.Is(context.Cause(workerCtx), fileDataRepo.ErrLockLost) {
+		err = context.Cause(workerCtx)
+	}
+	if errors.Is(err, fileDataRepo.ErrLockLost) {
+		// Our lock expired and another worker has taken over the row, so
+		// whatever happens to it is up to that worker now
+		mLockContention.WithLabelValues(lockOpWrite).Inc()
+		logger.WithField(logOutcome, logOutcomeAbandoned).Warn("Lost the lock while replicating file data, abandoning the row")
+		return err
+	}
+	if errors.Is(err, fileDataRepo.ErrRowDeleted) {
+		// The file was deleted meanwhile, and whatever was copied for it has
+		// been deleted again, see discardDeletedCopy. The rest is up to the
+		// deletion of the row.
+		logger.WithField(logOutcome, logOutcomeAbandoned).Info("File data was deleted while being replicated, abandoning the row")
+		c.releaseLocks(workerCtx, []filedata.Row{row}, newLockTime)
+		return nil
+	}
+	if errors.Is(err, errSourcePromoted) {
+		// The row has a new latest bucket, pick it up again right away to
+		// replicate from there
+		c.releaseLocks(workerCtx, []filedata.Row{row}, newLockTime)
+		return nil
+	}
+	if errors.Is(err, errOversized) {
+		// The size limit was lowered after the row was picked up, hand it over
+		// to the oversized pool right away
+		logger.WithField(logOutcome, logOutcomeAbandoned).Info("Not replicating file data over the maximum object size")
+		c.releaseLocks(workerCtx, []filedata.Row{row}, newLockTime)
+		return nil
+	}
+	if err != nil {
+		class := replicationErrorClass(ctx, err)
+		logger.WithFields(log.Fields{
+			logOutcome:    logOutcomeFailed,
+			logErrorClass: class,
+		}).WithError(err).Error("Could not replicate file data")
+		// Skipping a destination because of an outage or maintenance, or
+		// holding the row back because its type has no replicas, is not the
+		// row's fault, so it doesn't count towards dead lettering
+		c.recent.forget(row)
+		if !errors.Is(err, errCircuitOpen) && !errors.Is(err, errBucketDisabled) && !errors.Is(err, errNoReplicaConfigured) {
+			mReplicationErrors.WithLabelValues(string(row.Type), string(class)).Inc()
+			c.recordReplicationFailure(workerCtx, row, class, err)
+			c.releaseLockAfterFailure(workerCtx, policy, row, newLockTime, class)
+		}
 		return err
 	} else {
+		mReplicationDuration.WithLabelValues(string(row.Type)).Observe(time.Since(start).Seconds())
+		logger.WithFields(log.Fields{
+			logSourceBucket: transferred.sourceBucket(row.LatestBucket),
+			logDestBucket:   buckets,
+			logOutcome:      logOutcomeReplicated,
+		}).Info("Replicated file data")
+		c.recordHistory(row, buckets, transferred, start)
+		c.recordUsage(row, buckets, transferred)
 		// If the replication was completed without any errors, we can reset the lock time
-		return c.Repo.ResetSyncLock(ctx, *row, newLockTime)
+		c.resetLockAfterSuccess(ctx, row, newLockTime)
+		c.recent.recordSuccess(row)
+		return nil
 	}
 }
 
-func (c *Controller) replicateRowData(ctx context.Context, row filedata.Row) error {
-	wantInBucketIDs := map[string]bool{}
-	wantInBucketIDs[c.S3Config.GetBucketID(row.Type)] = true
-	rep := c.S3Config.GetReplicatedBuckets(row.Type)
-	for _, bucket := range rep {
+// releaseLocks puts back the locks that the rows had before they were locked
+// till heldLockTill as part of a batch that was not completed.
+func (c *Controller) releaseLocks(ctx context.Context, rows []filedata.Row, heldLockTill int64) {
+	ctx = context.WithoutCancel(ctx)
+	for _, row := range rows {
+		if err := c.Repo.ReleaseSyncLock(ctx, row, heldLockTill, row.SyncLockedTill); err != nil {
+			log.WithField("file_id", row.FileID).WithField("type", row.Type).Warnf("Could not release lock: %s", err)
+		}
+	}
+}
+
+// replicationBatchSize returns the number of rows that a worker locks at once.
+func replicationBatchSize() int {
+	if n := viper.GetInt("replication.file-data.batch-size"); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// maxLastErrorLength caps the length of the error that is kept with the row
+const maxLastErrorLength = 2000
+
+// recordReplicationFailure bumps the attempt count of the row, moving it to the
+// dead letter state once it has failed replication.file-data.max-attempts times,
+// or right away if the failure is permanent. Redundant failures are not
+// recorded while failures are being coalesced, see attemptBudget.
+func (c *Controller) recordReplicationFailure(ctx context.Context, row filedata.Row, class ReplicationErrorClass, replicationErr error) {
+	lastError := replicationErr.Error()
+	if len(lastError) > maxLastErrorLength {
+		lastError = strings.ToValidUTF8(lastError[:maxLastErrorLength], "")
+	}
+	if !c.attempts.shouldRecordFailure(row, class, time.Now()) {
+		mCoalescedFailures.WithLabelValues(string(row.Type)).Inc()
+		return
+	}
+	deadLettered, err := c.Repo.RecordReplicationFailure(ctx, row, maxReplicationAttempts(), class.permanent(), lastError)
+	if err != nil {
+		rowLogger(row).WithError(err).Error("Could not record replication failure")
+		return
+	}
+	if deadLettered {
+		mDeadLettered.WithLabelValues(string(row.Type)).Inc()
+		rowLogger(row).WithField(logErrorClass, class).Warn("Giving up on replicating file data, moved to dead letter")
+	}
+}
+
+// maxReplicationAttempts returns the number of failed attempts after which a row
+// is dead lettered. A non-positive value disables dead lettering.
+func maxReplicationAttempts() int {
+	if viper.IsSet("replication.file-data.max-attempts") {
+		return viper.GetInt("replication.file-data.max-attempts")
+	}
+	return defaultMaxReplicationAttempts
+}
+
+// pendingBuckets returns the buckets that the row should be in but hasn't been
+// replicated to yet. Since it is computed afresh from the row for every attempt,
+// a retry after a partial failure skips the buckets that already succeeded.
+// Buckets that were in flight when the attempt failed are still pending.
+func (c *Controller) pendingBuckets(row filedata.Row) map[string]bool {
+	wantInBucketIDs := map[string]bool{c.S3Config.GetBucketID(row.Type): true}
+	for _, bucket := range c.replicaBuckets(row) {
 		wantInBucketIDs[bucket] = true
 	}
 	delete(wantInBucketIDs, row.LatestBucket)
 	for _, bucket := range row.ReplicatedBuckets {
 		delete(wantInBucketIDs, bucket)
 	}
+	return wantInBucketIDs
+}
+
+// replicaBuckets returns the buckets that the row should be replicated to,
+// which are the replicas of its type unless the row overrides them.
+func (c *Controller) replicaBuckets(row filedata.Row) []string {
+	if row.ReplicaOverride != nil {
+		return row.ReplicaOverride
+	}
+	return c.S3Config.GetReplicatedBuckets(row.Type)
+}
+
+// wantedBuckets returns the buckets that the rows of the type should be in: the
+// primary bucket along with the replicas.
+func (c *Controller) wantedBuckets(oType ente.ObjectType) map[string]bool {
+	wantInBucketIDs := map[string]bool{}
+	wantInBucketIDs[c.S3Config.GetBucketID(oType)] = true
+	for _, bucket := range c.S3Config.GetReplicatedBuckets(oType) {
+		wantInBucketIDs[bucket] = true
+	}
+	return wantInBucketIDs
+}
+
+// rowBuckets returns the buckets that the row should be in: the primary bucket
+// of its type along with the row's replicas, see replicaBuckets.
+func (c *Controller) rowBuckets(row filedata.Row) map[string]bool {
+	buckets := map[string]bool{c.S3Config.GetBucketID(row.Type): true}
+	for _, bucketID := range c.replicaBuckets(row) {
+		buckets[bucketID] = true
+	}
+	return buckets
+}
+
+// replicateRowData copies the row's metadata object to all the buckets it is
+// pending in, and marks the row as replicated. It returns the buckets that the
+// row was replicated to.
+//
+// Buckets that are backed by the same store as the latest bucket are recorded
+// without copying anything, and buckets at the same provider get a server-side
+// copy where possible. The metadata object is only copied to a bucket once the
+// row's side objects, if any, are there, and the row is only marked as
+// replicated once every bucket has all of its objects.
+//
+// Disabled buckets are skipped. The row is then left pending, and the returned
+// error wraps errBucketDisabled. Other failures are returned as a
+// ReplicationError.
+//
+// Rows over the maximum object size are refused with errOversized, except by
+// the workers of the oversized pool, see checkObjectSize.
+//
+// The buckets still to be replicated to are worked out from the progress
+// persisted for the row, see loadProgress.
+//
+// Rows of a type with no replica buckets are flagged, and are held back with
+// errNoReplicaConfigured if so configured, see checkReplicasConfigured.
+//
+// Best-effort buckets are left out, unless the row is replicated on request,
+// and don't keep the row from being marked as replicated. They are caught up
+// with separately, see runBestEffort.
+func (c *Controller) replicateRowData(ctx context.Context, row filedata.Row) ([]string, error) {
+	if err := checkObjectSize(ctx, row); err != nil {
+		return nil, err
+	}
+	row, err := c.loadProgress(ctx, row)
+	if err != nil {
+		return nil, classifyReplicationError(ctx, err)
+	}
+	if err := c.checkReplicasConfigured(row); err != nil {
+		return nil, err
+	}
+	wantInBucketIDs := c.pendingBuckets(row)
+	if !isOnRequest(ctx) {
+		c.deferBestEffortBuckets(row, wantInBucketIDs)
+	}
+	skipped := c.skipDisabledBuckets(row, wantInBucketIDs)
 	if len(wantInBucketIDs) > 0 {
-		s3FileMetadata, err := c.downloadObject(ctx, row.S3FileMetadataObjectKey(), row.LatestBucket)
+		if err := c.replicateToBuckets(ctx, row, wantInBucketIDs); err != nil {
+			return nil, err
+		}
+	} else if len(skipped) == 0 {
+		rowLogger(row).Info("No replication pending for file data")
+	}
+	// Leave the row pending, to be copied to the disabled buckets later
+	if len(skipped) > 0 {
+		sort.Strings(skipped)
+		return nil, fmt.Errorf("skipped %v: %w", skipped, errBucketDisabled)
+	}
+	buckets := make([]string, 0, len(wantInBucketIDs))
+	for bucketID := range wantInBucketIDs {
+		buckets = append(buckets, bucketID)
+	}
+	sort.Strings(buckets)
+	if err := c.markReplicationAsDone(ctx, row, buckets); err != nil {
+		return nil, classifyReplicationError(ctx, err)
+	}
+	c.lastReplicatedAt.Store(time.Now().UnixMicro())
+	return buckets, nil
+}
+
+// replicateToBuckets copies the row's objects to the given buckets, without
+// marking the row as replicated. Failures are returned as a ReplicationError.
+func (c *Controller) replicateToBuckets(ctx context.Context, row filedata.Row, wantInBucketIDs map[string]bool) error {
+	toCopy, err := c.recordAliasedBuckets(ctx, row, wantInBucketIDs)
+	if err != nil {
+		return classifyReplicationError(ctx, err)
+	}
+	// A bucket only gets the metadata object once it has all the side
+	// objects, the others are retried later
+	toCopy, sideErr, err := c.replicateSideObjects(ctx, row, toCopy)
+	if err != nil {
+		return classifyReplicationError(ctx, err)
+	}
+	// Skip the download altogether if all the pending buckets turn out to
+	// already have the object
+	missing := c.reconcileExisting(ctx, row, toCopy)
+	missing, err = c.copyServerSide(ctx, row, missing)
+	if err != nil {
+		return classifyReplicationError(ctx, err)
+	}
+	if len(missing) > 0 {
+		setWorkerState(ctx, workerDownloading, row.FileID)
+		data, checksum, source, err := c.downloadSourceObject(ctx, row)
 		if err != nil {
-			return stacktrace.Propagate(err, "error fetching metadata object "+row.S3FileMetadataObjectKey())
+			err = stacktrace.Propagate(err, "error fetching metadata object "+row.S3FileMetadataObjectKey())
+			if errors.Is(err, objectstore.ErrNotFound) {
+				return &ReplicationError{Class: ErrSourceMissing, Err: err}
+			}
+			return classifyReplicationError(ctx, err)
 		}
-		for bucketID := range wantInBucketIDs {
-			if err := c.uploadAndVerify(ctx, row, s3FileMetadata, bucketID); err != nil {
-				return stacktrace.Propagate(err, "error uploading and verifying metadata object")
+		noteSource(ctx, source)
+		metadata, err := c.sourceMetadata(ctx, row.S3FileMetadataObjectKey(), source)
+		if err != nil {
+			return classifyReplicationError(ctx, err)
+		}
+		setWorkerState(ctx, workerUploading, row.FileID)
+		if err := c.fanOutUploads(ctx, row, data, checksum, metadata, source, missing); err != nil {
+			return classifyReplicationError(ctx, stacktrace.Propagate(err, "error uploading and verifying metadata object"))
+		}
+	}
+	if sideErr != nil {
+		return classifyReplicationError(ctx, stacktrace.Propagate(sideErr, "error replicating side objects"))
+	}
+	return nil
+}
+
+// fanOutUploads uploads the metadata object to all the destination buckets in
+// parallel, with at most replication.file-data.fan-out uploads in flight for the
+// row. Every destination is attempted even if some of them fail, so that the
+// successful ones are recorded as replicated (each as soon as it succeeds), and
+// the next attempt, see pendingBuckets, only targets the ones that failed. The
+// returned error joins the failures of all the destinations that could not be
+// replicated to.
+//
+// Each upload is given its own timeout, see lockPolicy.destinationTimeout, so
+// that a destination that hangs fails without holding up the others.
+//
+// Destinations whose circuit is open are skipped, leaving the row pending for
+// them. If those were the only destinations that did not succeed, the returned
+// error wraps errCircuitOpen.
+func (c *Controller) fanOutUploads(ctx context.Context, row filedata.Row, data []byte, checksum string, metadata objectstore.ObjectMetadata, source string, dstBucketIDs map[string]bool) error {
+	policy := newLockPolicy()
+	g := new(errgroup.Group)
+	g.SetLimit(fanOutLimit())
+	var mu sync.Mutex
+	var errs []error
+	var succeeded, skipped []string
+	for bucketID := range dstBucketIDs {
+		if !c.circuits.allow(bucketID) {
+			skipped = append(skipped, bucketID)
+			continue
+		}
+		g.Go(func() error {
+			start := time.Now()
+			// The wait for the cap on registrations isn't the bucket's doing,
+			// so it doesn't count against its timeout or circuit. Neither
+			// does running out of time while waiting for a request slot (see
+			// requestLimiter), which is the doing of the other uploads.
+			reservedCtx, err := c.reserveAttempt(ctx, row, bucketID)
+			reserved := err == nil
+			if reserved {
+				deadline, ok := ctx.Deadline()
+				timeout := policy.destinationTimeout(int64(len(data)), deadline, ok)
+				dstCtx, cancel := context.WithTimeout(reservedCtx, timeout)
+				err = c.uploadAndVerify(dstCtx, row, data, checksum, metadata, source, bucketID)
+				if err != nil && ctx.Err() == nil && errors.Is(dstCtx.Err(), context.DeadlineExceeded) && !errors.Is(err, errRequestQueued) {
+					mDestinationTimeouts.WithLabelValues(bucketID).Inc()
+					err = fmt.Errorf("timed out after %s: %w (%w)", timeout, context.DeadlineExceeded, err)
+				}
+				cancel()
+			}
+			if ctx.Err() != nil || !reserved || errors.Is(err, errRequestQueued) {
+				// Aborted because of shutdown or timeout, not a bucket failure
+				c.circuits.release(bucketID)
+			} else {
+				c.circuits.record(bucketID, err)
+			}
+			logger := rowLogger(row).WithFields(log.Fields{
+				logSourceBucket: source,
+				logDestBucket:   bucketID,
+				logDurationMs:   sinceMs(start),
+			})
+			if err != nil {
+				logger.WithFields(log.Fields{
+					logOutcome:    logOutcomeFailed,
+					logErrorClass: replicationErrorClass(ctx, err),
+				}).WithError(err).Warn("Could not replicate file data to bucket")
+			} else {
+				logger.WithField(logOutcome, logOutcomeReplicated).Info("Replicated file data to bucket")
+			}
+			mu.Lock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", bucketID, err))
+			} else {
+				succeeded = append(succeeded, bucketID)
 			}
+			mu.Unlock()
+			return nil
+		})
+	}
+	_ = g.Wait()
+	if len(errs) > 0 {
+		if len(succeeded) > 0 {
+			sort.Strings(succeeded)
+			rowLogger(row).WithField(logDestBucket, succeeded).Infof("Replicated to some destinations, only the %d failed ones will be retried", len(errs))
 		}
-	} else {
-		log.Infof("No replication pending for file %d and type %s", row.FileID, string(row.Type))
+		return errors.Join(errs...)
+	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("skipped %v: %w", skipped, errCircuitOpen)
 	}
-	return c.Repo.MarkReplicationAsDone(ctx, row)
+	return nil
 }
 
-func (c *Controller) uploadAndVerify(ctx context.Context, row filedata.Row, s3FileMetadata filedata.S3FileMetadata, dstBucketID string) error {
-	if err := c.Repo.RegisterReplicationAttempt(ctx, row, dstBucketID); err != nil {
+// fanOutLimit returns the maximum number of destination buckets that a single
+// row is uploaded to concurrently.
+func fanOutLimit() int {
+	if n := viper.GetInt("replication.file-data.fan-out"); n > 0 {
+		return n
+	}
+	return defaultFanOutLimit
+}
+
+// uploadAndVerify uploads the object, read from the bucket source, to
+// dstBucketID, verifies the copy, and records the bucket as replicated.
+func (c *Controller) uploadAndVerify(ctx context.Context, row filedata.Row, data []byte, checksum string, metadata objectstore.ObjectMetadata, source string, dstBucketID string) error {
+	if err := c.registerAttempt(ctx, row, dstBucketID); err != nil {
 		return stacktrace.Propagate(err, "could not register replication attempt")
 	}
-	metadataSize, err := c.uploadObject(s3FileMetadata, row.S3FileMetadataObjectKey(), dstBucketID)
+	objectKey := row.S3FileMetadataObjectKey()
+	// Objects in object locked buckets are never overwritten
+	if exists, err := c.existingImmutableCopy(ctx, objectKey, dstBucketID, checksum); err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		return err
+	} else if exists {
+		return c.recordImmutableCopy(ctx, row, dstBucketID)
+	}
+	stored, compressed, err := c.encodeForBucket(ctx, dstBucketID, data)
 	if err != nil {
+		return stacktrace.Propagate(err, "failed to encode object for %s", dstBucketID)
+	}
+	if err := c.checkNotDeleted(ctx, row, dstBucketID); err != nil {
+		return err
+	}
+	uploaded, err := c.uploadObject(ctx, stored, objectKey, dstBucketID, metadata)
+	if err != nil {
+		// The upload is rejected if someone else has written the object
+		// meanwhile
+		if exists, existErr := c.existingImmutableCopy(ctx, objectKey, dstBucketID, checksum); existErr == nil && exists {
+			return c.recordImmutableCopy(ctx, row, dstBucketID)
+		}
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		c.cleanUpPartialUpload(ctx, objectKey, dstBucketID, err)
+		return err
+	}
+	versionID, err := c.writtenVersion(dstBucketID, uploaded)
+	if err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		return err
+	}
+	if err := c.verifyUploadedMetadata(uploaded, metadata, dstBucketID); err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		c.cleanUpPartialUpload(ctx, objectKey, dstBucketID, err)
+		return stacktrace.Propagate(err, "uploaded object to %s failed verification", dstBucketID)
+	}
+	if err := c.verifyUploadedObject(ctx, stored, checksum, uploaded, objectKey, dstBucketID); err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		c.cleanUpPartialUpload(ctx, objectKey, dstBucketID, err)
+		return stacktrace.Propagate(err, "uploaded object to %s failed verification", dstBucketID)
+	}
+	if strictVerify(row.Type) {
+		if err := c.verifyByteForByte(ctx, row.Type, stored, objectKey, dstBucketID, versionID); err != nil {
+			mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+			c.cleanUpPartialUpload(ctx, objectKey, dstBucketID, err)
+			return stacktrace.Propagate(err, "uploaded object to %s failed byte for byte verification", dstBucketID)
+		}
+	}
+	if err := c.Repo.SetBucketCompressed(ctx, row, dstBucketID, compressed); err != nil {
 		return err
 	}
-	if metadataSize != row.Size {
-		return fmt.Errorf("uploaded metadata size %d does not match expected size %d", metadataSize, row.Size)
+	if err := c.recordWrittenVersion(ctx, row, dstBucketID, versionID); err != nil {
+		c.discardDeletedCopy(ctx, row, objectKey, dstBucketID, err)
+		return err
+	}
+	if err := c.Repo.MoveBetweenBuckets(ctx, row, dstBucketID, fileDataRepo.InflightRepColumn, fileDataRepo.ReplicationColumn); err != nil {
+		c.discardDeletedCopy(ctx, row, objectKey, dstBucketID, err)
+		return err
 	}
-	return c.Repo.MoveBetweenBuckets(row, dstBucketID, fileDataRepo.InflightRepColumn, fileDataRepo.ReplicationColumn)
+	countRoute(ctx, source, dstBucketID, int64(len(stored)))
+	mReplicatedBytes.WithLabelValues(string(row.Type), dstBucketID).Add(float64(len(stored)))
+	mReplicatedObjects.WithLabelValues(string(row.Type), dstBucketID).Inc()
+	return nil
 }
@@ -0,0 +1,90 @@
+package filedata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplicateNow replicates the given file's data synchronously, instead of
+// waiting for a worker to pick it up from the queue.
+//
+// The row is locked the same way the workers lock it, so this fails with a
+// conflict if a worker is replicating the row at the moment, or if replication
+// has been paused. Rows over the maximum object size are replicated too, and so
+// are the best-effort buckets.
+func (c *Controller) ReplicateNow(ctx context.Context, fileID int64, oType ente.ObjectType) (*filedata.ReplicateNowResponse, error) {
+	if c.pause.status().Paused {
+		return nil, stacktrace.Propagate(ente.NewConflictError("file data replication is paused"), "")
+	}
+	policy := newLockPolicy()
+	newLockTime := time.Now().Add(policy.min).UnixMicro()
+	row, err := c.Repo.LockForReplication(ctx, fileID, oType, newLockTime)
+	if err != nil {
+		if isLockConflict(err) {
+			mLockContention.WithLabelValues(lockOpLock).Inc()
+		}
+		return nil, stacktrace.Propagate(err, "")
+	}
+	newLockTime, lock, err := c.extendLockForRow(ctx, policy, *row, newLockTime)
+	if err != nil {
+		return nil, err
+	}
+	workCtx, stopHeartbeat := c.keepLockAlive(ctx, policy, row.LockToken)
+	defer stopHeartbeat()
+	workCtx, renewal := c.renewLock(workCtx, policy, *row, newLockTime, lock)
+	defer renewal.close()
+	workCtx, cancel := policy.workContext(forReplication(onRequest(workCtx)), row.Size, lock)
+	defer cancel()
+	buckets, err := c.replicateRowData(workCtx, *row)
+	newLockTime = renewal.stop()
+	if err != nil {
+		// The row stays locked as it is, but no longer counts as held
+		if releaseErr := c.Repo.ReleaseSyncLock(context.WithoutCancel(ctx), *row, newLockTime, newLockTime); releaseErr != nil {
+			log.WithError(releaseErr).WithField("file_id", fileID).Warn("Could not release the lock of file data after a failed replication")
+		}
+		return nil, stacktrace.Propagate(err, "replication failed")
+	}
+	c.resetLockAfterSuccess(ctx, *row, newLockTime)
+	log.WithFields(log.Fields{
+		"file_id": fileID,
+		"type":    oType,
+		"buckets": buckets,
+	}).Info("Replicated file data on request")
+	return &filedata.ReplicateNowResponse{FileID: fileID, Type: oType, Buckets: buckets}, nil
+}
+
+type synchronousCtxKey struct{}
+
+// ReplicateOnce runs a single replication cycle over the pending rows of all
+// types, the same one that a worker runs each time it polls, and returns once
+// it is done. It returns false if there was nothing to replicate.
+//
+// It is meant for driving replication deterministically from tests: nothing is
+// left running in the background once it returns, and no heartbeats are sent
+// for the rows it locks, so it must not be used for rows that take longer than
+// the minimum lock duration (replication.file-data.lock.min) to replicate.
+// Failed object store requests are still retried with backoff.
+func (c *Controller) ReplicateOnce(ctx context.Context) (replicated bool, err error) {
+	err = c.tryReplicate(forReplication(context.WithValue(ctx, synchronousCtxKey{}, true)), fileDataRepo.PendingSyncFilter{})
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isSynchronous reports whether ctx belongs to a ReplicateOnce call.
+func isSynchronous(ctx context.Context) bool {
+	synchronous, _ := ctx.Value(synchronousCtxKey{}).(bool)
+	return synchronous
+}
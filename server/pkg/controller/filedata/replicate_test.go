@@ -0,0 +1,2084 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/museum/pkg/utils/s3config"
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+const testConfig = `
+s3:
+    wasabi-eu-central-2-derived:
+        bucket: derived
+        store: memory
+    b5:
+        bucket: b5
+        store: memory
+    b6:
+        bucket: b6
+        store: memory
+    file-data-config:
+        mldata:
+            primaryBucket: wasabi-eu-central-2-derived
+            replicaBuckets: [b5, b6]
+`
+
+// newTestController returns a controller for mldata replicated from the
+// derived bucket to b5 and b6, all of them in memory.
+func newTestController(t *testing.T) *Controller {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(testConfig)); err != nil {
+		t.Fatal(err)
+	}
+	return &Controller{S3Config: s3config.NewS3Config()}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	c := newTestController(t)
+	// The row as picked up, before the upload to b5 succeeded and the process
+	// restarted while uploading to b6
+	picked := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+	persisted := picked
+	persisted.ReplicatedBuckets = []string{"b5"}
+	persisted.InflightReplicas = []string{"b6"}
+	row := withPersistedProgress(picked, persisted)
+	if got := sortedKeys(c.pendingBuckets(row)); strings.Join(got, ",") != "b6" {
+		t.Errorf("pendingBuckets() after the restart = %v, want [b6]", got)
+	}
+	token, other := "a", "b"
+	if !sameLockToken(&token, &token) || sameLockToken(&token, &other) || sameLockToken(&token, nil) || !sameLockToken(nil, nil) {
+		t.Error("sameLockToken() doesn't compare lock tokens by value")
+	}
+}
+
+func TestPendingBucketsAfterPartialFailure(t *testing.T) {
+	c := newTestController(t)
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+	if got := sortedKeys(c.pendingBuckets(row)); strings.Join(got, ",") != "b5,b6" {
+		t.Fatalf("pendingBuckets() = %v, want [b5 b6]", got)
+	}
+	// The first attempt registers both buckets as in flight, the upload to
+	// b5 succeeds and moves it to the replicated buckets while the one to b6
+	// fails and leaves it in flight
+	row.ReplicatedBuckets = []string{"b5"}
+	row.InflightReplicas = []string{"b6"}
+	if got := sortedKeys(c.pendingBuckets(row)); strings.Join(got, ",") != "b6" {
+		t.Errorf("pendingBuckets() after b6 failed = %v, want [b6]", got)
+	}
+	// Once the retry succeeds, nothing is left
+	row.ReplicatedBuckets = []string{"b5", "b6"}
+	row.InflightReplicas = nil
+	if got := c.pendingBuckets(row); len(got) != 0 {
+		t.Errorf("pendingBuckets() after the retry = %v, want none", sortedKeys(got))
+	}
+}
+
+func TestSourceOrder(t *testing.T) {
+	c := newTestController(t)
+	checksum := "c"
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived",
+		ReplicatedBuckets: []string{"b5", "b6"}, Checksum: &checksum}
+	for _, tc := range []struct {
+		preference []string
+		preferred  string
+		fallbacks  string
+	}{
+		{nil, "", "b5,b6"},
+		{[]string{"b6"}, "b6", "b5"},
+		{[]string{"b6", "wasabi-eu-central-2-derived", "b5"}, "b6", "b5"},
+		{[]string{"b6", "b5"}, "b6,b5", ""},
+		{[]string{"wasabi-eu-central-2-derived", "b6"}, "", "b5,b6"},
+	} {
+		viper.Set("replication.file-data.source-preference", tc.preference)
+		preferred, fallbacks := c.sourceOrder(row)
+		if strings.Join(preferred, ",") != tc.preferred || strings.Join(fallbacks, ",") != tc.fallbacks {
+			t.Errorf("sourceOrder() with preference %v = %v, %v, want [%s], [%s]",
+				tc.preference, preferred, fallbacks, tc.preferred, tc.fallbacks)
+		}
+	}
+}
+
+func TestDrainTargetsRecorded(t *testing.T) {
+	c := newTestController(t)
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "b6", ReplicatedBuckets: []string{"b5"}}
+	targets := c.drainTargets(row, "b6")
+	if strings.Join(targets, ",") != "b5,wasabi-eu-central-2-derived" {
+		t.Fatalf("drainTargets() = %v, want [b5 wasabi-eu-central-2-derived]", targets)
+	}
+	if c.isRecordedIn(row, "wasabi-eu-central-2-derived") {
+		t.Errorf("row is recorded in the primary bucket, but it only lists b5 and b6")
+	}
+	row.ReplicatedBuckets = append(row.ReplicatedBuckets, "wasabi-eu-central-2-derived")
+	row.InflightReplicas = []string{"b5"}
+	if c.isRecordedIn(row, "b5") {
+		t.Errorf("row is recorded in b5 while a copy to it is in flight")
+	}
+	if got := c.drainedLatestBucket(row, targets); got != "wasabi-eu-central-2-derived" {
+		t.Errorf("drainedLatestBucket() = %s, want the primary bucket", got)
+	}
+}
+
+func TestReplicateObjectMetadata(t *testing.T) {
+	c := newTestController(t)
+	viper.Set("replication.file-data.metadata.enabled", true)
+	viper.Set("replication.file-data.metadata.verify", true)
+	ctx := context.Background()
+	metadata := objectstore.ObjectMetadata{ContentType: "application/json", User: map[string]string{"origin": "museum"}}
+	key := "1/file-data/2/mldata"
+	if _, err := c.uploadObject(ctx, []byte("{}"), key, "wasabi-eu-central-2-derived", metadata); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.sourceMetadata(ctx, key, "wasabi-eu-central-2-derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(metadata) {
+		t.Fatalf("sourceMetadata() = %+v, want %+v", got, metadata)
+	}
+	uploaded, err := c.uploadObject(ctx, []byte("{}"), key, "b5", got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verifyUploadedMetadata(uploaded, metadata, "b5"); err != nil {
+		t.Errorf("verifyUploadedMetadata() = %v", err)
+	}
+	metadata.CacheControl = "no-store"
+	if err := c.verifyUploadedMetadata(uploaded, metadata, "b5"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("verifyUploadedMetadata() with different metadata = %v, want ErrIntegrity", err)
+	}
+}
+
+func TestOversizedRowsRefused(t *testing.T) {
+	c := newTestController(t)
+	viper.Set("replication.file-data.max-object-size-bytes", 100)
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived", Size: 200}
+	if _, err := c.replicateRowData(context.Background(), row); !errors.Is(err, errOversized) {
+		t.Fatalf("replicateRowData() = %v, want errOversized", err)
+	}
+	if err := checkObjectSize(onRequest(context.Background()), row); err != nil {
+		t.Errorf("checkObjectSize() on request = %v, want nil", err)
+	}
+	pool := newReplicationPool(context.Background(), oversizedPoolName, fileDataRepo.PendingSyncFilter{})
+	w := &replicationWorker{pool: pool}
+	if err := checkObjectSize(withWorker(context.Background(), w), row); err != nil {
+		t.Errorf("checkObjectSize() in the oversized pool = %v, want nil", err)
+	}
+	if f := applySizeLimit(withWorker(context.Background(), w), fileDataRepo.PendingSyncFilter{}); f.MinSize != 100 || f.MaxSize != 0 {
+		t.Errorf("applySizeLimit() in the oversized pool = %+v, want MinSize 100", f)
+	}
+	if f := applySizeLimit(context.Background(), fileDataRepo.PendingSyncFilter{}); f.MaxSize != 100 || f.MinSize != 0 {
+		t.Errorf("applySizeLimit() = %+v, want MaxSize 100", f)
+	}
+	if n := configuredWorkerCounts(viper.GetViper())[oversizedPoolName]; n != 0 {
+		t.Errorf("oversized pool has %d workers while skipping, want 0", n)
+	}
+	viper.Set("replication.file-data.oversized.action", oversizedRoute)
+	if n := configuredWorkerCounts(viper.GetViper())[oversizedPoolName]; n != defaultOversizedWorkerCount {
+		t.Errorf("oversized pool has %d workers while routing, want %d", n, defaultOversizedWorkerCount)
+	}
+}
+
+func TestDeferBestEffortBuckets(t *testing.T) {
+	c := newTestController(t)
+	viper.Set("replication.file-data.best-effort-buckets", []string{"b6", "wasabi-eu-central-2-derived"})
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+	dst := map[string]bool{"wasabi-eu-central-2-derived": true, "b5": true, "b6": true}
+	c.deferBestEffortBuckets(row, dst)
+	if len(dst) != 2 || !dst["wasabi-eu-central-2-derived"] || !dst["b5"] {
+		t.Errorf("deferBestEffortBuckets() left %v, want the primary and b5", dst)
+	}
+}
+
+func TestWorkerFallback(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("replication.file-data.worker-fallback.threshold", 2)
+	f := &workerFallback{}
+	f.record(workerOutcomeBadGateway)
+	f.record(workerOutcomeNotFound)
+	f.record(workerOutcomeTransport)
+	if f.active() {
+		t.Fatal("fallback active after failures that were not consecutive")
+	}
+	f.record(workerOutcomeTimeout)
+	if !f.active() {
+		t.Fatal("fallback not active after 2 consecutive worker failures")
+	}
+	f.until = time.Now().Add(-time.Second)
+	if f.active() || f.consecutiveFailures != 0 {
+		t.Errorf("fallback still active after its duration, %d failures", f.consecutiveFailures)
+	}
+}
+
+func TestRecentReplications(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	checksum, other := "abc", "def"
+	row := filedata.Row{FileID: 1, Type: ente.MlData, Size: 10, Checksum: &checksum}
+	r := &recentReplications{}
+	if _, ok := r.heldBackUntil(row); ok {
+		t.Fatal("row held back before being replicated")
+	}
+	r.recordSuccess(row)
+	if _, ok := r.heldBackUntil(row); !ok {
+		t.Error("row enqueued again with the same contents not held back")
+	}
+	changed := row
+	changed.Checksum = &other
+	if _, ok := r.heldBackUntil(changed); ok {
+		t.Error("row enqueued again with new contents held back")
+	}
+	r.forget(row)
+	if _, ok := r.heldBackUntil(row); ok {
+		t.Error("row held back after its replication failed")
+	}
+	viper.Set("replication.file-data.dedup-window", 0)
+	r.recordSuccess(row)
+	if _, ok := r.heldBackUntil(row); ok {
+		t.Error("row held back with dedup disabled")
+	}
+}
+
+func TestAwaitVisible(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("replication.file-data.read-after-write.delay", time.Millisecond)
+	reads := 0
+	err := awaitVisible(context.Background(), "upload", "b5", func() error {
+		reads++
+		if reads < 3 {
+			return objectstore.ErrNotVisible
+		}
+		return nil
+	})
+	if err != nil || reads != 3 {
+		t.Errorf("awaitVisible() = %v after %d reads, want nil after 3", err, reads)
+	}
+	reads = 0
+	err = awaitVisible(context.Background(), "upload", "b5", func() error {
+		reads++
+		return objectstore.ErrNotFound
+	})
+	if !errors.Is(err, objectstore.ErrNotFound) || reads != defaultReadAfterWriteRetries+1 {
+		t.Errorf("awaitVisible() of a missing object = %v after %d reads, want ErrNotFound after %d", err, reads, defaultReadAfterWriteRetries+1)
+	}
+}
+
+func TestReplicationWindow(t *testing.T) {
+	w := &replicationWindow{startMinute: 22 * 60, endMinute: 6 * 60, loc: time.UTC}
+	for _, tc := range []struct {
+		at, next string
+		open     bool
+	}{
+		{"2024-03-01T23:30:00Z", "2024-03-02T06:00:00Z", true},
+		{"2024-03-01T05:59:00Z", "2024-03-01T06:00:00Z", true},
+		{"2024-03-01T06:00:00Z", "2024-03-01T22:00:00Z", false},
+		{"2024-03-01T12:00:00Z", "2024-03-01T22:00:00Z", false},
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.at)
+		open, next := w.openAt(at)
+		if open != tc.open || next.Format(time.RFC3339) != tc.next {
+			t.Errorf("openAt(%s) = %v, %s, want %v, %s", tc.at, open, next.Format(time.RFC3339), tc.open, tc.next)
+		}
+	}
+}
+
+func TestExistingImmutableCopy(t *testing.T) {
+	c := newTestController(t)
+	viper.Set("s3.b5.object-lock", true)
+	c.S3Config = s3config.NewS3Config()
+	ctx := context.Background()
+	data := []byte(`{"version":1}`)
+	if _, err := c.S3Config.GetObjectStore("b5").Put(ctx, "key", strings.NewReader(string(data)), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := c.existingImmutableCopy(ctx, "key", "b5", checksumOf(data)); !exists || err != nil {
+		t.Errorf("existingImmutableCopy() of a matching copy = %v, %v, want true", exists, err)
+	}
+	if _, err := c.existingImmutableCopy(ctx, "key", "b5", checksumOf([]byte("other"))); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("existingImmutableCopy() of a different copy = %v, want ErrIntegrity", err)
+	}
+	if exists, err := c.existingImmutableCopy(ctx, "missing", "b5", checksumOf(data)); exists || err != nil {
+		t.Errorf("existingImmutableCopy() of a missing copy = %v, %v, want false", exists, err)
+	}
+	if _, err := c.S3Config.GetObjectStore("b6").Put(ctx, "key", strings.NewReader("other"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := c.existingImmutableCopy(ctx, "key", "b6", checksumOf(data)); exists || err != nil {
+		t.Errorf("existingImmutableCopy() in a bucket without object lock = %v, %v, want false", exists, err)
+	}
+}
+
+func TestCompareStored(t *testing.T) {
+	c := newTestController(t)
+	ctx := context.Background()
+	stored := bytes.Repeat([]byte("0123456789"), strictVerifyChunkSize/5)
+	if _, err := c.S3Config.GetObjectStore("b5").Put(ctx, "key", bytes.NewReader(stored), int64(len(stored))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.compareStored(ctx, stored, "key", "b5", ""); err != nil {
+		t.Errorf("compareStored() of a matching copy = %v, want nil", err)
+	}
+	other := bytes.Clone(stored)
+	other[len(other)-1] = 'x'
+	if err := c.compareStored(ctx, other, "key", "b5", ""); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("compareStored() of a different copy = %v, want ErrIntegrity", err)
+	}
+	if err := c.compareStored(ctx, stored[:len(stored)-1], "key", "b5", ""); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("compareStored() of a longer copy = %v, want ErrIntegrity", err)
+	}
+	if err := c.compareStored(ctx, append(bytes.Clone(stored), 'x'), "key", "b5", ""); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("compareStored() of a shorter copy = %v, want ErrIntegrity", err)
+	}
+}
+
+func TestCheckReplicasConfigured(t *testing.T) {
+	c := newTestController(t)
+	if err := c.checkReplicasConfigured(filedata.Row{FileID: 1, Type: ente.MlData}); err != nil {
+		t.Errorf("checkReplicasConfigured() of a type with replicas = %v, want nil", err)
+	}
+	row := filedata.Row{FileID: 1, Type: ente.PreviewVideo}
+	if err := c.checkReplicasConfigured(row); err != nil {
+		t.Errorf("checkReplicasConfigured() without hold = %v, want nil", err)
+	}
+	viper.Set("replication.file-data.no-replica.hold", true)
+	if err := c.checkReplicasConfigured(row); !errors.Is(err, errNoReplicaConfigured) {
+		t.Errorf("checkReplicasConfigured() with hold = %v, want errNoReplicaConfigured", err)
+	}
+	row.ReplicaOverride = []string{}
+	if err := c.checkReplicasConfigured(row); err != nil {
+		t.Errorf("checkReplicasConfigured() of a row with a replica override = %v, want nil", err)
+	}
+	if got := c.getNoReplicaTypes(); !slices.Equal(got, []ente.ObjectType{ente.PreviewVideo, ente.PreviewImage}) {
+		t.Errorf("getNoReplicaTypes() = %v, want [vid_preview img_preview]", got)
+	}
+}
+
+func TestDiscardDeletedCopy(t *testing.T) {
+	c := newTestController(t)
+	viper.Set("s3.b6.object-lock", true)
+	c.S3Config = s3config.NewS3Config()
+	ctx := context.Background()
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+	objectKey := row.S3FileMetadataObjectKey()
+	for _, dc := range []string{"b5", "b6"} {
+		if _, err := c.S3Config.GetObjectStore(dc).Put(ctx, objectKey, strings.NewReader("data"), 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The row was deleted while the copies were being written
+	c.discardDeletedCopy(ctx, row, objectKey, "b5", fileDataRepo.ErrLockLost)
+	if _, err := c.S3Config.GetObjectStore("b5").Head(ctx, objectKey); err != nil {
+		t.Errorf("copy deleted after the lock was lost: %v", err)
+	}
+	deleted := fmt.Errorf("bucket not moved: %w", fileDataRepo.ErrRowDeleted)
+	c.discardDeletedCopy(ctx, row, objectKey, "b5", deleted)
+	if _, err := c.S3Config.GetObjectStore("b5").Head(ctx, objectKey); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Errorf("Head() of the copy of a deleted row = %v, want ErrNotFound", err)
+	}
+	c.discardDeletedCopy(ctx, row, objectKey, "b6", deleted)
+	if _, err := c.S3Config.GetObjectStore("b6").Head(ctx, objectKey); err != nil {
+		t.Errorf("copy deleted from an object locked bucket: %v", err)
+	}
+}
+
+func TestRequestLimiter(t *testing.T) {
+	newTestController(t)
+	viper.Set("replication.file-data.max-concurrent-requests.b5", 1)
+	var l requestLimiter
+	ctx := forReplication(context.Background())
+	if err := l.acquire(ctx, "b5"); err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(waitCtx, "b5"); !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, errRequestQueued) {
+		t.Errorf("acquire() over the cap = %v, want a timeout while queued", err)
+	}
+	// The requests of users don't wait
+	userCtx, cancelUser := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelUser()
+	if err := l.acquire(userCtx, "b5"); err != nil {
+		t.Errorf("acquire() over the cap for a user = %v, want nil", err)
+	} else {
+		l.release("b5")
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.acquire(ctx, "b6"); err != nil {
+			t.Errorf("acquire() for a bucket without a cap = %v, want nil", err)
+		}
+	}
+	acquired := make(chan error)
+	go func() { acquired <- l.acquire(ctx, "b5") }()
+	l.release("b5")
+	if err := <-acquired; err != nil {
+		t.Errorf("acquire() once a slot is released = %v, want nil", err)
+	}
+}
+
+func TestRecoverMissingSource(t *testing.T) {
+	c := newTestController(t)
+	ctx := context.Background()
+	checksum := checksumOf([]byte("data"))
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived", Size: 4, Checksum: &checksum,
+		DeleteFromBuckets: []string{"b6"}}
+	if got := c.seedCandidates(row, nil); strings.Join(got, ",") != "b5" {
+		t.Errorf("seedCandidates() = %v, want [b5]", got)
+	}
+	row.DeleteFromBuckets = nil
+	if got := c.seedCandidates(row, []string{"b5"}); strings.Join(got, ",") != "b6" {
+		t.Errorf("seedCandidates() after trying b5 = %v, want [b6]", got)
+	}
+	latestErr := fmt.Errorf("%w: %s", objectstore.ErrNotFound, row.S3FileMetadataObjectKey())
+	if _, _, _, err := c.recoverMissingSource(ctx, row, row.S3FileMetadataObjectKey(), nil, latestErr); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Errorf("recoverMissingSource() of an object missing everywhere = %v, want ErrNotFound", err)
+	}
+}
+
+func TestInlineCandidates(t *testing.T) {
+	c := newTestController(t)
+	c.disabledBuckets = &disabledBuckets{}
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+	if got := c.inlineCandidates(row); !slices.Equal(got, []string{"b5", "b6"}) {
+		t.Errorf("inlineCandidates() = %v, want [b5 b6]", got)
+	}
+	// Uploaded to a replica, the primary bucket comes after the other replica
+	row = filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "b5", ReplicatedBuckets: []string{"b5"}}
+	if got := c.inlineCandidates(row); !slices.Equal(got, []string{"b6", "wasabi-eu-central-2-derived"}) {
+		t.Errorf("inlineCandidates() = %v, want [b6 wasabi-eu-central-2-derived]", got)
+	}
+	if got := c.replicatedCopies(row); len(got) != 0 {
+		t.Errorf("replicatedCopies() = %v, want none, the latest bucket doesn't count", got)
+	}
+	viper.Set("replication.file-data.best-effort-buckets", []string{"b6"})
+	row.ReplicatedBuckets = []string{"b5", "wasabi-eu-central-2-derived"}
+	if got := c.inlineCandidates(row); len(got) != 0 {
+		t.Errorf("inlineCandidates() = %v, want none, b6 is best-effort", got)
+	}
+	if got := c.replicatedCopies(row); !slices.Equal(got, []string{"wasabi-eu-central-2-derived"}) {
+		t.Errorf("replicatedCopies() = %v, want [wasabi-eu-central-2-derived]", got)
+	}
+}
+
+func TestVersionedReplica(t *testing.T) {
+	c := newTestController(t)
+	viper.Set("s3.b5.versioned", true)
+	c.S3Config = s3config.NewS3Config()
+	ctx := context.Background()
+	data := []byte(`{"version":1}`)
+	written, err := c.S3Config.GetObjectStore("b5").Put(ctx, "key", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versionID, err := c.writtenVersion("b5", written)
+	if err != nil || versionID == "" {
+		t.Fatalf("writtenVersion() in a versioned bucket = %q, %v, want its version", versionID, err)
+	}
+	if _, err := c.S3Config.GetObjectStore("b5").Put(ctx, "key", strings.NewReader("other"), 5); err != nil {
+		t.Fatal(err)
+	}
+	row := filedata.Row{ReplicaVersions: []string{"b6:x", "b5:" + versionID}}
+	if got := replicaVersion(row, "b5"); got != versionID {
+		t.Errorf("replicaVersion() = %q, want %q", got, versionID)
+	}
+	if got, err := c.downloadVersion(ctx, "key", "b5", replicaVersion(row, "b5")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloadVersion() = %q, %v, want the version written over", got, err)
+	}
+	if err := c.compareStored(ctx, data, "key", "b5", versionID); err != nil {
+		t.Errorf("compareStored() of the written version = %v, want nil", err)
+	}
+	if _, err := c.writtenVersion("b5", objectstore.ObjectInfo{}); err == nil {
+		t.Error("writtenVersion() without a version in a versioned bucket succeeded, want an error")
+	}
+	if versionID, err := c.writtenVersion("b6", written); versionID != "" || err != nil {
+		t.Errorf("writtenVersion() in an unversioned bucket = %q, %v, want none", versionID, err)
+	}
+}
+
+func TestApplySettle(t *testing.T) {
+	newTestController(t)
+	if f := applySettle(fileDataRepo.PendingSyncFilter{}); f.SettleFor != defaultSettleFor || len(f.SettleForTypes) != 0 {
+		t.Errorf("applySettle() = %+v, want the default grace period", f)
+	}
+	viper.Set("replication.file-data.settle.default", "0s")
+	viper.Set("replication.file-data.settle.types", map[string]interface{}{"mldata": "2m", "img_preview": "0s"})
+	f := applySettle(fileDataRepo.PendingSyncFilter{})
+	if f.SettleFor != 0 || f.SettleForTypes[ente.MlData] != 2*time.Minute || f.SettleForTypes[ente.PreviewImage] != 0 || len(f.SettleForTypes) != 2 {
+		t.Errorf("applySettle() = %+v, want no default grace period and 2m for mldata", f)
+	}
+}
+
+func TestCountRoute(t *testing.T) {
+	newTestController(t)
+	ctx, stats := withTransferCount(context.Background())
+	countRoute(ctx, "b5", "b6", 100)
+	countRoute(ctx, "b5", "b6", 50)
+	countRoute(ctx, "b2-eu-cen", "b6", 10)
+	want := []filedata.RouteTransfer{{Source: "b2-eu-cen", Destination: "b6", Bytes: 10}, {Source: "b5", Destination: "b6", Bytes: 150}}
+	if got := stats.routeTransfers(); !slices.Equal(got, want) {
+		t.Errorf("routeTransfers() = %+v, want %+v", got, want)
+	}
+	if got := stats.sourceBucket("b2-eu-cen"); got != "b2-eu-cen" {
+		t.Errorf("sourceBucket() without a download = %q, want the fallback", got)
+	}
+	noteSource(ctx, "b5")
+	if got := stats.sourceBucket("b2-eu-cen"); got != "b5" {
+		t.Errorf("sourceBucket() = %q, want the bucket read from", got)
+	}
+	viper.Set("replication.file-data.egress-cost-per-gb.b5.b6", 0.02)
+	if got := egressCostPerGB("b5", "b6"); got != 0.02 {
+		t.Errorf("egressCostPerGB() = %v, want 0.02", got)
+	}
+	if got := egressCostPerGB("b6", "b5"); got != 0 {
+		t.Errorf("egressCostPerGB() of an unlisted route = %v, want 0", got)
+	}
+}
+
+func TestCheckPromotionLockedRow(t *testing.T) {
+	c := newTestController(t)
+	ctx := context.Background()
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived", ReplicatedBuckets: []string{"b5"}, PendingSync: true}
+	if outcome, err := c.checkPromotionLockedRow(ctx, row, "b5", limiter); outcome != promotionOutcomeConfirmed || err != nil {
+		t.Errorf("checkPromotionLockedRow() of a replicated bucket = %v, %v, want confirmed", outcome, err)
+	}
+	if outcome, err := c.checkPromotionLockedRow(ctx, row, "b6", limiter); outcome != promotionOutcomeWaiting || err != nil {
+		t.Errorf("checkPromotionLockedRow() of a pending row = %v, %v, want waiting", outcome, err)
+	}
+	row.InflightReplicas = []string{"b5"}
+	if outcome, err := c.checkPromotionLockedRow(ctx, row, "b5", limiter); outcome != promotionOutcomeWaiting || err != nil {
+		t.Errorf("checkPromotionLockedRow() of an in-flight bucket = %v, %v, want waiting", outcome, err)
+	}
+	row.ReplicaOverride = []string{"b5"}
+	if outcome, err := c.checkPromotionLockedRow(ctx, row, "b6", limiter); outcome != promotionOutcomeUnconfirmed || err == nil {
+		t.Errorf("checkPromotionLockedRow() of a bucket excluded by the override = %v, %v, want unconfirmed", outcome, err)
+	}
+}
+
+func TestDeletionOrder(t *testing.T) {
+	row := filedata.Row{
+		LatestBucket:      "wasabi-eu-central-2-derived",
+		ReplicatedBuckets: []string{"b6", "b5"},
+		InflightReplicas:  []string{"b2-eu-cen"},
+		DeleteFromBuckets: []string{"wasabi-eu-central-2-v3"},
+	}
+	buckets, err := deletionOrder(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range buckets {
+		got = append(got, b.bucketID)
+	}
+	// A deletion cut short after any of these leaves the latest copy, and
+	// the replicated ones after the others
+	if strings.Join(got, ",") != "wasabi-eu-central-2-v3,b2-eu-cen,b5,b6" {
+		t.Errorf("deletionOrder() = %v, want the stale, in-flight and replicated buckets in turn", got)
+	}
+	row.InflightReplicas = []string{"b5"}
+	if _, err := deletionOrder(row); err == nil {
+		t.Error("deletionOrder() of a bucket recorded twice succeeded, want an error")
+	}
+}
+
+func TestConfirmRetainedCopies(t *testing.T) {
+	c := newTestController(t)
+	// b2-eu-cen has the copy of the previous version, and the row has moved on
+	// from it. Set along with the rest, as viper.Set would hide the replicas.
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(strings.Replace(testConfig, "    file-data-config:",
+		"    b2-eu-cen:\n        bucket: b2\n        store: memory\n    file-data-config:", 1))); err != nil {
+		t.Fatal(err)
+	}
+	c.S3Config = s3config.NewS3Config()
+	ctx := context.Background()
+	row := filedata.Row{FileID: 1, UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived",
+		ReplicatedBuckets: []string{"b5", "b6"}, DeleteFromBuckets: []string{"b2-eu-cen"}}
+	obj := filedata.S3FileMetadata{Version: 1, EncryptedData: "new", DecryptionHeader: "header"}
+	obj.Checksum = obj.ContentChecksum()
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := checksumOf(data)
+	row.Checksum = &checksum
+	put := func(dc string, data []byte) {
+		if _, err := c.S3Config.GetObjectStore(dc).Put(ctx, row.S3FileMetadataObjectKey(), bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("wasabi-eu-central-2-derived", data)
+	put("b5", data)
+	put("b6", data)
+	put("b2-eu-cen", []byte(`{"version":1,"encryptedData":"old"}`))
+	if err := c.confirmRetainedCopies(ctx, row); err != nil {
+		t.Errorf("confirmRetainedCopies() with every copy in place = %v, want nil", err)
+	}
+
+	// The process crashed after b6 was recorded as replicated but before its
+	// copy of the new version landed, leaving the previous version there
+	put("b6", []byte(`{"version":1,"encryptedData":"old"}`))
+	if err := c.confirmRetainedCopies(ctx, row); err != nil {
+		t.Errorf("confirmRetainedCopies() with one of two replicas confirmed = %v, want nil", err)
+	}
+	viper.Set("replication.file-data.purge.min-replicas", 2)
+	if err := c.confirmRetainedCopies(ctx, row); !errors.Is(err, errLastCopy) {
+		t.Errorf("confirmRetainedCopies() with 1 of 2 required replicas = %v, want errLastCopy", err)
+	}
+	viper.Set("replication.file-data.purge.min-replicas", 1)
+
+	// The copy in b5 went missing too, so the stale copy is the only other one
+	if err := c.S3Config.GetObjectStore("b5").Delete(ctx, row.S3FileMetadataObjectKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.confirmRetainedCopies(ctx, row); !errors.Is(err, errLastCopy) {
+		t.Errorf("confirmRetainedCopies() without a confirmed replica = %v, want errLastCopy", err)
+	}
+
+	// The latest copy itself is gone
+	if err := c.S3Config.GetObjectStore("wasabi-eu-central-2-derived").Delete(ctx, row.S3FileMetadataObjectKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.confirmRetainedCopies(ctx, row); !errors.Is(err, errLastCopy) {
+		t.Errorf("confirmRetainedCopies() without the latest copy = %v, want errLastCopy", err)
+	}
+
+	// A purge that deleted the stale copy but crashed before removing its
+	// bucket from the row deletes it again on the next round
+	if err := c.deleteAndVerify(ctx, row.S3FileMetadataObjectKey(), "b2-eu-cen"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.deleteAndVerify(ctx, row.S3FileMetadataObjectKey(), "b2-eu-cen"); err != nil {
+		t.Errorf("deleteAndVerify() of an object already deleted = %v, want nil", err)
+	}
+}
+
+func TestHoldsRetainedCopy(t *testing.T) {
+	c := newTestController(t)
+	dir := t.TempDir()
+	for _, dc := range []string{"b6", "b2-eu-cen"} {
+		viper.Set("s3."+dc+".bucket", dc)
+		viper.Set("s3."+dc+".store", "fs")
+		viper.Set("s3."+dc+".path", dir)
+	}
+	c.S3Config = s3config.NewS3Config()
+	row := filedata.Row{Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived", ReplicatedBuckets: []string{"b5"},
+		InflightReplicas: []string{"b6"}, DeleteFromBuckets: []string{"b2-eu-cen", "wasabi-eu-central-2-v3"}}
+	if !c.holdsRetainedCopy(row, "b2-eu-cen") {
+		t.Error("holdsRetainedCopy() of a bucket backed by the same store as an in-flight one = false, want true")
+	}
+	if c.holdsRetainedCopy(row, "wasabi-eu-central-2-v3") {
+		t.Error("holdsRetainedCopy() of a bucket of its own = true, want false")
+	}
+	if !c.holdsRetainedCopy(row, "b5") {
+		t.Error("holdsRetainedCopy() of a replicated bucket = false, want true")
+	}
+}
+
+func TestApplyPriorityFairUsers(t *testing.T) {
+	newTestController(t)
+	if f := applyPriority(fileDataRepo.PendingSyncFilter{}); f.FairUserWindow != 0 {
+		t.Errorf("applyPriority() without fair-users = %+v, want no fair user window", f)
+	}
+	viper.Set("replication.file-data.priority.fair-users", true)
+	if f := applyPriority(fileDataRepo.PendingSyncFilter{}); f.FairUserWindow != defaultFairUserWindow {
+		t.Errorf("applyPriority() with fair-users has window %d, want %d", f.FairUserWindow, defaultFairUserWindow)
+	}
+	viper.Set("replication.file-data.priority.fair-users-window", 10)
+	if f := applyPriority(fileDataRepo.PendingSyncFilter{}); f.FairUserWindow != 10 {
+		t.Errorf("applyPriority() with a fair-users-window of 10 has window %d", f.FairUserWindow)
+	}
+}
+
+func TestPendingReport(t *testing.T) {
+	c := newTestController(t)
+	now := time.Now()
+	row := filedata.Row{FileID: 1, UserID: 2, Type: ente.MlData, Size: 10, LatestBucket: "wasabi-eu-central-2-derived",
+		ReplicatedBuckets: []string{"b5"}, InflightReplicas: []string{"b6"}, UpdatedAt: now.Add(-time.Minute).UnixMicro()}
+	entry := c.pendingReportRow(row, now)
+	if strings.Join(entry.MissingBuckets, ",") != "b6" || strings.Join(entry.InflightBuckets, ",") != "b6" || entry.AgeSeconds != 60 {
+		t.Errorf("pendingReportRow() = %+v, want b6 missing and in flight for 60s", entry)
+	}
+
+	var out bytes.Buffer
+	enc := newPendingReportEncoder(PendingReportJSON, &out)
+	for _, page := range [][]filedata.PendingReportRow{{entry}, {entry, entry}} {
+		if err := enc.write(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.close(); err != nil {
+		t.Fatal(err)
+	}
+	var report struct{ Rows []filedata.PendingReportRow }
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil || len(report.Rows) != 3 {
+		t.Errorf("JSON report of 2 pages = %q (%v), want 3 rows", out.String(), err)
+	}
+
+	out.Reset()
+	enc = newPendingReportEncoder(PendingReportCSV, &out)
+	if err := enc.close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out.String()); got != strings.Join(pendingReportColumns, ",") {
+		t.Errorf("CSV report without rows = %q, want just the header", got)
+	}
+	out.Reset()
+	enc = newPendingReportEncoder(PendingReportCSV, &out)
+	if err := enc.write([]filedata.PendingReportRow{entry}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "1,2,mldata,10,wasabi-eu-central-2-derived,b6,b6,0,false,") {
+		t.Errorf("CSV report = %q, want the header and the row", out.String())
+	}
+}
+
+func TestAttemptBudget(t *testing.T) {
+	newTestController(t)
+	var b attemptBudget
+	row := filedata.Row{FileID: 1, Type: ente.MlData}
+	now := time.Now()
+	if !b.shouldRecordFailure(row, ErrTransient, now) || !b.shouldRecordFailure(row, ErrTransient, now) {
+		t.Error("shouldRecordFailure() = false while not coalescing, want true")
+	}
+	for i := 0; i < 1000; i++ {
+		b.shouldRecordFailure(row, ErrTransient, now)
+	}
+	b.measure(time.Second)
+	if !b.coalescing.Load() {
+		t.Fatal("not coalescing after 1002 failures in a second")
+	}
+	if !b.shouldRecordFailure(row, ErrTransient, now) {
+		t.Error("shouldRecordFailure() of the first failure while coalescing = false, want true")
+	}
+	if b.shouldRecordFailure(row, ErrTransient, now.Add(time.Second)) {
+		t.Error("shouldRecordFailure() of the same failure within the window = true, want false")
+	}
+	if got := b.takeCoalesced(); len(got) != 1 || !got[rowKey{row.FileID, row.Type}].Equal(now.Add(time.Second)) || b.takeCoalesced() != nil {
+		t.Errorf("takeCoalesced() = %v, want the coalesced failure once", got)
+	}
+	if !b.shouldRecordFailure(row, ErrTimeout, now.Add(time.Second)) {
+		t.Error("shouldRecordFailure() of another class of failure = false, want true")
+	}
+	if !b.shouldRecordFailure(row, ErrSourceMissing, now.Add(time.Second)) || !b.shouldRecordFailure(row, ErrSourceMissing, now.Add(time.Second)) {
+		t.Error("shouldRecordFailure() of a permanent failure = false, want true")
+	}
+	if !b.shouldRecordFailure(row, ErrTimeout, now.Add(2*time.Minute)) {
+		t.Error("shouldRecordFailure() of the same failure after the window = false, want true")
+	}
+	b.measure(time.Minute)
+	if b.coalescing.Load() || b.failures != nil {
+		t.Error("still coalescing once the failure rate is back under the threshold")
+	}
+
+	viper.Set("replication.file-data.attempts.registrations-per-second", 100)
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b.limiter == nil || b.limiter.Limit() != 100 || b.limiter.Burst() != 100 {
+		t.Errorf("registrations limited to %v, want 100 per second", b.limiter)
+	}
+	viper.Set("replication.file-data.attempts.registrations-per-second", 10)
+	if err := b.wait(context.Background()); err != nil || b.limiter.Limit() != 10 {
+		t.Errorf("registrations not limited to the new cap of 10 per second (%v)", err)
+	}
+	if got := b.registrations.Load(); got != 2 {
+		t.Errorf("%d registrations counted, want 2", got)
+	}
+}
+
+func TestAttemptBudgetWaitIsNotABucketFailure(t *testing.T) {
+	c := newTestController(t)
+	c.circuits = newCircuitBreaker()
+	viper.Set("replication.file-data.circuit-breaker.threshold", 1)
+	viper.Set("replication.file-data.attempts.registrations-per-second", 0.001)
+	if err := c.attempts.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The next registration is due long after the row's deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	row := filedata.Row{FileID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+	data := []byte("data")
+	if err := c.fanOutUploads(ctx, row, data, checksumOf(data), objectstore.ObjectMetadata{}, row.LatestBucket, map[string]bool{"b5": true}); err == nil {
+		t.Fatal("fanOutUploads() without a registration in time succeeded, want an error")
+	}
+	for _, s := range c.circuits.status() {
+		if s.ConsecutiveFailures != 0 || s.State != string(circuitClosed) {
+			t.Errorf("circuit of %s after waiting for a registration = %+v, want it closed", s.Bucket, s)
+		}
+	}
+}
+
+// TestQueuedUploadTimesOut times out an upload that is still waiting for a
+// request slot, which fanOutUploads doesn't count against the bucket. The
+// upload of a user, which doesn't wait for a slot, goes through meanwhile.
+func TestQueuedUploadTimesOut(t *testing.T) {
+	c := newTestController(t)
+	viper.Set("replication.file-data.max-concurrent-requests.b5", 1)
+	ctx := forReplication(context.Background())
+	if err := c.requests.acquire(ctx, "b5"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.requests.release("b5")
+	dstCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err := c.uploadObject(dstCtx, []byte("data"), "key", "b5", objectstore.ObjectMetadata{})
+	if !errors.Is(err, errRequestQueued) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("uploadObject() while the bucket's slots are taken = %v, want it to time out queued", err)
+	}
+	if _, err := c.S3Config.GetObjectStore("b5").Head(ctx, "key"); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Errorf("Head() after the queued upload timed out = %v, want ErrNotFound", err)
+	}
+	userCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.uploadObject(userCtx, []byte("data"), "key", "b5", objectstore.ObjectMetadata{}); err != nil {
+		t.Errorf("uploadObject() of a user while the bucket's slots are taken = %v, want it to go through", err)
+	}
+}
+
+func TestIntegrityFailureClasses(t *testing.T) {
+	c := newTestController(t)
+	ctx := context.Background()
+	row := filedata.Row{FileID: 1, Type: ente.MlData, Size: 3}
+	_, err := c.verifySourceObject(ctx, row, []byte("ab"))
+	if class := replicationErrorClass(ctx, classifyReplicationError(ctx, err)); class != ErrSourceIntegrity || !class.permanent() {
+		t.Errorf("class of a short source = %s, want the permanent %s", class, ErrSourceIntegrity)
+	}
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("verifySourceObject() = %v, want an ErrIntegrity", err)
+	}
+	// A bad upload is retried, the source is fine
+	err = c.verifyUploadedObject(ctx, []byte("abc"), checksumOf([]byte("abc")), objectstore.ObjectInfo{Size: 2}, "key", "b5")
+	if class := replicationErrorClass(ctx, classifyReplicationError(ctx, err)); class != ErrIntegrity || class.permanent() {
+		t.Errorf("class of a short upload = %s, want a retried %s", class, ErrIntegrity)
+	}
+}
+
+func TestRecoveryAction(t *testing.T) {
+	c := newTestController(t)
+	ctx := context.Background()
+	row := filedata.Row{FileID: 1, UserID: 1, Type: ente.PreviewVideo, LatestBucket: "wasabi-eu-central-2-derived"}
+	if got := c.recoveryAction(ctx, row, "b5"); got != missingSourceSeed {
+		t.Errorf("recoveryAction() by default = %s, want %s", got, missingSourceSeed)
+	}
+	viper.Set("replication.file-data.missing-source.action", missingSourcePromote)
+	if got := c.recoveryAction(ctx, row, "b5"); got != missingSourceSeed {
+		t.Errorf("recoveryAction() of a bucket without the side objects = %s, want %s", got, missingSourceSeed)
+	}
+	for _, key := range row.SideObjectKeys() {
+		if _, err := c.S3Config.GetObjectStore("b5").Put(ctx, key, strings.NewReader("segments"), 8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := c.recoveryAction(ctx, row, "b5"); got != missingSourcePromote {
+		t.Errorf("recoveryAction() of a bucket with the side objects = %s, want %s", got, missingSourcePromote)
+	}
+	viper.Set("s3.b5.compress", true)
+	c.S3Config = s3config.NewS3Config()
+	row.Type = ente.MlData
+	if got := c.recoveryAction(ctx, row, "b5"); got != missingSourceSeed {
+		t.Errorf("recoveryAction() of a compressed bucket = %s, want %s", got, missingSourceSeed)
+	}
+	if got := c.recoveryAction(ctx, row, "b6"); got != missingSourcePromote {
+		t.Errorf("recoveryAction() of an uncompressed bucket = %s, want %s", got, missingSourcePromote)
+	}
+}
+
+// TestRecoverMissingSourceActions recovers the object of a row from a replica,
+// by seeding the latest bucket from a compressed copy, and by promoting an
+// uncompressed one.
+func TestRecoverMissingSourceActions(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	c := newTestController(t)
+	viper.Set("s3.b5.compress", true)
+	viper.Set("replication.file-data.missing-source.action", missingSourcePromote)
+	c.S3Config = s3config.NewS3Config()
+	c.Repo = &fileDataRepo.Repository{DB: db}
+	first := int64(4)<<40 + time.Now().UnixMicro()%(1<<39)
+	for i, bucketID := range []string{"b5", "b6"} {
+		obj := filedata.S3FileMetadata{Version: 1, EncryptedData: "data", DecryptionHeader: "header"}
+		obj.Checksum = obj.ContentChecksum()
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checksum := checksumOf(data)
+		row := filedata.Row{FileID: first + int64(i), UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived",
+			Size: int64(len(data)), Checksum: &checksum}
+		if err := c.Repo.InsertOrUpdate(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		stored, _, err := c.encodeForBucket(ctx, bucketID, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objectKey := row.S3FileMetadataObjectKey()
+		if _, err := c.S3Config.GetObjectStore(bucketID).Put(ctx, objectKey, bytes.NewReader(stored), int64(len(stored))); err != nil {
+			t.Fatal(err)
+		}
+		latestErr := fmt.Errorf("%w: %s", objectstore.ErrNotFound, objectKey)
+		candidates := []string{"b5", "b6"}
+		tried := slices.DeleteFunc(candidates, func(b string) bool { return b == bucketID })
+		got, _, source, err := c.recoverMissingSource(ctx, row, objectKey, tried, latestErr)
+		var latest string
+		if err := db.QueryRowContext(ctx, `SELECT latest_bucket FROM file_data WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type)).Scan(&latest); err != nil {
+			t.Fatal(err)
+		}
+		if bucketID == "b5" {
+			if err != nil || !bytes.Equal(got, data) || source != "b5" {
+				t.Errorf("recoverMissingSource() from a compressed copy = %q, %s, %v, want the data seeded from b5", got, source, err)
+			}
+			if _, err := c.S3Config.GetObjectStore(row.LatestBucket).Head(ctx, objectKey); err != nil || latest != row.LatestBucket {
+				t.Errorf("latest bucket after seeding = %s (%v), want %s with the object", latest, err, row.LatestBucket)
+			}
+			continue
+		}
+		if !errors.Is(err, errSourcePromoted) || latest != "b6" {
+			t.Errorf("recoverMissingSource() from an uncompressed copy = %v with latest bucket %s, want b6 promoted", err, latest)
+		}
+	}
+}
+
+// TestPromotionCheckCoversNewerRows runs a promotion check with a row written
+// after the check was created, which keeps the check from being ready till it
+// is in the bucket.
+func TestPromotionCheckCoversNewerRows(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	c := newTestController(t)
+	c.Repo = &fileDataRepo.Repository{DB: db}
+	viper.Set("replication.file-data.promotion-check.batch-size", 1<<20)
+	viper.Set("replication.file-data.promotion-check.requeues-per-second", 1e6)
+	check, err := c.Repo.CreatePromotionCheck(ctx, ente.PreviewImage, "b5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`UPDATE file_data_promotion_check SET status = $1 WHERE id = $2`, fileDataRepo.PromotionCheckReady, check.ID)
+	})
+	checksum := checksumOf([]byte("data"))
+	row := filedata.Row{FileID: int64(5)<<40 + time.Now().UnixMicro()%(1<<39), UserID: 1, Type: ente.PreviewImage,
+		LatestBucket: "wasabi-eu-central-2-derived", Size: 4, Checksum: &checksum}
+	if err := c.Repo.InsertOrUpdate(ctx, row); err != nil {
+		t.Fatal(err)
+	}
+	// Written after the check, and neither queued nor in b5
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET pending_sync = false, sync_locked_till = 0, updated_at = now_utc_micro_seconds() + 1
+		WHERE file_id = $1 AND data_type = $2`, row.FileID, string(row.Type)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.runPromotionCheckBatch(ctx, check.ID); err != nil {
+		t.Fatal(err)
+	}
+	var pending bool
+	if err := db.QueryRowContext(ctx, `SELECT pending_sync FROM file_data WHERE file_id = $1 AND data_type = $2`,
+		row.FileID, string(row.Type)).Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if !pending {
+		t.Error("row written after the check was not queued for replication to b5")
+	}
+	check, err = c.Repo.GetPromotionCheck(ctx, check.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Ready || check.Passes != 1 || check.Remaining < 1 || check.Requeued < 1 {
+		t.Errorf("check after a pass = %+v, want a pass that requeued the newer row, and isn't ready without it", check)
+	}
+}
+
+func TestCleanUpPartialUpload(t *testing.T) {
+	c := newTestController(t)
+	store := c.S3Config.GetObjectStore("b5")
+	put := func() {
+		if _, err := store.Put(context.Background(), "key", strings.NewReader("partial"), 7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put()
+	lost, cancel := context.WithCancelCause(context.Background())
+	cancel(fileDataRepo.ErrLockLost)
+	c.cleanUpPartialUpload(lost, "key", "b5", errors.New("upload failed"))
+	if _, err := store.Head(context.Background(), "key"); err != nil {
+		t.Errorf("Head() after cleaning up with the lock lost = %v, want the object left for the new holder", err)
+	}
+	c.cleanUpPartialUpload(context.Background(), "key", "b5", errors.New("upload failed"))
+	if _, err := store.Head(context.Background(), "key"); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Errorf("Head() after cleaning up = %v, want ErrNotFound", err)
+	}
+	put()
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	c.cleanUpPartialUpload(expired, "key", "b5", context.DeadlineExceeded)
+	if _, err := store.Head(context.Background(), "key"); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Errorf("Head() after cleaning up a timed out upload = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDisabledBucketsList(t *testing.T) {
+	d := &disabledBuckets{}
+	d.set([]filedata.DisabledBucket{
+		{Bucket: "b5", DisabledUntil: time.Now().Add(time.Hour).UnixMicro()},
+		{Bucket: "b6", DisabledUntil: time.Now().Add(-time.Second).UnixMicro()},
+	})
+	if got := d.list(); !slices.Equal(got, []string{"b5"}) {
+		t.Errorf("list() = %v, want [b5], b6 has been re-enabled", got)
+	}
+}
+
+// TestFairUserOrder has one user with a backlog of old rows, and another with a
+// couple of newer ones, which get their turn in between.
+func TestFairUserOrder(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	repo := &fileDataRepo.Repository{DB: db}
+	start := time.Now().UnixMicro()
+	first := int64(6)<<40 + start%(1<<39)
+	bulkUser, otherUser := first, first+1
+	var ids []int64
+	insert := func(userID int64, updatedAt int64) int64 {
+		checksum := checksumOf([]byte("data"))
+		row := filedata.Row{FileID: first + int64(len(ids)), UserID: userID, Type: ente.MlData,
+			LatestBucket: "wasabi-eu-central-2-derived", Size: 4, Checksum: &checksum}
+		if err := repo.InsertOrUpdate(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0, updated_at = $3 WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type), updatedAt); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, row.FileID)
+		return row.FileID
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM file_data WHERE file_id = any($1)`, pq.Array(ids))
+	})
+	var bulk, other []int64
+	for i := int64(0); i < 5; i++ {
+		bulk = append(bulk, insert(bulkUser, start-1000+i))
+	}
+	for i := int64(0); i < 2; i++ {
+		other = append(other, insert(otherUser, start-500+i))
+	}
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}, CreatedAfter: start - 1,
+		Order: fileDataRepo.OldestFirst, FairUserWindow: 10}
+	pick := func() []int64 {
+		rows, err := repo.GetPendingSyncBatchAndExtendLock(ctx, time.Now().Add(10*time.Minute).UnixMicro(), filter, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var picked []int64
+		for _, row := range rows {
+			picked = append(picked, row.FileID)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0, lock_heartbeat_at = NULL WHERE file_id = any($1)`,
+			pq.Array(picked)); err != nil {
+			t.Fatal(err)
+		}
+		return picked
+	}
+	if got, want := pick(), []int64{bulk[0], other[0], bulk[1], other[1]}; !slices.Equal(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+	// The row of the bulk user that is being replicated counts as ahead
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = $2, lock_heartbeat_at = now_utc_micro_seconds() WHERE file_id = $1`,
+		bulk[0], time.Now().Add(10*time.Minute).UnixMicro()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pick(), []int64{other[0], bulk[1], other[1], bulk[2]}; !slices.Equal(got, want) {
+		t.Errorf("picked %v while a row of the bulk user is being replicated, want %v", got, want)
+	}
+}
+
+// staleLister leaves some of the objects out of the listings of a store, as a
+// listing that isn't up to date yet would.
+type staleLister struct {
+	objectstore.Lister
+	hidden map[string]bool
+}
+
+func (l staleLister) List(ctx context.Context, startAfter string, limit int) ([]string, bool, error) {
+	keys, more, err := l.Lister.List(ctx, startAfter, limit)
+	visible := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !l.hidden[key] {
+			visible = append(visible, key)
+		}
+	}
+	return visible, more, err
+}
+
+// TestReconcileListings reconciles the rows of two buckets from their listings,
+// over several pages and runs. One row is missing from b5, and another one is
+// missing from the (stale) listings, but not from the buckets.
+func TestReconcileListings(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(testConfig + `
+        vid_preview:
+            primaryBucket: wasabi-eu-central-2-derived
+            replicaBuckets: [b5, b6]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	c := New(&fileDataRepo.Repository{DB: db}, nil, nil, s3config.NewS3Config(), nil, nil)
+	first := int64(7)<<40 + time.Now().UnixMicro()%(1<<39)
+	var rows []filedata.Row
+	hidden := map[string]bool{}
+	for i := int64(0); i < 5; i++ {
+		row := filedata.Row{FileID: first + i, UserID: 1, Type: ente.PreviewVideo, LatestBucket: "wasabi-eu-central-2-derived", Size: 4}
+		if err := c.Repo.InsertOrUpdate(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0, pending_sync = false, replicated_buckets = '{b5,b6}'
+			WHERE file_id = $1 AND data_type = $2`, row.FileID, string(row.Type)); err != nil {
+			t.Fatal(err)
+		}
+		for _, bucketID := range []string{row.LatestBucket, "b5", "b6"} {
+			if i == 2 && bucketID == "b5" {
+				continue
+			}
+			if _, err := c.S3Config.GetObjectStore(bucketID).Put(ctx, row.S3FileMetadataObjectKey(), strings.NewReader("data"), 4); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 3 {
+			hidden[row.S3FileMetadataObjectKey()] = true
+		}
+		rows = append(rows, row)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM file_data WHERE file_id >= $1 AND file_id < $2`, first, first+5)
+	})
+	var targets []reconcileTarget
+	for _, bucketID := range []string{"b5", "b6"} {
+		lister := staleLister{Lister: c.S3Config.GetObjectStore(bucketID).(objectstore.Lister), hidden: hidden}
+		targets = append(targets, reconcileTarget{oType: ente.PreviewVideo, bucketID: bucketID, lister: lister})
+	}
+	limiter := c.newJobLimiter(jobReconcile, 1e6)
+	reconcile := func(batchSize int) *filedata.ReconciliationReport {
+		report := &filedata.ReconciliationReport{Corrections: make([]filedata.ReconciliationCorrection, 0)}
+		c.reconcileListings(ctx, report, targets, batchSize, limiter)
+		if report.Errors > 0 {
+			t.Fatalf("reconciliation had %d errors", report.Errors)
+		}
+		return report
+	}
+	c.reconciler.listPos = auditPosition{Type: ente.PreviewVideo, Bucket: "b5"}
+
+	// The first page of b5
+	if report := reconcile(2); report.RowsChecked != 2 || len(report.Corrections) != 0 {
+		t.Errorf("first run checked %d rows with corrections %+v, want 2 rows without any", report.RowsChecked, report.Corrections)
+	}
+	if want := (auditPosition{Type: ente.PreviewVideo, Bucket: "b5", After: rows[1].S3FileMetadataObjectKey()}); c.reconciler.listPos != want {
+		t.Errorf("position after the first run = %+v, want %+v", c.reconciler.listPos, want)
+	}
+	// The rest of b5, where the missing row is requeued, but not the one that
+	// the listing left out, and the first page of b6
+	report := reconcile(4)
+	wantCorrections := []filedata.ReconciliationCorrection{{FileID: rows[2].FileID, Type: ente.PreviewVideo, Bucket: "b5", Action: correctionRequeued}}
+	if report.RowsChecked != 5 || !slices.Equal(report.Corrections, wantCorrections) {
+		t.Errorf("second run checked %d rows with corrections %+v, want 5 rows with %+v", report.RowsChecked, report.Corrections, wantCorrections)
+	}
+	if want := (auditPosition{Type: ente.PreviewVideo, Bucket: "b6", After: rows[1].S3FileMetadataObjectKey()}); c.reconciler.listPos != want {
+		t.Errorf("position after the second run = %+v, want %+v", c.reconciler.listPos, want)
+	}
+	// The rest of b6, after which the listings start over
+	if report := reconcile(4); report.RowsChecked != 3 || len(report.Corrections) != 0 {
+		t.Errorf("third run checked %d rows with corrections %+v, want 3 rows without any", report.RowsChecked, report.Corrections)
+	}
+	if c.reconciler.listPos != (auditPosition{}) {
+		t.Errorf("position after the end of the listings = %+v, want the start", c.reconciler.listPos)
+	}
+	// Both buckets in a single run, which counts each row once
+	c.reconciler.listPos = auditPosition{Type: ente.PreviewVideo, Bucket: "b5"}
+	if report := reconcile(40); report.RowsChecked != 5 || len(report.Corrections) != 0 {
+		t.Errorf("run over both buckets checked %d rows with corrections %+v, want 5 rows without any", report.RowsChecked, report.Corrections)
+	}
+}
+
+// TestReplicateDeletedRow deletes a row while its copies are being uploaded,
+// after the check that precedes the uploads, so that it is only noticed when
+// the bucket is moved to the replicas. The copies are then deleted again.
+func TestReplicateDeletedRow(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// Faults are only injected into replication, in the test environment
+	ctx = forReplication(ctx)
+	t.Setenv("ENVIRONMENT", "test")
+	c := newTestController(t)
+	// Slow uploads leave the time to delete the row
+	viper.Set("replication.file-data.faults.enabled", true)
+	viper.Set("replication.file-data.faults.operations", []string{"upload"})
+	viper.Set("replication.file-data.faults.latency", time.Second)
+	c = New(&fileDataRepo.Repository{DB: db}, nil, nil, c.S3Config, nil, nil)
+
+	start := time.Now().UnixMicro()
+	row := filedata.Row{FileID: int64(9)<<40 + start%(1<<39), UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+	obj := filedata.S3FileMetadata{Version: 1, EncryptedData: "data", DecryptionHeader: "header"}
+	obj.Checksum = obj.ContentChecksum()
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objectKey := row.S3FileMetadataObjectKey()
+	if _, err := c.S3Config.GetObjectStore(row.LatestBucket).Put(ctx, objectKey, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	checksum := checksumOf(data)
+	row.Size = int64(len(data))
+	row.Checksum = &checksum
+	if err := c.Repo.InsertOrUpdate(ctx, row); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM file_data WHERE file_id = $1`, row.FileID)
+	})
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0 WHERE file_id = $1`, row.FileID); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := newLockPolicy()
+	lockTill := time.Now().Add(policy.min).UnixMicro()
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}, CreatedAfter: start - 1}
+	rows, err := c.Repo.GetPendingSyncBatchAndExtendLock(ctx, lockTill, filter, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].FileID != row.FileID {
+		t.Fatalf("locked %v, want file %d", rows, row.FileID)
+	}
+	deleted := make(chan error, 1)
+	go func() {
+		// The attempt is registered right before the uploads start
+		for ctx.Err() == nil {
+			var inflight int
+			if err := db.QueryRowContext(ctx, `SELECT cardinality(inflight_rep_buckets) FROM file_data WHERE file_id = $1`,
+				row.FileID).Scan(&inflight); err != nil {
+				deleted <- err
+				return
+			}
+			if inflight > 0 {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(200 * time.Millisecond)
+		_, err := db.ExecContext(ctx, `UPDATE file_data SET is_deleted = true WHERE file_id = $1`, row.FileID)
+		deleted <- err
+	}()
+	if err := c.replicateLockedRow(ctx, policy, rows[0], lockTill); err != nil {
+		t.Errorf("replicating the deleted row failed: %v", err)
+	}
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range []string{"b5", "b6"} {
+		if _, err := c.S3Config.GetObjectStore(dst).Head(ctx, objectKey); !errors.Is(err, objectstore.ErrNotFound) {
+			t.Errorf("Head of the copy in %s = %v, want it deleted again", dst, err)
+		}
+	}
+	var replicated int
+	if err := db.QueryRowContext(ctx, `SELECT cardinality(replicated_buckets) FROM file_data WHERE file_id = $1`,
+		row.FileID).Scan(&replicated); err != nil {
+		t.Fatal(err)
+	}
+	if replicated != 0 {
+		t.Errorf("the deleted row was moved to %d replicas, want none", replicated)
+	}
+}
+
+// TestResumeFromMovedSource moves the latest bucket of a locked row to b5, as
+// a promotion does, after the row was picked up. The attempt replicates from
+// b5, where the object is now, rather than from the bucket it was picked up
+// with.
+func TestResumeFromMovedSource(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c := newTestController(t)
+	c = New(&fileDataRepo.Repository{DB: db}, nil, nil, c.S3Config, nil, nil)
+
+	start := time.Now().UnixMicro()
+	row := filedata.Row{FileID: int64(10)<<40 + start%(1<<39), UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+	obj := filedata.S3FileMetadata{Version: 1, EncryptedData: "data", DecryptionHeader: "header"}
+	obj.Checksum = obj.ContentChecksum()
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := checksumOf(data)
+	row.Size = int64(len(data))
+	row.Checksum = &checksum
+	if err := c.Repo.InsertOrUpdate(ctx, row); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM file_data WHERE file_id = $1`, row.FileID)
+	})
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0 WHERE file_id = $1`, row.FileID); err != nil {
+		t.Fatal(err)
+	}
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}, CreatedAfter: start - 1}
+	rows, err := c.Repo.GetPendingSyncBatchAndExtendLock(ctx, time.Now().Add(10*time.Minute).UnixMicro(), filter, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].FileID != row.FileID {
+		t.Fatalf("locked %v, want file %d", rows, row.FileID)
+	}
+	picked := rows[0]
+
+	// Only b5 has the object by now
+	objectKey := row.S3FileMetadataObjectKey()
+	if _, err := c.S3Config.GetObjectStore("b5").Put(ctx, objectKey, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Repo.SetLatestBucket(ctx, picked, "b5"); err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := c.replicateRowData(ctx, picked)
+	if err != nil {
+		t.Fatalf("replicating from the moved source failed: %v", err)
+	}
+	if strings.Join(buckets, ",") != "b6" {
+		t.Errorf("replicated to %v, want [b6]", buckets)
+	}
+	if _, err := c.S3Config.GetObjectStore(picked.LatestBucket).Head(ctx, objectKey); !errors.Is(err, objectstore.ErrNotFound) {
+		t.Errorf("Head of the object in the stale source = %v, want it not written to", err)
+	}
+	body, err := c.S3Config.GetObjectStore("b6").Get(ctx, objectKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if got, _ := io.ReadAll(body); !bytes.Equal(got, data) {
+		t.Errorf("b6 has %q, want the object from b5", got)
+	}
+}
+
+// newDBController returns a controller over db, with the memory stores of c
+// and the configuration as it is by now (e.g. the faults to inject). It only
+// replicates the rows created from now on, and replicates them right away.
+func newDBController(c *Controller, db *sql.DB) *Controller {
+	viper.Set("replication.file-data.settle.default", "0s")
+	c = New(&fileDataRepo.Repository{DB: db}, nil, nil, c.S3Config, nil, nil)
+	c.storeCreatedAfter(time.Now().UnixMicro()-1, "")
+	return c
+}
+
+// insertPendingRow writes a metadata object for the row to its latest bucket,
+// and inserts the row unlocked, so that it is picked up for replication right
+// away. It returns the row as inserted, and the object.
+func insertPendingRow(t *testing.T, c *Controller, db *sql.DB, row filedata.Row) (filedata.Row, []byte) {
+	ctx := context.Background()
+	obj := filedata.S3FileMetadata{Version: 1, EncryptedData: fmt.Sprintf("data of %d", row.FileID), DecryptionHeader: "header"}
+	obj.Checksum = obj.ContentChecksum()
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.S3Config.GetObjectStore(row.LatestBucket).Put(ctx, row.S3FileMetadataObjectKey(), bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	checksum := checksumOf(data)
+	row.Size = int64(len(data))
+	row.Checksum = &checksum
+	if err := c.Repo.InsertOrUpdate(ctx, row); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM file_data WHERE file_id = $1 AND data_type = $2`, row.FileID, string(row.Type))
+	})
+	// Rows are inserted locked for a few minutes, see InsertOrUpdate
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0 WHERE file_id = $1 AND data_type = $2`,
+		row.FileID, string(row.Type)); err != nil {
+		t.Fatal(err)
+	}
+	return row, data
+}
+
+// replicatedBuckets returns the buckets that the row has been recorded as
+// replicated to, sorted.
+func replicatedBuckets(t *testing.T, db *sql.DB, row filedata.Row) []string {
+	var buckets []string
+	if err := db.QueryRow(`SELECT replicated_buckets FROM file_data WHERE file_id = $1 AND data_type = $2`,
+		row.FileID, string(row.Type)).Scan(pq.Array(&buckets)); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// TestRetryFailedDestination replicates a row while the uploads to b6 fail,
+// and then retries it once b6 is back. The retry only uploads to b6.
+func TestRetryFailedDestination(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// Faults are only injected into replication, in the test environment
+	ctx = forReplication(ctx)
+	t.Setenv("ENVIRONMENT", "test")
+	c := newTestController(t)
+	viper.Set("replication.file-data.faults.enabled", true)
+	viper.Set("replication.file-data.faults.buckets", []string{"b6"})
+	viper.Set("replication.file-data.faults.operations", []string{"upload"})
+	failing := newDBController(c, db)
+	row, data := insertPendingRow(t, failing, db, filedata.Row{FileID: int64(11)<<40 + time.Now().UnixMicro()%(1<<39),
+		UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"})
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}}
+	if err := failing.tryReplicate(ctx, filter); err == nil {
+		t.Fatal("tryReplicate() while b6 fails succeeded, want an error")
+	}
+	if got := replicatedBuckets(t, db, row); strings.Join(got, ",") != "b5" {
+		t.Fatalf("replicated to %v while b6 fails, want [b5]", got)
+	}
+
+	// Had the retry uploaded to b5 again, it would overwrite this
+	objectKey := row.S3FileMetadataObjectKey()
+	marker := []byte("uploaded by the first attempt")
+	if _, err := c.S3Config.GetObjectStore("b5").Put(ctx, objectKey, bytes.NewReader(marker), int64(len(marker))); err != nil {
+		t.Fatal(err)
+	}
+	// Retry right away, rather than after the backoff
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0 WHERE file_id = $1 AND data_type = $2`,
+		row.FileID, string(row.Type)); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("replication.file-data.faults.enabled", false)
+	if err := newDBController(c, db).tryReplicate(ctx, filter); err != nil {
+		t.Fatalf("tryReplicate() once b6 is back failed: %v", err)
+	}
+	if got := replicatedBuckets(t, db, row); strings.Join(got, ",") != "b5,b6" {
+		t.Errorf("replicated to %v after the retry, want [b5 b6]", got)
+	}
+	for dst, want := range map[string][]byte{"b5": marker, "b6": data} {
+		body, err := c.S3Config.GetObjectStore(dst).Get(ctx, objectKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s has %q after the retry, want %q", dst, got, want)
+		}
+	}
+}
+
+// TestPromotionCheckReplicates runs a promotion check of b5 over a row that
+// isn't in b5, replicates the row that it requeued, and checks that the next
+// pass finds it in b5.
+func TestPromotionCheckReplicates(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c := newDBController(newTestController(t), db)
+	viper.Set("replication.file-data.promotion-check.batch-size", 1<<20)
+	viper.Set("replication.file-data.promotion-check.requeues-per-second", 1e6)
+	row, _ := insertPendingRow(t, c, db, filedata.Row{FileID: int64(12)<<40 + time.Now().UnixMicro()%(1<<39),
+		UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"})
+	// Written before the check, and neither queued nor in b5
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET pending_sync = false WHERE file_id = $1 AND data_type = $2`,
+		row.FileID, string(row.Type)); err != nil {
+		t.Fatal(err)
+	}
+	check, err := c.Repo.CreatePromotionCheck(ctx, ente.MlData, "b5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`UPDATE file_data_promotion_check SET status = $1 WHERE id = $2`, fileDataRepo.PromotionCheckReady, check.ID)
+	})
+	isGap := func() bool {
+		gaps, err := c.Repo.GetPromotionGaps(ctx, ente.MlData, "b5", row.FileID-1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(gaps) == 1 && gaps[0].FileID == row.FileID
+	}
+
+	if err := c.runPromotionCheckBatch(ctx, check.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.tryReplicate(ctx, fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}}); err != nil {
+		t.Fatalf("tryReplicate() of the requeued row failed: %v", err)
+	}
+	if _, err := c.S3Config.GetObjectStore("b5").Head(ctx, row.S3FileMetadataObjectKey()); err != nil {
+		t.Errorf("the requeued row wasn't replicated to b5: %v", err)
+	}
+	if isGap() {
+		t.Error("the replicated row is still a gap of b5")
+	}
+	if err := c.runPromotionCheckBatch(ctx, check.ID); err != nil {
+		t.Fatal(err)
+	}
+	check, err = c.Repo.GetPromotionCheck(ctx, check.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Passes != 2 {
+		t.Errorf("check after two batches = %+v, want two passes", check)
+	}
+}
+
+// TestFairUsersReplicate replicates a batch of rows of two users, one of them
+// with a backlog, and checks that the batch interleaves them.
+func TestFairUsersReplicate(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c := newDBController(newTestController(t), db)
+	viper.Set("replication.file-data.batch-size", 4)
+	viper.Set("replication.file-data.priority.order", string(fileDataRepo.OldestFirst))
+	viper.Set("replication.file-data.priority.fair-users", true)
+	now := time.Now().UnixMicro()
+	first := int64(13)<<40 + now%(1<<39)
+	bulkUser, otherUser := first, first+1
+	var rows []filedata.Row
+	insert := func(userID int64, updatedAt int64) filedata.Row {
+		row, _ := insertPendingRow(t, c, db, filedata.Row{FileID: first + int64(len(rows)), UserID: userID, Type: ente.MlData,
+			LatestBucket: "wasabi-eu-central-2-derived"})
+		if _, err := db.ExecContext(ctx, `UPDATE file_data SET updated_at = $3 WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type), updatedAt); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+		return row
+	}
+	var want []int64
+	for i := int64(0); i < 5; i++ {
+		row := insert(bulkUser, now-1000+i)
+		if i < 2 {
+			want = append(want, row.FileID)
+		}
+	}
+	for i := int64(0); i < 2; i++ {
+		want = append(want, insert(otherUser, now-500+i).FileID)
+	}
+	if err := c.tryReplicate(ctx, fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}}); err != nil {
+		t.Fatal(err)
+	}
+	var replicated []int64
+	for _, row := range rows {
+		if len(replicatedBuckets(t, db, row)) > 0 {
+			replicated = append(replicated, row.FileID)
+		}
+	}
+	slices.Sort(want)
+	if !slices.Equal(replicated, want) {
+		t.Errorf("a batch of 4 replicated %v, want the 2 oldest rows of each user %v", replicated, want)
+	}
+}
+
+// TestCoalescedReplicationFailures fails the replication of a row twice while
+// failures are being coalesced. Only the first of the two is recorded, and the
+// second one only moves the time of the last failure forward.
+func TestCoalescedReplicationFailures(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// Faults are only injected into replication, in the test environment
+	ctx = forReplication(ctx)
+	t.Setenv("ENVIRONMENT", "test")
+	c := newTestController(t)
+	viper.Set("replication.file-data.faults.enabled", true)
+	viper.Set("replication.file-data.faults.buckets", []string{"b5", "b6"})
+	viper.Set("replication.file-data.faults.operations", []string{"upload"})
+	viper.Set("replication.file-data.circuit-breaker.threshold", 100)
+	viper.Set("replication.file-data.attempts.coalesce.failures-per-second", 0.001)
+	c = newDBController(c, db)
+	row, _ := insertPendingRow(t, c, db, filedata.Row{FileID: int64(14)<<40 + time.Now().UnixMicro()%(1<<39),
+		UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"})
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}}
+	failures := func() (int, int64) {
+		var attempts int
+		var lastErrorAt int64
+		if err := db.QueryRowContext(ctx, `SELECT attempt_count, coalesce(last_error_at, 0) FROM file_data WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type)).Scan(&attempts, &lastErrorAt); err != nil {
+			t.Fatal(err)
+		}
+		// Retry right away, rather than after the backoff
+		if _, err := db.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0 WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type)); err != nil {
+			t.Fatal(err)
+		}
+		return attempts, lastErrorAt
+	}
+
+	if err := c.tryReplicate(ctx, filter); err == nil {
+		t.Fatal("tryReplicate() while the replicas fail succeeded, want an error")
+	}
+	if attempts, _ := failures(); attempts != 1 {
+		t.Fatalf("%d attempts recorded after the first failure, want 1", attempts)
+	}
+	c.attempts.measure(attemptRateInterval)
+	if !c.attempts.coalescing.Load() {
+		t.Fatal("not coalescing after a failure, with a threshold of 0.001 per second")
+	}
+	if err := c.tryReplicate(ctx, filter); err == nil {
+		t.Fatal("tryReplicate() while the replicas fail succeeded, want an error")
+	}
+	attempts, recordedAt := failures()
+	if attempts != 2 {
+		t.Fatalf("%d attempts recorded after the first failure while coalescing, want 2", attempts)
+	}
+	if err := c.tryReplicate(ctx, filter); err == nil {
+		t.Fatal("tryReplicate() while the replicas fail succeeded, want an error")
+	}
+	if attempts, _ := failures(); attempts != 2 {
+		t.Errorf("%d attempts recorded after the same failure while coalescing, want 2", attempts)
+	}
+	c.flushCoalescedFailures(ctx)
+	if _, lastErrorAt := failures(); lastErrorAt <= recordedAt {
+		t.Errorf("last failure at %d after flushing the coalesced failure, want it after the recorded one at %d", lastErrorAt, recordedAt)
+	}
+}
+
+// TestAuditReplicaOverride audits a row whose replica override leaves out b6,
+// where a copy of its object was left. The copy isn't reported as unrecorded.
+func TestAuditReplicaOverride(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c := newDBController(newTestController(t), db)
+	row, data := insertPendingRow(t, c, db, filedata.Row{FileID: int64(15)<<40 + time.Now().UnixMicro()%(1<<39),
+		UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"})
+	for _, dst := range []string{"b5", "b6"} {
+		if _, err := c.S3Config.GetObjectStore(dst).Put(ctx, row.S3FileMetadataObjectKey(), bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Repo.SetReplicaOverride(ctx, row.FileID, row.Type, []string{"b5"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET replicated_buckets = ARRAY['b5']::s3region[], pending_sync = false
+		WHERE file_id = $1 AND data_type = $2`, row.FileID, string(row.Type)); err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.Audit(ctx, filedata.AuditRequest{Type: ente.MlData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(report.Buckets, "b6") {
+		t.Errorf("audited %v, want b6 too", report.Buckets)
+	}
+	for _, f := range report.Findings {
+		if f.FileID == row.FileID {
+			t.Errorf("audit reported %+v for the row, want nothing", f)
+		}
+	}
+}
+
+// TestVerifyMismatchedRows verifies a row with a corrupt replica, and another
+// one whose latest copy doesn't match its checksum. Both are recorded as
+// verified, so that the next pass starts with the other rows.
+func TestVerifyMismatchedRows(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c := newDBController(newTestController(t), db)
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	first := int64(16)<<40 + time.Now().UnixMicro()%(1<<39)
+	verify := func(fileID int64, corrupt string) ([]string, error) {
+		row, data := insertPendingRow(t, c, db, filedata.Row{FileID: fileID, UserID: 1, Type: ente.MlData,
+			LatestBucket: "wasabi-eu-central-2-derived"})
+		for _, dst := range []string{"b5", "b6"} {
+			copied := data
+			if dst == corrupt {
+				copied = []byte("corrupt")
+			}
+			if _, err := c.S3Config.GetObjectStore(dst).Put(ctx, row.S3FileMetadataObjectKey(), bytes.NewReader(copied), int64(len(copied))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if corrupt == row.LatestBucket {
+			if _, err := c.S3Config.GetObjectStore(row.LatestBucket).Put(ctx, row.S3FileMetadataObjectKey(), strings.NewReader("corrupt"), 7); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE file_data SET replicated_buckets = ARRAY['b5', 'b6']::s3region[], pending_sync = false, replicated_at = 1
+			WHERE file_id = $1 AND data_type = $2`, row.FileID, string(row.Type)); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := c.Repo.GetFilesData(ctx, row.Type, []int64{row.FileID})
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("GetFilesData() = %v, %v", rows, err)
+		}
+		mismatched, verifyErr := c.verifyRow(ctx, rows[0], limiter)
+		var verifiedAt int64
+		if err := db.QueryRowContext(ctx, `SELECT coalesce(last_verified_at, 0) FROM file_data WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type)).Scan(&verifiedAt); err != nil {
+			t.Fatal(err)
+		}
+		if verifiedAt == 0 {
+			t.Errorf("row with a copy that doesn't match in %s was not recorded as verified", corrupt)
+		}
+		return mismatched, verifyErr
+	}
+	if mismatched, err := verify(first, "b6"); err != nil || strings.Join(mismatched, ",") != "b6" {
+		t.Errorf("verifyRow() with a corrupt copy in b6 = %v, %v, want [b6] requeued", mismatched, err)
+	}
+	if _, err := verify(first+1, "wasabi-eu-central-2-derived"); err == nil {
+		t.Error("verifyRow() with a corrupt latest copy succeeded, want an error")
+	}
+}
+
+// TestBackfillSkipsLatestBucket backfills the bucket that a row has as its
+// latest bucket, and one that it isn't in. Only the latter requeues the row.
+func TestBackfillSkipsLatestBucket(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c := newDBController(newTestController(t), db)
+	start := time.Now().UnixMicro()
+	row, _ := insertPendingRow(t, c, db, filedata.Row{FileID: int64(17)<<40 + start%(1<<39), UserID: 1, Type: ente.MlData,
+		LatestBucket: "wasabi-eu-central-2-derived"})
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET replicated_buckets = ARRAY['b5']::s3region[], pending_sync = false
+		WHERE file_id = $1 AND data_type = $2`, row.FileID, string(row.Type)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		bucketID string
+		requeued int64
+	}{
+		{row.LatestBucket, 0},
+		{"b5", 0},
+		{"b6", 1},
+	} {
+		job, err := c.Repo.CreateBackfill(ctx, ente.MlData, tc.bucketID, start-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job, err = c.Repo.RunBackfillBatch(ctx, job.ID, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Requeued != tc.requeued {
+			t.Errorf("backfill of %s requeued %d rows, want %d", tc.bucketID, job.Requeued, tc.requeued)
+		}
+		if job.Status != fileDataRepo.BackfillCompleted {
+			db.ExecContext(ctx, `UPDATE file_data_backfill SET status = $1 WHERE id = $2`, fileDataRepo.BackfillCompleted, job.ID)
+		}
+	}
+}
+
+// TestClaimWatcher has two instances claim the same watcher. Only the first
+// one runs it, till it stops claiming it and its claim expires.
+func TestClaimWatcher(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	c := newTestController(t)
+	a := New(&fileDataRepo.Repository{DB: db, InstanceID: "instance-a"}, nil, nil, c.S3Config, nil, nil)
+	b := New(&fileDataRepo.Repository{DB: db, InstanceID: "instance-b"}, nil, nil, c.S3Config, nil, nil)
+	name := fmt.Sprintf("test-%d", time.Now().UnixMicro())
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM task_lock WHERE task_name = $1`, "file-data-"+name)
+	})
+	const interval = 100 * time.Millisecond
+	if !a.claimWatcher(ctx, name, interval) {
+		t.Fatal("the first instance didn't claim the watcher")
+	}
+	if b.claimWatcher(ctx, name, interval) {
+		t.Error("the second instance claimed the watcher while the first one runs it")
+	}
+	if !a.claimWatcher(ctx, name, interval) {
+		t.Error("the first instance couldn't claim the watcher again")
+	}
+	time.Sleep(watcherLockIntervals*interval + 50*time.Millisecond)
+	if !b.claimWatcher(ctx, name, interval) {
+		t.Error("the second instance didn't take over the watcher once the claim of the first one expired")
+	}
+	if a.claimWatcher(ctx, name, interval) {
+		t.Error("the first instance claimed the watcher back from the second one")
+	}
+}
+
+// TestRegisterInflightAttempt registers an attempt that is already in flight,
+// with the lock that the row is held with, with another one, and once the row
+// has been deleted.
+func TestRegisterInflightAttempt(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	c := newDBController(newTestController(t), db)
+	start := time.Now().UnixMicro()
+	insertPendingRow(t, c, db, filedata.Row{FileID: int64(18)<<40 + start%(1<<39), UserID: 1, Type: ente.MlData,
+		LatestBucket: "wasabi-eu-central-2-derived"})
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}, CreatedAfter: start - 1}
+	rows, err := c.Repo.GetPendingSyncBatchAndExtendLock(ctx, time.Now().Add(10*time.Minute).UnixMicro(), filter, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := rows[0]
+	if err := c.Repo.RegisterReplicationAttempt(ctx, row, "b5"); err != nil {
+		t.Fatal(err)
+	}
+	row.InflightReplicas = []string{"b5"}
+	if err := c.Repo.RegisterReplicationAttempt(ctx, row, "b5"); err != nil {
+		t.Errorf("RegisterReplicationAttempt() of an attempt in flight = %v, want nil", err)
+	}
+	stale := row
+	other := "instance-b" + filedata.LockTokenSeparator + "stale"
+	stale.LockToken = &other
+	if err := c.Repo.RegisterReplicationAttempt(ctx, stale, "b5"); !errors.Is(err, fileDataRepo.ErrLockLost) {
+		t.Errorf("RegisterReplicationAttempt() of an attempt in flight under another lock = %v, want ErrLockLost", err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE file_data SET is_deleted = true WHERE file_id = $1 AND data_type = $2`,
+		row.FileID, string(row.Type)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Repo.RegisterReplicationAttempt(ctx, row, "b5"); !errors.Is(err, fileDataRepo.ErrRowDeleted) {
+		t.Errorf("RegisterReplicationAttempt() of an attempt in flight for a deleted row = %v, want ErrRowDeleted", err)
+	}
+}
+
+// TestDeprioritizedUsersLast picks a batch of rows with the rows of a
+// deprioritized user older than those of another user, and has the batch
+// filled up with the oldest of them once the rows of the other user run out.
+func TestDeprioritizedUsersLast(t *testing.T) {
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	c := newDBController(newTestController(t), db)
+	start := time.Now().UnixMicro()
+	first := int64(19)<<40 + start%(1<<39)
+	users := []int64{1, 1, 2}
+	for i, userID := range users {
+		row, _ := insertPendingRow(t, c, db, filedata.Row{FileID: first + int64(i), UserID: userID, Type: ente.MlData,
+			LatestBucket: "wasabi-eu-central-2-derived"})
+		if _, err := db.ExecContext(ctx, `UPDATE file_data SET updated_at = $3 WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type), start-int64(len(users)-i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}, CreatedAfter: start - 1,
+		Order: fileDataRepo.OldestFirst, DeprioritizedUsers: []int64{1}}
+	rows, err := c.Repo.GetPendingSyncBatchAndExtendLock(ctx, time.Now().Add(10*time.Minute).UnixMicro(), filter, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	for _, row := range rows {
+		got = append(got, row.FileID-first)
+	}
+	if len(got) != 2 || got[0] != 2 || got[1] != 0 {
+		t.Errorf("picked rows %v, want the row of user 2 and then the oldest row of user 1", got)
+	}
+}
+
+func TestMaintenanceGate(t *testing.T) {
+	var g maintenanceGate
+	if ok, _ := g.begin(); !ok {
+		t.Fatal("begin() outside maintenance mode = false, want true")
+	}
+	g.enter()
+	if ok, _ := g.begin(); ok {
+		t.Error("begin() in maintenance mode = true, want false")
+	}
+	if s := g.status(); !s.Enabled || s.Drained || s.InFlight != 1 {
+		t.Errorf("status() with a worker in flight = %+v, want enabled and not drained", s)
+	}
+	g.end()
+	select {
+	case <-g.drainedChan():
+	default:
+		t.Error("not drained once the worker in flight is done")
+	}
+	_, left := g.begin()
+	g.leave()
+	select {
+	case <-left:
+	default:
+		t.Error("workers waiting out maintenance mode aren't released once it is left")
+	}
+	if ok, _ := g.begin(); !ok {
+		t.Error("begin() after leaving maintenance mode = false, want true")
+	}
+}
+
+// TestSetCreatedAfter limits replication to the rows created after a cutoff
+// through one instance, which the other one picks up.
+func TestSetCreatedAfter(t *testing.T) {
+	c := newTestController(t)
+	if err := c.SetCreatedAfter(context.Background(), -1); err == nil {
+		t.Error("SetCreatedAfter(-1) = nil, want an error")
+	}
+	if os.Getenv("ENV") != "test" {
+		t.Skip("Not running tests in non-test environment")
+	}
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	a := New(&fileDataRepo.Repository{DB: db, InstanceID: "instance-a"}, nil, nil, c.S3Config, nil, nil)
+	b := New(&fileDataRepo.Repository{DB: db, InstanceID: "instance-b"}, nil, nil, c.S3Config, nil, nil)
+	t.Cleanup(func() {
+		a.Repo.SetReplicationCreatedAfter(context.Background(), 0)
+	})
+	cutoff := time.Now().UnixMicro()
+	first := int64(8)<<40 + cutoff%(1<<39)
+	for i, createdAt := range []int64{cutoff - 1, cutoff + 1} {
+		row := filedata.Row{FileID: first + int64(i), UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived", Size: 4}
+		if err := a.Repo.InsertOrUpdate(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE file_data SET created_at = $3 WHERE file_id = $1 AND data_type = $2`,
+			row.FileID, string(row.Type), createdAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM file_data WHERE file_id >= $1 AND file_id < $2`, first, first+2)
+	})
+
+	// refreshed waits for b to refresh its copy of the cutoff to want
+	refreshed := func(want int64) {
+		refreshCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		go b.refreshCreatedAfter(refreshCtx)
+		for b.createdAfter.Load() != want {
+			if refreshCtx.Err() != nil {
+				t.Fatalf("cutoff of the other instance = %d, want %d", b.createdAfter.Load(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if err := a.SetCreatedAfter(ctx, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	filter := a.applyCreatedAfter(fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}})
+	if filter.CreatedAfter != cutoff || len(filter.Types) != 1 {
+		t.Errorf("applyCreatedAfter() = %+v, want the cutoff along with the types", filter)
+	}
+	refreshed(cutoff)
+	if pending, err := b.catchUpBacklog(ctx); err != nil || pending != 1 {
+		t.Errorf("catchUpBacklog() with the cutoff = %d, %v, want only the newer row", pending, err)
+	}
+	if err := a.SetCreatedAfter(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if filter := a.applyCreatedAfter(fileDataRepo.PendingSyncFilter{}); filter.CreatedAfter != 0 {
+		t.Errorf("applyCreatedAfter() after lifting the cutoff = %+v, want none", filter)
+	}
+	refreshed(0)
+	if pending, err := b.catchUpBacklog(ctx); err != nil || pending < 2 {
+		t.Errorf("catchUpBacklog() without the cutoff = %d, %v, want both rows", pending, err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestDownloadResumes(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("replication.file-data.s3-retry.base-delay", time.Millisecond)
+	viper.Set("replication.file-data.download.spool-threshold-bytes", 1)
+	dir := t.TempDir()
+	viper.Set("replication.file-data.download.temp-dir", dir)
+	object := "hello world"
+	info := objectstore.ObjectInfo{Size: int64(len(object)), ETag: `"e"`}
+	var offsets []int64
+	open := func(offset int64) (rangeBody, error) {
+		offsets = append(offsets, offset)
+		var r io.Reader = strings.NewReader(object[offset:])
+		if len(offsets) == 1 {
+			r = io.MultiReader(strings.NewReader(object[:5]), failingReader{})
+		}
+		return rangeBody{ReadCloser: io.NopCloser(r), info: info, offset: offset}, nil
+	}
+	buf := &downloadBuffer{}
+	var transferred int64
+	err := readResumable(context.Background(), "download", buf, open, func(n int64) { transferred += n })
+	if err != nil {
+		t.Fatalf("readResumable() = %v", err)
+	}
+	data, err := io.ReadAll(buf.reader())
+	if err != nil || string(data) != object {
+		t.Fatalf("downloaded %q, %v, want %q", data, err, object)
+	}
+	if len(offsets) != 2 || offsets[1] != 5 || transferred != int64(len(object)) {
+		t.Errorf("downloaded from offsets %v, %d bytes in all, want a resume at 5", offsets, transferred)
+	}
+	buf.close()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("temporary download file was left behind")
+	}
+}
@@ -0,0 +1,285 @@
+//go:build replicationbench
+
+package filedata
+
+// A harness for sizing the replication workers. It drives the real
+// tryReplicate against memory stores that answer with a configurable latency
+// and transfer rate, and a test database (see openTestDatabase), for each of a
+// list of worker counts:
+//
+//	ENV=test go test -tags replicationbench -run '^$' -bench Replication -benchtime 1x \
+//	    ./pkg/controller/filedata/ -args -replication.workers=1,4,16 \
+//	    -replication.rows=1000 -replication.sizes=4096,4096,4096,1048576 \
+//	    -replication.latency=30ms -replication.bytes-per-second=20971520
+//
+// Besides the throughput (rows/s and MiB/s), it reports how busy the workers
+// were, and how contended the row locks were: the polls that came back empty
+// while rows were still pending because the other workers held them, and the
+// share of the busy time that wasn't spent waiting on the object stores (i.e.
+// in the database, mostly locking and updating rows).
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/museum/pkg/utils/s3config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	benchWorkers        = flag.String("replication.workers", "1,2,4,8", "comma separated worker counts to benchmark")
+	benchRows           = flag.Int("replication.rows", 200, "rows to replicate per run")
+	benchSizes          = flag.String("replication.sizes", "4096", "comma separated object sizes in bytes, used in turn (repeat a size to weigh it)")
+	benchLatency        = flag.Duration("replication.latency", 20*time.Millisecond, "latency of every object store request")
+	benchBytesPerSecond = flag.Int64("replication.bytes-per-second", 0, "transfer rate of each object store request, 0 for unlimited")
+)
+
+// benchFileIDs is where the file IDs of the seeded rows start, so that they
+// don't collide with other test data. Every run uses new file IDs, so that its
+// rows aren't held back as duplicates of the previous run's.
+var benchFileIDs atomic.Int64
+
+func init() {
+	benchFileIDs.Store(1 << 40)
+}
+
+func BenchmarkReplication(b *testing.B) {
+	if os.Getenv("ENV") != "test" {
+		b.Skip("Not running benchmarks in non-test environment")
+	}
+	db := openTestDatabase(b)
+	sizes, err := parseInts(*benchSizes)
+	if err != nil {
+		b.Fatalf("-replication.sizes: %s", err)
+	}
+	workerCounts, err := parseInts(*benchWorkers)
+	if err != nil {
+		b.Fatalf("-replication.workers: %s", err)
+	}
+	log.SetLevel(log.WarnLevel)
+	b.Cleanup(func() { log.SetLevel(log.InfoLevel) })
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			c := newBenchController(b, db)
+			var stats benchStats
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				first := seedBenchRows(b, c, sizes)
+				b.StartTimer()
+				stats.add(runBenchWorkers(b, c, workers, first))
+			}
+			stats.report(b)
+		})
+	}
+}
+
+// newBenchController returns a controller for mldata replicated from the
+// derived bucket to b5 and b6, all of them memory stores that answer with the
+// configured latency.
+func newBenchController(b *testing.B, db *sql.DB) *Controller {
+	viper.Reset()
+	b.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(testConfig)); err != nil {
+		b.Fatal(err)
+	}
+	for _, dc := range []string{"wasabi-eu-central-2-derived", "b5", "b6"} {
+		viper.Set("s3."+dc+".latency", *benchLatency)
+		viper.Set("s3."+dc+".bytes-per-second", *benchBytesPerSecond)
+	}
+	return New(&fileDataRepo.Repository{DB: db}, nil, nil, s3config.NewS3Config(), nil, nil)
+}
+
+// seedBenchRows uploads *benchRows objects to the derived bucket and inserts
+// their rows, ready to be replicated. It returns the file ID of the first one.
+func seedBenchRows(b *testing.B, c *Controller, sizes []int) int64 {
+	ctx := context.Background()
+	first := benchFileIDs.Add(int64(*benchRows)) - int64(*benchRows)
+	// Seeded without the latency
+	source := c.S3Config.GetObjectStore("wasabi-eu-central-2-derived")
+	if store, ok := source.(*objectstore.LatencyStore); ok {
+		source = store.MemoryStore
+	}
+	for i := 0; i < *benchRows; i++ {
+		row := filedata.Row{FileID: first + int64(i), UserID: 1, Type: ente.MlData, LatestBucket: "wasabi-eu-central-2-derived"}
+		obj := filedata.S3FileMetadata{Version: 1, EncryptedData: strings.Repeat("a", sizes[i%len(sizes)]), DecryptionHeader: "header"}
+		obj.Checksum = obj.ContentChecksum()
+		data, err := json.Marshal(obj)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := source.Put(ctx, row.S3FileMetadataObjectKey(), bytes.NewReader(data), int64(len(data))); err != nil {
+			b.Fatal(err)
+		}
+		checksum := checksumOf(data)
+		row.Size = int64(len(data))
+		row.Checksum = &checksum
+		if err := c.Repo.InsertOrUpdate(ctx, row); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// Rows are inserted locked for a few minutes, see InsertOrUpdate
+	if _, err := c.Repo.DB.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = 0 WHERE file_id >= $1 AND file_id < $2`,
+		first, first+int64(*benchRows)); err != nil {
+		b.Fatal(err)
+	}
+	return first
+}
+
+// benchRun is what happened during one run of the workers.
+type benchRun struct {
+	wall  time.Duration
+	rows  int
+	bytes int64
+	// busy is the time that each worker spent replicating
+	busy []time.Duration
+	// emptyPolls is the number of times that a worker found no row to lock
+	// while some were still pending
+	emptyPolls int64
+	failures   int64
+	// storeWait is the time that the requests to the object stores took
+	storeWait time.Duration
+}
+
+// runBenchWorkers has workers workers replicate the seeded rows, the same way
+// the replication workers do, until none of them is pending.
+func runBenchWorkers(b *testing.B, c *Controller, workers int, first int64) benchRun {
+	ctx := context.Background()
+	filter := fileDataRepo.PendingSyncFilter{Types: []ente.ObjectType{ente.MlData}}
+	storeWaitBefore := benchStoreWait(c)
+	run := benchRun{busy: make([]time.Duration, workers)}
+	var done atomic.Bool
+	var emptyPolls, failures atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for !done.Load() {
+				attempt := time.Now()
+				err := c.tryReplicate(ctx, filter)
+				if errors.Is(err, sql.ErrNoRows) {
+					pending, err := benchPending(c, first)
+					if err != nil {
+						b.Error(err)
+					}
+					if err != nil || pending == 0 {
+						done.Store(true)
+						return
+					}
+					emptyPolls.Add(1)
+					time.Sleep(5 * time.Millisecond)
+					continue
+				}
+				run.busy[w] += time.Since(attempt)
+				if err != nil {
+					failures.Add(1)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	run.wall = time.Since(start)
+	run.rows = *benchRows
+	run.emptyPolls = emptyPolls.Load()
+	run.failures = failures.Load()
+	run.storeWait = benchStoreWait(c) - storeWaitBefore
+	if err := c.Repo.DB.QueryRowContext(ctx, `SELECT coalesce(sum(size), 0) FROM file_data WHERE file_id >= $1 AND file_id < $2`,
+		first, first+int64(*benchRows)).Scan(&run.bytes); err != nil {
+		b.Fatal(err)
+	}
+	return run
+}
+
+func benchPending(c *Controller, first int64) (int, error) {
+	var pending int
+	err := c.Repo.DB.QueryRow(`SELECT count(*) FROM file_data WHERE pending_sync = true AND file_id >= $1 AND file_id < $2`,
+		first, first+int64(*benchRows)).Scan(&pending)
+	return pending, err
+}
+
+func benchStoreWait(c *Controller) time.Duration {
+	var waited time.Duration
+	for _, dc := range []string{"wasabi-eu-central-2-derived", "b5", "b6"} {
+		if store, ok := c.S3Config.GetObjectStore(dc).(*objectstore.LatencyStore); ok {
+			waited += store.Waited()
+		}
+	}
+	return waited
+}
+
+// benchStats adds up the runs of a worker count.
+type benchStats struct {
+	runs []benchRun
+}
+
+func (s *benchStats) add(run benchRun) {
+	s.runs = append(s.runs, run)
+}
+
+func (s *benchStats) report(b *testing.B) {
+	var wall, busy, storeWait time.Duration
+	var rows, emptyPolls, failures int64
+	var totalBytes int64
+	minUtil, maxUtil := 1.0, 0.0
+	for _, run := range s.runs {
+		wall += run.wall
+		rows += int64(run.rows)
+		totalBytes += run.bytes
+		emptyPolls += run.emptyPolls
+		failures += run.failures
+		storeWait += run.storeWait
+		for w, workerBusy := range run.busy {
+			busy += workerBusy
+			util := workerBusy.Seconds() / run.wall.Seconds()
+			minUtil = min(minUtil, util)
+			maxUtil = max(maxUtil, util)
+			b.Logf("worker %d: %.0f%% busy", w, 100*util)
+		}
+	}
+	workers := len(s.runs[0].busy)
+	b.ReportMetric(float64(rows)/wall.Seconds(), "rows/s")
+	b.ReportMetric(float64(totalBytes)/(1024*1024)/wall.Seconds(), "MiB/s")
+	b.ReportMetric(100*busy.Seconds()/(wall.Seconds()*float64(workers)), "%busy")
+	b.ReportMetric(100*minUtil, "%busy-min")
+	b.ReportMetric(100*maxUtil, "%busy-max")
+	b.ReportMetric(float64(emptyPolls)/float64(rows), "empty-polls/row")
+	// The object store requests of a row partly overlap (its uploads fan
+	// out), so this is a lower bound of the time spent outside of them
+	if busy > 0 {
+		b.ReportMetric(100*max(0, 1-storeWait.Seconds()/busy.Seconds()), "%not-in-store")
+	}
+	if failures > 0 {
+		b.Logf("%d attempts failed", failures)
+	}
+}
+
+func parseInts(list string) ([]int, error) {
+	var ints []int
+	for _, s := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%q is not a positive number", s)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
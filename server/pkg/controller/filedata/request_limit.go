@@ -0,0 +1,130 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// requestLimiter caps the number of requests that the replication workers of
+// an instance make to each bucket at the same time, at
+// replication.file-data.max-concurrent-requests.<bucket ID>. Buckets without a
+// cap are not limited, but their requests are still counted in
+// mBucketRequestsInflight, which is what the caps are tuned by.
+//
+// Some S3 compatible backends throttle much earlier than AWS, and a cap keeps
+// them from being hammered by all the workers at once, however many there are.
+// The caps are read for every request, so changes to the config take effect on
+// the next SIGHUP.
+//
+// Only requests made for replication (see forReplication) wait for a slot. The
+// requests made on behalf of users, like their uploads and the reads of their
+// file data, are never held up behind the workers, but they still take up a
+// slot while they are in flight, so that replication backs off from a bucket
+// that users are busy with.
+//
+// The zero value is ready to use, and reads the caps from the global config.
+type requestLimiter struct {
+	// config returns the config that the caps are read from, if set
+	config func() *viper.Viper
+	mu     sync.Mutex
+	inUse  map[string]int
+	// changed is closed, and replaced, whenever a slot may have become free
+	changed chan struct{}
+}
+
+// errRequestQueued is returned, wrapping the error of ctx, when ctx is done
+// while a request is still waiting for a slot, i.e. before it was made.
+var errRequestQueued = errors.New("request to bucket was still waiting for a slot")
+
+type replicationCtxKey struct{}
+
+// forReplication marks ctx as doing the work of replication: that of the
+// workers and the background jobs, of ReplicateNow and of inline replication,
+// as opposed to the work done on behalf of user requests.
+func forReplication(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replicationCtxKey{}, true)
+}
+
+// isReplication reports whether ctx has been marked with forReplication.
+func isReplication(ctx context.Context) bool {
+	replication, _ := ctx.Value(replicationCtxKey{}).(bool)
+	return replication
+}
+
+// maxConcurrentRequests returns the cap on the concurrent requests to the
+// bucket, or 0 if there is none.
+func (l *requestLimiter) maxConcurrentRequests(bucketID string) int {
+	v := viper.GetViper()
+	if l.config != nil {
+		v = l.config()
+	}
+	return v.GetInt("replication.file-data.max-concurrent-requests." + bucketID)
+}
+
+// acquire waits for a slot for a request to the bucket, giving up with
+// errRequestQueued if ctx is done first. A request that isn't made for
+// replication takes a slot right away, even if that goes over the cap. Every
+// successful acquire must be followed by a release. The wait doesn't count
+// against the work budget of ctx, see workBudget.
+func (l *requestLimiter) acquire(ctx context.Context, bucketID string) error {
+	l.mu.Lock()
+	if l.inUse == nil {
+		l.inUse = map[string]int{}
+		l.changed = make(chan struct{})
+	}
+	if !isReplication(ctx) {
+		l.inUse[bucketID]++
+		l.mu.Unlock()
+		mBucketRequestsInflight.WithLabelValues(bucketID).Inc()
+		return nil
+	}
+	if limit := l.maxConcurrentRequests(bucketID); limit > 0 && l.inUse[bucketID] >= limit {
+		defer waitOutsideBudget(ctx)()
+	}
+	for limit := l.maxConcurrentRequests(bucketID); limit > 0 && l.inUse[bucketID] >= limit; limit = l.maxConcurrentRequests(bucketID) {
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", errRequestQueued, ctx.Err())
+		}
+		l.mu.Lock()
+	}
+	l.inUse[bucketID]++
+	l.mu.Unlock()
+	mBucketRequestsInflight.WithLabelValues(bucketID).Inc()
+	return nil
+}
+
+func (l *requestLimiter) release(bucketID string) {
+	l.mu.Lock()
+	l.inUse[bucketID]--
+	close(l.changed)
+	l.changed = make(chan struct{})
+	l.mu.Unlock()
+	mBucketRequestsInflight.WithLabelValues(bucketID).Dec()
+}
+
+// releaseOnClose returns body, releasing the slot of the request that opened it
+// once it is closed.
+func (l *requestLimiter) releaseOnClose(body io.ReadCloser, bucketID string) io.ReadCloser {
+	return &releasingBody{ReadCloser: body, release: func() { l.release(bucketID) }}
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
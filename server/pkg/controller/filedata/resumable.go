@@ -0,0 +1,190 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// defaultDownloadSpoolThreshold is the size from which downloads are buffered
+// in a temporary file instead of in memory.
+const defaultDownloadSpoolThreshold = 64 * 1024 * 1024
+
+// rangeBody is the body of a download that was asked to start at an offset.
+type rangeBody struct {
+	io.ReadCloser
+	// info is the size and ETag of the whole object. The size is -1 if it
+	// isn't known, and the ETag may be empty.
+	info objectstore.ObjectInfo
+	// offset is where the body starts within the object, which is 0 if the
+	// range was ignored
+	offset int64
+}
+
+// readCloser closes Closer once done with reading from Reader, which wraps it.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// downloadBuffer holds the bytes of a download across its attempts. Large
+// objects are buffered in a temporary file, see prepare, which is removed by
+// close.
+type downloadBuffer struct {
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+	// writeErr is the last failure to write to the file, which, unlike a
+	// failure to read the download, is not worth retrying the download for
+	writeErr error
+}
+
+// prepare switches the buffer to a temporary file if the object is at least
+// replication.file-data.download.spool-threshold-bytes large. It must be called
+// while the buffer is empty.
+func (b *downloadBuffer) prepare(objectSize int64) error {
+	threshold := viper.GetInt64("replication.file-data.download.spool-threshold-bytes")
+	if threshold <= 0 {
+		threshold = defaultDownloadSpoolThreshold
+	}
+	if b.file != nil || objectSize < threshold {
+		return nil
+	}
+	file, err := os.CreateTemp(viper.GetString("replication.file-data.download.temp-dir"), "museum-download-*")
+	if err != nil {
+		return stacktrace.Propagate(err, "could not create a temporary file for the download")
+	}
+	b.file = file
+	return nil
+}
+
+func (b *downloadBuffer) Write(p []byte) (int, error) {
+	var n int
+	if b.file != nil {
+		n, b.writeErr = b.file.Write(p)
+	} else {
+		n, b.writeErr = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, b.writeErr
+}
+
+// reset discards the bytes buffered so far.
+func (b *downloadBuffer) reset() error {
+	b.mem.Reset()
+	b.size = 0
+	if b.file == nil {
+		return nil
+	}
+	if err := b.file.Truncate(0); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	_, err := b.file.Seek(0, io.SeekStart)
+	return stacktrace.Propagate(err, "")
+}
+
+// reader returns a reader of everything that has been buffered. A buffer in a
+// temporary file is read back from the file as the reader is read, rather than
+// all at once.
+func (b *downloadBuffer) reader() io.Reader {
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes())
+	}
+	return io.NewSectionReader(b.file, 0, b.size)
+}
+
+// close removes the temporary file, if any.
+func (b *downloadBuffer) close() {
+	if b.file == nil {
+		return
+	}
+	b.file.Close()
+	if err := os.Remove(b.file.Name()); err != nil {
+		log.WithError(err).Warnf("Could not remove temporary download file %s", b.file.Name())
+	}
+	b.file = nil
+}
+
+// readResumable downloads a whole object into buf, retrying failures the same
+// way as withS3Retry. open is asked for the object from the first byte that
+// isn't in buf yet, so a download that is interrupted halfway through resumes
+// from where it stopped instead of starting over. Everything is downloaded
+// again if the object turns out to have been replaced in the meantime, or if
+// open ignores the offset. Transferred is called with the number of bytes of
+// each attempt.
+//
+// The download only succeeds once buf has as many bytes as the object, if its
+// size is known.
+func readResumable(ctx context.Context, op string, buf *downloadBuffer, open func(offset int64) (rangeBody, error), transferred func(n int64)) error {
+	var object objectstore.ObjectInfo
+	started := false
+	return withS3Retry(ctx, op, func() error {
+		body, err := open(buf.size)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if started && !sameObject(object, body.info) {
+			started = false
+			if err := buf.reset(); err != nil {
+				return err
+			}
+			return awserr.New("ReadError", "object changed while it was being downloaded", nil)
+		}
+		if body.offset != buf.size {
+			if err := buf.reset(); err != nil {
+				return err
+			}
+		} else if body.offset > 0 {
+			log.Infof("%s: resuming at byte %d of %d", op, body.offset, body.info.Size)
+		}
+		if !started {
+			object = body.info
+			started = true
+			if err := buf.prepare(object.Size); err != nil {
+				return err
+			}
+		}
+		n, err := io.Copy(buf, body)
+		transferred(n)
+		if err != nil {
+			if buf.writeErr != nil || ctx.Err() != nil {
+				return err
+			}
+			return awserr.New("ReadError", "download interrupted", err)
+		}
+		if object.Size >= 0 && buf.size != object.Size {
+			return awserr.New("ReadError", fmt.Sprintf("download ended after %d of %d bytes", buf.size, object.Size), nil)
+		}
+		return nil
+	})
+}
+
+// sameObject reports whether two responses are for the same version of an
+// object, as far as they tell.
+func sameObject(a objectstore.ObjectInfo, b objectstore.ObjectInfo) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	return a.ETag == "" || b.ETag == "" || a.ETag == b.ETag
+}
+
+// openRange starts downloading the object from the store at offset, or from the
+// beginning if the store can't read from an offset.
+func openRange(ctx context.Context, store objectstore.ObjectStore, objectKey string, offset int64) (rangeBody, error) {
+	getter, ok := store.(objectstore.RangeGetter)
+	if !ok {
+		body, err := store.Get(ctx, objectKey)
+		return rangeBody{ReadCloser: body, info: objectstore.ObjectInfo{Size: -1}}, err
+	}
+	body, info, err := getter.GetRange(ctx, objectKey, offset)
+	return rangeBody{ReadCloser: body, info: info, offset: offset}, err
+}
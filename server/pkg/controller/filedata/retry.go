@@ -0,0 +1,89 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultS3RetryAttempts  = 3
+	defaultS3RetryBaseDelay = 500 * time.Millisecond
+)
+
+// withS3Retry runs fn, retrying it with exponential backoff (and jitter) if it
+// fails with an error that isRetryableS3Error considers transient.
+//
+// fn is called at most replication.file-data.s3-retry.attempts times, and the
+// wait starts at replication.file-data.s3-retry.base-delay, doubling after each
+// attempt. Retrying stops early if ctx is done.
+func withS3Retry(ctx context.Context, op string, fn func() error) error {
+	attempts := viper.GetInt("replication.file-data.s3-retry.attempts")
+	if attempts <= 0 {
+		attempts = defaultS3RetryAttempts
+	}
+	delay := viper.GetDuration("replication.file-data.s3-retry.base-delay")
+	if delay <= 0 {
+		delay = defaultS3RetryBaseDelay
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		workerHeartbeat(ctx)
+		err = fn()
+		if err == nil || attempt >= attempts || !isRetryableS3Error(err) {
+			return err
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.WithError(err).Infof("%s failed (attempt %d/%d), retrying in %s", op, attempt, attempts, wait)
+		if !sleepWithContext(ctx, wait) {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// isRetryableS3Error returns true for errors that are likely to go away if the
+// request is retried: timeouts, throttling (429, SlowDown) and server side (5xx)
+// errors. Client errors such as 403 or 404, and cancellations are permanent.
+func isRetryableS3Error(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		code := reqErr.StatusCode()
+		if code == http.StatusTooManyRequests || code >= 500 {
+			return true
+		}
+		if code >= 400 {
+			return false
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case request.CanceledErrorCode:
+			return false
+		case "RequestTimeout", "RequestTimeoutException", "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "InternalError", "ServiceUnavailable":
+			return true
+		case request.ErrCodeSerialization, request.ErrCodeResponseTimeout, request.ErrCodeRequestError, "ReadError":
+			return true
+		}
+		if awsErr.OrigErr() != nil {
+			return isRetryableS3Error(awsErr.OrigErr())
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return false
+}
@@ -4,24 +4,31 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/ente-io/museum/ente"
 	fileData "github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
 	"github.com/ente-io/stacktrace"
 	log "github.com/sirupsen/logrus"
+	"io"
 	stime "time"
 )
 
 const PreSignedRequestValidityDuration = 7 * 24 * stime.Hour
 
+// getUploadURL returns a presigned URL to upload the object to. The object key
+// in the URL is the one that the object is stored under in the bucket (see
+// S3Config.ObjectKey), and so is the one that is cleaned up if the upload is
+// never reported.
 func (c *Controller) getUploadURL(dc string, objectKey string) (*ente.UploadURL, error) {
+	storedKey := c.S3Config.ObjectKey(dc, objectKey)
 	s3Client := c.S3Config.GetS3Client(dc)
 	r, _ := s3Client.PutObjectRequest(&s3.PutObjectInput{
 		Bucket: c.S3Config.GetBucket(dc),
-		Key:    &objectKey,
+		Key:    &storedKey,
 	})
 	url, err := r.Presign(PreSignedRequestValidityDuration)
 	if err != nil {
@@ -30,7 +37,7 @@ func (c *Controller) getUploadURL(dc string, objectKey string) (*ente.UploadURL,
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "")
 	}
-	err = c.ObjectCleanupController.AddTempObjectKey(objectKey, dc)
+	err = c.ObjectCleanupController.AddTempObjectKey(storedKey, dc)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "")
 	}
@@ -44,7 +51,7 @@ func (c *Controller) signedUrlGet(dc string, objectKey string) (*ente.UploadURL,
 	s3Client := c.S3Config.GetS3Client(dc)
 	r, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: c.S3Config.GetBucket(dc),
-		Key:    &objectKey,
+		Key:    aws.String(c.S3Config.ObjectKey(dc, objectKey)),
 	})
 	url, err := r.Presign(PreSignedRequestValidityDuration)
 	if err != nil {
@@ -55,55 +62,167 @@ func (c *Controller) signedUrlGet(dc string, objectKey string) (*ente.UploadURL,
 
 func (c *Controller) downloadObject(ctx context.Context, objectKey string, dc string) (fileData.S3FileMetadata, error) {
 	var obj fileData.S3FileMetadata
-	buff := &aws.WriteAtBuffer{}
-	bucket := c.S3Config.GetBucket(dc)
-	downloader := c.downloadManagerCache[dc]
-	_, err := downloader.DownloadWithContext(ctx, buff, &s3.GetObjectInput{
-		Bucket: bucket,
-		Key:    &objectKey,
-	})
+	data, err := c.downloadLogicalObject(ctx, objectKey, dc)
 	if err != nil {
 		return obj, err
 	}
-	err = json.Unmarshal(buff.Bytes(), &obj)
+	err = json.Unmarshal(data, &obj)
 	if err != nil {
 		return obj, stacktrace.Propagate(err, "unmarshal failed")
 	}
+	if err := checkContentChecksum(obj); err != nil {
+		return obj, stacktrace.Propagate(err, "%s in %s is corrupt", objectKey, dc)
+	}
 	return obj, nil
 }
 
-// uploadObject uploads the embedding object to the object store and returns the object size
-func (c *Controller) uploadObject(obj fileData.S3FileMetadata, objectKey string, dc string) (int64, error) {
-	embeddingObj, _ := json.Marshal(obj)
-	s3Client := c.S3Config.GetS3Client(dc)
-	s3Bucket := c.S3Config.GetBucket(dc)
-	uploader := s3manager.NewUploaderWithClient(&s3Client)
-	up := s3manager.UploadInput{
-		Bucket: s3Bucket,
-		Key:    &objectKey,
-		Body:   bytes.NewReader(embeddingObj),
+// downloadRawObject downloads the object and passes its contents, as stored in
+// the bucket, to consume, which must be done reading them when it returns.
+// It is downloaded through the worker if the bucket is configured for that, see
+// viaWorker, and directly otherwise, including while the worker is being
+// skipped after repeated failures, see workerFallback.
+//
+// Failed downloads are resumed from where they stopped, see readResumable, and
+// large objects are buffered in a temporary file while they are downloaded, and
+// read back from it by consume.
+func (c *Controller) downloadRawObject(ctx context.Context, objectKey string, dc string, consume func(stored io.Reader) error) error {
+	store := c.S3Config.GetObjectStore(dc)
+	viaWorker := c.viaWorker(dc)
+	buf := &downloadBuffer{}
+	defer buf.close()
+	// the path of the last attempt
+	path := "direct"
+	open := func(offset int64) (rangeBody, error) {
+		if err := c.faults.inject(ctx, faultOpDownload, dc); err != nil {
+			return rangeBody{}, err
+		}
+		if err := c.requests.acquire(ctx, dc); err != nil {
+			return rangeBody{}, err
+		}
+		var body rangeBody
+		var err error
+		if viaWorker && !c.workerFallback.active() {
+			path = "worker"
+			body, err = c.openViaWorker(ctx, objectKey, dc, offset)
+		} else {
+			path = "direct"
+			body, err = openRange(ctx, store, objectKey, offset)
+		}
+		if err != nil {
+			c.requests.release(dc)
+			return rangeBody{}, err
+		}
+		// The request is in flight until the body has been read
+		closer := c.requests.releaseOnClose(body.ReadCloser, dc)
+		body.ReadCloser = readCloser{Reader: c.throttleReader(ctx, body.ReadCloser), Closer: closer}
+		return body, nil
+	}
+	start := stime.Now()
+	err := readResumable(ctx, "download "+objectKey+" from "+dc, buf, open, func(n int64) {
+		mDownloadedBytes.WithLabelValues(dc).Add(float64(n))
+		countTransfer(ctx, int(n))
+	})
+	outcome := downloadOutcome(ctx, err)
+	mDownloadDuration.WithLabelValues(dc, path, outcome).Observe(stime.Since(start).Seconds())
+	logger := log.WithFields(log.Fields{
+		"object_key": objectKey,
+		"bucket":     dc,
+		"path":       path,
+		"outcome":    outcome,
+		"duration":   stime.Since(start).Round(stime.Millisecond),
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Could not download file data object")
+		return err
+	}
+	logger.Info("Downloaded file data object")
+	return consume(buf.reader())
+}
+
+// uploadObject uploads the serialized metadata object to the object store. It
+// returns the size and ETag of the object as stored.
+//
+// Like the downloads and HEAD requests, each attempt waits for a slot if the
+// bucket has a cap on its concurrent requests, see requestLimiter.
+//
+// The object is stored with the given metadata, unless it is empty or the
+// store doesn't keep metadata. If the store can't find the object right after
+// the upload, it is looked up again for a while, see awaitVisible.
+func (c *Controller) uploadObject(ctx context.Context, data []byte, objectKey string, dc string, metadata objectstore.ObjectMetadata) (objectstore.ObjectInfo, error) {
+	store := c.S3Config.GetObjectStore(dc)
+	putter, withMetadata := store.(objectstore.MetadataPutter)
+	withMetadata = withMetadata && !metadata.IsZero()
+	var info objectstore.ObjectInfo
+	err := withS3Retry(ctx, "upload to "+dc, func() error {
+		if err := c.requests.acquire(ctx, dc); err != nil {
+			return err
+		}
+		defer c.requests.release(dc)
+		start := stime.Now()
+		err := c.faults.inject(ctx, faultOpUpload, dc)
+		if err == nil && withMetadata {
+			info, err = putter.PutWithMetadata(ctx, objectKey, c.throttleReader(ctx, bytes.NewReader(data)), int64(len(data)), metadata)
+		} else if err == nil {
+			info, err = store.Put(ctx, objectKey, c.throttleReader(ctx, bytes.NewReader(data)), int64(len(data)))
+		}
+		c.throttle.observe(ctx, err, stime.Since(start))
+		return err
+	})
+	if errors.Is(err, objectstore.ErrNotVisible) {
+		err = awaitVisible(ctx, "upload of "+objectKey+" to "+dc, dc, func() error {
+			var err error
+			info, err = store.Head(ctx, objectKey)
+			return err
+		})
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"object_key":  objectKey,
+			logDestBucket: dc,
+			logSize:       len(data),
+		}).WithError(err).Error("Could not upload file data object")
+		return info, stacktrace.Propagate(err, "")
 	}
-	result, err := uploader.Upload(&up)
+	countTransfer(ctx, len(data))
+	log.WithFields(log.Fields{
+		"object_key":  objectKey,
+		logDestBucket: dc,
+		logSize:       len(data),
+	}).Info("Uploaded file data object")
+	return info, nil
+}
+
+// headObject returns the size and ETag of the object in the given bucket
+func (c *Controller) headObject(ctx context.Context, objectKey string, dc string) (int64, string, error) {
+	store := c.S3Config.GetObjectStore(dc)
+	var info objectstore.ObjectInfo
+	err := withS3Retry(ctx, "head in "+dc, func() error {
+		if err := c.requests.acquire(ctx, dc); err != nil {
+			return err
+		}
+		defer c.requests.release(dc)
+		var err error
+		info, err = store.Head(ctx, objectKey)
+		return err
+	})
 	if err != nil {
-		log.Error(err)
-		return -1, stacktrace.Propagate(err, "")
+		return 0, "", stacktrace.Propagate(err, "")
 	}
-	log.Infof("Uploaded to bucket %s", result.Location)
-	return int64(len(embeddingObj)), nil
+	return info.Size, info.ETag, nil
 }
 
 // copyObject copies the object from srcObjectKey to destObjectKey in the same bucket and returns the object size
-func (c *Controller) copyObject(srcObjectKey string, destObjectKey string, bucketID string) error {
+func (c *Controller) copyObject(ctx context.Context, srcObjectKey string, destObjectKey string, bucketID string) error {
 	bucket := c.S3Config.GetBucket(bucketID)
 	s3Client := c.S3Config.GetS3Client(bucketID)
-	copySource := fmt.Sprintf("%s/%s", *bucket, srcObjectKey)
+	copySource := fmt.Sprintf("%s/%s", *bucket, c.S3Config.ObjectKey(bucketID, srcObjectKey))
 	copyInput := &s3.CopyObjectInput{
 		Bucket:     bucket,
 		CopySource: &copySource,
-		Key:        aws.String(destObjectKey),
+		Key:        aws.String(c.S3Config.ObjectKey(bucketID, destObjectKey)),
 	}
 
-	_, err := s3Client.CopyObject(copyInput)
+	_, err := s3Client.CopyObjectWithContext(ctx, copyInput)
 	if err != nil {
 		return fmt.Errorf("failed to copy (%s) from %s to %s: %v", bucketID, srcObjectKey, destObjectKey, err)
 	}
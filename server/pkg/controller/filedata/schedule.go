@@ -0,0 +1,29 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/stacktrace"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// scheduleJob runs fn as per the cron spec till ctx is done. An empty spec
+// means that the job is not scheduled.
+func scheduleJob(ctx context.Context, name string, spec string, fn func()) error {
+	if spec == "" {
+		log.Infof("File data %s is not scheduled", name)
+		return nil
+	}
+	cr := cron.New()
+	if _, err := cr.AddFunc(spec, fn); err != nil {
+		return stacktrace.Propagate(err, "invalid %s schedule %q", name, spec)
+	}
+	cr.Start()
+	go func() {
+		<-ctx.Done()
+		cr.Stop()
+	}()
+	log.Infof("Scheduled file data %s %s", name, spec)
+	return nil
+}
@@ -0,0 +1,168 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// serverSideCopyEnabled returns true unless
+// replication.file-data.server-side-copy is turned off.
+func serverSideCopyEnabled() bool {
+	if viper.IsSet("replication.file-data.server-side-copy") {
+		return viper.GetBool("replication.file-data.server-side-copy")
+	}
+	return true
+}
+
+// copyServerSide copies the object to the pending buckets that are at the same
+// provider as the row's latest bucket, without the object passing through
+// museum. It returns the pending buckets that still need the object to be
+// downloaded and uploaded, including those for which the copy failed.
+//
+// Only buckets that store objects as is are copied to, since a copy can't be
+// compressed or encrypted on the way. Neither are object locked buckets, whose
+// existing copies are checked before writing, see existingImmutableCopy. Nor
+// are the rows of the types that are verified byte for byte, which needs the
+// uploaded bytes, see verifyByteForByte.
+func (c *Controller) copyServerSide(ctx context.Context, row filedata.Row, pending map[string]bool) (map[string]bool, error) {
+	if !serverSideCopyEnabled() {
+		return pending, nil
+	}
+	if strictVerify(row.Type) {
+		return pending, nil
+	}
+	remaining := make(map[string]bool, len(pending))
+	for bucketID := range pending {
+		if !c.storedAsIs(bucketID) || c.S3Config.IsObjectLocked(bucketID) || !c.S3Config.CanCopyBetween(row.LatestBucket, bucketID) {
+			remaining[bucketID] = true
+			continue
+		}
+		err := c.copyAndVerify(ctx, row, bucketID)
+		if errors.Is(err, fileDataRepo.ErrLockLost) {
+			return nil, err
+		}
+		if err != nil {
+			rowLogger(row).WithFields(log.Fields{
+				logSourceBucket: row.LatestBucket,
+				logDestBucket:   bucketID,
+				logOutcome:      logOutcomeFailed,
+			}).WithError(err).Warn("Server-side copy failed, falling back to uploading")
+			remaining[bucketID] = true
+		}
+	}
+	return remaining, nil
+}
+
+// copyAndVerify copies the object from the latest bucket to dstBucketID, checks
+// that the copy is intact, and records the bucket as replicated.
+func (c *Controller) copyAndVerify(ctx context.Context, row filedata.Row, dstBucketID string) error {
+	copier, ok := c.S3Config.GetObjectStore(dstBucketID).(objectstore.Copier)
+	if !ok {
+		return objectstore.ErrCopyUnsupported
+	}
+	if err := c.registerAttempt(ctx, row, dstBucketID); err != nil {
+		return stacktrace.Propagate(err, "could not register replication attempt")
+	}
+	objectKey := row.S3FileMetadataObjectKey()
+	src := c.S3Config.GetObjectStore(row.LatestBucket)
+	if err := c.checkNotDeleted(ctx, row, dstBucketID); err != nil {
+		return err
+	}
+	var copied objectstore.ObjectInfo
+	err := withS3Retry(ctx, "copy to "+dstBucketID, func() error {
+		var err error
+		copied, err = copier.CopyFrom(ctx, src, objectKey)
+		return err
+	})
+	if errors.Is(err, objectstore.ErrNotVisible) {
+		err = awaitVisible(ctx, "copy of "+objectKey+" to "+dstBucketID, dstBucketID, func() error {
+			var err error
+			copied, err = c.S3Config.GetObjectStore(dstBucketID).Head(ctx, objectKey)
+			return err
+		})
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	versionID, err := c.writtenVersion(dstBucketID, copied)
+	if err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		return err
+	}
+	if err := c.verifyCopiedObject(ctx, row, copied, objectKey, dstBucketID); err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		return stacktrace.Propagate(err, "copied object in %s failed verification", dstBucketID)
+	}
+	if err := c.Repo.SetBucketCompressed(ctx, row, dstBucketID, false); err != nil {
+		return err
+	}
+	if err := c.recordWrittenVersion(ctx, row, dstBucketID, versionID); err != nil {
+		c.discardDeletedCopy(ctx, row, objectKey, dstBucketID, err)
+		return err
+	}
+	if err := c.Repo.MoveBetweenBuckets(ctx, row, dstBucketID, fileDataRepo.InflightRepColumn, fileDataRepo.ReplicationColumn); err != nil {
+		c.discardDeletedCopy(ctx, row, objectKey, dstBucketID, err)
+		return err
+	}
+	countServerSideCopy(ctx, dstBucketID)
+	countRoute(ctx, row.LatestBucket, dstBucketID, copied.Size)
+	mReplicatedObjects.WithLabelValues(string(row.Type), dstBucketID).Inc()
+	mServerSideCopies.WithLabelValues(string(row.Type), dstBucketID).Inc()
+	mServerSideCopyBytes.WithLabelValues(string(row.Type), dstBucketID).Add(float64(copied.Size))
+	rowLogger(row).WithFields(log.Fields{
+		logSourceBucket: row.LatestBucket,
+		logDestBucket:   dstBucketID,
+		logOutcome:      logOutcomeReplicated,
+	}).Info("Copied file data to bucket server side")
+	return nil
+}
+
+// verifyCopiedObject confirms that the copy in dc has the row's size, and that
+// it is identical to the object in the latest bucket. This is decided by the
+// ETags if both are plain MD5s, and otherwise by reading the copy back and
+// comparing it with the row's checksum, which isn't possible for some storage
+// classes.
+func (c *Controller) verifyCopiedObject(ctx context.Context, row filedata.Row, copied objectstore.ObjectInfo, objectKey string, dc string) error {
+	if copied.Size != row.Size {
+		return fmt.Errorf("copied metadata size %d does not match expected size %d: %w", copied.Size, row.Size, ErrIntegrity)
+	}
+	if dstMD5, ok := plainMD5ETag(copied.ETag); ok {
+		_, srcETag, err := c.headObject(ctx, objectKey, row.LatestBucket)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to head source object")
+		}
+		if srcMD5, ok := plainMD5ETag(srcETag); ok {
+			if srcMD5 != dstMD5 {
+				return fmt.Errorf("copied metadata etag %s does not match source etag %s: %w", copied.ETag, srcETag, ErrIntegrity)
+			}
+			return nil
+		}
+	}
+	if row.Checksum == nil {
+		return stacktrace.NewError("copy can't be verified without a recorded checksum")
+	}
+	if !c.S3Config.IsReadable(dc) {
+		return stacktrace.NewError("copy in %s can't be read back to verify it because of its storage class", dc)
+	}
+	var readBack []byte
+	err := awaitVisible(ctx, "read back of "+objectKey+" from "+dc, dc, func() error {
+		var err error
+		readBack, err = c.downloadVersion(ctx, objectKey, dc, c.readBackVersion(dc, copied))
+		return err
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to read back copied object")
+	}
+	if got := checksumOf(readBack); got != *row.Checksum {
+		return fmt.Errorf("copied metadata checksum %s does not match expected checksum %s: %w", got, *row.Checksum, ErrIntegrity)
+	}
+	return nil
+}
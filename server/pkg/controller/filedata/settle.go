@@ -0,0 +1,36 @@
+package filedata
+
+import (
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/spf13/viper"
+)
+
+// defaultSettleFor is how long a row is left alone after it is uploaded before
+// its first replication attempt, unless configured otherwise.
+const defaultSettleFor = 30 * time.Second
+
+// applySettle makes the workers skip the rows that were uploaded too recently
+// for their first replication attempt, as set in replication.file-data.settle.
+// Replicating an object right after it was uploaded sometimes races with the
+// upload itself, and fails because the source isn't there yet. The grace
+// period is replication.file-data.settle.default, or the duration listed for
+// the row's type under settle.types (0 to replicate the type right away). Only
+// the first attempt waits, retries are scheduled by their own backoff.
+func applySettle(filter fileDataRepo.PendingSyncFilter) fileDataRepo.PendingSyncFilter {
+	filter.SettleFor = defaultSettleFor
+	if viper.IsSet("replication.file-data.settle.default") {
+		filter.SettleFor = max(0, viper.GetDuration("replication.file-data.settle.default"))
+	}
+	const typesKey = "replication.file-data.settle.types"
+	types := viper.GetStringMap(typesKey)
+	if len(types) > 0 {
+		filter.SettleForTypes = make(map[ente.ObjectType]time.Duration, len(types))
+		for name := range types {
+			filter.SettleForTypes[ente.ObjectType(name)] = max(0, viper.GetDuration(typesKey+"."+name))
+		}
+	}
+	return filter
+}
@@ -0,0 +1,148 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// replicateSideObjects copies the row's side objects (see Row.SideObjectKeys)
+// from its latest bucket to the destination buckets, and returns the
+// destinations that now have all of them. Only those should get the metadata
+// object, since a row is replicated to a bucket once its metadata object is.
+//
+// Each side object that is copied to a bucket is recorded right away, so that a
+// retry only copies the ones that are still missing, and doesn't download a
+// side object at all if every destination already has it. failed joins the
+// failures of the copies that did not succeed, while err is returned if none of
+// the destinations could be worked on, e.g. because a side object is missing
+// from the latest bucket.
+//
+// Side objects are only encrypted for the destination, never compressed. They
+// are opaque (client encrypted) blobs, so compressing them would not gain
+// anything.
+func (c *Controller) replicateSideObjects(ctx context.Context, row filedata.Row, dstBucketIDs map[string]bool) (ready map[string]bool, failed error, err error) {
+	keys := row.SideObjectKeys()
+	if len(keys) == 0 || len(dstBucketIDs) == 0 {
+		return dstBucketIDs, nil, nil
+	}
+	ready = make(map[string]bool, len(dstBucketIDs))
+	for bucketID := range dstBucketIDs {
+		ready[bucketID] = true
+	}
+	var errs []error
+	for _, objectKey := range keys {
+		var missing []string
+		for bucketID := range dstBucketIDs {
+			if !c.hasSideObject(row, bucketID, objectKey) {
+				missing = append(missing, bucketID)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		data, err := c.downloadLogicalObject(ctx, objectKey, row.LatestBucket)
+		if err != nil {
+			err = stacktrace.Propagate(err, "error fetching side object "+objectKey)
+			if errors.Is(err, objectstore.ErrNotFound) {
+				return nil, nil, &ReplicationError{Class: ErrSourceMissing, Err: err}
+			}
+			return nil, nil, err
+		}
+		checksum := checksumOf(data)
+		metadata, err := c.sourceMetadata(ctx, objectKey, row.LatestBucket)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, bucketID := range missing {
+			if err := c.copySideObject(ctx, row, data, checksum, metadata, objectKey, bucketID); err != nil {
+				if errors.Is(err, fileDataRepo.ErrLockLost) {
+					return nil, nil, err
+				}
+				errs = append(errs, fmt.Errorf("%s: %w", bucketID, err))
+				ready[bucketID] = false
+			}
+		}
+	}
+	for bucketID, ok := range ready {
+		if !ok {
+			delete(ready, bucketID)
+		}
+	}
+	if len(errs) > 0 {
+		log.WithFields(log.Fields{
+			"file_id": row.FileID,
+			"type":    row.Type,
+		}).Infof("Side objects replicated to %d of %d destinations", len(ready), len(dstBucketIDs))
+	}
+	return ready, errors.Join(errs...), nil
+}
+
+// hasSideObject reports whether the side object has already been copied to
+// bucketID. Copies to a bucket that the row is scheduled to be deleted from
+// don't count, since they may be deleted at any time.
+func (c *Controller) hasSideObject(row filedata.Row, bucketID string, objectKey string) bool {
+	if array.StringInList(bucketID, row.DeleteFromBuckets) {
+		return false
+	}
+	return array.StringInList(fileDataRepo.SideObjectEntry(bucketID, objectKey), row.ReplicatedSideObjects)
+}
+
+func (c *Controller) copySideObject(ctx context.Context, row filedata.Row, data []byte, checksum string, metadata objectstore.ObjectMetadata, objectKey string, dstBucketID string) error {
+	if err := c.registerAttempt(ctx, row, dstBucketID); err != nil {
+		return stacktrace.Propagate(err, "could not register replication attempt")
+	}
+	// Objects in object locked buckets are never overwritten
+	exists, err := c.existingImmutableCopy(ctx, objectKey, dstBucketID, checksum)
+	if err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		return err
+	}
+	if exists {
+		return c.Repo.RecordSideObjectReplicated(ctx, row, dstBucketID, objectKey)
+	}
+	stored, err := c.encryptForBucket(ctx, dstBucketID, data)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to encrypt side object for %s", dstBucketID)
+	}
+	if err := c.checkNotDeleted(ctx, row, dstBucketID); err != nil {
+		return err
+	}
+	uploaded, err := c.uploadObject(ctx, stored, objectKey, dstBucketID, metadata)
+	if err != nil {
+		if exists, existErr := c.existingImmutableCopy(ctx, objectKey, dstBucketID, checksum); existErr == nil && exists {
+			return c.Repo.RecordSideObjectReplicated(ctx, row, dstBucketID, objectKey)
+		}
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		return err
+	}
+	if err := c.verifyUploadedMetadata(uploaded, metadata, dstBucketID); err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		return stacktrace.Propagate(err, "uploaded side object to %s failed verification", dstBucketID)
+	}
+	if err := c.verifyUploadedObject(ctx, stored, checksum, uploaded, objectKey, dstBucketID); err != nil {
+		mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+		return stacktrace.Propagate(err, "uploaded side object to %s failed verification", dstBucketID)
+	}
+	if strictVerify(row.Type) {
+		if err := c.verifyByteForByte(ctx, row.Type, stored, objectKey, dstBucketID, uploaded.VersionID); err != nil {
+			mReplicationFailures.WithLabelValues(dstBucketID).Inc()
+			c.cleanUpPartialUpload(ctx, objectKey, dstBucketID, err)
+			return stacktrace.Propagate(err, "uploaded side object to %s failed byte for byte verification", dstBucketID)
+		}
+	}
+	if err := c.Repo.RecordSideObjectReplicated(ctx, row, dstBucketID, objectKey); err != nil {
+		c.discardDeletedCopy(ctx, row, objectKey, dstBucketID, err)
+		return err
+	}
+	countRoute(ctx, row.LatestBucket, dstBucketID, int64(len(stored)))
+	mReplicatedBytes.WithLabelValues(string(row.Type), dstBucketID).Add(float64(len(stored)))
+	return nil
+}
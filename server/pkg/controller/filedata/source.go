@@ -0,0 +1,161 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// verifySourceObject checks the downloaded metadata object against the size and
+// checksum recorded for the row, and returns its checksum.
+//
+// Rows written before checksums were tracked don't have one, for those we record
+// the checksum of what we downloaded so that later verifications can use it.
+// Before that, the object is checked against the checksum embedded in it, if it
+// has one, so that a corrupt source isn't taken as the reference.
+//
+// The failed checks are ErrSourceIntegrity errors, since uploading the object
+// again can't fix its source.
+func (c *Controller) verifySourceObject(ctx context.Context, row filedata.Row, data []byte) (string, error) {
+	if int64(len(data)) != row.Size {
+		return "", sourceIntegrityError(fmt.Errorf("downloaded metadata size %d does not match expected size %d: %w", len(data), row.Size, ErrIntegrity))
+	}
+	checksum := checksumOf(data)
+	if row.Checksum == nil {
+		if err := verifyEmbeddedChecksum(data); err != nil {
+			return "", sourceIntegrityError(err)
+		}
+		if err := c.Repo.SetChecksum(ctx, row, checksum); err != nil {
+			return "", stacktrace.Propagate(err, "failed to record checksum")
+		}
+		return checksum, nil
+	}
+	if *row.Checksum != checksum {
+		return "", sourceIntegrityError(fmt.Errorf("downloaded metadata checksum %s does not match expected checksum %s: %w", checksum, *row.Checksum, ErrIntegrity))
+	}
+	return checksum, nil
+}
+
+// downloadSourceObject downloads the metadata object that is to be replicated,
+// returning its contents, its checksum and the bucket it was read from.
+//
+// The object is read from the row's latest bucket, unless a bucket that the
+// row has already been replicated to is preferred over it, see sourceOrder. If
+// that fails, we fall back to the other buckets the row has been replicated to.
+// Each download first waits for a slot of the instance's download limiter.
+//
+// If the latest bucket doesn't have the object at all, rather than being
+// unreachable, every other bucket that may have a copy is looked at, see
+// recoverMissingSource.
+func (c *Controller) downloadSourceObject(ctx context.Context, row filedata.Row) ([]byte, string, string, error) {
+	if err := c.downloads.acquire(ctx); err != nil {
+		return nil, "", "", stacktrace.Propagate(err, "gave up waiting for a download slot")
+	}
+	defer c.downloads.release()
+	objectKey := row.S3FileMetadataObjectKey()
+	preferred, fallbacks := c.sourceOrder(row)
+	for _, bucketID := range preferred {
+		if data, ok := c.downloadReplicaCopy(ctx, row, objectKey, bucketID); ok {
+			rowLogger(row).WithField(logSourceBucket, bucketID).Info("Replicating from a preferred source instead of the latest bucket")
+			return data, *row.Checksum, bucketID, nil
+		}
+	}
+	data, err := c.downloadLogicalObject(ctx, objectKey, row.LatestBucket)
+	if err == nil {
+		checksum, verifyErr := c.verifySourceObject(ctx, row, data)
+		if verifyErr != nil {
+			return nil, "", "", stacktrace.Propagate(verifyErr, "source metadata object failed verification")
+		}
+		rowLogger(row).WithField(logSourceBucket, row.LatestBucket).Info("Replicating from the latest bucket")
+		return data, checksum, row.LatestBucket, nil
+	}
+	latestErr := err
+	for _, bucketID := range fallbacks {
+		if data, ok := c.downloadReplicaCopy(ctx, row, objectKey, bucketID); ok {
+			rowLogger(row).WithField(logSourceBucket, bucketID).WithError(latestErr).Warn("Latest bucket unavailable, replicating from a fallback source")
+			return data, *row.Checksum, bucketID, nil
+		}
+	}
+	if errors.Is(latestErr, objectstore.ErrNotFound) {
+		return c.recoverMissingSource(ctx, row, objectKey, append(preferred, fallbacks...), latestErr)
+	}
+	rowLogger(row).WithField(logSourceBucket, row.LatestBucket).WithError(latestErr).Warn("Latest bucket is unreachable, and no fallback source was usable")
+	return nil, "", "", stacktrace.Propagate(latestErr, "could not read from latest bucket %s, and no fallback source was usable", row.LatestBucket)
+}
+
+// downloadReplicaCopy downloads the copy of the object in a bucket that the row
+// has been replicated to, returning false if it can't be read or doesn't match
+// the checksum recorded for the row.
+func (c *Controller) downloadReplicaCopy(ctx context.Context, row filedata.Row, objectKey string, bucketID string) ([]byte, bool) {
+	data, err := c.downloadLogicalObject(ctx, objectKey, bucketID)
+	if err != nil {
+		log.WithField("file_id", row.FileID).WithError(err).Warnf("Could not read source %s", bucketID)
+		return nil, false
+	}
+	if got := checksumOf(data); got != *row.Checksum {
+		log.WithField("file_id", row.FileID).Warnf("Source %s has checksum %s, expected %s", bucketID, got, *row.Checksum)
+		return nil, false
+	}
+	return data, true
+}
+
+// sourceOrder splits the buckets other than the latest one that the row may be
+// read from (see fallbackSources) into those that are preferred over the latest
+// bucket, best first, and those that are only read from if the latest bucket
+// is unavailable.
+//
+// The preference is replication.file-data.source-preference, a list of buckets
+// from the most preferred (e.g. the closest, or cheapest to read from) to the
+// least. Listed buckets are preferred over the ones that are not listed. By
+// default no bucket is preferred over the latest one.
+func (c *Controller) sourceOrder(row filedata.Row) (preferred []string, fallbacks []string) {
+	preference := viper.GetStringSlice("replication.file-data.source-preference")
+	rank := func(bucketID string) int {
+		if i := slices.Index(preference, bucketID); i >= 0 {
+			return i
+		}
+		return len(preference)
+	}
+	latestRank := rank(row.LatestBucket)
+	for _, bucketID := range c.fallbackSources(row) {
+		if rank(bucketID) < latestRank {
+			preferred = append(preferred, bucketID)
+		} else {
+			fallbacks = append(fallbacks, bucketID)
+		}
+	}
+	slices.SortStableFunc(preferred, func(a, b string) int { return rank(a) - rank(b) })
+	return preferred, fallbacks
+}
+
+// fallbackSources returns the buckets that may be read from instead of the
+// latest bucket.
+//
+// Only buckets that the row has been replicated (and verified) to are
+// considered, excluding any that are being re-uploaded to or are scheduled for
+// deletion, or whose storage class doesn't allow reading right away. And since a fallback copy must be verified against the checksum
+// recorded for the row, rows without one don't have any fallback sources.
+func (c *Controller) fallbackSources(row filedata.Row) []string {
+	if row.Checksum == nil {
+		return nil
+	}
+	var sources []string
+	for _, bucketID := range row.ReplicatedBuckets {
+		if bucketID == row.LatestBucket ||
+			array.StringInList(bucketID, row.InflightReplicas) ||
+			array.StringInList(bucketID, row.DeleteFromBuckets) ||
+			!c.S3Config.IsReadable(bucketID) {
+			continue
+		}
+		sources = append(sources, bucketID)
+	}
+	return sources
+}
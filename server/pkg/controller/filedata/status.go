@@ -0,0 +1,51 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	enteTime "github.com/ente-io/museum/pkg/utils/time"
+	"github.com/ente-io/stacktrace"
+)
+
+// GetReplicationStatus reports the replication backlog for each object type.
+func (c *Controller) GetReplicationStatus(ctx context.Context) (*filedata.ReplicationStatus, error) {
+	types, err := c.Repo.GetReplicationStatus(ctx, enteTime.MicrosecondsBeforeMinutes(60))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	buckets, err := c.getBucketReplicationStatus(ctx)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	oversized, err := c.getOversizedStatus(ctx)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	bestEffort, err := c.getBestEffortStatus(ctx)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &filedata.ReplicationStatus{Types: types, Buckets: buckets, Circuits: c.circuits.status(), Pause: c.pause.status(), CatchUp: c.catchUp.status(),
+		Oversized: oversized, BestEffort: bestEffort, Window: c.getWindowStatus(), Maintenance: c.maintenance.status(),
+		CreatedAfter: c.createdAfter.Load(), NoReplicaConfigured: c.getNoReplicaTypes()}, nil
+}
+
+// replicatedTypes are the object types whose data is stored in file_data.
+var replicatedTypes = []ente.ObjectType{ente.MlData, ente.PreviewVideo, ente.PreviewImage}
+
+// getBucketReplicationStatus reports the replication backlog for each object
+// type and required destination bucket.
+func (c *Controller) getBucketReplicationStatus(ctx context.Context) ([]filedata.BucketReplicationStatus, error) {
+	wanted := make(map[ente.ObjectType][]string, len(replicatedTypes))
+	for _, oType := range replicatedTypes {
+		for bucketID := range c.wantedBuckets(oType) {
+			if c.isBestEffort(oType, bucketID) {
+				continue
+			}
+			wanted[oType] = append(wanted[oType], bucketID)
+		}
+	}
+	return c.Repo.GetBucketReplicationStatus(ctx, wanted)
+}
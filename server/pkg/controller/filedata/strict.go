@@ -0,0 +1,107 @@
+package filedata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// strictVerifyChunkSize is how much of a copy is read back at a time when it is
+// compared byte for byte.
+const strictVerifyChunkSize = 64 * 1024
+
+// Outcomes of a strict verification, as counted in mStrictVerifications.
+const (
+	strictMatch    = "match"
+	strictMismatch = "mismatch"
+	strictError    = "error"
+	strictSkipped  = "skipped"
+)
+
+// strictVerify reports whether the copies of objects of the type are
+// verified byte for byte after being uploaded, i.e. whether the type is listed
+// in replication.file-data.strict-verify-types.
+func strictVerify(oType ente.ObjectType) bool {
+	return array.StringInList(string(oType), viper.GetStringSlice("replication.file-data.strict-verify-types"))
+}
+
+// verifyByteForByte reads back the object that has just been uploaded to dc,
+// and compares it as stored (i.e. still compressed or encrypted, if it is) with
+// stored, the bytes that were uploaded. This is on top of the checks of
+// verifyUploadedObject, and doubles the traffic of the upload, so it is only
+// done for the types for which strictVerify is set. The copy is streamed and
+// compared a chunk at a time, without holding a second copy of it in memory.
+//
+// A copy that doesn't match fails with ErrIntegrity. Copies in buckets that
+// can't be read back because of their storage class are not compared. In a
+// versioned bucket, versionID is the version that the upload created, which is
+// the one compared.
+func (c *Controller) verifyByteForByte(ctx context.Context, oType ente.ObjectType, stored []byte, objectKey string, dc string, versionID string) error {
+	if !c.S3Config.IsReadable(dc) {
+		mStrictVerifications.WithLabelValues(string(oType), dc, strictSkipped).Inc()
+		log.WithFields(log.Fields{
+			logType:       oType,
+			"object":      objectKey,
+			logDestBucket: dc,
+		}).Warn("Copy can't be read back because of its storage class, not verifying it byte for byte")
+		return nil
+	}
+	op := "byte for byte verification of " + objectKey + " in " + dc
+	err := awaitVisible(ctx, op, dc, func() error {
+		return withS3Retry(ctx, op, func() error {
+			return c.compareStored(ctx, stored, objectKey, dc, versionID)
+		})
+	})
+	switch {
+	case err == nil:
+		mStrictVerifications.WithLabelValues(string(oType), dc, strictMatch).Inc()
+		return nil
+	case errors.Is(err, ErrIntegrity):
+		mStrictVerifications.WithLabelValues(string(oType), dc, strictMismatch).Inc()
+	default:
+		mStrictVerifications.WithLabelValues(string(oType), dc, strictError).Inc()
+	}
+	return stacktrace.Propagate(err, "")
+}
+
+// compareStored reads the object (or its version versionID, if not "") from dc,
+// failing with ErrIntegrity at the first chunk where it differs from stored.
+func (c *Controller) compareStored(ctx context.Context, stored []byte, objectKey string, dc string, versionID string) error {
+	body, err := c.openVersion(ctx, objectKey, dc, versionID)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	buf := make([]byte, strictVerifyChunkSize)
+	offset := 0
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if offset+n > len(stored) {
+				return fmt.Errorf("copy is longer than the %d bytes uploaded: %w", len(stored), ErrIntegrity)
+			}
+			if !bytes.Equal(buf[:n], stored[offset:offset+n]) {
+				return fmt.Errorf("copy differs from what was uploaded within bytes %d-%d: %w", offset, offset+n-1, ErrIntegrity)
+			}
+			offset += n
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if offset != len(stored) {
+		return fmt.Errorf("copy has %d bytes, %d were uploaded: %w", offset, len(stored), ErrIntegrity)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package filedata
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultThrottleFailureRatio   = 0.5
+	defaultThrottleSlowUpload     = 5 * time.Minute
+	defaultThrottleInterval       = 10 * time.Second
+	defaultThrottleMinWorkers     = 1
+	defaultThrottleDecreaseFactor = 0.5
+	// throttleSmoothing is the weight of each new upload in the moving
+	// averages of the failure ratio and the upload latency.
+	throttleSmoothing = 0.2
+	// throttleMinSamples is the number of uploads that must have been seen
+	// since the last adjustment before the throttle adjusts again.
+	throttleMinSamples = 5
+)
+
+// adaptiveThrottle sheds load off the destination object stores when they are
+// in distress, by limiting how many replication workers of an instance, across
+// all pools, replicate rows at the same time.
+//
+// It keeps moving averages of the failure ratio of the uploads (counting only
+// the transient failures, see isRetryableS3Error) and of their latency. Every
+// replication.file-data.throttle.interval (provided there have been enough
+// uploads in the meantime to go by), if either is above its threshold,
+// the number of workers allowed to run is multiplied by the decrease factor
+// (but never made less than min-workers). Otherwise it is increased by one,
+// until it covers all the workers and the throttle stops limiting anything.
+//
+// A nil throttle doesn't limit anything.
+type adaptiveThrottle struct {
+	mu sync.Mutex
+	// limit is the number of workers that may replicate at the same time, 0
+	// while the throttle isn't limiting anything
+	limit   int
+	active  int
+	waiting int
+	// changed is closed, and replaced, whenever a waiting worker may be able
+	// to proceed
+	changed chan struct{}
+
+	failureRatio float64
+	latency      float64 // seconds
+	samples      int
+	lastAdjusted time.Time
+}
+
+// newAdaptiveThrottle returns a throttle unless
+// replication.file-data.throttle.enabled is turned off.
+func newAdaptiveThrottle() *adaptiveThrottle {
+	if viper.IsSet("replication.file-data.throttle.enabled") && !viper.GetBool("replication.file-data.throttle.enabled") {
+		return nil
+	}
+	mThrottleLimited.Set(0)
+	return &adaptiveThrottle{changed: make(chan struct{}), lastAdjusted: time.Now()}
+}
+
+// acquire waits till the worker may replicate, giving up (with false) if the
+// pool is shutting down or the worker has been asked to stop. Every successful
+// acquire must be followed by a release.
+func (t *adaptiveThrottle) acquire(ctx context.Context, w *replicationWorker) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	t.waiting++
+	for {
+		t.adjust(time.Now())
+		if t.limit == 0 || t.active < t.limit {
+			t.waiting--
+			t.active++
+			t.mu.Unlock()
+			return true
+		}
+		changed := t.changed
+		t.mu.Unlock()
+		w.health.set(workerThrottled, 0)
+		timer := time.NewTimer(throttleInterval())
+		select {
+		case <-ctx.Done():
+		case <-w.stop:
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		t.mu.Lock()
+		if w.stopped(ctx) {
+			t.waiting--
+			t.mu.Unlock()
+			return false
+		}
+	}
+}
+
+func (t *adaptiveThrottle) release() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	t.notify()
+}
+
+// observe records the outcome of an upload that took latency. Uploads that
+// were cut short by ctx are not counted.
+func (t *adaptiveThrottle) observe(ctx context.Context, err error, latency time.Duration) {
+	if t == nil || ctx.Err() != nil {
+		return
+	}
+	failure := 0.0
+	if err != nil {
+		if !isRetryableS3Error(err) {
+			return
+		}
+		failure = 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failureRatio += throttleSmoothing * (failure - t.failureRatio)
+	t.latency += throttleSmoothing * (latency.Seconds() - t.latency)
+	t.samples++
+	mThrottleFailureRatio.Set(t.failureRatio)
+	mThrottleUploadLatency.Set(t.latency)
+	t.adjust(time.Now())
+}
+
+// adjust moves the limit once per interval, additively increasing it while the
+// uploads are healthy and multiplicatively decreasing it while they are not.
+// It must be called with t.mu held.
+func (t *adaptiveThrottle) adjust(now time.Time) {
+	if now.Sub(t.lastAdjusted) < throttleInterval() || t.samples < throttleMinSamples {
+		return
+	}
+	workers := t.active + t.waiting
+	switch {
+	case t.distressed():
+		current := t.limit
+		if current == 0 {
+			current = max(t.active, 1)
+		}
+		decreased := max(int(math.Floor(float64(current)*throttleDecreaseFactor())), throttleMinWorkers())
+		if decreased < current || t.limit == 0 {
+			log.Warnf("Object stores look distressed (failure ratio %.2f, upload latency %.1fs), limiting file data replication to %d workers",
+				t.failureRatio, t.latency, decreased)
+		}
+		t.limit = decreased
+	case t.limit != 0:
+		t.limit++
+		if t.limit >= workers {
+			log.Info("Object stores have recovered, no longer limiting file data replication workers")
+			t.limit = 0
+		}
+		t.notify()
+	}
+	if t.limit == 0 {
+		mThrottleLimited.Set(0)
+		mEffectiveConcurrency.Set(float64(workers))
+	} else {
+		mThrottleLimited.Set(1)
+		mEffectiveConcurrency.Set(float64(min(t.limit, workers)))
+	}
+	t.samples = 0
+	t.lastAdjusted = now
+}
+
+func (t *adaptiveThrottle) distressed() bool {
+	if t.failureRatio > throttleFailureRatio() {
+		return true
+	}
+	slow := viper.GetDuration("replication.file-data.throttle.slow-upload")
+	if slow <= 0 {
+		slow = defaultThrottleSlowUpload
+	}
+	return t.latency > slow.Seconds()
+}
+
+// share returns the fraction of the replication workers that the throttle
+// currently lets run, 1 while it isn't limiting anything.
+func (t *adaptiveThrottle) share() float64 {
+	if t == nil {
+		return 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	workers := t.active + t.waiting
+	if t.limit == 0 || workers <= t.limit {
+		return 1
+	}
+	return float64(t.limit) / float64(workers)
+}
+
+// notify wakes up the waiting workers. It must be called with t.mu held.
+func (t *adaptiveThrottle) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func throttleInterval() time.Duration {
+	d := viper.GetDuration("replication.file-data.throttle.interval")
+	if d <= 0 {
+		return defaultThrottleInterval
+	}
+	return d
+}
+
+func throttleFailureRatio() float64 {
+	r := viper.GetFloat64("replication.file-data.throttle.failure-ratio")
+	if r <= 0 || r > 1 {
+		return defaultThrottleFailureRatio
+	}
+	return r
+}
+
+func throttleDecreaseFactor() float64 {
+	f := viper.GetFloat64("replication.file-data.throttle.decrease-factor")
+	if f <= 0 || f >= 1 {
+		return defaultThrottleDecreaseFactor
+	}
+	return f
+}
+
+func throttleMinWorkers() int {
+	n := viper.GetInt("replication.file-data.throttle.min-workers")
+	if n <= 0 {
+		return defaultThrottleMinWorkers
+	}
+	return n
+}
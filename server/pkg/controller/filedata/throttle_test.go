@@ -0,0 +1,48 @@
+package filedata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestAdaptiveThrottleBacksOffAndRecovers(t *testing.T) {
+	now := time.Now()
+	th := &adaptiveThrottle{changed: make(chan struct{}), active: 8, lastAdjusted: now}
+	unavailable := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "")
+	// step records a few uploads, and then lets an interval pass
+	step := func(err error) int {
+		for i := 0; i < throttleMinSamples; i++ {
+			th.observe(context.Background(), err, time.Second)
+		}
+		now = now.Add(defaultThrottleInterval)
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		th.adjust(now)
+		return th.limit
+	}
+
+	if limit := step(unavailable); limit != 4 {
+		t.Fatalf("limit after failures = %d, want 4", limit)
+	}
+	if limit := step(unavailable); limit != 2 {
+		t.Fatalf("limit after more failures = %d, want 2", limit)
+	}
+	if share := th.share(); share != 0.25 {
+		t.Errorf("share() limited to 2 of 8 workers = %v, want 0.25", share)
+	}
+	if limit := step(nil); limit != 3 {
+		t.Fatalf("limit after successes = %d, want 3", limit)
+	}
+	for i := 0; i < 5; i++ {
+		step(nil)
+	}
+	if th.limit != 0 {
+		t.Fatalf("limit after recovery = %d, want 0 (unlimited)", th.limit)
+	}
+	if share := th.share(); share != 1 {
+		t.Errorf("share() after recovery = %v, want 1", share)
+	}
+}
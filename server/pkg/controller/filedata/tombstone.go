@@ -0,0 +1,48 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	log "github.com/sirupsen/logrus"
+)
+
+// The rows of deleted files are marked as deleted, and then removed once their
+// objects have been deleted from all the buckets, without regard for the lock
+// of a replication attempt that is still in progress, e.g. one whose lock ran
+// out while it was stuck on a slow upload. Such an attempt must not put back
+// copies of the deleted file.
+//
+// So the updates that add replicas to a row don't match deleted rows, and fail
+// with fileDataRepo.ErrRowDeleted. The attempt checks that the row is still
+// live before each write (see checkNotDeleted), and deletes what it wrote if
+// the row was deleted while it was writing (see discardDeletedCopy), after
+// which it abandons the row.
+
+// checkNotDeleted returns fileDataRepo.ErrRowDeleted if the row has been
+// deleted since it was picked up, before an object is written for it to dc.
+func (c *Controller) checkNotDeleted(ctx context.Context, row filedata.Row, dc string) error {
+	err := c.Repo.CheckNotDeleted(ctx, row)
+	if errors.Is(err, fileDataRepo.ErrRowDeleted) {
+		mDeletedWhileReplicating.WithLabelValues(string(row.Type), dc).Inc()
+	}
+	return err
+}
+
+// discardDeletedCopy deletes the object that was just written to dc, if err
+// shows that the row was deleted meanwhile, so that the copy doesn't outlive
+// the file. Nothing is deleted from object locked buckets, see
+// cleanUpPartialUpload.
+func (c *Controller) discardDeletedCopy(ctx context.Context, row filedata.Row, objectKey string, dc string, err error) {
+	if !errors.Is(err, fileDataRepo.ErrRowDeleted) {
+		return
+	}
+	mDeletedWhileReplicating.WithLabelValues(string(row.Type), dc).Inc()
+	rowLogger(row).WithFields(log.Fields{
+		"object":      objectKey,
+		logDestBucket: dc,
+	}).Warn("File data was deleted while being replicated, deleting the copy")
+	c.cleanUpPartialUpload(ctx, objectKey, dc, err)
+}
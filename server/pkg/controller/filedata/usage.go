@@ -0,0 +1,213 @@
+package filedata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultUsageFlushInterval   = 30 * time.Second
+	defaultUsageRetention       = 30 * 24 * time.Hour
+	defaultQuotaWindow          = 24 * time.Hour
+	defaultQuotaRefreshInterval = time.Minute
+	usagePruneInterval          = time.Hour
+	defaultUsageWindow          = 24 * time.Hour
+	defaultUsageListLimit       = 50
+	maxUsageListLimit           = 1000
+)
+
+// usageRecorder adds up the replication work done on behalf of each user, which
+// is written to file_data_replication_usage by writeUsage, and keeps the users
+// that are over the soft per-user limit.
+//
+// Users over the limit are not cut off. Their rows are picked after everyone
+// else's (see PendingSyncFilter.DeprioritizedUsers), so that a single account
+// uploading in bulk can't keep the workers from replicating the others.
+type usageRecorder struct {
+	mu        sync.Mutex
+	pending   map[fileDataRepo.UsageKey]fileDataRepo.UsageDelta
+	overQuota []int64
+}
+
+// configureUsage enables the per-user accounting if
+// replication.file-data.usage.enabled is set.
+func (c *Controller) configureUsage() {
+	if viper.GetBool("replication.file-data.usage.enabled") {
+		c.usage = &usageRecorder{pending: map[fileDataRepo.UsageKey]fileDataRepo.UsageDelta{}}
+	}
+}
+
+// recordUsage adds a completed replication of the row to its user's usage, if
+// the accounting is enabled.
+func (c *Controller) recordUsage(row filedata.Row, buckets []string, stats *transferStats) {
+	if c.usage == nil {
+		return
+	}
+	hour := time.Now().Truncate(time.Hour).UnixMicro()
+	c.usage.add(map[fileDataRepo.UsageKey]fileDataRepo.UsageDelta{
+		{UserID: row.UserID, Hour: hour}: {Bytes: stats.bytes.Load(), Objects: int64(len(buckets))},
+	})
+}
+
+func (u *usageRecorder) add(usage map[fileDataRepo.UsageKey]fileDataRepo.UsageDelta) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, delta := range usage {
+		sum := u.pending[key]
+		sum.Bytes += delta.Bytes
+		sum.Objects += delta.Objects
+		u.pending[key] = sum
+	}
+}
+
+// take returns the usage added since the last take.
+func (u *usageRecorder) take() map[fileDataRepo.UsageKey]fileDataRepo.UsageDelta {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	pending := u.pending
+	u.pending = map[fileDataRepo.UsageKey]fileDataRepo.UsageDelta{}
+	return pending
+}
+
+// overQuotaUsers returns the users that are over the limit. It is nil safe.
+func (u *usageRecorder) overQuotaUsers() []int64 {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.overQuota
+}
+
+func (u *usageRecorder) setOverQuota(userIDs []int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.overQuota = userIDs
+}
+
+// writeUsage writes the added usage every
+// replication.file-data.usage.flush-interval, refreshes the users over the
+// limit, and prunes the usage older than replication.file-data.usage.retention,
+// until ctx is cancelled.
+func (c *Controller) writeUsage(ctx context.Context) {
+	interval := viper.GetDuration("replication.file-data.usage.flush-interval")
+	if interval <= 0 {
+		interval = defaultUsageFlushInterval
+	}
+	retention := viper.GetDuration("replication.file-data.usage.retention")
+	if retention <= 0 {
+		retention = defaultUsageRetention
+	}
+	quotaInterval := viper.GetDuration("replication.file-data.usage.quota.refresh-interval")
+	if quotaInterval <= 0 {
+		quotaInterval = defaultQuotaRefreshInterval
+	}
+	flushTicker := time.NewTicker(interval)
+	defer flushTicker.Stop()
+	pruneTicker := time.NewTicker(usagePruneInterval)
+	defer pruneTicker.Stop()
+	quotaTicker := time.NewTicker(quotaInterval)
+	defer quotaTicker.Stop()
+	c.refreshOverQuota(ctx)
+	flush := func(ctx context.Context) {
+		usage := c.usage.take()
+		if err := c.Repo.AddReplicationUsage(ctx, usage); err != nil {
+			log.Errorf("Could not write the file data replication usage of %d users: %s", len(usage), err)
+			// Try again with the next flush
+			c.usage.add(usage)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			flush(context.WithoutCancel(ctx))
+			return
+		case <-flushTicker.C:
+			flush(ctx)
+		case <-quotaTicker.C:
+			c.refreshOverQuota(ctx)
+		case <-pruneTicker.C:
+			before := time.Now().Add(-retention).UnixMicro()
+			if n, err := c.Repo.PruneReplicationUsage(ctx, before); err != nil {
+				log.Errorf("Could not prune file data replication usage: %s", err)
+			} else if n > 0 {
+				log.Infof("Pruned %d hours of file data replication usage", n)
+			}
+		}
+	}
+}
+
+// refreshOverQuota refetches the users that are over the limit.
+func (c *Controller) refreshOverQuota(ctx context.Context) {
+	userIDs, err := c.getOverQuotaUsers(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("Could not fetch the users over the file data replication quota: %s", err)
+		}
+		return
+	}
+	previous := c.usage.overQuotaUsers()
+	if len(userIDs) != len(previous) {
+		log.Infof("%d users are over the file data replication quota, their rows are replicated last", len(userIDs))
+	}
+	c.usage.setOverQuota(userIDs)
+	mUsersOverQuota.Set(float64(len(userIDs)))
+}
+
+// getOverQuotaUsers returns the users that have had more than
+// replication.file-data.usage.quota.max-bytes bytes or max-objects objects
+// replicated over the last quota.window, or none if no limit is configured.
+func (c *Controller) getOverQuotaUsers(ctx context.Context) ([]int64, error) {
+	maxBytes := viper.GetInt64("replication.file-data.usage.quota.max-bytes")
+	maxObjects := viper.GetInt64("replication.file-data.usage.quota.max-objects")
+	if maxBytes <= 0 && maxObjects <= 0 {
+		return nil, nil
+	}
+	window := viper.GetDuration("replication.file-data.usage.quota.window")
+	if window <= 0 {
+		window = defaultQuotaWindow
+	}
+	since := time.Now().Add(-window).Truncate(time.Hour).UnixMicro()
+	return c.Repo.GetUsersOverReplicationQuota(ctx, since, maxBytes, maxObjects)
+}
+
+// GetReplicationUsage returns the replication work done on behalf of users
+// over the last window, the users with the most bytes first. If userID is not
+// nil only that user is returned, otherwise up to limit users (the default
+// number for 0). The window is rounded up to whole hours.
+func (c *Controller) GetReplicationUsage(ctx context.Context, window time.Duration, userID *int64, limit int) ([]filedata.UserReplicationUsage, error) {
+	if !viper.GetBool("replication.file-data.usage.enabled") {
+		return nil, stacktrace.Propagate(ente.NewBadRequestWithMessage("file data replication usage accounting is not enabled"), "")
+	}
+	if window <= 0 {
+		window = defaultUsageWindow
+	}
+	if limit <= 0 {
+		limit = defaultUsageListLimit
+	}
+	if limit > maxUsageListLimit {
+		limit = maxUsageListLimit
+	}
+	since := time.Now().Add(-window).Truncate(time.Hour).UnixMicro()
+	usage, err := c.Repo.GetReplicationUsage(ctx, since, userID, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	overQuota, err := c.getOverQuotaUsers(ctx)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	for i := range usage {
+		usage[i].OverQuota = array.Int64InList(usage[i].UserID, overQuota)
+	}
+	return usage, nil
+}
@@ -0,0 +1,213 @@
+package filedata
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultVerifyAfter             = 30 * 24 * time.Hour
+	defaultVerifyBatchSize         = 500
+	defaultVerifyRequestsPerSecond = 10
+	verifyLockDuration             = 10 * time.Minute
+)
+
+// StartVerification schedules the re-verification of replicated copies as per
+// the cron spec in replication.file-data.verify.schedule, till ctx is done. It
+// does nothing if no schedule is configured.
+func (c *Controller) StartVerification(ctx context.Context) error {
+	return scheduleJob(ctx, "verification", viper.GetString("replication.file-data.verify.schedule"), func() {
+		c.Verify(ctx)
+	})
+}
+
+// Verify runs a single verification pass over the rows that are due for it.
+//
+// Each replicated copy of a row is checked against the row's checksum, and a
+// copy that is missing or differs is removed from the row's replicated buckets
+// so that the normal replication flow copies it again.
+func (c *Controller) Verify(ctx context.Context) {
+	if !c.verifying.CompareAndSwap(false, true) {
+		log.Info("File data verification is already running, skipping")
+		return
+	}
+	defer c.verifying.Store(false)
+
+	after := viper.GetDuration("replication.file-data.verify.after")
+	if after <= 0 {
+		after = defaultVerifyAfter
+	}
+	sampleRate := 1.0
+	if viper.IsSet("replication.file-data.verify.sample-rate") {
+		sampleRate = viper.GetFloat64("replication.file-data.verify.sample-rate")
+	}
+	batchSize := viper.GetInt("replication.file-data.verify.batch-size")
+	if batchSize <= 0 {
+		batchSize = defaultVerifyBatchSize
+	}
+	requestsPerSecond := viper.GetFloat64("replication.file-data.verify.requests-per-second")
+	if requestsPerSecond <= 0 {
+		requestsPerSecond = defaultVerifyRequestsPerSecond
+	}
+	limiter := rate.NewLimiter(rate.Limit(requestsPerSecond), 1)
+
+	rows, err := c.Repo.GetRowsDueForVerification(ctx, time.Now().Add(-after).UnixMicro(), sampleRate, batchSize)
+	if err != nil {
+		log.WithError(err).Error("Could not fetch rows for file data verification")
+		return
+	}
+	verified, requeued, failed := 0, 0, 0
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			break
+		}
+		var mismatched []string
+		locked, err := c.withBorrowedLock(ctx, row, verifyLockDuration, func(row filedata.Row) error {
+			var err error
+			mismatched, err = c.verifyRow(ctx, row, limiter)
+			return err
+		})
+		switch {
+		case locked:
+			// Being replicated, it will be picked up by a later pass
+		case err != nil:
+			log.WithField("file_id", row.FileID).WithField("type", row.Type).WithError(err).Warn("Could not verify file data")
+			failed++
+		default:
+			verified++
+			if len(mismatched) > 0 {
+				requeued++
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"verified": verified,
+		"requeued": requeued,
+		"errors":   failed,
+	}).Info("File data verification finished")
+}
+
+// verifyRow verifies each replicated copy of the row, requeueing the copies
+// that don't match, and returns the buckets of those copies. Copies in object
+// locked buckets are only requeued if they are missing.
+//
+// The row is recorded as verified once all its copies have been checked, even
+// if some of them don't match and can't be healed, so that the rows that need
+// a human are not checked again first by every pass, ahead of the others. The
+// row is only checked again by the next pass if a copy couldn't be checked.
+func (c *Controller) verifyRow(ctx context.Context, row filedata.Row, limiter *rate.Limiter) ([]string, error) {
+	objectKey := row.S3FileMetadataObjectKey()
+	// Read the latest copy to establish what the replicas should contain
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	data, err := c.downloadLogicalObject(ctx, objectKey, row.LatestBucket)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read latest copy from %s", row.LatestBucket)
+	}
+	checksum := checksumOf(data)
+	if row.Checksum == nil {
+		if err := verifyEmbeddedChecksum(data); err != nil {
+			mVerificationMismatches.WithLabelValues(row.LatestBucket).Inc()
+			return nil, errors.Join(stacktrace.Propagate(err, "latest copy in %s is corrupt", row.LatestBucket), c.Repo.MarkVerified(ctx, row))
+		}
+		if err := c.Repo.SetChecksum(ctx, row, checksum); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+	} else if *row.Checksum != checksum {
+		// Nothing to heal from, this needs a human
+		mVerificationMismatches.WithLabelValues(row.LatestBucket).Inc()
+		return nil, errors.Join(fmt.Errorf("latest copy in %s does not match the recorded checksum", row.LatestBucket), c.Repo.MarkVerified(ctx, row))
+	}
+	md5Sum := md5.Sum(data)
+	plainMD5 := hex.EncodeToString(md5Sum[:])
+
+	mismatched := make([]string, 0)
+	// errs are the copies that couldn't be checked or requeued, unhealed the
+	// ones that don't match and can't be requeued
+	var errs, unhealed []error
+	for _, bucketID := range row.ReplicatedBuckets {
+		if bucketID == row.LatestBucket {
+			continue
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return mismatched, err
+		}
+		ok, err := c.verifyReplica(ctx, objectKey, bucketID, replicaVersion(row, bucketID), int64(len(data)), plainMD5, checksum)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			continue
+		}
+		mVerificationMismatches.WithLabelValues(bucketID).Inc()
+		if c.S3Config.IsObjectLocked(bucketID) {
+			// A corrupt copy in an object locked bucket can't be overwritten,
+			// only a missing one can be replicated again
+			if _, _, err := c.headObject(ctx, objectKey, bucketID); !errors.Is(err, objectstore.ErrNotFound) {
+				unhealed = append(unhealed, fmt.Errorf("copy in object locked bucket %s does not match and can't be overwritten", bucketID))
+				continue
+			}
+		}
+		rowLogger(row).WithField(logDestBucket, bucketID).Warn("Replicated file data copy is missing or corrupt, requeueing it")
+		if err := c.Repo.RequeueMissingReplica(ctx, row, bucketID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		mismatched = append(mismatched, bucketID)
+	}
+	if len(errs) > 0 {
+		return mismatched, errors.Join(append(errs, unhealed...)...)
+	}
+	return mismatched, errors.Join(append(unhealed, c.Repo.MarkVerified(ctx, row))...)
+}
+
+// verifyReplica returns true if the copy in bucketID has the expected contents.
+//
+// For copies stored as is (neither compressed nor encrypted) with a plain MD5
+// ETag a HEAD request is enough, otherwise the copy is read back and its
+// checksum compared. Copies that can't be read back because of the storage
+// class of their bucket are only checked to be there. In a versioned bucket,
+// the version that replication wrote is checked (if one is recorded), not
+// whatever was written over it since.
+func (c *Controller) verifyReplica(ctx context.Context, objectKey string, bucketID string, versionID string, size int64, plainMD5 string, checksum string) (bool, error) {
+	stored, err := c.headVersion(ctx, objectKey, bucketID, versionID)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if c.storedAsIs(bucketID) {
+		if stored.Size != size {
+			return false, nil
+		}
+		if md5Hex, ok := plainMD5ETag(stored.ETag); ok {
+			return md5Hex == plainMD5, nil
+		}
+	}
+	if !c.S3Config.IsReadable(bucketID) {
+		// Reading the copy would need a restore, its presence has to do
+		return true, nil
+	}
+	replica, err := c.downloadVersion(ctx, objectKey, bucketID, versionID)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return checksumOf(replica) == checksum, nil
+}
@@ -0,0 +1,126 @@
+package filedata
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+)
+
+// replicaVersion returns the version of the row's metadata object that was
+// written to bucketID, or "" if none is recorded (the bucket isn't versioned,
+// or the copy was already there and wasn't written by replication).
+func replicaVersion(row filedata.Row, bucketID string) string {
+	for _, entry := range row.ReplicaVersions {
+		if versionID, ok := strings.CutPrefix(entry, bucketID+":"); ok {
+			return versionID
+		}
+	}
+	return ""
+}
+
+// writtenVersion returns the version that a write to dc created, as reported in
+// written, or "" if dc isn't versioned. A write to a versioned bucket that
+// doesn't report a version fails, since the copy couldn't be referenced by it.
+func (c *Controller) writtenVersion(dc string, written objectstore.ObjectInfo) (string, error) {
+	if !c.S3Config.IsVersioned(dc) {
+		return "", nil
+	}
+	if written.VersionID == "" {
+		return "", stacktrace.NewError("%s is configured as versioned, but the write returned no version (is versioning enabled on the bucket?)", dc)
+	}
+	return written.VersionID, nil
+}
+
+// readBackVersion returns the version to read back a write to dc by, to verify
+// it, or "" to read back the current version if dc isn't versioned. The stores
+// of unversioned buckets can still report a version for the write (S3 reports
+// "null"), which doesn't tell it apart from the writes that follow it.
+func (c *Controller) readBackVersion(dc string, written objectstore.ObjectInfo) string {
+	if !c.S3Config.IsVersioned(dc) {
+		return ""
+	}
+	return written.VersionID
+}
+
+// recordWrittenVersion records versionID as the version of the row's metadata
+// object in dc. It does nothing if versionID is "".
+func (c *Controller) recordWrittenVersion(ctx context.Context, row filedata.Row, dc string, versionID string) error {
+	if versionID == "" {
+		return nil
+	}
+	return stacktrace.Propagate(c.Repo.RecordReplicaVersion(ctx, row, dc, versionID), "")
+}
+
+// headVersion returns the information of the given version of the object in dc,
+// or of its current version if versionID is "".
+func (c *Controller) headVersion(ctx context.Context, objectKey string, dc string, versionID string) (objectstore.ObjectInfo, error) {
+	if versionID == "" {
+		size, etag, err := c.headObject(ctx, objectKey, dc)
+		return objectstore.ObjectInfo{Size: size, ETag: etag}, err
+	}
+	reader, ok := c.S3Config.GetObjectStore(dc).(objectstore.VersionReader)
+	if !ok {
+		return objectstore.ObjectInfo{}, stacktrace.NewError("the store of %s can't read versions of objects", dc)
+	}
+	var info objectstore.ObjectInfo
+	err := withS3Retry(ctx, "head of version "+versionID+" in "+dc, func() error {
+		if err := c.requests.acquire(ctx, dc); err != nil {
+			return err
+		}
+		defer c.requests.release(dc)
+		var err error
+		info, err = reader.HeadVersion(ctx, objectKey, versionID)
+		return err
+	})
+	if err != nil {
+		return info, stacktrace.Propagate(err, "")
+	}
+	return info, nil
+}
+
+// openVersion opens the given version of the object in dc as it is stored, or
+// its current version if versionID is "". The caller must close it.
+func (c *Controller) openVersion(ctx context.Context, objectKey string, dc string, versionID string) (io.ReadCloser, error) {
+	store := c.S3Config.GetObjectStore(dc)
+	if versionID == "" {
+		return store.Get(ctx, objectKey)
+	}
+	reader, ok := store.(objectstore.VersionReader)
+	if !ok {
+		return nil, stacktrace.NewError("the store of %s can't read versions of objects", dc)
+	}
+	return reader.GetVersion(ctx, objectKey, versionID)
+}
+
+// downloadVersion is downloadLogicalObject for the given version of the object,
+// or for its current version if versionID is "". Versions are always
+// downloaded directly, in a single request.
+func (c *Controller) downloadVersion(ctx context.Context, objectKey string, dc string, versionID string) ([]byte, error) {
+	if versionID == "" {
+		return c.downloadLogicalObject(ctx, objectKey, dc)
+	}
+	var stored []byte
+	err := withS3Retry(ctx, "download of version "+versionID+" of "+objectKey+" from "+dc, func() error {
+		if err := c.requests.acquire(ctx, dc); err != nil {
+			return err
+		}
+		defer c.requests.release(dc)
+		body, err := c.openVersion(ctx, objectKey, dc, versionID)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		stored, err = io.ReadAll(body)
+		return err
+	})
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	mDownloadedBytes.WithLabelValues(dc).Add(float64(len(stored)))
+	countTransfer(ctx, len(stored))
+	return c.decodeStored(ctx, stored)
+}
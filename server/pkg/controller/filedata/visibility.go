@@ -0,0 +1,64 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultReadAfterWriteRetries = 3
+	defaultReadAfterWriteDelay   = 200 * time.Millisecond
+)
+
+// awaitVisible calls read, which reads back an object that has just been
+// written to dc, until it stops failing because the object can't be found.
+//
+// Stores that are only eventually consistent may not find an object right after
+// it has been written, so read is retried up to
+// replication.file-data.read-after-write.retries times, waiting
+// read-after-write.delay before the first retry and twice as long before each
+// further one. An object that is still not found after that is taken to be
+// truly missing, and the returned error is then an objectstore.ErrNotFound.
+// Reads that only succeed after a retry are logged, since they tell how
+// consistent the store is.
+func awaitVisible(ctx context.Context, op string, dc string, read func() error) error {
+	retries := defaultReadAfterWriteRetries
+	if viper.IsSet("replication.file-data.read-after-write.retries") {
+		retries = viper.GetInt("replication.file-data.read-after-write.retries")
+	}
+	delay := viper.GetDuration("replication.file-data.read-after-write.delay")
+	if delay <= 0 {
+		delay = defaultReadAfterWriteDelay
+	}
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := read()
+		if !errors.Is(err, objectstore.ErrNotFound) && !errors.Is(err, objectstore.ErrNotVisible) {
+			if attempt > 0 && err == nil {
+				mReadAfterWriteRetries.WithLabelValues(dc, "visible").Inc()
+				log.WithFields(log.Fields{
+					"bucket":   dc,
+					"retries":  attempt,
+					"duration": time.Since(start).Round(time.Millisecond),
+				}).Warnf("%s: the written object became visible only after retrying", op)
+			}
+			return err
+		}
+		if attempt >= retries {
+			if attempt > 0 {
+				mReadAfterWriteRetries.WithLabelValues(dc, "missing").Inc()
+			}
+			return fmt.Errorf("%s: written object not found after %d retries over %s: %w", op, attempt, time.Since(start).Round(time.Millisecond), objectstore.ErrNotFound)
+		}
+		if !sleepWithContext(ctx, delay) {
+			return err
+		}
+		delay *= 2
+	}
+}
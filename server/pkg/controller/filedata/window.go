@@ -0,0 +1,170 @@
+package filedata
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// replicationWindow is the time of day window configured in
+// replication.file-data.window.
+type replicationWindow struct {
+	start, end string
+	// startMinute and endMinute are the minutes since midnight
+	startMinute, endMinute int
+	loc                    *time.Location
+}
+
+// configuredWindow returns the replication window, or nil if none is
+// configured.
+func configuredWindow() (*replicationWindow, error) {
+	w := &replicationWindow{
+		start: viper.GetString("replication.file-data.window.start"),
+		end:   viper.GetString("replication.file-data.window.end"),
+	}
+	if w.start == "" && w.end == "" {
+		return nil, nil
+	}
+	var err error
+	if w.startMinute, err = parseTimeOfDay(w.start); err != nil {
+		return nil, stacktrace.Propagate(err, "invalid replication.file-data.window.start")
+	}
+	if w.endMinute, err = parseTimeOfDay(w.end); err != nil {
+		return nil, stacktrace.Propagate(err, "invalid replication.file-data.window.end")
+	}
+	if w.startMinute == w.endMinute {
+		return nil, stacktrace.NewError("replication.file-data.window.start and end are the same")
+	}
+	if w.loc, err = time.LoadLocation(viper.GetString("replication.file-data.window.timezone")); err != nil {
+		return nil, stacktrace.Propagate(err, "invalid replication.file-data.window.timezone")
+	}
+	return w, nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of a HH:MM time.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// openAt reports whether the window is open at t, and when it next opens or
+// closes. Windows that end before they start span midnight.
+func (w *replicationWindow) openAt(t time.Time) (bool, time.Time) {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	var open bool
+	if w.startMinute < w.endMinute {
+		open = minute >= w.startMinute && minute < w.endMinute
+	} else {
+		open = minute >= w.startMinute || minute < w.endMinute
+	}
+	changeMinute := w.startMinute
+	if open {
+		changeMinute = w.endMinute
+	}
+	next := time.Date(t.Year(), t.Month(), t.Day(), changeMinute/60, changeMinute%60, 0, 0, w.loc)
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, changeMinute/60, changeMinute%60, 0, 0, w.loc)
+	}
+	return open, next
+}
+
+// windowGate logs the changes of the replication window, and the problems with
+// its config, once each.
+type windowGate struct {
+	mu sync.Mutex
+	// open is the state of the window when last checked, nil if unknown
+	open    *bool
+	lastErr string
+}
+
+func (g *windowGate) noteError(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if msg := err.Error(); msg != g.lastErr {
+		g.lastErr = msg
+		log.WithError(err).Error("Ignoring the file data replication window")
+	}
+}
+
+func (g *windowGate) noteState(open bool, next time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lastErr = ""
+	if g.open != nil && *g.open == open {
+		return
+	}
+	g.open = &open
+	if open {
+		log.Infof("File data replication window is open, until %s", next.Format(time.RFC3339))
+	} else {
+		log.Infof("File data replication window is closed, only urgent rows are replicated until %s", next.Format(time.RFC3339))
+	}
+}
+
+// applyWindow limits the rows that the workers pick to the urgent ones while
+// the replication window is closed. Rows are urgent if they were updated within
+// replication.file-data.window.urgent-newer-than, or if they are of one of
+// window.urgent-types. It returns false if there are no urgent rows to look
+// for, in which case the workers should go idle.
+//
+// A window that is misconfigured is ignored, so that replication doesn't stop.
+func (c *Controller) applyWindow(filter fileDataRepo.PendingSyncFilter) (fileDataRepo.PendingSyncFilter, bool) {
+	w, err := configuredWindow()
+	if err != nil {
+		c.window.noteError(err)
+		return filter, true
+	}
+	if w == nil {
+		return filter, true
+	}
+	now := time.Now()
+	open, next := w.openAt(now)
+	c.window.noteState(open, next)
+	if open {
+		return filter, true
+	}
+	newerThan := viper.GetDuration("replication.file-data.window.urgent-newer-than")
+	for _, name := range viper.GetStringSlice("replication.file-data.window.urgent-types") {
+		filter.UrgentTypes = append(filter.UrgentTypes, ente.ObjectType(name))
+	}
+	if newerThan <= 0 && len(filter.UrgentTypes) == 0 {
+		return filter, false
+	}
+	filter.UrgentOnly = true
+	filter.UrgentSince = now.UnixMicro()
+	if newerThan > 0 {
+		filter.UrgentSince = now.Add(-newerThan).UnixMicro()
+	}
+	return filter, true
+}
+
+// getWindowStatus returns the state of the replication window, or nil if none
+// is configured or it is misconfigured.
+func (c *Controller) getWindowStatus() *filedata.ReplicationWindowStatus {
+	w, err := configuredWindow()
+	if err != nil {
+		c.window.noteError(err)
+		return nil
+	}
+	if w == nil {
+		return nil
+	}
+	open, next := w.openAt(time.Now())
+	return &filedata.ReplicationWindowStatus{
+		Start:      w.start,
+		End:        w.end,
+		Timezone:   w.loc.String(),
+		Open:       open,
+		NextChange: next.UnixMicro(),
+	}
+}
@@ -0,0 +1,150 @@
+package filedata
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type workBudgetCtxKey struct{}
+
+// workBudget is the context that the work on a locked row is done in. Like a
+// context with a timeout, it is done once its timeout has been spent, but its
+// clock is stopped while the work waits for the limits of the instance: for a
+// download slot (see downloadLimiter), a request slot (see requestLimiter) or
+// the bandwidth limit. The time spent queueing behind the other workers isn't
+// the row's doing, and on a busy instance it would otherwise use up the time
+// of rows whose transfer has hardly started.
+//
+// The waits never take the work past limit though, if it is set, so that work
+// done under a lock that isn't renewed is still abandoned before the lock
+// expires.
+type workBudget struct {
+	// Context is the parent, which the values are looked up in
+	context.Context
+	done       chan struct{}
+	stopParent func() bool
+	limit      time.Time
+
+	mu  sync.Mutex
+	err error
+	// deadline is when the budget runs out, if the clock isn't stopped
+	deadline time.Time
+	// remaining is what is left of the budget while the clock is stopped
+	remaining time.Duration
+	// waiting is the number of waits in progress, the clock is stopped while
+	// it is above 0
+	waiting int
+	timer   *time.Timer
+}
+
+// withWorkBudget returns a context that is done once timeout has been spent on
+// the work, not counting the waits for the limits of the instance, or once
+// limit has passed if it is positive, whichever comes first. Its Err is then
+// context.DeadlineExceeded, as for a context with a timeout.
+func withWorkBudget(parent context.Context, timeout time.Duration, limit time.Duration) (context.Context, context.CancelFunc) {
+	now := time.Now()
+	b := &workBudget{Context: parent, done: make(chan struct{}), deadline: now.Add(timeout)}
+	if limit > 0 {
+		b.limit = now.Add(limit)
+		if b.limit.Before(b.deadline) {
+			b.deadline = b.limit
+		}
+	}
+	b.mu.Lock()
+	b.timer = time.AfterFunc(time.Until(b.deadline), b.expire)
+	b.mu.Unlock()
+	b.stopParent = context.AfterFunc(parent, func() { b.finish(parent.Err()) })
+	return b, func() {
+		b.stopParent()
+		b.finish(context.Canceled)
+	}
+}
+
+func (b *workBudget) Deadline() (time.Time, bool) {
+	b.mu.Lock()
+	deadline, ok := b.deadline, true
+	if b.waiting > 0 {
+		deadline, ok = b.limit, !b.limit.IsZero()
+	}
+	b.mu.Unlock()
+	if parentDeadline, parentOk := b.Context.Deadline(); parentOk && (!ok || parentDeadline.Before(deadline)) {
+		return parentDeadline, true
+	}
+	return deadline, ok
+}
+
+func (b *workBudget) Done() <-chan struct{} {
+	return b.done
+}
+
+func (b *workBudget) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *workBudget) Value(key any) any {
+	if key == (workBudgetCtxKey{}) {
+		return b
+	}
+	return b.Context.Value(key)
+}
+
+func (b *workBudget) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return
+	}
+	b.err = err
+	b.timer.Stop()
+	close(b.done)
+}
+
+// expire is called by the timer. The timer may have been reset, or the clock
+// stopped, after it fired, in which case it is too early to give up.
+func (b *workBudget) expire() {
+	b.mu.Lock()
+	now := time.Now()
+	early := now.Before(b.deadline)
+	if b.waiting > 0 {
+		early = b.limit.IsZero() || now.Before(b.limit)
+	}
+	b.mu.Unlock()
+	if !early {
+		b.finish(context.DeadlineExceeded)
+	}
+}
+
+// waitOutsideBudget stops the clock of the work budget of ctx, if any, until
+// the returned function is called. It is called around the waits for the
+// limits of the instance.
+func waitOutsideBudget(ctx context.Context) func() {
+	b, ok := ctx.Value(workBudgetCtxKey{}).(*workBudget)
+	if !ok {
+		return func() {}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.waiting == 0 && b.err == nil {
+		b.remaining = time.Until(b.deadline)
+		b.timer.Stop()
+		if !b.limit.IsZero() {
+			b.timer.Reset(time.Until(b.limit))
+		}
+	}
+	b.waiting++
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.waiting--
+		if b.waiting == 0 && b.err == nil {
+			b.deadline = time.Now().Add(b.remaining)
+			if !b.limit.IsZero() && b.limit.Before(b.deadline) {
+				b.deadline = b.limit
+			}
+			b.timer.Reset(time.Until(b.deadline))
+		}
+	}
+}
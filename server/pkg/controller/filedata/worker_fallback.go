@@ -0,0 +1,170 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultWorkerFallbackThreshold = 5
+	defaultWorkerFallbackDuration  = 5 * time.Minute
+)
+
+// Ways in which a download through the worker can go.
+const (
+	workerOutcomeOK          = "ok"
+	workerOutcomeTransport   = "transport"
+	workerOutcomeNotFound    = "not_found"
+	workerOutcomeForbidden   = "forbidden"
+	workerOutcomeRateLimited = "rate_limited"
+	workerOutcomeBadGateway  = "bad_gateway"
+	workerOutcomeTimeout     = "timeout"
+	workerOutcomeServerError = "server_error"
+	workerOutcomeOther       = "other"
+)
+
+// workerOutcome classifies the response (or the failure to get one) of a call
+// to the worker, for the metrics and the logs.
+func workerOutcome(ctx context.Context, statusCode int, err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil && statusCode/100 == 2:
+		return workerOutcomeOK
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return workerOutcomeTimeout
+	case err != nil:
+		return workerOutcomeTransport
+	case statusCode == http.StatusNotFound:
+		return workerOutcomeNotFound
+	case statusCode == http.StatusForbidden:
+		return workerOutcomeForbidden
+	case statusCode == http.StatusTooManyRequests:
+		return workerOutcomeRateLimited
+	case statusCode == http.StatusBadGateway:
+		return workerOutcomeBadGateway
+	case statusCode == http.StatusGatewayTimeout:
+		return workerOutcomeTimeout
+	case statusCode >= 500:
+		return workerOutcomeServerError
+	default:
+		return workerOutcomeOther
+	}
+}
+
+// isWorkerFault reports whether an outcome points at the worker itself rather
+// than at the object being downloaded. Only these count towards the fallback.
+func isWorkerFault(outcome string) bool {
+	switch outcome {
+	case workerOutcomeTransport, workerOutcomeRateLimited, workerOutcomeBadGateway, workerOutcomeTimeout, workerOutcomeServerError:
+		return true
+	default:
+		return false
+	}
+}
+
+// workerFallback switches the downloads through the worker to direct ones for
+// a while after the worker has failed repeatedly.
+//
+// After replication.file-data.worker-fallback.threshold consecutive calls to
+// the worker have failed because of the worker (see isWorkerFault), the buckets
+// that are normally downloaded from through it are downloaded from directly
+// for worker-fallback.duration, after which the worker is tried again. Both
+// switches are logged, and notified to replication.file-data.alert.webhook-url
+// if it is set.
+type workerFallback struct {
+	mu                  sync.Mutex
+	consecutiveFailures int
+	// the downloads are direct until then, if it is in the future
+	until time.Time
+}
+
+// active reports whether downloads should skip the worker for now.
+func (f *workerFallback) active() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.until.IsZero() {
+		return false
+	}
+	if time.Now().Before(f.until) {
+		return true
+	}
+	f.until = time.Time{}
+	f.consecutiveFailures = 0
+	mWorkerFallbackActive.Set(0)
+	host, _ := os.Hostname()
+	notifyWorkerFallback(fmt.Sprintf(":white_check_mark: File data replication on %s is downloading through the worker again", host))
+	return false
+}
+
+// record updates the fallback with the outcome of a call to the worker.
+func (f *workerFallback) record(outcome string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !isWorkerFault(outcome) {
+		f.consecutiveFailures = 0
+		return
+	}
+	f.consecutiveFailures++
+	if !f.until.IsZero() || f.consecutiveFailures < workerFallbackThreshold() {
+		return
+	}
+	duration := workerFallbackDuration()
+	f.until = time.Now().Add(duration)
+	mWorkerFallbackActive.Set(1)
+	host, _ := os.Hostname()
+	notifyWorkerFallback(fmt.Sprintf(":warning: File data replication on %s is downloading directly instead of through the worker for %s, after %d consecutive worker failures (last: %s)",
+		host, duration, f.consecutiveFailures, outcome))
+}
+
+// notifyWorkerFallback logs text, and posts it to the alert webhook in the
+// background.
+func notifyWorkerFallback(text string) {
+	log.Warn(text)
+	url := viper.GetString("replication.file-data.alert.webhook-url")
+	if url == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := postAlert(ctx, &http.Client{}, url, text); err != nil {
+			log.WithError(err).Error("Could not send worker fallback alert")
+		}
+	}()
+}
+
+func workerFallbackThreshold() int {
+	if n := viper.GetInt("replication.file-data.worker-fallback.threshold"); n > 0 {
+		return n
+	}
+	return defaultWorkerFallbackThreshold
+}
+
+func workerFallbackDuration() time.Duration {
+	if d := viper.GetDuration("replication.file-data.worker-fallback.duration"); d > 0 {
+		return d
+	}
+	return defaultWorkerFallbackDuration
+}
+
+// downloadOutcome classifies how a whole download went, for the metrics.
+func downloadOutcome(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return workerOutcomeOK
+	case errors.Is(err, objectstore.ErrNotFound):
+		return workerOutcomeNotFound
+	default:
+		return string(replicationErrorClass(ctx, err))
+	}
+}
@@ -0,0 +1,105 @@
+package filedata
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// workerClient is used for the downloads made through the worker. The timeout
+// is left to the context of each download.
+var workerClient = &http.Client{}
+
+// viaWorker reports whether objects from bucketID should be downloaded through
+// replication.worker-url instead of directly, which is the case for the buckets
+// listed in replication.file-data.worker-buckets (e.g. those whose direct
+// egress is expensive). By default no bucket is, and all the downloads are
+// direct.
+func (c *Controller) viaWorker(bucketID string) bool {
+	if c.workerURL == "" || c.S3Config.AreLocalBuckets() {
+		return false
+	}
+	return array.StringInList(bucketID, viper.GetStringSlice("replication.file-data.worker-buckets"))
+}
+
+// openViaWorker starts downloading the object from bucketID through the
+// worker, which is given a presigned URL for the object to fetch. The caller
+// must close the returned body.
+//
+// A positive offset is asked for with a Range header, which the worker passes
+// on. If the worker ignores it, the body starts at offset 0.
+//
+// Failures are mapped to the errors that the object stores return, so that
+// they are retried and classified the same way as direct downloads. Each call
+// is also counted by outcome (see workerOutcome), and the failures of the
+// worker itself may make the downloads skip it for a while, see workerFallback.
+func (c *Controller) openViaWorker(ctx context.Context, objectKey string, bucketID string, offset int64) (rangeBody, error) {
+	signed, err := c.signedUrlGet(bucketID, objectKey)
+	if err != nil {
+		return rangeBody{}, stacktrace.Propagate(err, "could not presign %s in %s", objectKey, bucketID)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.workerURL, nil)
+	if err != nil {
+		return rangeBody{}, stacktrace.Propagate(err, "could not create request for worker %s", c.workerURL)
+	}
+	q := request.URL.Query()
+	q.Add("src", base64.StdEncoding.EncodeToString([]byte(signed.URL)))
+	request.URL.RawQuery = q.Encode()
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	response, err := workerClient.Do(request)
+	statusCode := 0
+	if err == nil {
+		statusCode = response.StatusCode
+	}
+	outcome := workerOutcome(ctx, statusCode, err)
+	mWorkerCalls.WithLabelValues(bucketID, outcome).Inc()
+	c.workerFallback.record(outcome)
+	if err != nil {
+		return rangeBody{}, fmt.Errorf("call to worker failed for %s: %w", objectKey, err)
+	}
+	info := objectstore.ObjectInfo{Size: response.ContentLength, ETag: response.Header.Get("ETag")}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return rangeBody{ReadCloser: response.Body, info: info}, nil
+	case http.StatusPartialContent:
+		if size, ok := objectstore.ContentRangeSize(response.Header.Get("Content-Range")); ok {
+			info.Size = size
+			return rangeBody{ReadCloser: response.Body, info: info, offset: offset}, nil
+		}
+	}
+	response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusNotFound:
+		return rangeBody{}, objectstore.ErrNotFound
+	case http.StatusForbidden:
+		return rangeBody{}, objectstore.ErrAccessDenied
+	case http.StatusPartialContent:
+		return rangeBody{}, fmt.Errorf("worker GET for %s returned a range without the object size", objectKey)
+	}
+	return rangeBody{}, awserr.NewRequestFailure(awserr.New(http.StatusText(response.StatusCode),
+		fmt.Sprintf("worker GET for %s failed with HTTP status %s", objectKey, response.Status), nil), response.StatusCode, "")
+}
+
+// logDownloadPaths logs, when replication starts, which buckets are
+// downloaded from through the worker.
+func (c *Controller) logDownloadPaths() {
+	buckets := viper.GetStringSlice("replication.file-data.worker-buckets")
+	if len(buckets) == 0 {
+		return
+	}
+	if c.workerURL == "" {
+		log.Warnf("replication.worker-url is not defined, downloading from %v directly instead of through the worker", buckets)
+		return
+	}
+	log.Infof("File data will be downloaded from %v through the worker, and from other buckets directly", buckets)
+}
@@ -0,0 +1,64 @@
+package filedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ente-io/museum/ente/filedata"
+	fileDataRepo "github.com/ente-io/museum/pkg/repo/filedata"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
+	"github.com/ente-io/stacktrace"
+	log "github.com/sirupsen/logrus"
+)
+
+// existingImmutableCopy checks the copy of the object that is already in dc if
+// dc is a bucket with object lock (s3.<dc>.object-lock), where it can't be
+// overwritten. It returns true if there is such a copy and its logical contents
+// have the given checksum, false if there is none (or dc isn't object locked),
+// and an ErrIntegrity if there is one with other contents, which the upload
+// can't replace. Like the other failures of a destination, it is retried until
+// the row runs out of attempts, in case the copy is removed meanwhile.
+//
+// Copies in buckets that can't be read back because of their storage class are
+// only checked to be there, like verifyReplica does.
+func (c *Controller) existingImmutableCopy(ctx context.Context, objectKey string, dc string, checksum string) (bool, error) {
+	if !c.S3Config.IsObjectLocked(dc) {
+		return false, nil
+	}
+	_, _, err := c.headObject(ctx, objectKey, dc)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to look for %s in object locked bucket %s", objectKey, dc)
+	}
+	logger := log.WithField("object", objectKey).WithField("bucket", dc)
+	if !c.S3Config.IsReadable(dc) {
+		logger.Info("Object is already in object locked bucket, not overwriting it")
+		return true, nil
+	}
+	data, err := c.downloadLogicalObject(ctx, objectKey, dc)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to read %s from object locked bucket %s", objectKey, dc)
+	}
+	if got := checksumOf(data); got != checksum {
+		mImmutableMismatches.WithLabelValues(dc).Inc()
+		return false, fmt.Errorf("object locked bucket %s already has %s with checksum %s instead of %s, and it can't be overwritten: %w", dc, objectKey, got, checksum, ErrIntegrity)
+	}
+	logger.Info("Object is already in object locked bucket, not overwriting it")
+	return true, nil
+}
+
+// recordImmutableCopy records dc as replicated for the row, whose metadata
+// object was found to already be in dc by existingImmutableCopy.
+func (c *Controller) recordImmutableCopy(ctx context.Context, row filedata.Row, dc string) error {
+	if err := c.Repo.SetBucketCompressed(ctx, row, dc, c.S3Config.IsCompressedBucket(dc)); err != nil {
+		return err
+	}
+	if err := c.Repo.MoveBetweenBuckets(ctx, row, dc, fileDataRepo.InflightRepColumn, fileDataRepo.ReplicationColumn); err != nil {
+		return err
+	}
+	mReplicatedObjects.WithLabelValues(string(row.Type), dc).Inc()
+	return nil
+}
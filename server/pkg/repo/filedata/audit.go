@@ -0,0 +1,50 @@
+package filedata
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// objectPrefixExpr is filedata.BasePrefix of a row, it must match the
+// expression of idx_file_data_object_prefix.
+const objectPrefixExpr = `(user_id::text || '/file-data/' || file_id::text || '/') COLLATE "C"`
+
+// PrefixRange is a range of object prefixes (see filedata.BasePrefix). An empty
+// To leaves the range open ended.
+type PrefixRange struct {
+	From          string
+	FromInclusive bool
+	To            string
+	ToInclusive   bool
+}
+
+// GetLiveRowsInBucket returns up to limit live rows of the type whose object
+// prefix is within the range, and which are recorded as being in bucketID
+// (either as their latest bucket, or as a replica). They are ordered by their
+// object prefix, which is the order in which buckets list their objects.
+func (r *Repository) GetLiveRowsInBucket(ctx context.Context, oType ente.ObjectType, bucketID string, prefixes PrefixRange, limit int) ([]filedata.Row, error) {
+	fromOp, toOp := ">", "<"
+	if prefixes.FromInclusive {
+		fromOp = ">="
+	}
+	if prefixes.ToInclusive {
+		toOp = "<="
+	}
+	query := fmt.Sprintf(`SELECT `+rowColumns+`
+		FROM file_data
+		WHERE data_type = $1 AND is_deleted = false
+		AND (latest_bucket = $2 OR $2 = ANY(replicated_buckets))
+		AND %[1]s %[2]s $3
+		AND ($4 = '' OR %[1]s %[3]s $4)
+		ORDER BY %[1]s
+		LIMIT $5`, objectPrefixExpr, fromOp, toOp)
+	rows, err := r.DB.QueryContext(ctx, query, string(oType), bucketID, prefixes.From, prefixes.To, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return convertRowsToFilesData(rows)
+}
@@ -0,0 +1,163 @@
+package filedata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+const (
+	BackfillRunning   = "running"
+	BackfillCompleted = "completed"
+)
+
+const backfillColumns = `id, data_type, bucket, status, last_file_id, total, scanned, requeued, created_after, created_at, updated_at`
+
+func scanBackfill(s rowScanner) (filedata.BackfillJob, error) {
+	var job filedata.BackfillJob
+	err := s.Scan(&job.ID, &job.Type, &job.Bucket, &job.Status, &job.LastFileID, &job.Total, &job.Scanned, &job.Requeued, &job.CreatedAfter, &job.CreatedAt, &job.UpdatedAt)
+	return job, err
+}
+
+// CreateBackfill creates a backfill job for copying the rows of oType to
+// bucketID, only those created after createdAfter (epoch microseconds) if it is
+// positive. It fails with a conflict if such a job is already running.
+func (r *Repository) CreateBackfill(ctx context.Context, oType ente.ObjectType, bucketID string, createdAfter int64) (*filedata.BackfillJob, error) {
+	row := r.DB.QueryRowContext(ctx, `INSERT INTO file_data_backfill (data_type, bucket, created_after, total)
+		VALUES ($1, $2, $3, (SELECT COUNT(*) FROM file_data WHERE data_type = $1 AND is_deleted = false AND ($3::bigint <= 0 OR created_at > $3)))
+		RETURNING `+backfillColumns, string(oType), bucketID, createdAfter)
+	job, err := scanBackfill(row)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, stacktrace.Propagate(ente.NewConflictError("a backfill for this type and bucket is already running"), "")
+		}
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &job, nil
+}
+
+// GetBackfills returns all the backfill jobs, the most recent first.
+func (r *Repository) GetBackfills(ctx context.Context) ([]filedata.BackfillJob, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+backfillColumns+` FROM file_data_backfill ORDER BY id DESC`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	jobs := make([]filedata.BackfillJob, 0)
+	for rows.Next() {
+		job, err := scanBackfill(rows)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return jobs, nil
+}
+
+// GetRunningBackfillIDs returns the IDs of the backfill jobs that still have
+// rows left to re-queue.
+func (r *Repository) GetRunningBackfillIDs(ctx context.Context) ([]int64, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT id FROM file_data_backfill WHERE status = $1 ORDER BY id`, BackfillRunning)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return ids, nil
+}
+
+// RunBackfillBatch re-queues the next batchSize rows of the backfill job, and
+// records the progress in the same transaction so that an interrupted job
+// resumes exactly where it stopped.
+//
+// Only rows that are not already pending sync, and that are not in the job's
+// bucket already, as their latest bucket or as a replica, are re-queued, and
+// of those only the ones created after the job's cutoff, if it has one. The
+// job is marked as completed once there are no more rows.
+//
+// It returns nil, without doing anything, if the job is being run by another
+// instance at the moment.
+func (r *Repository) RunBackfillBatch(ctx context.Context, id int64, batchSize int) (*filedata.BackfillJob, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer tx.Rollback()
+	job, err := scanBackfill(tx.QueryRowContext(ctx, `SELECT `+backfillColumns+`
+		FROM file_data_backfill WHERE id = $1 FOR UPDATE SKIP LOCKED`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	if job.Status != BackfillRunning {
+		return &job, nil
+	}
+	var scanned, requeued, lastFileID int64
+	err = tx.QueryRowContext(ctx, `WITH batch AS (
+			SELECT file_id FROM file_data
+			WHERE data_type = $1 AND file_id > $2 AND is_deleted = false AND ($5::bigint <= 0 OR created_at > $5)
+			ORDER BY file_id
+			LIMIT $4
+		), requeued AS (
+			UPDATE file_data SET pending_sync = true, attempt_count = 0, is_dead_lettered = false
+			FROM batch
+			WHERE file_data.file_id = batch.file_id AND file_data.data_type = $1
+			AND file_data.pending_sync = false AND file_data.latest_bucket != $3::s3region
+			AND NOT ($3::s3region = ANY(file_data.replicated_buckets))
+			RETURNING 1
+		)
+		SELECT (SELECT COUNT(*) FROM batch), (SELECT COUNT(*) FROM requeued), COALESCE((SELECT MAX(file_id) FROM batch), $2)`,
+		string(job.Type), job.LastFileID, job.Bucket, batchSize, job.CreatedAfter).Scan(&scanned, &requeued, &lastFileID)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	status := BackfillRunning
+	if scanned < int64(batchSize) {
+		status = BackfillCompleted
+	}
+	job, err = scanBackfill(tx.QueryRowContext(ctx, `UPDATE file_data_backfill SET
+			status = $2, last_file_id = $3, scanned = scanned + $4, requeued = requeued + $5, updated_at = now_utc_micro_seconds()
+		WHERE id = $1
+		RETURNING `+backfillColumns, id, status, lastFileID, scanned, requeued))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &job, nil
+}
+
+// CountPendingSync returns the number of live rows that are pending sync, but
+// counts no further than limit.
+func (r *Repository) CountPendingSync(ctx context.Context, limit int) (int, error) {
+	var count int
+	err := r.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM (
+			SELECT 1 FROM file_data WHERE pending_sync = true AND is_deleted = false AND is_dead_lettered = false LIMIT $1
+		) AS pending`, limit).Scan(&count)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return count, nil
+}
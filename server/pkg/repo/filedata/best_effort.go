@@ -0,0 +1,45 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// missingBestEffortCondition matches the live rows of type $1 that are done
+// replicating but are not in bucket $2. The bucket is wanted by the rows
+// without a replica override if $3 is true, and by the rows whose override
+// lists it.
+const missingBestEffortCondition = `data_type = $1 AND pending_sync = false AND is_deleted = false
+	AND latest_bucket <> $2 AND NOT ($2 = ANY(replicated_buckets))
+	AND ((replica_buckets_override IS NULL AND $3) OR $2 = ANY(replica_buckets_override))`
+
+// GetRowsMissingBestEffortBucket returns up to limit rows of the type, with a
+// file ID greater than afterFileID, that are done replicating to their other
+// buckets but not to bucketID (a best-effort bucket), in the order of their
+// file IDs. isReplica tells whether bucketID is one of the replicas configured
+// for the type.
+func (r *Repository) GetRowsMissingBestEffortBucket(ctx context.Context, oType ente.ObjectType, bucketID string, isReplica bool, afterFileID int64, limit int) ([]filedata.Row, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+rowColumns+` FROM file_data
+		WHERE `+missingBestEffortCondition+` AND file_id > $4
+		ORDER BY file_id
+		LIMIT $5`, string(oType), bucketID, isReplica, afterFileID, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return convertRowsToFilesData(rows)
+}
+
+// CountRowsMissingBestEffortBucket returns the number of rows that
+// GetRowsMissingBestEffortBucket would go through.
+func (r *Repository) CountRowsMissingBestEffortBucket(ctx context.Context, oType ente.ObjectType, bucketID string, isReplica bool) (int64, error) {
+	var count int64
+	err := r.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM file_data WHERE `+missingBestEffortCondition,
+		string(oType), bucketID, isReplica).Scan(&count)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return count, nil
+}
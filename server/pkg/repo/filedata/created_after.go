@@ -0,0 +1,52 @@
+package filedata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/ente-io/stacktrace"
+)
+
+// SetReplicationCreatedAfter records that replication is limited to the rows
+// created after createdAfter (epoch microseconds), or that it isn't limited if
+// createdAfter is 0.
+func (r *Repository) SetReplicationCreatedAfter(ctx context.Context, createdAfter int64) error {
+	var err error
+	if createdAfter == 0 {
+		_, err = r.DB.ExecContext(ctx, `DELETE FROM file_data_replication_created_after`)
+	} else {
+		_, err = r.DB.ExecContext(ctx, `INSERT INTO file_data_replication_created_after (id, created_after) VALUES (true, $1)
+			ON CONFLICT (id) DO UPDATE SET created_after = EXCLUDED.created_after`, createdAfter)
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
+
+// GetReplicationCreatedAfter returns the cutoff (epoch microseconds) that
+// replication is limited to, or 0 if it isn't.
+func (r *Repository) GetReplicationCreatedAfter(ctx context.Context) (int64, error) {
+	var createdAfter int64
+	err := r.DB.QueryRowContext(ctx, `SELECT created_after FROM file_data_replication_created_after`).Scan(&createdAfter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return createdAfter, nil
+}
+
+// CountPendingCreatedAfter returns the number of live rows that are pending
+// replication, and were created after createdAfter (epoch microseconds).
+func (r *Repository) CountPendingCreatedAfter(ctx context.Context, createdAfter int64) (int64, error) {
+	var count int64
+	err := r.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM file_data
+		WHERE pending_sync = true AND is_deleted = false AND is_dead_lettered = false AND created_at > $1`, createdAfter).Scan(&count)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return count, nil
+}
@@ -0,0 +1,59 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// DisableBucket pauses replication to the bucket till disabledUntil, replacing
+// any earlier expiry.
+func (r *Repository) DisableBucket(ctx context.Context, bucketID string, disabledUntil int64, reason string) (*filedata.DisabledBucket, error) {
+	var d filedata.DisabledBucket
+	err := r.DB.QueryRowContext(ctx, `INSERT INTO file_data_disabled_buckets (bucket, disabled_until, reason)
+		VALUES ($1, $2, NULLIF($3, ''))
+		ON CONFLICT (bucket) DO UPDATE SET disabled_until = EXCLUDED.disabled_until, reason = EXCLUDED.reason
+		RETURNING bucket, disabled_until, reason, created_at`, bucketID, disabledUntil, reason).
+		Scan(&d.Bucket, &d.DisabledUntil, &d.Reason, &d.CreatedAt)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &d, nil
+}
+
+// EnableBucket resumes replication to the bucket.
+func (r *Repository) EnableBucket(ctx context.Context, bucketID string) error {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM file_data_disabled_buckets WHERE bucket = $1`, bucketID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
+
+// GetDisabledBuckets returns the buckets that are currently disabled. Expired
+// entries are removed along the way.
+func (r *Repository) GetDisabledBuckets(ctx context.Context) ([]filedata.DisabledBucket, error) {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM file_data_disabled_buckets WHERE disabled_until <= now_utc_micro_seconds()`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	rows, err := r.DB.QueryContext(ctx, `SELECT bucket, disabled_until, reason, created_at FROM file_data_disabled_buckets
+		WHERE disabled_until > now_utc_micro_seconds() ORDER BY bucket`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	buckets := make([]filedata.DisabledBucket, 0)
+	for rows.Next() {
+		var d filedata.DisabledBucket
+		if err := rows.Scan(&d.Bucket, &d.DisabledUntil, &d.Reason, &d.CreatedAt); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		buckets = append(buckets, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return buckets, nil
+}
@@ -0,0 +1,206 @@
+package filedata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+const (
+	DrainRunning   = "running"
+	DrainCompleted = "completed"
+)
+
+const drainColumns = `id, bucket, status, last_file_id, last_type, total, drained, requeued, unconfirmed, remaining, passes, created_at, updated_at`
+
+// DrainBatch is the outcome of a batch of a drain job.
+type DrainBatch struct {
+	// LastFileID and LastType are the position of the last row of the batch
+	LastFileID int64
+	LastType   ente.ObjectType
+	Drained    int64
+	Requeued   int64
+	// Unconfirmed is the number of rows of the batch that the bucket was left
+	// in because their copies couldn't be confirmed in the other buckets
+	Unconfirmed int64
+	// PassEnded is true if the batch reached the last row listing the bucket,
+	// Remaining then being the number of rows still listing it
+	PassEnded bool
+	Remaining int64
+}
+
+func scanDrain(s rowScanner) (filedata.DrainJob, error) {
+	var job filedata.DrainJob
+	err := s.Scan(&job.ID, &job.Bucket, &job.Status, &job.LastFileID, &job.LastType, &job.Total, &job.Drained, &job.Requeued,
+		&job.Unconfirmed, &job.Remaining, &job.Passes, &job.CreatedAt, &job.UpdatedAt)
+	return job, err
+}
+
+// CreateDrain creates a job for moving all the file data off bucketID. It fails
+// with a conflict if a drain of the bucket is already running.
+func (r *Repository) CreateDrain(ctx context.Context, bucketID string) (*filedata.DrainJob, error) {
+	row := r.DB.QueryRowContext(ctx, `INSERT INTO file_data_drain (bucket, total, remaining)
+		SELECT $1, COUNT(*), COUNT(*) FROM file_data
+		WHERE is_deleted = false AND (latest_bucket = $1 OR $1 = ANY(replicated_buckets))
+		RETURNING `+drainColumns, bucketID)
+	job, err := scanDrain(row)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, stacktrace.Propagate(ente.NewConflictError("a drain of this bucket is already running"), "")
+		}
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &job, nil
+}
+
+// GetDrains returns all the drain jobs, the most recent first.
+func (r *Repository) GetDrains(ctx context.Context) ([]filedata.DrainJob, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+drainColumns+` FROM file_data_drain ORDER BY id DESC`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	jobs := make([]filedata.DrainJob, 0)
+	for rows.Next() {
+		job, err := scanDrain(rows)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return jobs, nil
+}
+
+// GetRunningDrainIDs returns the IDs of the drain jobs that are not completed.
+func (r *Repository) GetRunningDrainIDs(ctx context.Context) ([]int64, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT id FROM file_data_drain WHERE status = $1 ORDER BY id`, DrainRunning)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return ids, nil
+}
+
+// ClaimDrain holds the running drain job till lockTill (epoch microseconds),
+// so that a single instance runs its next batch.
+//
+// It returns nil, without doing anything, if the job is being run by another
+// instance at the moment, or is no longer running.
+func (r *Repository) ClaimDrain(ctx context.Context, id int64, lockTill int64) (*filedata.DrainJob, error) {
+	job, err := scanDrain(r.DB.QueryRowContext(ctx, `UPDATE file_data_drain SET locked_till = $2
+		WHERE id = $1 AND status = $3 AND locked_till < now_utc_micro_seconds()
+		RETURNING `+drainColumns, id, lockTill, DrainRunning))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &job, nil
+}
+
+// FinishDrainBatch records the outcome of a batch of the drain job claimed till
+// lockTill, and releases the job.
+//
+// Once a pass ends, the next one starts again from the first row. The job is
+// completed when a pass ends with no row listing the bucket anymore. The
+// unconfirmed rows are counted afresh by each pass.
+func (r *Repository) FinishDrainBatch(ctx context.Context, id int64, lockTill int64, batch DrainBatch) (*filedata.DrainJob, error) {
+	job, err := scanDrain(r.DB.QueryRowContext(ctx, `UPDATE file_data_drain SET
+			status = CASE WHEN $7 AND $8 = 0 THEN $10 ELSE status END,
+			last_file_id = CASE WHEN $7 THEN 0 ELSE $3 END,
+			last_type = CASE WHEN $7 THEN '' ELSE $4 END,
+			drained = drained + $5,
+			requeued = requeued + $6,
+			unconfirmed = CASE WHEN last_file_id = 0 AND last_type = '' THEN $9 ELSE unconfirmed + $9 END,
+			remaining = CASE WHEN $7 THEN $8 ELSE remaining END,
+			passes = passes + CASE WHEN $7 THEN 1 ELSE 0 END,
+			locked_till = 0,
+			updated_at = now_utc_micro_seconds()
+		WHERE id = $1 AND locked_till = $2
+		RETURNING `+drainColumns, id, lockTill, batch.LastFileID, string(batch.LastType), batch.Drained, batch.Requeued,
+		batch.PassEnded, batch.Remaining, batch.Unconfirmed, DrainCompleted))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, stacktrace.Propagate(ErrLockLost, "drain %d is no longer held", id)
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &job, nil
+}
+
+// GetRowsListingBucket returns up to limit live rows that list bucketID as
+// their latest bucket or as a replica, and that come after the given
+// (file_id, data_type) position, in that order. Passing 0 and "" starts from
+// the beginning.
+func (r *Repository) GetRowsListingBucket(ctx context.Context, bucketID string, afterFileID int64, afterType ente.ObjectType, limit int) ([]filedata.Row, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+rowColumns+`
+		FROM file_data
+		WHERE is_deleted = false AND (latest_bucket = $1 OR $1 = ANY(replicated_buckets))
+		AND (file_id, data_type::text) > ($2, $3)
+		ORDER BY file_id, data_type::text
+		LIMIT $4`, bucketID, afterFileID, string(afterType), limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return convertRowsToFilesData(rows)
+}
+
+// CountRowsListingBucket returns the number of live rows that list bucketID as
+// their latest bucket or as a replica.
+func (r *Repository) CountRowsListingBucket(ctx context.Context, bucketID string) (int64, error) {
+	var count int64
+	err := r.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM file_data
+		WHERE is_deleted = false AND (latest_bucket = $1 OR $1 = ANY(replicated_buckets))`, bucketID).Scan(&count)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return count, nil
+}
+
+// RemoveDrainedBucket removes bucketID from the row, along with the record of
+// what is stored in it, and makes latestBucket (which must be the bucket it
+// already was, or one of the replicated buckets) the row's latest bucket. The
+// objects in bucketID are left as they are.
+func (r *Repository) RemoveDrainedBucket(ctx context.Context, row filedata.Row, bucketID string, latestBucket string) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data SET
+			latest_bucket = $2,
+			replicated_buckets = array_remove(array_remove(replicated_buckets, $1), $2),
+			inflight_rep_buckets = array_remove(inflight_rep_buckets, $1),
+			compressed_buckets = array_remove(compressed_buckets, $1),
+			replicated_side_objects = array(SELECT e FROM unnest(replicated_side_objects) AS e WHERE NOT starts_with(e, $1::text || ':')),
+			replica_versions = array(SELECT e FROM unnest(replica_versions) AS e WHERE NOT starts_with(e, $1::text || ':'))
+		WHERE file_id = $3 AND data_type = $4 AND user_id = $5 AND is_deleted = false AND lock_token IS NOT DISTINCT FROM $6`,
+		bucketID, latestBucket, row.FileID, string(row.Type), row.UserID, row.LockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.Propagate(ErrLockLost, "bucket %s not removed", bucketID)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+// UpsertDryRunReport records what replication would do for the row.
+func (r *Repository) UpsertDryRunReport(ctx context.Context, row filedata.Row, sourceBucket string, missingBuckets []string) error {
+	_, err := r.DB.ExecContext(ctx, `INSERT INTO file_data_dry_run_report
+		(file_id, data_type, user_id, source_bucket, missing_buckets, size, row_updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (file_id, data_type) DO UPDATE SET
+			source_bucket = EXCLUDED.source_bucket,
+			missing_buckets = EXCLUDED.missing_buckets,
+			size = EXCLUDED.size,
+			row_updated_at = EXCLUDED.row_updated_at,
+			created_at = now_utc_micro_seconds()`,
+		row.FileID, string(row.Type), row.UserID, sourceBucket, pq.Array(missingBuckets), row.Size, row.UpdatedAt)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to record dry run report")
+	}
+	return nil
+}
+
+// GetDryRunSummary aggregates the dry run report per object type and missing
+// bucket.
+func (r *Repository) GetDryRunSummary(ctx context.Context) ([]filedata.DryRunDiscrepancy, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT data_type, bucket, COUNT(*), COALESCE(SUM(size), 0)
+		FROM file_data_dry_run_report, unnest(missing_buckets) AS bucket
+		GROUP BY data_type, bucket
+		ORDER BY data_type, bucket`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	result := make([]filedata.DryRunDiscrepancy, 0)
+	for rows.Next() {
+		var d filedata.DryRunDiscrepancy
+		if err := rows.Scan(&d.Type, &d.Bucket, &d.Rows, &d.Bytes); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		result = append(result, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return result, nil
+}
+
+// ClearDryRunReport removes all the entries from the dry run report, so that
+// the next dry run scans all the pending rows again.
+func (r *Repository) ClearDryRunReport(ctx context.Context) error {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM file_data_dry_run_report`)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package filedata
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+// MarkReplicationAsDoneWithEvent is MarkReplicationAsDone, but additionally
+// records a replication event for the row in the outbox, in the same
+// transaction, so that the event is emitted if and only if the row is marked as
+// replicated.
+func (r *Repository) MarkReplicationAsDoneWithEvent(ctx context.Context, row filedata.Row, buckets []string) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, markReplicationAsDoneQuery, row.FileID, string(row.Type), row.UserID, row.LockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	// Either the row was deleted meanwhile, and there is nothing to announce,
+	// or the lock was lost
+	if rowsAffected == 0 {
+		return checkLockHeld(ctx, tx, row)
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO file_data_replication_events (file_id, data_type, user_id, size, buckets)
+		VALUES ($1, $2, $3, $4, $5)`, row.FileID, string(row.Type), row.UserID, row.Size, pq.Array(buckets))
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to record replication event")
+	}
+	if err := tx.Commit(); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
+
+// ClaimPendingEvents claims up to limit unpublished events, oldest first, till
+// claimTill (epoch microseconds), and returns them.
+//
+// The claim is committed before the events are returned, so that they can be
+// published without holding a transaction open, and concurrent callers (e.g.
+// other instances) each get different events. Events whose claim has expired
+// without them being published can be claimed again.
+func (r *Repository) ClaimPendingEvents(ctx context.Context, limit int, claimTill int64) ([]filedata.ReplicationEvent, error) {
+	rows, err := r.DB.QueryContext(ctx, `UPDATE file_data_replication_events SET claimed_till = $2
+		WHERE id IN (
+			SELECT id FROM file_data_replication_events
+			WHERE published_at IS NULL AND claimed_till < now_utc_micro_seconds()
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, file_id, data_type, user_id, size, buckets, replicated_at`, limit, claimTill)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	var events []filedata.ReplicationEvent
+	for rows.Next() {
+		var e filedata.ReplicationEvent
+		if err := rows.Scan(&e.ID, &e.FileID, &e.Type, &e.UserID, &e.Size, pq.Array(&e.Buckets), &e.ReplicatedAt); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	// RETURNING doesn't follow the order of the subquery
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// FinishClaimedEvents records the outcome of publishing the events claimed till
+// claimTill: the published ones are marked as such, and the failed ones are
+// released to be retried. The failures of events that have meanwhile been
+// claimed again are left for their new claimant to record.
+func (r *Repository) FinishClaimedEvents(ctx context.Context, claimTill int64, published []int64, failed []int64) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	defer tx.Rollback()
+	if len(published) > 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE file_data_replication_events
+			SET published_at = now_utc_micro_seconds(), attempts = attempts + 1, claimed_till = 0
+			WHERE id = ANY($1) AND published_at IS NULL`, pq.Array(published))
+		if err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+	}
+	if len(failed) > 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE file_data_replication_events
+			SET attempts = attempts + 1, claimed_till = 0
+			WHERE id = ANY($1) AND claimed_till = $2`, pq.Array(failed), claimTill)
+		if err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
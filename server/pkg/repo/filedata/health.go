@@ -0,0 +1,41 @@
+package filedata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+// pendingIn is the buckets that a row of type $1 is still to be replicated to,
+// given the primary bucket $2 and the buckets $3 that the rows of the type are
+// wanted in, which a replica override replaces but for the primary bucket.
+const pendingIn = `SELECT 1 FROM unnest(CASE WHEN replica_buckets_override IS NULL THEN $3::text[]
+		ELSE array_append(replica_buckets_override::text[], $2::text) END) AS b
+		WHERE b != latest_bucket::text AND NOT b = ANY(replicated_buckets::text[])`
+
+// HasActionablePending reports whether there is a live row of the type that is
+// pending sync and that a worker could replicate right now. Rows that are
+// intentionally parked don't count: those held back after a failure (which
+// are locked without a heartbeat, see ReleaseSyncLock), those over maxSize if
+// it is positive, and those only pending for the parked buckets, e.g. the
+// buckets that are disabled or whose circuit is open.
+func (r *Repository) HasActionablePending(ctx context.Context, oType ente.ObjectType, primary string, wanted []string, parked []string, maxSize int64) (bool, error) {
+	var found int
+	err := r.DB.QueryRowContext(ctx, `SELECT 1 FROM file_data
+		WHERE pending_sync = true AND is_deleted = false AND is_dead_lettered = false AND data_type = $1
+		AND NOT (sync_locked_till > now_utc_micro_seconds() AND lock_heartbeat_at IS NULL)
+		AND ($5::bigint <= 0 OR size <= $5)
+		AND (cardinality($4::text[]) = 0 OR EXISTS (`+pendingIn+` AND NOT b = ANY($4::text[])) OR NOT EXISTS (`+pendingIn+`))
+		LIMIT 1`, string(oType), primary, pq.Array(wanted), pq.Array(parked), maxSize).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	return true, nil
+}
@@ -0,0 +1,63 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+// InsertReplicationHistory records the given completed replications.
+func (r *Repository) InsertReplicationHistory(ctx context.Context, records []filedata.ReplicationRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO file_data_replication_history
+		(file_id, data_type, source_bucket, dest_buckets, copied_buckets, bytes, duration_ms, attempts, replicated_at,
+		 route_sources, route_destinations, route_bytes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	defer stmt.Close()
+	for _, rec := range records {
+		sources := make([]string, len(rec.Routes))
+		destinations := make([]string, len(rec.Routes))
+		routeBytes := make([]int64, len(rec.Routes))
+		for i, route := range rec.Routes {
+			sources[i], destinations[i], routeBytes[i] = route.Source, route.Destination, route.Bytes
+		}
+		_, err := stmt.ExecContext(ctx, rec.FileID, string(rec.Type), rec.SourceBucket, pq.Array(rec.DestBuckets), pq.Array(rec.CopiedBuckets),
+			rec.Bytes, rec.DurationMs, rec.Attempts, rec.ReplicatedAt, pq.Array(sources), pq.Array(destinations), pq.Array(routeBytes))
+		if err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
+
+// PruneReplicationHistory deletes up to limit history rows of replications
+// that completed before the given time (epoch microseconds). It returns the
+// number of rows deleted.
+func (r *Repository) PruneReplicationHistory(ctx context.Context, before int64, limit int) (int64, error) {
+	res, err := r.DB.ExecContext(ctx, `DELETE FROM file_data_replication_history WHERE id IN (
+			SELECT id FROM file_data_replication_history WHERE replicated_at < $1 LIMIT $2
+		)`, before, limit)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return n, nil
+}
@@ -0,0 +1,67 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+// SetReplicaOverride makes the live row replicate to buckets instead of the
+// replica buckets configured for its type. The row is queued for replication,
+// so that it is copied to any of the buckets that it isn't in yet, and the
+// sync lock of whoever is replicating it right now is invalidated, since they
+// work towards the previous set of buckets.
+func (r *Repository) SetReplicaOverride(ctx context.Context, fileID int64, oType ente.ObjectType, buckets []string) error {
+	if buckets == nil {
+		buckets = []string{}
+	}
+	return r.updateReplicaOverride(ctx, fileID, oType, pq.Array(buckets))
+}
+
+// ClearReplicaOverride makes the live row replicate to the replica buckets
+// configured for its type again.
+func (r *Repository) ClearReplicaOverride(ctx context.Context, fileID int64, oType ente.ObjectType) error {
+	return r.updateReplicaOverride(ctx, fileID, oType, nil)
+}
+
+func (r *Repository) updateReplicaOverride(ctx context.Context, fileID int64, oType ente.ObjectType, buckets interface{}) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data SET replica_buckets_override = $3::s3region[], pending_sync = true, lock_token = NULL
+		WHERE file_id = $1 AND data_type = $2 AND is_deleted = false`, fileID, string(oType), buckets)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.Propagate(ente.ErrNotFound, "no file data for file %d and type %s", fileID, oType)
+	}
+	return nil
+}
+
+// GetReplicaOverrideBuckets returns the buckets that the live rows of the type
+// have been made to replicate to with SetReplicaOverride.
+func (r *Repository) GetReplicaOverrideBuckets(ctx context.Context, oType ente.ObjectType) ([]string, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT DISTINCT bucket::text
+		FROM file_data, unnest(replica_buckets_override) AS bucket
+		WHERE data_type = $1 AND replica_buckets_override IS NOT NULL AND is_deleted = false`, string(oType))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	var buckets []string
+	for rows.Next() {
+		var bucketID string
+		if err := rows.Scan(&bucketID); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		buckets = append(buckets, bucketID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return buckets, nil
+}
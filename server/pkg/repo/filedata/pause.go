@@ -0,0 +1,46 @@
+package filedata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/ente-io/stacktrace"
+)
+
+// PauseReplication records that replication is paused, and returns when
+// (epoch microseconds) it was paused, which is earlier than now if it already
+// was.
+func (r *Repository) PauseReplication(ctx context.Context) (int64, error) {
+	var pausedAt int64
+	err := r.DB.QueryRowContext(ctx, `INSERT INTO file_data_replication_pause (id) VALUES (true)
+		ON CONFLICT (id) DO UPDATE SET paused_at = file_data_replication_pause.paused_at
+		RETURNING paused_at`).Scan(&pausedAt)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return pausedAt, nil
+}
+
+// ResumeReplication records that replication is no longer paused.
+func (r *Repository) ResumeReplication(ctx context.Context) error {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM file_data_replication_pause`)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
+
+// GetReplicationPause returns when (epoch microseconds) replication was
+// paused, or nil if it isn't.
+func (r *Repository) GetReplicationPause(ctx context.Context) (*int64, error) {
+	var pausedAt int64
+	err := r.DB.QueryRowContext(ctx, `SELECT paused_at FROM file_data_replication_pause`).Scan(&pausedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &pausedAt, nil
+}
@@ -0,0 +1,54 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// ForEachPendingRow calls fn with the live rows that are pending replication,
+// pageSize at a time, in the order of their file IDs and types, until fn fails
+// or there are none left.
+//
+// Each page is read on its own, resuming after the last row of the previous
+// one (on the primary key), so that going through the rows takes a snapshot
+// per page rather than holding one, which would keep vacuum from cleaning up
+// after the rows replicated meanwhile, for as long as the report takes. A row
+// that is requeued or replicated while the pages are read may so be left out,
+// or be listed although it is no longer pending. Nothing is locked, so
+// replication carries on as usual meanwhile.
+func (r *Repository) ForEachPendingRow(ctx context.Context, pageSize int, fn func(rows []filedata.Row) error) error {
+	var last *filedata.Row
+	for {
+		query := `SELECT ` + rowColumns + ` FROM file_data
+			WHERE pending_sync = true AND is_deleted = false
+			ORDER BY file_id, data_type
+			LIMIT $1`
+		args := []interface{}{pageSize}
+		if last != nil {
+			query = `SELECT ` + rowColumns + ` FROM file_data
+				WHERE pending_sync = true AND is_deleted = false AND (file_id, data_type) > ($2, $3)
+				ORDER BY file_id, data_type
+				LIMIT $1`
+			args = append(args, last.FileID, string(last.Type))
+		}
+		rows, err := r.DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+		page, err := convertRowsToFilesData(rows)
+		if err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+		if len(page) > 0 {
+			if err := fn(page); err != nil {
+				return err
+			}
+			last = &page[len(page)-1]
+		}
+		if len(page) < pageSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package filedata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+const (
+	PromotionCheckRunning = "running"
+	PromotionCheckReady   = "ready"
+)
+
+const promotionCheckColumns = `id, data_type, bucket, status, last_file_id, total, requeued, waiting, unconfirmed, remaining, passes, created_at, updated_at`
+
+// notInBucket is the condition on the rows that aren't recorded in bucket $2.
+const notInBucket = `latest_bucket != $2 AND NOT ($2 = ANY(replicated_buckets) AND NOT $2 = ANY(inflight_rep_buckets))`
+
+// promotionGap is the condition on the live rows of type $1 that aren't
+// recorded in bucket $2.
+const promotionGap = `is_deleted = false AND data_type = $1 AND ` + notInBucket
+
+// PromotionCheckBatch is the outcome of a batch of a promotion check.
+type PromotionCheckBatch struct {
+	// LastFileID is the position of the last row of the batch
+	LastFileID  int64
+	Requeued    int64
+	Waiting     int64
+	Unconfirmed int64
+	// PassEnded is true if the batch reached the last row not in the bucket,
+	// Remaining then being the number of rows still not in it, of which
+	// Newer were written after the check was created
+	PassEnded bool
+	Remaining int64
+	Newer     int64
+}
+
+func scanPromotionCheck(s rowScanner) (filedata.PromotionCheck, error) {
+	var check filedata.PromotionCheck
+	err := s.Scan(&check.ID, &check.Type, &check.Bucket, &check.Status, &check.LastFileID, &check.Total, &check.Requeued,
+		&check.Waiting, &check.Unconfirmed, &check.Remaining, &check.Passes, &check.CreatedAt, &check.UpdatedAt)
+	check.Ready = check.Status == PromotionCheckReady
+	return check, err
+}
+
+// CreatePromotionCheck creates a check that all the live rows of the type are
+// in bucketID. It fails with a conflict if a check of the bucket for the type
+// is already running.
+func (r *Repository) CreatePromotionCheck(ctx context.Context, oType ente.ObjectType, bucketID string) (*filedata.PromotionCheck, error) {
+	row := r.DB.QueryRowContext(ctx, `INSERT INTO file_data_promotion_check (data_type, bucket, total, remaining)
+		SELECT $1, $2, COUNT(*), COUNT(*) FILTER (WHERE `+notInBucket+`) FROM file_data
+		WHERE is_deleted = false AND data_type = $1
+		RETURNING `+promotionCheckColumns, string(oType), bucketID)
+	check, err := scanPromotionCheck(row)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, stacktrace.Propagate(ente.NewConflictError("a check of this bucket is already running"), "")
+		}
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &check, nil
+}
+
+// GetPromotionChecks returns all the promotion checks, the most recent first.
+func (r *Repository) GetPromotionChecks(ctx context.Context) ([]filedata.PromotionCheck, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+promotionCheckColumns+` FROM file_data_promotion_check ORDER BY id DESC`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	checks := make([]filedata.PromotionCheck, 0)
+	for rows.Next() {
+		check, err := scanPromotionCheck(rows)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		checks = append(checks, check)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return checks, nil
+}
+
+// GetPromotionCheck returns the promotion check with the given ID, failing with
+// ErrNotFound if there is none.
+func (r *Repository) GetPromotionCheck(ctx context.Context, id int64) (*filedata.PromotionCheck, error) {
+	check, err := scanPromotionCheck(r.DB.QueryRowContext(ctx, `SELECT `+promotionCheckColumns+` FROM file_data_promotion_check WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, stacktrace.Propagate(ente.ErrNotFound, "promotion check %d not found", id)
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &check, nil
+}
+
+// GetRunningPromotionCheckIDs returns the IDs of the promotion checks that are
+// not ready yet.
+func (r *Repository) GetRunningPromotionCheckIDs(ctx context.Context) ([]int64, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT id FROM file_data_promotion_check WHERE status = $1 ORDER BY id`, PromotionCheckRunning)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return ids, nil
+}
+
+// ClaimPromotionCheck holds the running promotion check till lockTill (epoch
+// microseconds), so that a single instance runs its next batch.
+//
+// It returns nil, without doing anything, if the check is being run by another
+// instance at the moment, or is no longer running.
+func (r *Repository) ClaimPromotionCheck(ctx context.Context, id int64, lockTill int64) (*filedata.PromotionCheck, error) {
+	check, err := scanPromotionCheck(r.DB.QueryRowContext(ctx, `UPDATE file_data_promotion_check SET locked_till = $2
+		WHERE id = $1 AND status = $3 AND locked_till < now_utc_micro_seconds()
+		RETURNING `+promotionCheckColumns, id, lockTill, PromotionCheckRunning))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &check, nil
+}
+
+// FinishPromotionCheckBatch records the outcome of a batch of the promotion
+// check claimed till lockTill, and releases the check.
+//
+// Once a pass ends, the next one starts again from the first row. The check is
+// ready when a pass ends with no row left that isn't in the bucket. The waiting
+// and unconfirmed rows are counted afresh by each pass.
+func (r *Repository) FinishPromotionCheckBatch(ctx context.Context, id int64, lockTill int64, batch PromotionCheckBatch) (*filedata.PromotionCheck, error) {
+	check, err := scanPromotionCheck(r.DB.QueryRowContext(ctx, `UPDATE file_data_promotion_check SET
+			status = CASE WHEN $4 AND $5 = 0 THEN $9 ELSE status END,
+			last_file_id = CASE WHEN $4 THEN 0 ELSE $3 END,
+			requeued = requeued + $6,
+			waiting = CASE WHEN last_file_id = 0 THEN $7 ELSE waiting + $7 END,
+			unconfirmed = CASE WHEN last_file_id = 0 THEN $8 ELSE unconfirmed + $8 END,
+			remaining = CASE WHEN $4 THEN $5 ELSE remaining END,
+			passes = passes + CASE WHEN $4 THEN 1 ELSE 0 END,
+			locked_till = 0,
+			updated_at = now_utc_micro_seconds()
+		WHERE id = $1 AND locked_till = $2
+		RETURNING `+promotionCheckColumns, id, lockTill, batch.LastFileID, batch.PassEnded, batch.Remaining,
+		batch.Requeued, batch.Waiting, batch.Unconfirmed, PromotionCheckReady))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, stacktrace.Propagate(ErrLockLost, "promotion check %d is no longer held", id)
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return &check, nil
+}
+
+// GetPromotionGaps returns up to limit live rows of the type that aren't
+// recorded in bucketID, and come after the given file_id, in file_id order.
+// Passing 0 starts from the beginning. The rows written after the check was
+// created are included, since the bucket is only safe to promote once it has
+// those too.
+func (r *Repository) GetPromotionGaps(ctx context.Context, oType ente.ObjectType, bucketID string, afterFileID int64, limit int) ([]filedata.Row, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+rowColumns+`
+		FROM file_data
+		WHERE `+promotionGap+` AND file_id > $3
+		ORDER BY file_id
+		LIMIT $4`, string(oType), bucketID, afterFileID, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return convertRowsToFilesData(rows)
+}
+
+// CountPromotionGaps returns the number of live rows of the type that aren't
+// recorded in bucketID, and how many of them were last updated after
+// updatedAfter (epoch microseconds), i.e. written after the check was created.
+func (r *Repository) CountPromotionGaps(ctx context.Context, oType ente.ObjectType, bucketID string, updatedAfter int64) (count int64, newer int64, err error) {
+	err = r.DB.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(*) FILTER (WHERE updated_at > $3) FROM file_data WHERE `+promotionGap,
+		string(oType), bucketID, updatedAfter).Scan(&count, &newer)
+	if err != nil {
+		return 0, 0, stacktrace.Propagate(err, "")
+	}
+	return count, newer, nil
+}
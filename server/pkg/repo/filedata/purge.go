@@ -0,0 +1,26 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// GetRowsWithStaleCopies returns up to limit live rows of the type, with a file
+// ID greater than afterFileID, that are done replicating but still have copies
+// to be deleted from buckets that they were in before (e.g. from the previous
+// latest bucket, after a new version was uploaded to another one), in the order
+// of their file IDs.
+func (r *Repository) GetRowsWithStaleCopies(ctx context.Context, oType ente.ObjectType, afterFileID int64, limit int) ([]filedata.Row, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+rowColumns+` FROM file_data
+		WHERE data_type = $1 AND pending_sync = false AND is_deleted = false
+		AND cardinality(delete_from_buckets) > 0 AND file_id > $2
+		ORDER BY file_id
+		LIMIT $3`, string(oType), afterFileID, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return convertRowsToFilesData(rows)
+}
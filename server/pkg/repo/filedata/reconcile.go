@@ -0,0 +1,51 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente"
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// GetRowsForReconciliation returns up to limit live rows that come after the
+// given (file_id, data_type) position, in that order. Passing 0 and "" starts
+// from the beginning.
+func (r *Repository) GetRowsForReconciliation(ctx context.Context, afterFileID int64, afterType ente.ObjectType, limit int) ([]filedata.Row, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+rowColumns+`
+		FROM file_data
+		WHERE is_deleted = false AND (file_id, data_type::text) > ($1, $2)
+		ORDER BY file_id, data_type::text
+		LIMIT $3`, afterFileID, string(afterType), limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return convertRowsToFilesData(rows)
+}
+
+// RequeueMissingReplica records that bucketID does not have a copy of the
+// row's object after all, and queues the row for replication again. The row's
+// side objects are copied to the bucket again too.
+func (r *Repository) RequeueMissingReplica(ctx context.Context, row filedata.Row, bucketID string) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data SET
+			replicated_buckets = array_remove(replicated_buckets, $1),
+			compressed_buckets = array_remove(compressed_buckets, $1),
+			replicated_side_objects = array(SELECT e FROM unnest(replicated_side_objects) AS e WHERE NOT starts_with(e, $1::text || ':')),
+			replica_versions = array(SELECT e FROM unnest(replica_versions) AS e WHERE NOT starts_with(e, $1::text || ':')),
+			pending_sync = true,
+			attempt_count = 0,
+			is_dead_lettered = false
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND is_deleted = false AND lock_token IS NOT DISTINCT FROM $5`,
+		bucketID, row.FileID, string(row.Type), row.UserID, row.LockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.NewError("file data for file %d and type %s not requeued", row.FileID, row.Type)
+	}
+	return nil
+}
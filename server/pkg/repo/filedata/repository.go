@@ -3,18 +3,54 @@ package filedata
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/ente-io/museum/ente"
 	"github.com/ente-io/museum/ente/filedata"
 	"github.com/ente-io/museum/pkg/utils/array"
 	"github.com/ente-io/stacktrace"
+	"github.com/google/uuid"
 	"github.com/lib/pq"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Repository defines the methods for inserting, updating, and retrieving file data.
 type Repository struct {
 	DB *sql.DB
+	// InstanceID identifies the museum instance in the tokens of the row locks
+	// that it takes, see newLockToken. Instances that share the database should
+	// have different IDs, so if it isn't set, a random one is used.
+	InstanceID string
+}
+
+// defaultInstanceID is the instance ID of the repositories that don't have one
+// set: the host name along with a random suffix, since instances in different
+// containers may have the same host name.
+var defaultInstanceID = sync.OnceValue(func() string {
+	host, _ := os.Hostname()
+	return host + "-" + uuid.NewString()[:8]
+})
+
+// newLockToken returns a token for a new lock on rows, made of the instance
+// ID and a random part (see filedata.Row.LockHolder).
+//
+// Rows are locked in the database (with sync_locked_till, picked up with FOR
+// UPDATE SKIP LOCKED), and every update made on behalf of the holder of a lock
+// checks its token, so the locks already hold across the instances that share
+// the database. The instance ID is what tells which of them holds a lock.
+func (r *Repository) newLockToken() string {
+	return r.instanceID() + filedata.LockTokenSeparator + uuid.NewString()
+}
+
+func (r *Repository) instanceID() string {
+	if r.InstanceID == "" {
+		return defaultInstanceID()
+	}
+	return r.InstanceID
 }
 
 const (
@@ -23,17 +59,22 @@ const (
 	InflightRepColumn = "inflight_rep_buckets"
 )
 
+// rowColumns are the columns that are read into a filedata.Row, in the order
+// expected by scanRow.
+const rowColumns = `file_id, user_id, data_type, size, latest_bucket, replicated_buckets, delete_from_buckets, inflight_rep_buckets, pending_sync, is_deleted, sync_locked_till, created_at, updated_at, attempt_count, is_dead_lettered, checksum, compressed_buckets, lock_token, replica_buckets_override, replicated_side_objects, lock_heartbeat_at, replica_versions`
+
 func (r *Repository) InsertOrUpdate(ctx context.Context, data filedata.Row) error {
 	// During insert, we set the sync_locked_till to 5 minutes in the future. This is to prevent
 	// immediate replication of the file data row, that can result in failure of update/retry requests
 	query := `
         INSERT INTO file_data 
-            (file_id, user_id, data_type, size, latest_bucket, sync_locked_till) 
+            (file_id, user_id, data_type, size, latest_bucket, checksum, sync_locked_till) 
         VALUES 
-            ($1, $2, $3, $4, $5, now_utc_micro_seconds() + 5 * 60 * 1000*1000)
+            ($1, $2, $3, $4, $5, $6, now_utc_micro_seconds() + 5 * 60 * 1000*1000)
         ON CONFLICT (file_id, data_type)
         DO UPDATE SET 
             size = EXCLUDED.size,
+            checksum = EXCLUDED.checksum,
             delete_from_buckets = array(
                 SELECT DISTINCT elem FROM unnest(
                     array_append(
@@ -44,12 +85,19 @@ func (r *Repository) InsertOrUpdate(ctx context.Context, data filedata.Row) erro
                 WHERE elem IS NOT NULL AND elem != EXCLUDED.latest_bucket
             ),
             replicated_buckets = ARRAY[]::s3region[],
+            compressed_buckets = ARRAY[]::s3region[],
+            replicated_side_objects = ARRAY[]::text[],
+            replica_versions = ARRAY[]::text[],
             pending_sync = true,
+            attempt_count = 0,
+            is_dead_lettered = false,
+            lock_token = NULL,
+            lock_heartbeat_at = NULL,
             latest_bucket = EXCLUDED.latest_bucket,
             updated_at = now_utc_micro_seconds()
         WHERE file_data.is_deleted = false`
 	_, err := r.DB.ExecContext(ctx, query,
-		data.FileID, data.UserID, string(data.Type), data.Size, data.LatestBucket)
+		data.FileID, data.UserID, string(data.Type), data.Size, data.LatestBucket, data.Checksum)
 	if err != nil {
 		return stacktrace.Propagate(err, "failed to insert file data")
 	}
@@ -57,7 +105,7 @@ func (r *Repository) InsertOrUpdate(ctx context.Context, data filedata.Row) erro
 }
 
 func (r *Repository) GetFilesData(ctx context.Context, oType ente.ObjectType, fileIDs []int64) ([]filedata.Row, error) {
-	rows, err := r.DB.QueryContext(ctx, `SELECT file_id, user_id, data_type, size, latest_bucket, replicated_buckets, delete_from_buckets, inflight_rep_buckets, pending_sync, is_deleted, sync_locked_till, created_at, updated_at
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+rowColumns+`
 										FROM file_data
 										WHERE data_type = $1 AND file_id = ANY($2)`, string(oType), pq.Array(fileIDs))
 	if err != nil {
@@ -67,7 +115,7 @@ func (r *Repository) GetFilesData(ctx context.Context, oType ente.ObjectType, fi
 }
 
 func (r *Repository) GetFileData(ctx context.Context, fileIDs int64) ([]filedata.Row, error) {
-	rows, err := r.DB.QueryContext(ctx, `SELECT file_id, user_id, data_type, size, latest_bucket, replicated_buckets, delete_from_buckets,inflight_rep_buckets, pending_sync, is_deleted, sync_locked_till, created_at, updated_at
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+rowColumns+`
 										FROM file_data
 										WHERE file_id = $1`, fileIDs)
 	if err != nil {
@@ -76,7 +124,7 @@ func (r *Repository) GetFileData(ctx context.Context, fileIDs int64) ([]filedata
 	return convertRowsToFilesData(rows)
 }
 
-func (r *Repository) AddBucket(row filedata.Row, bucketID string, columnName string) error {
+func (r *Repository) AddBucket(ctx context.Context, row filedata.Row, bucketID string, columnName string) error {
 	query := fmt.Sprintf(`
         UPDATE file_data
         SET %s = array(
@@ -84,8 +132,8 @@ func (r *Repository) AddBucket(row filedata.Row, bucketID string, columnName str
                 array_append(file_data.%s, $1)
             ) AS elem
         )
-        WHERE file_id = $2 AND data_type = $3 and user_id = $4`, columnName, columnName)
-	result, err := r.DB.Exec(query, bucketID, row.FileID, string(row.Type), row.UserID)
+        WHERE file_id = $2 AND data_type = $3 and user_id = $4 AND lock_token IS NOT DISTINCT FROM $5`, columnName, columnName) + liveOnly(columnName)
+	result, err := r.DB.ExecContext(ctx, query, bucketID, row.FileID, string(row.Type), row.UserID, row.LockToken)
 	if err != nil {
 		return stacktrace.Propagate(err, "failed to add bucket to "+columnName)
 	}
@@ -94,7 +142,7 @@ func (r *Repository) AddBucket(row filedata.Row, bucketID string, columnName str
 		return stacktrace.Propagate(err, "")
 	}
 	if rowsAffected == 0 {
-		return stacktrace.NewError("bucket not added to " + columnName)
+		return r.notUpdatedError(ctx, row, "bucket not added to "+columnName)
 	}
 	return nil
 }
@@ -111,8 +159,8 @@ func (r *Repository) RemoveBucket(row filedata.Row, bucketID string, columnName
             ) AS elem
             WHERE elem IS NOT NULL
         )
-        WHERE file_id = $2 AND data_type = $3 and user_id = $4`, columnName, columnName)
-	result, err := r.DB.Exec(query, bucketID, row.FileID, string(row.Type), row.UserID)
+        WHERE file_id = $2 AND data_type = $3 and user_id = $4 AND lock_token IS NOT DISTINCT FROM $5`, columnName, columnName)
+	result, err := r.DB.Exec(query, bucketID, row.FileID, string(row.Type), row.UserID, row.LockToken)
 	if err != nil {
 		return stacktrace.Propagate(err, "failed to remove bucket from "+columnName)
 	}
@@ -121,7 +169,7 @@ func (r *Repository) RemoveBucket(row filedata.Row, bucketID string, columnName
 		return stacktrace.Propagate(err, "")
 	}
 	if rowsAffected == 0 {
-		return stacktrace.NewError("bucket not removed from " + columnName)
+		return stacktrace.Propagate(ErrLockLost, "bucket not removed from "+columnName)
 	}
 	return nil
 }
@@ -146,7 +194,7 @@ func (r *Repository) GetFDForUser(ctx context.Context, userID int64, lastUpdated
 	return fdStatuses, nil
 }
 
-func (r *Repository) MoveBetweenBuckets(row filedata.Row, bucketID string, sourceColumn string, destColumn string) error {
+func (r *Repository) MoveBetweenBuckets(ctx context.Context, row filedata.Row, bucketID string, sourceColumn string, destColumn string) error {
 	query := fmt.Sprintf(`
   UPDATE file_data
   SET %s = array(
@@ -167,8 +215,8 @@ func (r *Repository) MoveBetweenBuckets(row filedata.Row, bucketID string, sourc
    ) AS elem
    WHERE elem IS NOT NULL
   )
-  WHERE file_id = $2 AND data_type = $3 and user_id = $4`, destColumn, destColumn, sourceColumn, sourceColumn)
-	result, err := r.DB.Exec(query, bucketID, row.FileID, string(row.Type), row.UserID)
+  WHERE file_id = $2 AND data_type = $3 and user_id = $4 AND lock_token IS NOT DISTINCT FROM $5`, destColumn, destColumn, sourceColumn, sourceColumn) + liveOnly(destColumn)
+	result, err := r.DB.ExecContext(ctx, query, bucketID, row.FileID, string(row.Type), row.UserID, row.LockToken)
 	if err != nil {
 		return stacktrace.Propagate(err, "failed to move bucket from "+sourceColumn+" to "+destColumn)
 	}
@@ -177,64 +225,567 @@ func (r *Repository) MoveBetweenBuckets(row filedata.Row, bucketID string, sourc
 		return stacktrace.Propagate(err, "")
 	}
 	if rowsAffected == 0 {
-		return stacktrace.NewError("bucket not moved from " + sourceColumn + " to " + destColumn)
+		return r.notUpdatedError(ctx, row, "bucket not moved from "+sourceColumn+" to "+destColumn)
 	}
 	return nil
 }
 
+// PendingSyncFilter narrows down the rows that GetPendingSyncDataAndExtendLock
+// picks from. The zero value matches all the rows.
+type PendingSyncFilter struct {
+	// Types, if not empty, limits the rows to these object types
+	Types []ente.ObjectType
+	// ExcludeTypes skips rows of these object types
+	ExcludeTypes []ente.ObjectType
+	// SkipDryRunReported skips rows that already have an up to date entry in
+	// the dry run report
+	SkipDryRunReported bool
+	// Order decides which of the matching rows is picked first
+	Order PendingSyncOrder
+	// TypeWeights, if not empty, picks rows of types with a higher weight
+	// first, before applying Order. Types that are not listed have weight 0.
+	TypeWeights map[ente.ObjectType]int
+	// ReclaimAfter, if positive, also picks rows whose lock is still held but
+	// whose lock holder hasn't sent a heartbeat for ReclaimAfter plus
+	// ReclaimPerMiB for each MiB of the row's size. Such rows are assumed to
+	// have been abandoned by a worker that died. Rows locked without a
+	// heartbeat are never reclaimed, and neither are rows picked for deletion.
+	ReclaimAfter  time.Duration
+	ReclaimPerMiB time.Duration
+	// DeprioritizedUsers are picked after the rows of all the other users,
+	// before applying TypeWeights and Order
+	DeprioritizedUsers []int64
+	// MaxSize, if positive, skips rows larger than MaxSize bytes
+	MaxSize int64
+	// MinSize, if positive, limits the rows to those larger than MinSize bytes
+	MinSize int64
+	// UrgentOnly limits the rows to those updated at or after UrgentSince
+	// (epoch microseconds), and to those of UrgentTypes
+	UrgentOnly  bool
+	UrgentSince int64
+	UrgentTypes []ente.ObjectType
+	// CreatedAfter, if positive, limits the rows to those created after it
+	// (epoch microseconds)
+	CreatedAfter int64
+	// SettleFor skips the rows that haven't had a replication attempt yet
+	// until SettleFor has passed since they were last updated, or, for the
+	// types in SettleForTypes, the duration listed there
+	SettleFor      time.Duration
+	SettleForTypes map[ente.ObjectType]time.Duration
+	// FairUserWindow, if positive, interleaves the rows of different users,
+	// after applying TypeWeights and before Order: a row is picked after the
+	// rows of other users that have fewer pending rows ahead of their own,
+	// oldest first, counting up to FairUserWindow of them. The rows that are
+	// being replicated count as ahead too, so a user whose rows are being
+	// replicated yields to the others. Without it, one user's bulk upload can
+	// hold up everyone else's rows until it is done. Only the rows at the
+	// front of the queue are interleaved, see fairUsersQuery.
+	FairUserWindow int
+}
+
+// PendingSyncOrder is the order in which pending rows are picked up.
+type PendingSyncOrder string
+
+const (
+	// AnyOrder picks whichever row the database finds first, which is the
+	// cheapest
+	AnyOrder PendingSyncOrder = ""
+	// OldestFirst picks the least recently updated rows first
+	OldestFirst PendingSyncOrder = "oldest-first"
+	// NewestFirst picks the most recently updated rows first, so that fresh
+	// uploads are protected quickly during a backfill
+	NewestFirst PendingSyncOrder = "newest-first"
+)
+
+// fairUserCandidates is the least number of rows that are ranked among the rows
+// of their users, see PendingSyncFilter.FairUserWindow.
+const fairUserCandidates = 1000
+
+// orderBy returns the ORDER BY clause for the filter. The type weights are
+// passed as the query parameters $5 (types) and $6 (weights). With a fair user
+// window, the rank of the row among the rows of its user is userRank, see
+// fairUsersQuery.
+//
+// The deprioritized users aren't part of the order, as no index could serve
+// it, but are picked in a pass of their own, see deprioritizedPasses.
+func (f PendingSyncFilter) orderBy(userRank string) string {
+	var terms []string
+	if len(f.TypeWeights) > 0 {
+		terms = append(terms, `COALESCE((SELECT w FROM unnest($5::text[], $6::int[]) AS t(ty, w) WHERE ty = data_type::text), 0) DESC`)
+	}
+	if f.FairUserWindow > 0 && userRank != "" {
+		terms = append(terms, userRank+" ASC")
+	}
+	switch f.Order {
+	case OldestFirst:
+		terms = append(terms, "updated_at ASC")
+	case NewestFirst:
+		terms = append(terms, "updated_at DESC")
+	}
+	if len(terms) == 0 {
+		return ""
+	}
+	return "ORDER BY " + strings.Join(terms, ", ")
+}
+
+// fairUsersQuery returns the query that picks the rows that match the
+// conditions, interleaving the rows of different users for the fair user
+// window $20 (see PendingSyncFilter.FairUserWindow).
+//
+// Rather than counting the rows ahead of every row, which is a query per row
+// of the table, it ranks a bounded set of candidates: the first $7 * $20 rows
+// (and at least fairUserCandidates) in the order of the filter, by the number
+// of the candidates of the same user that are older, plus the number of the
+// user's rows that are being replicated. The candidates are picked again, and
+// locked, in the order of their rank.
+func (f PendingSyncFilter) fairUsersQuery(conditions string) string {
+	candidateOrder := f.orderBy("")
+	if candidateOrder == "" {
+		candidateOrder = "ORDER BY updated_at ASC"
+	}
+	return `WITH candidates AS (
+			SELECT file_id, data_type, user_id, updated_at FROM file_data
+			WHERE ` + conditions + `
+			` + candidateOrder + `, file_id
+			LIMIT greatest($7 * $20, ` + fmt.Sprint(fairUserCandidates) + `)
+		), replicating AS (
+			SELECT user_id, count(*) AS n FROM file_data
+			WHERE pending_sync = true AND is_deleted = $1 AND sync_locked_till >= now_utc_micro_seconds()
+			AND lock_heartbeat_at IS NOT NULL AND user_id IN (SELECT user_id FROM candidates)
+			GROUP BY user_id
+		), ranked AS (
+			SELECT c.file_id AS ranked_file_id, c.data_type AS ranked_data_type,
+				least(row_number() OVER (PARTITION BY c.user_id ORDER BY c.updated_at, c.file_id) - 1 + coalesce(r.n, 0), $20) AS user_rank
+			FROM candidates c LEFT JOIN replicating r ON r.user_id = c.user_id
+		)
+		SELECT ` + rowColumns + `
+		FROM file_data JOIN ranked ON file_data.file_id = ranked.ranked_file_id AND file_data.data_type = ranked.ranked_data_type
+		WHERE ` + conditions + `
+		` + f.orderBy("user_rank") + `, file_id
+		LIMIT $7
+		FOR UPDATE OF file_data SKIP LOCKED`
+}
+
+// The passes of getPendingSyncAndExtendLock, passed as $21: without any
+// deprioritized users, the rows of all the users are picked in a single pass,
+// and otherwise the rows of the other users first, and those of the
+// deprioritized users only if there aren't enough of them.
+const (
+	allUsersPass = iota
+	otherUsersPass
+	deprioritizedUsersPass
+)
+
+// deprioritizedPasses returns the passes that the rows are picked in.
+func (f PendingSyncFilter) deprioritizedPasses() []int {
+	if len(f.DeprioritizedUsers) == 0 {
+		return []int{allUsersPass}
+	}
+	return []int{otherUsersPass, deprioritizedUsersPass}
+}
+
+func (f PendingSyncFilter) weightParams() (interface{}, interface{}) {
+	types := make([]string, 0, len(f.TypeWeights))
+	weights := make([]int64, 0, len(f.TypeWeights))
+	for oType, weight := range f.TypeWeights {
+		types = append(types, string(oType))
+		weights = append(weights, int64(weight))
+	}
+	return pq.Array(types), pq.Array(weights)
+}
+
+func (f PendingSyncFilter) settleParams() (interface{}, interface{}) {
+	types := make([]string, 0, len(f.SettleForTypes))
+	durations := make([]int64, 0, len(f.SettleForTypes))
+	for oType, d := range f.SettleForTypes {
+		types = append(types, string(oType))
+		durations = append(durations, d.Microseconds())
+	}
+	return pq.Array(types), pq.Array(durations)
+}
+
+func typesToStrings(types []ente.ObjectType) []string {
+	result := make([]string, len(types))
+	for i := range types {
+		result[i] = string(types[i])
+	}
+	return result
+}
+
 // GetPendingSyncDataAndExtendLock in a transaction gets single file data row that has been deleted and pending sync is true and sync_lock_till is less than now_utc_micro_seconds() and extends the lock till newSyncLockTime
 // This is used to lock the file data row for deletion and extend
-func (r *Repository) GetPendingSyncDataAndExtendLock(ctx context.Context, newSyncLockTime int64, forDeletion bool) (*filedata.Row, error) {
+func (r *Repository) GetPendingSyncDataAndExtendLock(ctx context.Context, newSyncLockTime int64, forDeletion bool, filter PendingSyncFilter) (*filedata.Row, error) {
+	rows, err := r.getPendingSyncAndExtendLock(ctx, newSyncLockTime, forDeletion, filter, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &rows[0], nil
+}
+
+// GetPendingSyncBatchAndExtendLock is the batched variant of
+// GetPendingSyncDataAndExtendLock for replication. It locks up to limit live
+// rows that are pending sync till newSyncLockTime in a single transaction, and
+// returns them. Like the single row variant, it fails with sql.ErrNoRows if
+// there is nothing to replicate.
+func (r *Repository) GetPendingSyncBatchAndExtendLock(ctx context.Context, newSyncLockTime int64, filter PendingSyncFilter, limit int) ([]filedata.Row, error) {
+	return r.getPendingSyncAndExtendLock(ctx, newSyncLockTime, false, filter, limit)
+}
+
+func (r *Repository) getPendingSyncAndExtendLock(ctx context.Context, newSyncLockTime int64, forDeletion bool, filter PendingSyncFilter, limit int) ([]filedata.Row, error) {
 	// ensure newSyncLockTime is in the future
 	if newSyncLockTime < time.Now().Add(5*time.Minute).UnixMicro() {
 		return nil, stacktrace.NewError("newSyncLockTime should be at least 5min in the future")
 	}
+	if limit < 1 {
+		limit = 1
+	}
 	tx, err := r.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "")
 	}
 	defer tx.Rollback()
-	row := tx.QueryRow(`SELECT file_id, user_id, data_type, size, latest_bucket, replicated_buckets, delete_from_buckets, inflight_rep_buckets, pending_sync, is_deleted, sync_locked_till, created_at, updated_at
+	// Dead lettered rows are skipped for replication, but they are still
+	// picked up for deletion.
+	// The type weights and the fair user window are always referenced in the
+	// WHERE clause, even when not used for ordering, so that postgres can infer
+	// the types of $5, $6 and $20.
+	weightTypes, weights := filter.weightParams()
+	settleTypes, settleDurations := filter.settleParams()
+	conditions := `pending_sync = true and is_deleted = $1
+		and (sync_locked_till < now_utc_micro_seconds() or (not $1 and $8 > 0 and lock_heartbeat_at is not null
+			and lock_heartbeat_at < now_utc_micro_seconds() - $8 - (size / (1024 * 1024)) * $9))
+		and ($1 or is_dead_lettered = false)
+		and (cardinality($2::text[]) = 0 or data_type::text = any($2))
+		and not (data_type::text = any($3))
+		and (not $4 or not exists (
+			select 1 from file_data_dry_run_report r
+			where r.file_id = file_data.file_id and r.data_type = file_data.data_type and r.row_updated_at = file_data.updated_at))
+		and cardinality($5::text[]) = cardinality($6::int[])
+		and ($21::int = ` + fmt.Sprint(allUsersPass) + ` or (user_id = any($10::bigint[])) = ($21 = ` + fmt.Sprint(deprioritizedUsersPass) + `))
+		and ($11::bigint <= 0 or size <= $11)
+		and ($12::bigint <= 0 or size > $12)
+		and (not $13 or updated_at >= $14::bigint or data_type::text = any($15::text[]))
+		and ($16::bigint <= 0 or created_at > $16)
+		and ($1 or attempt_count > 0 or updated_at <= now_utc_micro_seconds() - coalesce(
+			(select s from unnest($17::text[], $18::bigint[]) as t(ty, s) where ty = data_type::text), $19::bigint))
+		and $20::int >= 0`
+	query := `SELECT ` + rowColumns + `
 		FROM file_data
-		where pending_sync = true and is_deleted = $1 and sync_locked_till < now_utc_micro_seconds()
-		LIMIT 1
-		FOR UPDATE SKIP LOCKED`, forDeletion)
-	var fileData filedata.Row
-	err = row.Scan(&fileData.FileID, &fileData.UserID, &fileData.Type, &fileData.Size, &fileData.LatestBucket, pq.Array(&fileData.ReplicatedBuckets), pq.Array(&fileData.DeleteFromBuckets), pq.Array(&fileData.InflightReplicas), &fileData.PendingSync, &fileData.IsDeleted, &fileData.SyncLockedTill, &fileData.CreatedAt, &fileData.UpdatedAt)
+		WHERE ` + conditions + `
+		` + filter.orderBy("") + `
+		LIMIT $7
+		FOR UPDATE SKIP LOCKED`
+	if filter.FairUserWindow > 0 {
+		query = filter.fairUsersQuery(conditions)
+	}
+	var filesData []filedata.Row
+	for _, pass := range filter.deprioritizedPasses() {
+		if len(filesData) >= limit {
+			break
+		}
+		rows, err := tx.QueryContext(ctx, query, forDeletion, pq.Array(typesToStrings(filter.Types)), pq.Array(typesToStrings(filter.ExcludeTypes)), filter.SkipDryRunReported, weightTypes, weights, limit-len(filesData),
+			filter.ReclaimAfter.Microseconds(), filter.ReclaimPerMiB.Microseconds(), pq.Array(filter.DeprioritizedUsers),
+			filter.MaxSize, filter.MinSize, filter.UrgentOnly, filter.UrgentSince, pq.Array(typesToStrings(filter.UrgentTypes)), filter.CreatedAfter,
+			settleTypes, settleDurations, filter.SettleFor.Microseconds(), max(filter.FairUserWindow, 0), pass)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		passData, err := convertRowsToFilesData(rows)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		filesData = append(filesData, passData...)
+	}
+	if len(filesData) == 0 {
+		return nil, stacktrace.Propagate(sql.ErrNoRows, "")
+	}
+	fileIDs := make([]int64, len(filesData))
+	types := make([]string, len(filesData))
+	for i, fileData := range filesData {
+		// A reclaimed row may have been locked for longer by its previous
+		// holder, but that lock is void now
+		if fileData.SyncLockedTill > newSyncLockTime && filter.ReclaimAfter <= 0 {
+			return nil, stacktrace.NewError(fmt.Sprintf("newSyncLockTime (%d) is less than existing SyncLockedTill(%d), newSync", newSyncLockTime, fileData.SyncLockedTill))
+		}
+		fileIDs[i] = fileData.FileID
+		types[i] = string(fileData.Type)
+	}
+	token := r.newLockToken()
+	_, err = tx.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = $1, lock_token = $4, lock_heartbeat_at = now_utc_micro_seconds()
+		FROM unnest($2::bigint[], $3::text[]) AS locked(file_id, data_type)
+		WHERE file_data.file_id = locked.file_id AND file_data.data_type::text = locked.data_type`,
+		newSyncLockTime, pq.Array(fileIDs), pq.Array(types), token)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "")
 	}
-	if fileData.SyncLockedTill > newSyncLockTime {
-		return nil, stacktrace.NewError(fmt.Sprintf("newSyncLockTime (%d) is less than existing SyncLockedTill(%d), newSync", newSyncLockTime, fileData.SyncLockedTill))
+	for i := range filesData {
+		filesData[i].LockToken = &token
 	}
-	_, err = tx.Exec(`UPDATE file_data SET sync_locked_till = $1 WHERE file_id = $2 AND data_type = $3 AND user_id = $4`, newSyncLockTime, fileData.FileID, string(fileData.Type), fileData.UserID)
+	err = tx.Commit()
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "")
 	}
-	err = tx.Commit()
+	return filesData, nil
+}
+
+// GetPendingDeletionAndExtendLock locks a single row that has been marked as
+// deleted, but whose objects have not yet been removed from all the buckets,
+// till newSyncLockTime.
+//
+// Rows are marked as deleted without touching their lock, so a row that is
+// being replicated when it is deleted is only picked up once the replication
+// worker's lock has expired or been released.
+func (r *Repository) GetPendingDeletionAndExtendLock(ctx context.Context, newSyncLockTime int64) (*filedata.Row, error) {
+	return r.GetPendingSyncDataAndExtendLock(ctx, newSyncLockTime, true, PendingSyncFilter{})
+}
+
+const markReplicationAsDoneQuery = `UPDATE file_data SET pending_sync = false, attempt_count = 0, last_error = NULL, last_error_at = NULL, replicated_at = now_utc_micro_seconds() WHERE is_deleted=false and file_id = $1 AND data_type = $2 AND user_id = $3 AND lock_token IS NOT DISTINCT FROM $4`
+
+// ErrLockLost is returned by the updates made on behalf of a lock holder when
+// the row's lock has meanwhile been taken over by someone else.
+var ErrLockLost = errors.New("file data row lock is no longer held")
+
+// ErrRowDeleted is returned by the updates that add replicas to a row when the
+// row has meanwhile been deleted (or marked as deleted), so that a replication
+// attempt that outlived the row doesn't resurrect its copies.
+var ErrRowDeleted = errors.New("file data row has been deleted")
+
+// liveOnly returns the condition that keeps an update that adds bucketID to
+// columnName from matching deleted rows, if columnName records replicas.
+func liveOnly(columnName string) string {
+	if columnName == ReplicationColumn || columnName == InflightRepColumn {
+		return " AND is_deleted = false"
+	}
+	return ""
+}
+
+// CheckNotDeleted returns ErrRowDeleted if the row has been deleted (or marked
+// as deleted) since it was picked up.
+func (r *Repository) CheckNotDeleted(ctx context.Context, row filedata.Row) error {
+	var deleted bool
+	err := r.DB.QueryRowContext(ctx, `SELECT is_deleted FROM file_data WHERE file_id = $1 AND data_type = $2 AND user_id = $3`,
+		row.FileID, string(row.Type), row.UserID).Scan(&deleted)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && deleted) {
+		return stacktrace.Propagate(ErrRowDeleted, "")
+	}
+	return stacktrace.Propagate(err, "")
+}
+
+// notUpdatedError is used after an update made on behalf of a lock holder did
+// not match the row. It returns ErrRowDeleted if that is because the row has
+// been deleted, and ErrLockLost otherwise.
+func (r *Repository) notUpdatedError(ctx context.Context, row filedata.Row, msg string) error {
+	if err := r.CheckNotDeleted(ctx, row); errors.Is(err, ErrRowDeleted) {
+		return stacktrace.Propagate(err, msg)
+	}
+	return stacktrace.Propagate(ErrLockLost, msg)
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// checkLockHeld is used after a conditional update did not match the row. It
+// returns ErrLockLost if that is because the lock has been taken over, and nil
+// if the row has been deleted (or marked as deleted) instead.
+func checkLockHeld(ctx context.Context, q rowQuerier, row filedata.Row) error {
+	var held bool
+	err := q.QueryRowContext(ctx, `SELECT lock_token IS NOT DISTINCT FROM $4 FROM file_data
+		WHERE file_id = $1 AND data_type = $2 AND user_id = $3`, row.FileID, string(row.Type), row.UserID, row.LockToken).Scan(&held)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if !held {
+		return stacktrace.Propagate(ErrLockLost, "")
+	}
+	return nil
+}
+
+// LockForReplication locks the given live row till newSyncLockTime, regardless of
+// whether it is pending sync. It fails with a conflict if the row is currently
+// locked, e.g. because a worker is replicating it.
+func (r *Repository) LockForReplication(ctx context.Context, fileID int64, oType ente.ObjectType, newSyncLockTime int64) (*filedata.Row, error) {
+	return r.lockForReplication(ctx, fileID, oType, newSyncLockTime, false)
+}
+
+// LockUploadedForReplication is LockForReplication for a row that has just been
+// inserted or updated: it also takes over the lock that InsertOrUpdate puts on
+// the row to delay its replication, which isn't held by anyone (i.e. has no
+// lock token). It still fails with a conflict if a worker holds the row.
+func (r *Repository) LockUploadedForReplication(ctx context.Context, fileID int64, oType ente.ObjectType, newSyncLockTime int64) (*filedata.Row, error) {
+	return r.lockForReplication(ctx, fileID, oType, newSyncLockTime, true)
+}
+
+func (r *Repository) lockForReplication(ctx context.Context, fileID int64, oType ente.ObjectType, newSyncLockTime int64, takeOverUnheld bool) (*filedata.Row, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "")
 	}
+	defer tx.Rollback()
+	row := tx.QueryRowContext(ctx, `SELECT `+rowColumns+`
+		FROM file_data
+		WHERE file_id = $1 AND data_type = $2 AND is_deleted = false
+		FOR UPDATE`, fileID, string(oType))
+	fileData, err := scanRow(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, stacktrace.Propagate(ente.ErrNotFound, "no file data for file %d and type %s", fileID, oType)
+		}
+		return nil, stacktrace.Propagate(err, "")
+	}
+	if fileData.SyncLockedTill > time.Now().UnixMicro() && !(takeOverUnheld && fileData.LockToken == nil) {
+		return nil, stacktrace.Propagate(ente.NewConflictError("file data is locked, it is probably being replicated"), "")
+	}
+	token := r.newLockToken()
+	_, err = tx.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = $1, lock_token = $5, lock_heartbeat_at = now_utc_micro_seconds() WHERE file_id = $2 AND data_type = $3 AND user_id = $4`, newSyncLockTime, fileData.FileID, string(fileData.Type), fileData.UserID, token)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	fileData.LockToken = &token
+	if err := tx.Commit(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
 	return &fileData, nil
 }
 
 // MarkReplicationAsDone marks the pending_sync as false for the file data row, while
-// ensuring that the row is not deleted
+// ensuring that the row is not deleted. It also resets the count of failed attempts.
+// It fails with ErrLockLost if the row's lock is no longer held.
 func (r *Repository) MarkReplicationAsDone(ctx context.Context, row filedata.Row) error {
-	query := `UPDATE file_data SET pending_sync = false WHERE is_deleted=false and file_id = $1 AND data_type = $2 AND user_id = $3`
-	_, err := r.DB.ExecContext(ctx, query, row.FileID, string(row.Type), row.UserID)
+	res, err := r.DB.ExecContext(ctx, markReplicationAsDoneQuery, row.FileID, string(row.Type), row.UserID, row.LockToken)
 	if err != nil {
 		return stacktrace.Propagate(err, "")
 	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return checkLockHeld(ctx, r.DB, row)
+	}
 	return nil
 }
 
+// GetOldestPendingSyncTime returns the updated_at of the oldest live row that is
+// still pending replication, or 0 if there is no such row.
+func (r *Repository) GetOldestPendingSyncTime(ctx context.Context) (int64, error) {
+	var oldest int64
+	err := r.DB.QueryRowContext(ctx, `SELECT COALESCE(MIN(updated_at), 0) FROM file_data WHERE pending_sync = true AND is_deleted = false AND is_dead_lettered = false`).Scan(&oldest)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return oldest, nil
+}
+
+// RegisterReplicationAttempt records dstBucketID as in flight for the row,
+// provided the row is still held with row.LockToken. An attempt that is already
+// registered needs no write, but the lock is still checked, so that it fails
+// like the others with ErrLockLost, or ErrRowDeleted, if the row is no longer
+// held.
 func (r *Repository) RegisterReplicationAttempt(ctx context.Context, row filedata.Row, dstBucketID string) error {
 	if array.StringInList(dstBucketID, row.DeleteFromBuckets) {
-		return r.MoveBetweenBuckets(row, dstBucketID, DeletionColumn, InflightRepColumn)
+		return r.MoveBetweenBuckets(ctx, row, dstBucketID, DeletionColumn, InflightRepColumn)
 	}
 	if !array.StringInList(dstBucketID, row.InflightReplicas) {
-		return r.AddBucket(row, dstBucketID, InflightRepColumn)
+		return r.AddBucket(ctx, row, dstBucketID, InflightRepColumn)
+	}
+	var deleted, held bool
+	err := r.DB.QueryRowContext(ctx, `SELECT is_deleted, lock_token IS NOT DISTINCT FROM $4 FROM file_data
+		WHERE file_id = $1 AND data_type = $2 AND user_id = $3`, row.FileID, string(row.Type), row.UserID, row.LockToken).Scan(&deleted, &held)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && deleted) {
+		return stacktrace.Propagate(ErrRowDeleted, "")
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if !held {
+		return stacktrace.Propagate(ErrLockLost, "")
+	}
+	return nil
+}
+
+// UpdateSyncLock moves sync_locked_till of the row to newLockTill, provided the
+// row is still held with heldLockTill. It is used to extend a lock once the
+// worker knows how long it needs the row for, and by dry runs to put back the
+// lock that the row had before it was picked up.
+func (r *Repository) UpdateSyncLock(ctx context.Context, row filedata.Row, heldLockTill int64, newLockTill int64) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = $1
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND sync_locked_till = $5`,
+		newLockTill, row.FileID, string(row.Type), row.UserID, heldLockTill)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.NewError("lock for file %d and type %s is no longer held", row.FileID, row.Type)
+	}
+	return nil
+}
+
+// ReleaseSyncLock is UpdateSyncLock for a holder that is done with the row: it
+// also clears the heartbeat of the lock, so that the row isn't taken for
+// abandoned once the lock runs out, see Row.LockHeartbeatAt.
+func (r *Repository) ReleaseSyncLock(ctx context.Context, row filedata.Row, heldLockTill int64, newLockTill int64) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = $1, lock_heartbeat_at = NULL
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND sync_locked_till = $5`,
+		newLockTill, row.FileID, string(row.Type), row.UserID, heldLockTill)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.NewError("lock for file %d and type %s is no longer held", row.FileID, row.Type)
+	}
+	return nil
+}
+
+// RenewSyncLock moves sync_locked_till of the row to newLockTill and records a
+// heartbeat, provided the row is still held with heldLockTill and its lock
+// token. It fails with ErrLockLost otherwise.
+func (r *Repository) RenewSyncLock(ctx context.Context, row filedata.Row, heldLockTill int64, newLockTill int64) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data SET sync_locked_till = $1, lock_heartbeat_at = now_utc_micro_seconds()
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND sync_locked_till = $5 AND lock_token IS NOT DISTINCT FROM $6`,
+		newLockTill, row.FileID, string(row.Type), row.UserID, heldLockTill, row.LockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.Propagate(ErrLockLost, "lock for file %d and type %s is no longer held", row.FileID, row.Type)
+	}
+	return nil
+}
+
+// TouchSyncLock records a heartbeat for the rows that are locked with
+// lockToken, so that they are not reclaimed as abandoned while they are being
+// worked on. It fails with ErrLockLost if none of the rows is held with the
+// token anymore. The rows that have already been released (see
+// ReleaseSyncLock) are left alone.
+func (r *Repository) TouchSyncLock(ctx context.Context, lockToken string) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data SET lock_heartbeat_at = now_utc_micro_seconds()
+		WHERE lock_token = $1 AND pending_sync = true AND lock_heartbeat_at IS NOT NULL`, lockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.Propagate(ErrLockLost, "no rows are locked with token %s", lockToken)
 	}
 	return nil
 }
@@ -242,7 +793,7 @@ func (r *Repository) RegisterReplicationAttempt(ctx context.Context, row filedat
 // ResetSyncLock resets the sync_locked_till to now_utc_micro_seconds() for the file data row only if pending_sync is false and
 // the input syncLockedTill is equal to the existing sync_locked_till. This is used to reset the lock after the replication is done
 func (r *Repository) ResetSyncLock(ctx context.Context, row filedata.Row, syncLockedTill int64) error {
-	query := `UPDATE file_data SET sync_locked_till = now_utc_micro_seconds() WHERE pending_sync = false and file_id = $1 AND data_type = $2 AND user_id = $3 AND sync_locked_till = $4`
+	query := `UPDATE file_data SET sync_locked_till = now_utc_micro_seconds(), lock_heartbeat_at = NULL WHERE pending_sync = false and file_id = $1 AND data_type = $2 AND user_id = $3 AND sync_locked_till = $4`
 	_, err := r.DB.ExecContext(ctx, query, row.FileID, string(row.Type), row.UserID, syncLockedTill)
 	if err != nil {
 		return stacktrace.Propagate(err, "")
@@ -269,11 +820,343 @@ func (r *Repository) DeleteFileData(ctx context.Context, row filedata.Row) error
 	return nil
 }
 
+// GetBucketReplicationStatus returns the backlog per object type and
+// destination bucket. wanted maps each object type to the buckets that its rows
+// should be in; a pending row counts against each of these buckets that is
+// neither its latest bucket nor one of its replicated buckets.
+func (r *Repository) GetBucketReplicationStatus(ctx context.Context, wanted map[ente.ObjectType][]string) ([]filedata.BucketReplicationStatus, error) {
+	types := make([]string, 0)
+	buckets := make([]string, 0)
+	for oType, bucketIDs := range wanted {
+		for _, bucketID := range bucketIDs {
+			types = append(types, string(oType))
+			buckets = append(buckets, bucketID)
+		}
+	}
+	rows, err := r.DB.QueryContext(ctx, `SELECT wanted.data_type, wanted.bucket,
+			COUNT(*),
+			COUNT(*) FILTER (WHERE wanted.bucket = ANY(file_data.inflight_rep_buckets::text[]))
+		FROM file_data
+		JOIN unnest($1::text[], $2::text[]) AS wanted(data_type, bucket) ON file_data.data_type::text = wanted.data_type
+		WHERE file_data.pending_sync = true AND file_data.is_deleted = false AND file_data.is_dead_lettered = false
+		AND file_data.latest_bucket::text <> wanted.bucket
+		AND NOT (wanted.bucket = ANY(file_data.replicated_buckets::text[]))
+		GROUP BY wanted.data_type, wanted.bucket
+		ORDER BY wanted.data_type, wanted.bucket`, pq.Array(types), pq.Array(buckets))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	result := make([]filedata.BucketReplicationStatus, 0)
+	for rows.Next() {
+		var status filedata.BucketReplicationStatus
+		if err := rows.Scan(&status.Type, &status.Bucket, &status.Pending, &status.InFlight); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		result = append(result, status)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return result, nil
+}
+
+// GetOversizedPending returns the number and the total size of the live rows
+// larger than maxSize bytes that are pending replication.
+func (r *Repository) GetOversizedPending(ctx context.Context, maxSize int64) (count int64, size int64, err error) {
+	err = r.DB.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(size), 0) FROM file_data
+		WHERE pending_sync = true AND is_deleted = false AND is_dead_lettered = false AND size > $1`, maxSize).Scan(&count, &size)
+	if err != nil {
+		return 0, 0, stacktrace.Propagate(err, "")
+	}
+	return count, size, nil
+}
+
+// GetReplicationStatus returns, for each object type that has rows, the
+// replication backlog along with the number of rows replicated since
+// completedSince (epoch microseconds).
+func (r *Repository) GetReplicationStatus(ctx context.Context, completedSince int64) ([]filedata.TypeReplicationStatus, error) {
+	statusByType := map[ente.ObjectType]*filedata.TypeReplicationStatus{}
+	get := func(oType ente.ObjectType) *filedata.TypeReplicationStatus {
+		if _, ok := statusByType[oType]; !ok {
+			statusByType[oType] = &filedata.TypeReplicationStatus{Type: oType}
+		}
+		return statusByType[oType]
+	}
+	rows, err := r.DB.QueryContext(ctx, `SELECT data_type, COUNT(*),
+		COUNT(*) FILTER (WHERE sync_locked_till > now_utc_micro_seconds()),
+		MIN(updated_at)
+		FROM file_data
+		WHERE pending_sync = true AND is_deleted = false AND is_dead_lettered = false
+		GROUP BY data_type`)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oType ente.ObjectType
+		var pending, inFlight, oldest int64
+		if err := rows.Scan(&oType, &pending, &inFlight, &oldest); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		status := get(oType)
+		status.Pending = pending
+		status.InFlight = inFlight
+		status.OldestPendingAt = oldest
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	completedRows, err := r.DB.QueryContext(ctx, `SELECT data_type, COUNT(*) FROM file_data
+		WHERE replicated_at > $1 GROUP BY data_type`, completedSince)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer completedRows.Close()
+	for completedRows.Next() {
+		var oType ente.ObjectType
+		var completed int64
+		if err := completedRows.Scan(&oType, &completed); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		get(oType).CompletedLastHour = completed
+	}
+	if err := completedRows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	result := make([]filedata.TypeReplicationStatus, 0, len(statusByType))
+	for _, status := range statusByType {
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Type < result[j].Type })
+	return result, nil
+}
+
+// SetLatestBucket records bucketID, which has a copy of the row's metadata
+// object, as the row's latest bucket, provided the row is still held with
+// row.LockToken. The bucket is no longer recorded as a replica, and the previous
+// latest bucket isn't recorded as anything, so the row stays pending till it
+// has been replicated to it again, if it is one of the wanted buckets.
+func (r *Repository) SetLatestBucket(ctx context.Context, row filedata.Row, bucketID string) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data SET latest_bucket = $1,
+		replicated_buckets = array_remove(replicated_buckets, $1),
+		inflight_rep_buckets = array_remove(inflight_rep_buckets, $1),
+		delete_from_buckets = array_remove(delete_from_buckets, $1),
+		pending_sync = true
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND lock_token IS NOT DISTINCT FROM $5 AND is_deleted = false`,
+		bucketID, row.FileID, string(row.Type), row.UserID, row.LockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return r.notUpdatedError(ctx, row, "latest bucket not set to "+bucketID)
+	}
+	return nil
+}
+
+// SetBucketCompressed records whether the copy of the row's metadata object in
+// bucketID is stored compressed.
+func (r *Repository) SetBucketCompressed(ctx context.Context, row filedata.Row, bucketID string, compressed bool) error {
+	query := `UPDATE file_data SET compressed_buckets = array_remove(compressed_buckets, $1)
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND lock_token IS NOT DISTINCT FROM $5`
+	if compressed {
+		query = `UPDATE file_data SET compressed_buckets = array_append(array_remove(compressed_buckets, $1), $1)
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND lock_token IS NOT DISTINCT FROM $5`
+	}
+	res, err := r.DB.ExecContext(ctx, query, bucketID, row.FileID, string(row.Type), row.UserID, row.LockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.Propagate(ErrLockLost, "")
+	}
+	return nil
+}
+
+// SetChecksum records the checksum of the metadata object for rows that were
+// written before checksums were tracked. An already recorded checksum is left
+// untouched.
+func (r *Repository) SetChecksum(ctx context.Context, row filedata.Row, checksum string) error {
+	_, err := r.DB.ExecContext(ctx, `UPDATE file_data SET checksum = $1
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND checksum IS NULL`,
+		checksum, row.FileID, string(row.Type), row.UserID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
+
+// RecordReplicationFailure increments the count of failed replication attempts
+// for the row. If the count reaches maxAttempts, or the failure is permanent
+// (and in both cases maxAttempts is positive), the row is moved to the dead
+// letter state. It returns true if the row is now dead lettered. lastError is
+// kept with the row for investigating it later.
+//
+// It fails with ErrLockLost if the row's lock is no longer held, e.g. because
+// the row has been updated with new data since.
+func (r *Repository) RecordReplicationFailure(ctx context.Context, row filedata.Row, maxAttempts int, permanent bool, lastError string) (bool, error) {
+	var deadLettered bool
+	err := r.DB.QueryRowContext(ctx, `UPDATE file_data
+		SET attempt_count = attempt_count + 1,
+		    is_dead_lettered = ($4 > 0 AND ($5 OR attempt_count + 1 >= $4)),
+		    last_error = $7, last_error_at = now_utc_micro_seconds()
+		WHERE file_id = $1 AND data_type = $2 AND user_id = $3 AND lock_token IS NOT DISTINCT FROM $6
+		RETURNING is_dead_lettered`, row.FileID, string(row.Type), row.UserID, maxAttempts, permanent, row.LockToken, lastError).Scan(&deadLettered)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, stacktrace.Propagate(ErrLockLost, "")
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	return deadLettered, nil
+}
+
+// CoalescedFailure is when (epoch microseconds) a row last failed, without the
+// failure being recorded with RecordReplicationFailure.
+type CoalescedFailure struct {
+	FileID   int64
+	Type     ente.ObjectType
+	FailedAt int64
+}
+
+// TouchReplicationFailures moves last_error_at of the rows forward to when they
+// last failed. The rows that have been replicated since their last recorded
+// failure are left alone.
+func (r *Repository) TouchReplicationFailures(ctx context.Context, failures []CoalescedFailure) error {
+	fileIDs := make([]int64, len(failures))
+	types := make([]string, len(failures))
+	failedAt := make([]int64, len(failures))
+	for i, f := range failures {
+		fileIDs[i], types[i], failedAt[i] = f.FileID, string(f.Type), f.FailedAt
+	}
+	_, err := r.DB.ExecContext(ctx, `UPDATE file_data AS f SET last_error_at = greatest(f.last_error_at, v.failed_at)
+		FROM unnest($1::bigint[], $2::object_type[], $3::bigint[]) AS v(file_id, data_type, failed_at)
+		WHERE f.file_id = v.file_id AND f.data_type = v.data_type AND f.last_error_at IS NOT NULL`,
+		pq.Array(fileIDs), pq.Array(types), pq.Array(failedAt))
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
+
+// GetLastReplicationError returns the error of the most recent failed
+// replication attempt of the row, and when (epoch microseconds) it happened.
+// Both are nil if the row hasn't failed since it was last replicated.
+func (r *Repository) GetLastReplicationError(ctx context.Context, fileID int64, oType ente.ObjectType) (*string, *int64, error) {
+	var lastError *string
+	var lastErrorAt *int64
+	err := r.DB.QueryRowContext(ctx, `SELECT last_error, last_error_at FROM file_data WHERE file_id = $1 AND data_type = $2`,
+		fileID, string(oType)).Scan(&lastError, &lastErrorAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, stacktrace.Propagate(ente.ErrNotFound, "no file data for file %d and type %s", fileID, oType)
+	}
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "")
+	}
+	return lastError, lastErrorAt, nil
+}
+
+// GetDeadLetteredRows returns up to limit dead lettered rows, most recently
+// updated first, along with the error that their last attempt failed with.
+func (r *Repository) GetDeadLetteredRows(ctx context.Context, limit int) ([]filedata.DeadLetteredRow, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT file_id, user_id, data_type, size, latest_bucket, replicated_buckets, attempt_count, updated_at, last_error, last_error_at
+		FROM file_data
+		WHERE is_dead_lettered = true
+		ORDER BY updated_at DESC
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	result := make([]filedata.DeadLetteredRow, 0)
+	for rows.Next() {
+		var row filedata.DeadLetteredRow
+		if err := rows.Scan(&row.FileID, &row.UserID, &row.Type, &row.Size, &row.LatestBucket, pq.Array(&row.ReplicatedBuckets),
+			&row.AttemptCount, &row.UpdatedAt, &row.LastError, &row.LastErrorAt); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return result, nil
+}
+
+// RequeueDeadLettered moves a dead lettered row back into the replication queue,
+// resetting its attempt count and lock so that it is picked up again soon.
+func (r *Repository) RequeueDeadLettered(ctx context.Context, fileID int64, oType ente.ObjectType) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data
+		SET is_dead_lettered = false, attempt_count = 0, sync_locked_till = now_utc_micro_seconds()
+		WHERE file_id = $1 AND data_type = $2 AND is_dead_lettered = true`, fileID, string(oType))
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return stacktrace.Propagate(ente.ErrNotFound, "no dead lettered row for file %d and type %s", fileID, oType)
+	}
+	return nil
+}
+
+// RequeueFailed moves all the live rows of the type whose replication has
+// failed, dead lettered or not, back into the replication queue, resetting
+// their attempt count and lock like RequeueDeadLettered. It returns the number
+// of rows requeued.
+//
+// If errorContains is not empty, only the rows whose last error contains it are
+// requeued, and if failedSince or failedUntil (epoch microseconds) are
+// positive, only the rows whose last failure happened in between. Rows that
+// are locked by a worker that sent a heartbeat after activeSince are left
+// alone, since they are being retried at the moment.
+func (r *Repository) RequeueFailed(ctx context.Context, oType ente.ObjectType, errorContains string, failedSince int64, failedUntil int64, activeSince int64) (int64, error) {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data
+		SET is_dead_lettered = false, attempt_count = 0, sync_locked_till = now_utc_micro_seconds()
+		WHERE data_type = $1 AND pending_sync = true AND is_deleted = false
+		AND (is_dead_lettered = true OR attempt_count > 0)
+		AND ($2 = '' OR strpos(last_error, $2) > 0)
+		AND ($3::bigint <= 0 OR last_error_at >= $3)
+		AND ($4::bigint <= 0 OR last_error_at <= $4)
+		AND NOT (sync_locked_till > now_utc_micro_seconds() AND coalesce(lock_heartbeat_at, 0) > $5)`,
+		string(oType), errorContains, failedSince, failedUntil, activeSince)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return rowsAffected, nil
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanRow reads the rowColumns of a single row into a filedata.Row
+func scanRow(s rowScanner) (filedata.Row, error) {
+	var fileData filedata.Row
+	err := s.Scan(&fileData.FileID, &fileData.UserID, &fileData.Type, &fileData.Size, &fileData.LatestBucket, pq.Array(&fileData.ReplicatedBuckets), pq.Array(&fileData.DeleteFromBuckets), pq.Array(&fileData.InflightReplicas), &fileData.PendingSync, &fileData.IsDeleted, &fileData.SyncLockedTill, &fileData.CreatedAt, &fileData.UpdatedAt, &fileData.AttemptCount, &fileData.IsDeadLettered, &fileData.Checksum, pq.Array(&fileData.CompressedBuckets), &fileData.LockToken, pq.Array(&fileData.ReplicaOverride), pq.Array(&fileData.ReplicatedSideObjects), &fileData.LockHeartbeatAt, pq.Array(&fileData.ReplicaVersions))
+	return fileData, err
+}
+
 func convertRowsToFilesData(rows *sql.Rows) ([]filedata.Row, error) {
+	defer rows.Close()
 	var filesData []filedata.Row
 	for rows.Next() {
-		var fileData filedata.Row
-		err := rows.Scan(&fileData.FileID, &fileData.UserID, &fileData.Type, &fileData.Size, &fileData.LatestBucket, pq.Array(&fileData.ReplicatedBuckets), pq.Array(&fileData.DeleteFromBuckets), pq.Array(&fileData.InflightReplicas), &fileData.PendingSync, &fileData.IsDeleted, &fileData.SyncLockedTill, &fileData.CreatedAt, &fileData.UpdatedAt)
+		fileData, err := scanRow(rows)
 		if err != nil {
 			return nil, stacktrace.Propagate(err, "")
 		}
@@ -0,0 +1,35 @@
+package filedata
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// SideObjectEntry is how a side object copied to a bucket is recorded in
+// replicated_side_objects.
+func SideObjectEntry(bucketID string, objectKey string) string {
+	return bucketID + ":" + objectKey
+}
+
+// RecordSideObjectReplicated records that the side object has been copied to
+// bucketID, provided the row is still locked by row.LockToken.
+func (r *Repository) RecordSideObjectReplicated(ctx context.Context, row filedata.Row, bucketID string, objectKey string) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data
+		SET replicated_side_objects = array_append(array_remove(replicated_side_objects, $1), $1)
+		WHERE file_id = $2 AND data_type = $3 AND user_id = $4 AND lock_token IS NOT DISTINCT FROM $5 AND is_deleted = false`,
+		SideObjectEntry(bucketID, objectKey), row.FileID, string(row.Type), row.UserID, row.LockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return r.notUpdatedError(ctx, row, fmt.Sprintf("side object %s not recorded for %s", objectKey, bucketID))
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/stacktrace"
+)
+
+// ClaimTaskLock claims the task lock with the given name (in the task_lock
+// table, see repo.TaskLockRepository) for the instance till lockTill (epoch
+// microseconds), and returns true if the instance holds it. A lock that has
+// expired is taken over, and one that the instance already holds is extended,
+// so that a task is done by one instance at a time for as long as it keeps
+// claiming the lock.
+func (r *Repository) ClaimTaskLock(ctx context.Context, name string, lockTill int64) (bool, error) {
+	res, err := r.DB.ExecContext(ctx, `INSERT INTO task_lock (task_name, lock_until, locked_at, locked_by)
+		VALUES ($1, $2, now_utc_micro_seconds(), $3)
+		ON CONFLICT ON CONSTRAINT task_lock_pkey DO UPDATE SET lock_until = $2, locked_at = now_utc_micro_seconds(), locked_by = $3
+		WHERE task_lock.lock_until < now_utc_micro_seconds() OR task_lock.locked_by = $3`, name, lockTill, r.instanceID())
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	return rowsAffected == 1, nil
+}
@@ -0,0 +1,119 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+	"github.com/lib/pq"
+)
+
+// UsageKey is a user's hourly bucket in file_data_replication_usage.
+type UsageKey struct {
+	UserID int64
+	// Hour is the start of the hour in epoch microseconds
+	Hour int64
+}
+
+// UsageDelta is the work to add to a user's hourly bucket.
+type UsageDelta struct {
+	Bytes   int64
+	Objects int64
+}
+
+// AddReplicationUsage adds the given work to the users' hourly buckets.
+func (r *Repository) AddReplicationUsage(ctx context.Context, usage map[UsageKey]UsageDelta) error {
+	if len(usage) == 0 {
+		return nil
+	}
+	userIDs := make([]int64, 0, len(usage))
+	hours := make([]int64, 0, len(usage))
+	bytes := make([]int64, 0, len(usage))
+	objects := make([]int64, 0, len(usage))
+	for key, delta := range usage {
+		userIDs = append(userIDs, key.UserID)
+		hours = append(hours, key.Hour)
+		bytes = append(bytes, delta.Bytes)
+		objects = append(objects, delta.Objects)
+	}
+	_, err := r.DB.ExecContext(ctx, `INSERT INTO file_data_replication_usage (user_id, hour, bytes, objects)
+		SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::bigint[], $4::bigint[])
+		ON CONFLICT (user_id, hour) DO UPDATE
+		SET bytes = file_data_replication_usage.bytes + EXCLUDED.bytes,
+			objects = file_data_replication_usage.objects + EXCLUDED.objects`,
+		pq.Array(userIDs), pq.Array(hours), pq.Array(bytes), pq.Array(objects))
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
+
+// GetReplicationUsage returns the work done for each user in the hourly
+// buckets starting at or after since (epoch microseconds), the users with the
+// most bytes first. If userID is not nil, only that user is returned.
+func (r *Repository) GetReplicationUsage(ctx context.Context, since int64, userID *int64, limit int) ([]filedata.UserReplicationUsage, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT user_id, SUM(bytes), SUM(objects)
+		FROM file_data_replication_usage
+		WHERE hour >= $1 AND ($2::bigint IS NULL OR user_id = $2)
+		GROUP BY user_id
+		ORDER BY SUM(bytes) DESC
+		LIMIT $3`, since, userID, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	result := make([]filedata.UserReplicationUsage, 0)
+	for rows.Next() {
+		var u filedata.UserReplicationUsage
+		if err := rows.Scan(&u.UserID, &u.Bytes, &u.Objects); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		result = append(result, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return result, nil
+}
+
+// GetUsersOverReplicationQuota returns the users for whom, in the hourly
+// buckets starting at or after since (epoch microseconds), more than maxBytes
+// bytes or more than maxObjects objects have been replicated. A non-positive
+// maximum is not checked.
+func (r *Repository) GetUsersOverReplicationQuota(ctx context.Context, since int64, maxBytes int64, maxObjects int64) ([]int64, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT user_id
+		FROM file_data_replication_usage
+		WHERE hour >= $1
+		GROUP BY user_id
+		HAVING ($2::bigint > 0 AND SUM(bytes) > $2) OR ($3::bigint > 0 AND SUM(objects) > $3)`, since, maxBytes, maxObjects)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	defer rows.Close()
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return userIDs, nil
+}
+
+// PruneReplicationUsage deletes the hourly buckets that start before the given
+// time (epoch microseconds), returning the number of buckets deleted.
+func (r *Repository) PruneReplicationUsage(ctx context.Context, before int64) (int64, error) {
+	res, err := r.DB.ExecContext(ctx, `DELETE FROM file_data_replication_usage WHERE hour < $1`, before)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	return n, nil
+}
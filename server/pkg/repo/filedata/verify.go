@@ -0,0 +1,38 @@
+package filedata
+
+import (
+	"context"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// GetRowsDueForVerification returns up to limit live, fully replicated rows
+// that have neither been verified nor replicated since verifiedBefore (epoch
+// microseconds), the least recently verified first. Each due row is included
+// with probability sampleRate, so that only a fraction of them is verified in
+// each pass.
+func (r *Repository) GetRowsDueForVerification(ctx context.Context, verifiedBefore int64, sampleRate float64, limit int) ([]filedata.Row, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+rowColumns+`
+		FROM file_data
+		WHERE is_deleted = false AND pending_sync = false
+		AND COALESCE(last_verified_at, replicated_at, 0) < $1
+		AND random() < $2
+		ORDER BY COALESCE(last_verified_at, replicated_at, 0)
+		LIMIT $3`, verifiedBefore, sampleRate, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+	return convertRowsToFilesData(rows)
+}
+
+// MarkVerified records that the replicated copies of the row have just been
+// verified.
+func (r *Repository) MarkVerified(ctx context.Context, row filedata.Row) error {
+	_, err := r.DB.ExecContext(ctx, `UPDATE file_data SET last_verified_at = now_utc_micro_seconds()
+		WHERE file_id = $1 AND data_type = $2 AND user_id = $3`, row.FileID, string(row.Type), row.UserID)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package filedata
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ente-io/museum/ente/filedata"
+	"github.com/ente-io/stacktrace"
+)
+
+// ReplicaVersionEntry is how the version written to a versioned bucket is
+// recorded in replica_versions.
+func ReplicaVersionEntry(bucketID string, versionID string) string {
+	return bucketID + ":" + versionID
+}
+
+// RecordReplicaVersion records versionID as the version of the row's metadata
+// object that has been written to bucketID, replacing the one recorded for the
+// bucket before (if any), provided the row is still locked by row.LockToken.
+func (r *Repository) RecordReplicaVersion(ctx context.Context, row filedata.Row, bucketID string, versionID string) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE file_data
+		SET replica_versions = array_append(
+			array(SELECT e FROM unnest(replica_versions) AS e WHERE NOT starts_with(e, $1::text || ':')), $2::text)
+		WHERE file_id = $3 AND data_type = $4 AND user_id = $5 AND lock_token IS NOT DISTINCT FROM $6 AND is_deleted = false`,
+		bucketID, ReplicaVersionEntry(bucketID, versionID), row.FileID, string(row.Type), row.UserID, row.LockToken)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if rowsAffected == 0 {
+		return r.notUpdatedError(ctx, row, fmt.Sprintf("version %s not recorded for %s", versionID, bucketID))
+	}
+	return nil
+}
@@ -33,30 +33,45 @@ import (
 )
 
 func ConfigureViper(environment string) error {
+	return configure(viper.GetViper(), environment)
+}
+
+// ReadViper reads the config into a new Viper instance, the same way that
+// ConfigureViper reads it into the global one. The global instance is read
+// concurrently by everything that runs, and so can't be read again in place.
+func ReadViper(environment string) (*viper.Viper, error) {
+	v := viper.New()
+	if err := configure(v, environment); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func configure(v *viper.Viper, environment string) error {
 	// Ask Viper to read in values from the environment. These values will
 	// override the values specified in the config files.
-	viper.AutomaticEnv()
+	v.AutomaticEnv()
 	// Set the prefix for the environment variables that Viper will look for.
-	viper.SetEnvPrefix("ENTE")
+	v.SetEnvPrefix("ENTE")
 	// Ask Viper to look for underscores (instead of dots) for nested configs.
-	viper.SetEnvKeyReplacer(strings.NewReplacer(`.`, `_`))
+	v.SetEnvKeyReplacer(strings.NewReplacer(`.`, `_`))
 
-	viper.SetConfigFile("configurations/" + environment + ".yaml")
-	err := viper.ReadInConfig()
+	v.SetConfigFile("configurations/" + environment + ".yaml")
+	err := v.ReadInConfig()
 	if err != nil {
 		return err
 	}
 
-	credentialsFile := viper.GetString("credentials-file")
+	credentialsFile := v.GetString("credentials-file")
 	if credentialsFile == "" {
 		credentialsFile = "credentials.yaml"
 	}
-	err = mergeConfigFileIfExists(credentialsFile)
+	err = mergeConfigFileIfExists(v, credentialsFile)
 	if err != nil {
 		return err
 	}
 
-	err = mergeConfigFileIfExists("museum.yaml")
+	err = mergeConfigFileIfExists(v, "museum.yaml")
 	if err != nil {
 		return err
 	}
@@ -64,14 +79,14 @@ func ConfigureViper(environment string) error {
 	return nil
 }
 
-func mergeConfigFileIfExists(configFile string) error {
+func mergeConfigFileIfExists(v *viper.Viper, configFile string) error {
 	configFileExists, err := doesFileExist(configFile)
 	if err != nil {
 		return err
 	}
 	if configFileExists {
-		viper.SetConfigFile(configFile)
-		err = viper.MergeInConfig()
+		v.SetConfigFile(configFile)
+		err = v.MergeInConfig()
 		if err != nil {
 			return err
 		}
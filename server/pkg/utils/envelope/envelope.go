@@ -0,0 +1,122 @@
+// Package envelope encrypts objects with envelope encryption: each object is
+// encrypted with its own random data key, and the data key is stored alongside
+// the ciphertext, itself encrypted ("wrapped") with a key encryption key that
+// is managed by a KeyProvider.
+//
+// Objects and data keys are encrypted with libsodium's secretbox
+// (XSalsa20-Poly1305).
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	cryptosecretbox "github.com/GoKillers/libsodium-go/cryptosecretbox"
+	"github.com/ente-io/museum/pkg/utils/auth"
+)
+
+// magic starts every sealed object. Metadata objects are JSON (or gzip), and
+// so never start with a zero byte, which lets readers tell sealed objects
+// apart.
+var magic = []byte{0x00, 'e', 'n', 'v', 1}
+
+// ErrUnknownKey is returned by key providers for key IDs that they don't have.
+var ErrUnknownKey = errors.New("unknown key encryption key")
+
+// KeyProvider generates and unwraps data keys. Its methods correspond to the
+// data key operations of KMSs, e.g. GenerateDataKey and Decrypt of AWS KMS, so
+// that one can be plugged in.
+type KeyProvider interface {
+	// GenerateDataKey returns a new data key, in plain and wrapped with the
+	// key encryption key keyID.
+	GenerateDataKey(ctx context.Context, keyID string) (plain []byte, wrapped []byte, err error)
+	// DecryptDataKey unwraps a data key that was wrapped with keyID.
+	DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// IsSealed reports whether data looks like the output of Seal.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Seal encrypts data with a new data key that is wrapped with keyID.
+//
+// The result is laid out as the magic, the key ID and the wrapped data key
+// (each preceded by its length as a big endian uint16), the nonce, and the
+// ciphertext. The ciphertext is secretbox's MAC followed by the encrypted data,
+// so the result is Overhead(keyID, wrapped data key) bytes longer than data.
+func Seal(ctx context.Context, keys KeyProvider, keyID string, data []byte) ([]byte, error) {
+	dataKey, wrapped, err := keys.GenerateDataKey(ctx, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	if len(keyID) > 0xffff || len(wrapped) > 0xffff {
+		return nil, errors.New("key ID or wrapped data key too long")
+	}
+	nonce, err := auth.GenerateRandomBytes(cryptosecretbox.CryptoSecretBoxNonceBytes())
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, errCode := cryptosecretbox.CryptoSecretBoxEasy(data, nonce, dataKey)
+	if errCode != 0 {
+		return nil, errors.New("encryption failed")
+	}
+	out := make([]byte, 0, Overhead(keyID, len(wrapped))+len(data))
+	out = append(out, magic...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(keyID)))
+	out = append(out, keyID...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	out = append(out, nonce...)
+	return append(out, ciphertext...), nil
+}
+
+// Open decrypts the output of Seal.
+func Open(ctx context.Context, keys KeyProvider, sealed []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, errors.New("not a sealed object")
+	}
+	rest := sealed[len(magic):]
+	keyID, rest, ok := readField(rest)
+	if !ok {
+		return nil, errors.New("truncated key ID")
+	}
+	wrapped, rest, ok := readField(rest)
+	if !ok {
+		return nil, errors.New("truncated data key")
+	}
+	nonceSize := cryptosecretbox.CryptoSecretBoxNonceBytes()
+	if len(rest) < nonceSize+cryptosecretbox.CryptoSecretBoxMacBytes() {
+		return nil, errors.New("truncated ciphertext")
+	}
+	dataKey, err := keys.DecryptDataKey(ctx, string(keyID), wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	data, errCode := cryptosecretbox.CryptoSecretBoxOpenEasy(rest[nonceSize:], rest[:nonceSize], dataKey)
+	if errCode != 0 {
+		return nil, errors.New("decryption failed")
+	}
+	return data, nil
+}
+
+// Overhead returns by how many bytes Seal grows the data when wrapping its data
+// key with keyID results in wrappedLen bytes.
+func Overhead(keyID string, wrappedLen int) int {
+	return len(magic) + 2 + len(keyID) + 2 + wrappedLen +
+		cryptosecretbox.CryptoSecretBoxNonceBytes() + cryptosecretbox.CryptoSecretBoxMacBytes()
+}
+
+func readField(b []byte) (field []byte, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
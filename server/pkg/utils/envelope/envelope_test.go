@@ -0,0 +1,79 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func testKeys(t *testing.T) *StaticKeyProvider {
+	keys, err := NewStaticKeyProvider(map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestSealOpen(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeys(t)
+	data := []byte(`{"encryptedData":"abc"}`)
+	sealed, err := Seal(ctx, keys, "k1", data)
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if !IsSealed(sealed) || IsSealed(data) {
+		t.Error("IsSealed() did not tell sealed and plain data apart")
+	}
+	if bytes.Contains(sealed, data) {
+		t.Error("sealed object contains the plain data")
+	}
+	_, wrapped, _ := keys.GenerateDataKey(ctx, "k1")
+	if got, want := len(sealed), len(data)+Overhead("k1", len(wrapped)); got != want {
+		t.Errorf("sealed size = %d, want %d", got, want)
+	}
+	opened, err := Open(ctx, keys, sealed)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if !bytes.Equal(opened, data) {
+		t.Errorf("Open() = %q, want %q", opened, data)
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeys(t)
+	sealed, err := Seal(ctx, keys, "k1", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := Open(ctx, keys, tampered); err == nil {
+		t.Error("Open() of tampered ciphertext succeeded")
+	}
+	if _, err := Open(ctx, keys, sealed[:len(sealed)-20]); err == nil {
+		t.Error("Open() of truncated object succeeded")
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeys(t)
+	if _, err := Seal(ctx, keys, "missing", []byte("data")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Seal() error = %v, want ErrUnknownKey", err)
+	}
+	sealed, err := Seal(ctx, keys, "k2", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewStaticKeyProvider(map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if _, err := Open(ctx, other, sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open() error = %v, want ErrUnknownKey", err)
+	}
+}
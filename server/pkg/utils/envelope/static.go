@@ -0,0 +1,64 @@
+package envelope
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	cryptosecretbox "github.com/GoKillers/libsodium-go/cryptosecretbox"
+	"github.com/ente-io/museum/pkg/utils/auth"
+)
+
+// StaticKeyProvider is a KeyProvider whose key encryption keys are given to it,
+// e.g. from the configuration. Data keys are wrapped with secretbox, the
+// wrapped key being the nonce followed by the ciphertext.
+type StaticKeyProvider struct {
+	keys map[string][]byte
+}
+
+// NewStaticKeyProvider returns a provider for the given key encryption keys,
+// keyed by their ID. Each must be a 32 byte secretbox key.
+func NewStaticKeyProvider(keys map[string][]byte) (*StaticKeyProvider, error) {
+	for id, key := range keys {
+		if len(key) != cryptosecretbox.CryptoSecretBoxKeyBytes() {
+			return nil, fmt.Errorf("key %s is %d bytes long, and not %d", id, len(key), cryptosecretbox.CryptoSecretBoxKeyBytes())
+		}
+	}
+	return &StaticKeyProvider{keys: keys}, nil
+}
+
+func (p *StaticKeyProvider) GenerateDataKey(ctx context.Context, keyID string) ([]byte, []byte, error) {
+	kek, ok := p.keys[keyID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	dataKey, err := auth.GenerateRandomBytes(cryptosecretbox.CryptoSecretBoxKeyBytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := auth.GenerateRandomBytes(cryptosecretbox.CryptoSecretBoxNonceBytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, errCode := cryptosecretbox.CryptoSecretBoxEasy(dataKey, nonce, kek)
+	if errCode != 0 {
+		return nil, nil, errors.New("failed to wrap data key")
+	}
+	return dataKey, append(nonce, wrapped...), nil
+}
+
+func (p *StaticKeyProvider) DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	kek, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	nonceSize := cryptosecretbox.CryptoSecretBoxNonceBytes()
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("wrapped data key too short")
+	}
+	dataKey, errCode := cryptosecretbox.CryptoSecretBoxOpenEasy(wrapped[nonceSize:], wrapped[:nonceSize], kek)
+	if errCode != 0 {
+		return nil, errors.New("failed to unwrap data key")
+	}
+	return dataKey, nil
+}
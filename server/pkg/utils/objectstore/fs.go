@@ -0,0 +1,167 @@
+package objectstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FSStore is an ObjectStore that keeps objects as files under a root directory.
+// It is meant for local development and testing. Like the MemoryStore, its
+// transfers fail once their context is done.
+type FSStore struct {
+	root string
+}
+
+func NewFSStore(root string) *FSStore {
+	return &FSStore{root: root}
+}
+
+// path maps the key to a file under root, refusing keys that would escape it.
+func (s *FSStore) path(key string) (string, error) {
+	p := filepath.Join(s.root, filepath.FromSlash(key))
+	if p != s.root && !strings.HasPrefix(p, filepath.Clean(s.root)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return p, nil
+}
+
+func (s *FSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := s.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return withContext(ctx, f), nil
+}
+
+// open opens the file of the object, unless ctx is already done.
+func (s *FSStore) open(ctx context.Context, key string) (*os.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return f, err
+}
+
+// GetRange doesn't return the ETag, since that would need reading the whole
+// file.
+func (s *FSStore) GetRange(ctx context.Context, key string, offset int64) (io.ReadCloser, ObjectInfo, error) {
+	f, err := s.open(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	stat, err := f.Stat()
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return withContext(ctx, f), ObjectInfo{Size: stat.Size()}, nil
+}
+
+func (s *FSStore) Put(ctx context.Context, key string, body io.Reader, size int64) (ObjectInfo, error) {
+	if err := s.put(key, contextReader{ctx: ctx, r: body}); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.Head(ctx, key)
+}
+
+func (s *FSStore) put(key string, body io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename, so that readers never see a
+	// partially written object
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *FSStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer r.Close()
+	h := md5.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: size, ETag: `"` + hex.EncodeToString(h.Sum(nil)) + `"`}, nil
+}
+
+// List walks the whole root on every call, which is fine for the small trees
+// that it is meant for.
+func (s *FSStore) List(ctx context.Context, startAfter string, limit int) ([]string, bool, error) {
+	var keys []string
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); key > startAfter {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+func (s *FSStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
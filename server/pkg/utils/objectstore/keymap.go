@@ -0,0 +1,231 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errNotListable is returned by KeyMappedStore.List if the store that it wraps
+// can't list its objects.
+var errNotListable = errors.New("store can't list its objects")
+
+// KeyMapping maps the keys of objects to the keys under which they are stored in
+// a bucket with a layout of its own, e.g. with every key under a tenant prefix,
+// or with flattened paths. The zero value is the identity, which stores the
+// objects under their own keys.
+//
+// The mapping is reversible (see Canonical), and keeps the byte-wise order of
+// the file data keys ("<user>/file-data/<file>/<type>"), so that their listings
+// can be resumed and matched against the rows as in the other buckets.
+type KeyMapping struct {
+	// Prefix is prepended to each key
+	Prefix string
+	// Separator replaces each "/" in the key, if set
+	Separator string
+}
+
+// IsIdentity reports whether the mapping stores the objects under their own
+// keys.
+func (m KeyMapping) IsIdentity() bool {
+	return m.Prefix == "" && (m.Separator == "" || m.Separator == "/")
+}
+
+// Validate returns an error if the keys that the mapping stores objects under
+// can't be mapped back to the keys of the objects, or would not be listed in
+// the same order. This is the case unless the separator is made of the
+// printable characters that sort before digits and "-", which don't occur in
+// the file data keys.
+func (m KeyMapping) Validate() error {
+	if m.Separator == "" || m.Separator == "/" {
+		return nil
+	}
+	for i := 0; i < len(m.Separator); i++ {
+		if b := m.Separator[i]; b < '!' || b >= '-' {
+			return fmt.Errorf("key separator %q can only have the characters %s", m.Separator, "!\"#$%&'()*+,")
+		}
+	}
+	return nil
+}
+
+// Key returns the key that the object with the given key is stored under.
+func (m KeyMapping) Key(key string) string {
+	if m.Separator != "" && m.Separator != "/" {
+		key = strings.ReplaceAll(key, "/", m.Separator)
+	}
+	return m.Prefix + key
+}
+
+// Canonical returns the key of the object stored under storedKey, i.e. the one
+// that Key maps to storedKey, and false if the stored key isn't one that the
+// mapping would store an object under.
+func (m KeyMapping) Canonical(storedKey string) (string, bool) {
+	key, ok := strings.CutPrefix(storedKey, m.Prefix)
+	if !ok {
+		return "", false
+	}
+	if m.Separator != "" && m.Separator != "/" {
+		if strings.Contains(key, "/") {
+			return "", false
+		}
+		key = strings.ReplaceAll(key, m.Separator, "/")
+	}
+	return key, m.Key(key) == storedKey
+}
+
+func (m KeyMapping) String() string {
+	return fmt.Sprintf("prefix=%q separator=%q", m.Prefix, m.Separator)
+}
+
+// KeyMappedStore is an ObjectStore that stores the objects of another one
+// under the keys of a KeyMapping. It is read and written with the keys of the
+// objects, and lists them by these keys too, leaving out the stored objects
+// whose keys the mapping doesn't map to.
+//
+// It wraps stores that keep metadata, like the S3 and memory stores. The
+// capabilities that the wrapped store doesn't have fail with the same errors
+// as the controller would return for a store without them, or do nothing.
+type KeyMappedStore struct {
+	store   ObjectStore
+	mapping KeyMapping
+}
+
+func NewKeyMappedStore(store ObjectStore, mapping KeyMapping) *KeyMappedStore {
+	return &KeyMappedStore{store: store, mapping: mapping}
+}
+
+// Mapping returns the mapping that the objects are stored with.
+func (s *KeyMappedStore) Mapping() KeyMapping {
+	return s.mapping
+}
+
+func (s *KeyMappedStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.store.Get(ctx, s.mapping.Key(key))
+}
+
+func (s *KeyMappedStore) GetRange(ctx context.Context, key string, offset int64) (io.ReadCloser, ObjectInfo, error) {
+	getter, ok := s.store.(RangeGetter)
+	if !ok {
+		if offset > 0 {
+			return nil, ObjectInfo{}, fmt.Errorf("the store can't read %s from an offset", key)
+		}
+		body, err := s.store.Get(ctx, s.mapping.Key(key))
+		return body, ObjectInfo{Size: -1}, err
+	}
+	return getter.GetRange(ctx, s.mapping.Key(key), offset)
+}
+
+func (s *KeyMappedStore) Put(ctx context.Context, key string, body io.Reader, size int64) (ObjectInfo, error) {
+	return s.store.Put(ctx, s.mapping.Key(key), body, size)
+}
+
+func (s *KeyMappedStore) PutWithMetadata(ctx context.Context, key string, body io.Reader, size int64, metadata ObjectMetadata) (ObjectInfo, error) {
+	putter, ok := s.store.(MetadataPutter)
+	if !ok {
+		return s.store.Put(ctx, s.mapping.Key(key), body, size)
+	}
+	return putter.PutWithMetadata(ctx, s.mapping.Key(key), body, size, metadata)
+}
+
+func (s *KeyMappedStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.store.Head(ctx, s.mapping.Key(key))
+}
+
+func (s *KeyMappedStore) Delete(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, s.mapping.Key(key))
+}
+
+func (s *KeyMappedStore) GetVersion(ctx context.Context, key string, versionID string) (io.ReadCloser, error) {
+	reader, ok := s.store.(VersionReader)
+	if !ok {
+		return nil, fmt.Errorf("the store can't read versions of %s", key)
+	}
+	return reader.GetVersion(ctx, s.mapping.Key(key), versionID)
+}
+
+func (s *KeyMappedStore) HeadVersion(ctx context.Context, key string, versionID string) (ObjectInfo, error) {
+	reader, ok := s.store.(VersionReader)
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("the store can't read versions of %s", key)
+	}
+	return reader.HeadVersion(ctx, s.mapping.Key(key), versionID)
+}
+
+// CopyFrom copies the object from another KeyMappedStore with the same
+// mapping, so that the object has the same stored key in both. Copies between
+// stores with different mappings fail with ErrCopyUnsupported, as the stores
+// can only copy an object to the key it was stored under.
+func (s *KeyMappedStore) CopyFrom(ctx context.Context, src ObjectStore, key string) (ObjectInfo, error) {
+	copier, ok := s.store.(Copier)
+	srcStore, isMapped := src.(*KeyMappedStore)
+	if !ok || !isMapped || srcStore.mapping != s.mapping {
+		return ObjectInfo{}, ErrCopyUnsupported
+	}
+	return copier.CopyFrom(ctx, srcStore.store, s.mapping.Key(key))
+}
+
+// List lists the objects stored under the keys that the mapping maps to, by
+// their own keys. The keys that come after the prefix without starting with
+// it are past the end of the listing, since they are listed in order.
+func (s *KeyMappedStore) List(ctx context.Context, startAfter string, limit int) ([]string, bool, error) {
+	lister, ok := s.store.(Lister)
+	if !ok {
+		return nil, false, errNotListable
+	}
+	after := s.mapping.Prefix
+	if startAfter != "" {
+		after = s.mapping.Key(startAfter)
+	}
+	for {
+		stored, more, err := lister.List(ctx, after, limit)
+		if err != nil {
+			return nil, false, err
+		}
+		keys := make([]string, 0, len(stored))
+		for _, storedKey := range stored {
+			if !strings.HasPrefix(storedKey, s.mapping.Prefix) {
+				return keys, false, nil
+			}
+			if key, ok := s.mapping.Canonical(storedKey); ok {
+				keys = append(keys, key)
+			}
+		}
+		// Keep going past the pages without any of the objects, so that an
+		// empty page is only returned at the end of the listing
+		if len(keys) > 0 || !more || len(stored) == 0 {
+			return keys, more, nil
+		}
+		after = stored[len(stored)-1]
+	}
+}
+
+// ListMultipartUploads lists the incomplete uploads of the objects stored under
+// the keys that the mapping maps to, by the keys of the objects.
+func (s *KeyMappedStore) ListMultipartUploads(ctx context.Context) ([]MultipartUpload, error) {
+	aborter, ok := s.store.(MultipartAborter)
+	if !ok {
+		return nil, nil
+	}
+	stored, err := aborter.ListMultipartUploads(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var uploads []MultipartUpload
+	for _, upload := range stored {
+		if key, ok := s.mapping.Canonical(upload.Key); ok {
+			upload.Key = key
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+func (s *KeyMappedStore) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	aborter, ok := s.store.(MultipartAborter)
+	if !ok {
+		return nil
+	}
+	return aborter.AbortMultipartUpload(ctx, s.mapping.Key(key), uploadID)
+}
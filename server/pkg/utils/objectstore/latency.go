@@ -0,0 +1,133 @@
+package objectstore
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyStore is a MemoryStore that takes time to answer, like a store across
+// a network would: every request waits for latency, and the ones that transfer
+// an object also for its size at bytesPerSecond (unless that is 0). It is meant
+// for benchmarking replication against realistic latencies.
+type LatencyStore struct {
+	*MemoryStore
+	latency        time.Duration
+	bytesPerSecond int64
+	// waited is the total time (in nanoseconds) that requests were delayed
+	waited atomic.Int64
+}
+
+func NewLatencyStore(store *MemoryStore, latency time.Duration, bytesPerSecond int64) *LatencyStore {
+	return &LatencyStore{MemoryStore: store, latency: latency, bytesPerSecond: bytesPerSecond}
+}
+
+// Waited returns the total time that the requests to the store were delayed
+// for.
+func (s *LatencyStore) Waited() time.Duration {
+	return time.Duration(s.waited.Load())
+}
+
+// wait delays a request that transfers size bytes, or returns the context's
+// error if it is done first.
+func (s *LatencyStore) wait(ctx context.Context, size int64) error {
+	delay := s.latency
+	if s.bytesPerSecond > 0 {
+		delay += time.Duration(size * int64(time.Second) / s.bytesPerSecond)
+	}
+	if delay <= 0 {
+		return nil
+	}
+	s.waited.Add(int64(delay))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *LatencyStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, _, err := s.GetRange(ctx, key, 0)
+	return body, err
+}
+
+func (s *LatencyStore) GetRange(ctx context.Context, key string, offset int64) (io.ReadCloser, ObjectInfo, error) {
+	body, info, err := s.MemoryStore.GetRange(ctx, key, offset)
+	if err != nil {
+		if waitErr := s.wait(ctx, 0); waitErr != nil {
+			return nil, ObjectInfo{}, waitErr
+		}
+		return nil, ObjectInfo{}, err
+	}
+	if err := s.wait(ctx, info.Size-offset); err != nil {
+		body.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return body, info, nil
+}
+
+func (s *LatencyStore) GetVersion(ctx context.Context, key string, versionID string) (io.ReadCloser, error) {
+	info, err := s.MemoryStore.HeadVersion(ctx, key, versionID)
+	if waitErr := s.wait(ctx, info.Size); waitErr != nil {
+		return nil, waitErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.GetVersion(ctx, key, versionID)
+}
+
+func (s *LatencyStore) HeadVersion(ctx context.Context, key string, versionID string) (ObjectInfo, error) {
+	if err := s.wait(ctx, 0); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.MemoryStore.HeadVersion(ctx, key, versionID)
+}
+
+func (s *LatencyStore) Put(ctx context.Context, key string, body io.Reader, size int64) (ObjectInfo, error) {
+	return s.PutWithMetadata(ctx, key, body, size, ObjectMetadata{})
+}
+
+func (s *LatencyStore) PutWithMetadata(ctx context.Context, key string, body io.Reader, size int64, metadata ObjectMetadata) (ObjectInfo, error) {
+	if err := s.wait(ctx, size); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.MemoryStore.PutWithMetadata(ctx, key, body, size, metadata)
+}
+
+func (s *LatencyStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	if err := s.wait(ctx, 0); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.MemoryStore.Head(ctx, key)
+}
+
+// CopyFrom copies the object from another MemoryStore or LatencyStore, which
+// takes latency, since the data doesn't pass through museum.
+func (s *LatencyStore) CopyFrom(ctx context.Context, src ObjectStore, key string) (ObjectInfo, error) {
+	if srcStore, ok := src.(*LatencyStore); ok {
+		src = srcStore.MemoryStore
+	}
+	if err := s.wait(ctx, 0); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.MemoryStore.CopyFrom(ctx, src, key)
+}
+
+func (s *LatencyStore) List(ctx context.Context, startAfter string, limit int) ([]string, bool, error) {
+	if err := s.wait(ctx, 0); err != nil {
+		return nil, false, err
+	}
+	return s.MemoryStore.List(ctx, startAfter, limit)
+}
+
+func (s *LatencyStore) Delete(ctx context.Context, key string) error {
+	if err := s.wait(ctx, 0); err != nil {
+		return err
+	}
+	return s.MemoryStore.Delete(ctx, key)
+}
@@ -0,0 +1,202 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// MemoryStore is an ObjectStore that keeps objects in memory. It is meant for
+// tests. Its transfers fail once their context is done, as over a network.
+type MemoryStore struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]ObjectMetadata
+	// versions are all the versions of each object, the current one last, if
+	// the store is versioned
+	versions map[string][]memoryVersion
+	// lastVersion numbers the versions of the store
+	lastVersion int
+}
+
+type memoryVersion struct {
+	id       string
+	data     []byte
+	metadata ObjectMetadata
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: map[string][]byte{}, metadata: map[string]ObjectMetadata{}}
+}
+
+// NewVersionedMemoryStore returns a MemoryStore that keeps every version of its
+// objects, like a versioned S3 bucket: each write creates a new version, and
+// deleting an object only removes its current version.
+func NewVersionedMemoryStore() *MemoryStore {
+	s := NewMemoryStore()
+	s.versions = map[string][]memoryVersion{}
+	return s
+}
+
+// store makes data the current contents of the object. It must be called with
+// mu held.
+func (s *MemoryStore) store(key string, data []byte, metadata ObjectMetadata) {
+	s.objects[key] = data
+	s.metadata[key] = metadata
+	if s.versions != nil {
+		s.lastVersion++
+		s.versions[key] = append(s.versions[key], memoryVersion{id: fmt.Sprintf("v%d", s.lastVersion), data: data, metadata: metadata})
+	}
+}
+
+// currentVersion returns the version ID of the current contents of the object,
+// empty if the store isn't versioned. It must be called with mu held.
+func (s *MemoryStore) currentVersion(key string) string {
+	versions := s.versions[key]
+	if len(versions) == 0 {
+		return ""
+	}
+	return versions[len(versions)-1].id
+}
+
+// version returns the version of the object. It must be called with mu held.
+func (s *MemoryStore) version(key string, versionID string) (memoryVersion, error) {
+	for _, v := range s.versions[key] {
+		if v.id == versionID {
+			return v, nil
+		}
+	}
+	return memoryVersion{}, fmt.Errorf("%w: %s version %s", ErrNotFound, key, versionID)
+}
+
+func (s *MemoryStore) GetVersion(ctx context.Context, key string, versionID string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, err := s.version(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return withContext(ctx, io.NopCloser(bytes.NewReader(v.data))), nil
+}
+
+func (s *MemoryStore) HeadVersion(ctx context.Context, key string, versionID string) (ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, err := s.version(key, versionID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	sum := md5.Sum(v.data)
+	return ObjectInfo{Size: int64(len(v.data)), ETag: `"` + hex.EncodeToString(sum[:]) + `"`, Metadata: v.metadata, VersionID: v.id}, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return withContext(ctx, io.NopCloser(bytes.NewReader(data))), nil
+}
+
+func (s *MemoryStore) GetRange(ctx context.Context, key string, offset int64) (io.ReadCloser, ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if offset > int64(len(data)) {
+		return nil, ObjectInfo{}, fmt.Errorf("offset %d is past the end of %s", offset, key)
+	}
+	sum := md5.Sum(data)
+	info := ObjectInfo{Size: int64(len(data)), ETag: `"` + hex.EncodeToString(sum[:]) + `"`, Metadata: s.metadata[key]}
+	return withContext(ctx, io.NopCloser(bytes.NewReader(data[offset:]))), info, nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key string, body io.Reader, size int64) (ObjectInfo, error) {
+	return s.PutWithMetadata(ctx, key, body, size, ObjectMetadata{})
+}
+
+func (s *MemoryStore) PutWithMetadata(ctx context.Context, key string, body io.Reader, size int64, metadata ObjectMetadata) (ObjectInfo, error) {
+	data, err := io.ReadAll(contextReader{ctx: ctx, r: body})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	s.mu.Lock()
+	s.store(key, data, metadata)
+	s.mu.Unlock()
+	return s.Head(ctx, key)
+}
+
+func (s *MemoryStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	sum := md5.Sum(data)
+	return ObjectInfo{Size: int64(len(data)), ETag: `"` + hex.EncodeToString(sum[:]) + `"`, Metadata: s.metadata[key], VersionID: s.currentVersion(key)}, nil
+}
+
+// CopyFrom copies the object from another MemoryStore (or LatencyStore).
+func (s *MemoryStore) CopyFrom(ctx context.Context, src ObjectStore, key string) (ObjectInfo, error) {
+	if latencyStore, ok := src.(*LatencyStore); ok {
+		src = latencyStore.MemoryStore
+	}
+	srcStore, ok := src.(*MemoryStore)
+	if !ok {
+		return ObjectInfo{}, ErrCopyUnsupported
+	}
+	srcStore.mu.Lock()
+	data, found := srcStore.objects[key]
+	metadata := srcStore.metadata[key]
+	srcStore.mu.Unlock()
+	if !found {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	s.mu.Lock()
+	s.store(key, data, metadata)
+	s.mu.Unlock()
+	return s.Head(ctx, key)
+}
+
+func (s *MemoryStore) List(ctx context.Context, startAfter string, limit int) ([]string, bool, error) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		if key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+	if len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	delete(s.metadata, key)
+	return nil
+}
@@ -0,0 +1,202 @@
+// Package objectstore abstracts the object storage backends that file data is
+// replicated to.
+//
+// Each bucket ID (data center) maps to an ObjectStore. S3 compatible providers
+// (including GCS, via its S3 interoperability API) use the S3 store, while the
+// filesystem and in-memory stores are meant for local development and tests.
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned (possibly wrapped) when the requested object does not
+// exist in the store.
+var ErrNotFound = errors.New("object not found")
+
+// ErrAccessDenied is returned (possibly wrapped) when the store rejects the
+// request because of missing permissions or invalid credentials.
+var ErrAccessDenied = errors.New("access to object denied")
+
+// ErrNotVisible is returned when an object has been written, but could not be
+// read back right after. Stores that are only eventually consistent may take a
+// moment to make a written object visible.
+var ErrNotVisible = errors.New("written object not visible yet")
+
+// ErrCopyUnsupported is returned when an object can't be copied between two
+// stores without reading it, e.g. because they have different backends.
+var ErrCopyUnsupported = errors.New("server-side copy not supported")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size int64
+	// ETag is the backend's entity tag for the object. For single part S3
+	// uploads without SSE-KMS it is the quoted hex MD5 of the contents, and
+	// the other stores follow the same convention.
+	ETag string
+	// StorageClass is the S3 storage class of the object, which S3 leaves
+	// empty for STANDARD. The other stores don't have storage classes.
+	StorageClass string
+	// Metadata is filled in by the stores that keep object metadata, see
+	// MetadataPutter
+	Metadata ObjectMetadata
+	// VersionID is the version of the object in a bucket that keeps every
+	// version of its objects, empty in the other buckets. For an object that
+	// has just been written, it is the version that the write created.
+	VersionID string
+}
+
+// ObjectMetadata is the metadata stored with an object besides its contents:
+// the standard headers that are served with it, and user-defined metadata.
+type ObjectMetadata struct {
+	ContentType        string
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	ContentLanguage    string
+	// User is the user-defined metadata (x-amz-meta-* for S3), keyed by the
+	// lowercased name
+	User map[string]string
+}
+
+// Equal reports whether the two have the same values. Empty user metadata is
+// equal to none.
+func (m ObjectMetadata) Equal(o ObjectMetadata) bool {
+	return m.ContentType == o.ContentType &&
+		m.CacheControl == o.CacheControl &&
+		m.ContentDisposition == o.ContentDisposition &&
+		m.ContentEncoding == o.ContentEncoding &&
+		m.ContentLanguage == o.ContentLanguage &&
+		maps.Equal(m.User, o.User)
+}
+
+// IsZero reports whether no metadata is set.
+func (m ObjectMetadata) IsZero() bool {
+	return m.Equal(ObjectMetadata{})
+}
+
+// ObjectStore is a single bucket in an object storage backend.
+type ObjectStore interface {
+	// Get returns the contents of the object. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Put stores size bytes read from body as the object, replacing any
+	// existing object with the same key. It returns the information of the
+	// stored object, as reported by the store after the upload, or
+	// ErrNotVisible if the store doesn't find the object after storing it.
+	Put(ctx context.Context, key string, body io.Reader, size int64) (ObjectInfo, error)
+	// Head returns information about the object without reading it.
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes the object. Deleting an object that does not exist is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Copier is implemented by the stores that can copy an object from another
+// store of the same backend without the data passing through museum.
+type Copier interface {
+	// CopyFrom copies the object from src to the same key in this store,
+	// replacing any existing object. It returns the information of the copy as
+	// reported by the store, or ErrCopyUnsupported if src is not a store that
+	// can be copied from. Like Put, it returns ErrNotVisible if the copy can't
+	// be found right after.
+	CopyFrom(ctx context.Context, src ObjectStore, key string) (ObjectInfo, error)
+}
+
+// MetadataPutter is implemented by the stores that keep object metadata, and
+// return it from Head.
+type MetadataPutter interface {
+	// PutWithMetadata is Put, storing the object with the given metadata.
+	PutWithMetadata(ctx context.Context, key string, body io.Reader, size int64, metadata ObjectMetadata) (ObjectInfo, error)
+}
+
+// VersionReader is implemented by the stores that can read a specific version of
+// an object, in buckets that keep every version of their objects (see
+// ObjectInfo.VersionID).
+type VersionReader interface {
+	// GetVersion returns the contents of the version of the object. The
+	// caller must close it.
+	GetVersion(ctx context.Context, key string, versionID string) (io.ReadCloser, error)
+	// HeadVersion returns information about the version of the object
+	// without reading it.
+	HeadVersion(ctx context.Context, key string, versionID string) (ObjectInfo, error)
+}
+
+// RangeGetter is implemented by the stores that can read an object starting at
+// an offset, so that an interrupted download can be resumed.
+type RangeGetter interface {
+	// GetRange returns the contents of the object from offset to its end, along
+	// with the size and ETag of the whole object. The ETag is empty if the
+	// store can't tell it without reading the object. The caller must close the
+	// returned reader.
+	GetRange(ctx context.Context, key string, offset int64) (io.ReadCloser, ObjectInfo, error)
+}
+
+// ContentRangeSize returns the size of the whole object from the value of a
+// Content-Range header ("bytes 100-199/200"), and false if it isn't known.
+func ContentRangeSize(contentRange string) (int64, bool) {
+	_, total, found := strings.Cut(contentRange, "/")
+	if !found || !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// Lister is implemented by the stores that can list their objects.
+type Lister interface {
+	// List returns the keys of up to limit objects whose keys come after
+	// startAfter, in ascending byte-wise order, and whether there are more
+	// objects after the returned ones.
+	List(ctx context.Context, startAfter string, limit int) (keys []string, more bool, err error)
+}
+
+// MultipartUpload is an upload in parts that has been started but neither
+// completed nor aborted.
+type MultipartUpload struct {
+	Key      string
+	UploadID string
+	// Initiated is when the upload was started
+	Initiated time.Time
+}
+
+// MultipartAborter is implemented by the stores that upload objects in parts,
+// and can list and abort the uploads that were left incomplete.
+type MultipartAborter interface {
+	// ListMultipartUploads returns all the incomplete uploads in the store.
+	ListMultipartUploads(ctx context.Context) ([]MultipartUpload, error)
+	// AbortMultipartUpload aborts the upload, removing the parts uploaded so
+	// far. Aborting an upload that no longer exists succeeds.
+	AbortMultipartUpload(ctx context.Context, key string, uploadID string) error
+}
+
+// contextReader fails its reads once ctx is done, so that the transfers of the
+// stores that don't go over the network stop partway through when they are
+// cancelled, like those of the S3 store.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// withContext returns body with its reads failing once ctx is done.
+func withContext(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{contextReader{ctx: ctx, r: body}, body}
+}
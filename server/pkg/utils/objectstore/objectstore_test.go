@@ -0,0 +1,273 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectStores(t *testing.T) {
+	tests := []struct {
+		name  string
+		store ObjectStore
+		// cancellable stores stop their transfers once the context is done
+		cancellable bool
+	}{
+		{"memory", NewMemoryStore(), true},
+		{"latency", NewLatencyStore(NewMemoryStore(), time.Millisecond, 1024*1024), true},
+		{"versioned", NewVersionedMemoryStore(), false},
+		{"fs", NewFSStore(t.TempDir()), true},
+		{"key mapped", NewKeyMappedStore(NewMemoryStore(), KeyMapping{Prefix: "tenant/", Separator: "!"}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			key := "1/mldata/abc"
+			if _, err := tt.store.Head(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Head() of missing object error = %v, want ErrNotFound", err)
+			}
+			info, err := tt.store.Put(ctx, key, strings.NewReader("hello"), 5)
+			if err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			if info.Size != 5 {
+				t.Errorf("Put() size = %d, want 5", info.Size)
+			}
+			info, err = tt.store.Head(ctx, key)
+			if err != nil {
+				t.Fatalf("Head() error = %v", err)
+			}
+			// ETag is the quoted MD5 of "hello"
+			if info.Size != 5 || info.ETag != `"5d41402abc4b2a76b9719d911017c592"` {
+				t.Errorf("Head() = %+v", info)
+			}
+			body, err := tt.store.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			data, _ := io.ReadAll(body)
+			body.Close()
+			if string(data) != "hello" {
+				t.Errorf("Get() = %q, want %q", data, "hello")
+			}
+			body, info, err = tt.store.(RangeGetter).GetRange(ctx, key, 2)
+			if err != nil {
+				t.Fatalf("GetRange() error = %v", err)
+			}
+			data, _ = io.ReadAll(body)
+			body.Close()
+			if string(data) != "llo" || info.Size != 5 {
+				t.Errorf("GetRange() = %q, %+v, want %q of 5 bytes", data, info, "llo")
+			}
+			if err := tt.store.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if err := tt.store.Delete(ctx, key); err != nil {
+				t.Errorf("Delete() of missing object error = %v", err)
+			}
+			if _, err := tt.store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get() of deleted object error = %v, want ErrNotFound", err)
+			}
+			if !tt.cancellable {
+				return
+			}
+			if _, err := tt.store.Put(ctx, key, strings.NewReader("hello"), 5); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+
+			// A download stops once its context is cancelled
+			ctx, cancel := context.WithCancel(context.Background())
+			body, err = tt.store.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if _, err := io.ReadFull(body, make([]byte, 1)); err != nil {
+				t.Fatalf("could not read the start of the object: %v", err)
+			}
+			cancel()
+			if _, err := io.ReadAll(body); !errors.Is(err, context.Canceled) {
+				t.Errorf("reading a cancelled download error = %v, want context.Canceled", err)
+			}
+			body.Close()
+			if _, err := tt.store.Get(ctx, key); !errors.Is(err, context.Canceled) {
+				t.Errorf("Get() with a cancelled context error = %v, want context.Canceled", err)
+			}
+
+			// An upload too, without replacing the object
+			ctx, cancel = context.WithCancel(context.Background())
+			upload := cancellingReader{r: strings.NewReader("goodbye"), cancel: cancel}
+			if _, err := tt.store.Put(ctx, key, upload, 7); !errors.Is(err, context.Canceled) {
+				t.Errorf("cancelled Put() error = %v, want context.Canceled", err)
+			}
+			if info, err := tt.store.Head(context.Background(), key); err != nil || info.Size != 5 {
+				t.Errorf("Head() after a cancelled Put() = %+v, %v, want the 5 bytes from before", info, err)
+			}
+		})
+	}
+}
+
+// cancellingReader calls cancel after its first read.
+type cancellingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r cancellingReader) Read(p []byte) (int, error) {
+	defer r.cancel()
+	return r.r.Read(p[:1])
+}
+
+func TestVersionedMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewVersionedMemoryStore()
+	key := "1/mldata/abc"
+	first, err := store.Put(ctx, key, strings.NewReader("first"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.Put(ctx, key, strings.NewReader("second"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.VersionID == "" || first.VersionID == second.VersionID {
+		t.Fatalf("Put() versions = %q and %q, want two different ones", first.VersionID, second.VersionID)
+	}
+	if info, err := store.Head(ctx, key); err != nil || info.VersionID != second.VersionID {
+		t.Errorf("Head() = %+v, %v, want version %s", info, err, second.VersionID)
+	}
+	// The older version can still be read, even once the object is deleted
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	body, err := store.GetVersion(ctx, key, first.VersionID)
+	if err != nil {
+		t.Fatalf("GetVersion() error = %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "first" {
+		t.Errorf("GetVersion() = %q, want %q", data, "first")
+	}
+	if info, err := store.HeadVersion(ctx, key, second.VersionID); err != nil || info.Size != 6 {
+		t.Errorf("HeadVersion() = %+v, %v, want 6 bytes", info, err)
+	}
+	if _, err := store.HeadVersion(ctx, key, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("HeadVersion() of a missing version error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestVersionedLatencyStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewLatencyStore(NewVersionedMemoryStore(), time.Millisecond, 0)
+	key := "1/mldata/abc"
+	first, err := store.Put(ctx, key, strings.NewReader("first"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(ctx, key, strings.NewReader("second"), 6); err != nil {
+		t.Fatal(err)
+	}
+	waited := store.Waited()
+	body, err := store.GetVersion(ctx, key, first.VersionID)
+	if err != nil {
+		t.Fatalf("GetVersion() error = %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "first" {
+		t.Errorf("GetVersion() = %q, want %q", data, "first")
+	}
+	if info, err := store.HeadVersion(ctx, key, first.VersionID); err != nil || info.Size != 5 {
+		t.Errorf("HeadVersion() = %+v, %v, want 5 bytes", info, err)
+	}
+	if got := store.Waited() - waited; got != 2*time.Millisecond {
+		t.Errorf("reads of the version waited %v, want %v", got, 2*time.Millisecond)
+	}
+}
+
+func TestObjectStoresList(t *testing.T) {
+	tests := []struct {
+		name  string
+		store interface {
+			ObjectStore
+			Lister
+		}
+	}{
+		{"memory", NewMemoryStore()},
+		{"fs", NewFSStore(t.TempDir())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			// "1-a" sorts between "1/b" and "10/c" byte-wise, but not when
+			// walking directories
+			for _, key := range []string{"10/c", "1/b", "1-a", "2"} {
+				if _, err := tt.store.Put(ctx, key, strings.NewReader(key), int64(len(key))); err != nil {
+					t.Fatalf("Put(%s) error = %v", key, err)
+				}
+			}
+			keys, more, err := tt.store.List(ctx, "", 2)
+			if err != nil || !more || strings.Join(keys, ",") != "1-a,1/b" {
+				t.Fatalf("List() = %v, %v, %v", keys, more, err)
+			}
+			keys, more, err = tt.store.List(ctx, keys[1], 2)
+			if err != nil || more || strings.Join(keys, ",") != "10/c,2" {
+				t.Fatalf("List() after 1/b = %v, %v, %v", keys, more, err)
+			}
+		})
+	}
+}
+
+func TestKeyMappedStore(t *testing.T) {
+	ctx := context.Background()
+	mapping := KeyMapping{Prefix: "tenant/", Separator: "!"}
+	if err := mapping.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (KeyMapping{Separator: "_"}).Validate(); err == nil {
+		t.Error("Validate() accepted a separator that occurs in the keys")
+	}
+	key := "12/file-data/345/mldata"
+	if got := mapping.Key(key); got != "tenant/12!file-data!345!mldata" {
+		t.Errorf("Key() = %q", got)
+	}
+	if got, ok := mapping.Canonical(mapping.Key(key)); !ok || got != key {
+		t.Errorf("Canonical() = %q, %v, want %q", got, ok, key)
+	}
+	inner := NewMemoryStore()
+	store := NewKeyMappedStore(inner, mapping)
+	for _, key := range []string{"2/file-data/1/mldata", "10/file-data/1/mldata", "1/file-data/2/mldata", "1/file-data/10/mldata"} {
+		if _, err := store.Put(ctx, key, strings.NewReader(key), int64(len(key))); err != nil {
+			t.Fatalf("Put(%s) error = %v", key, err)
+		}
+	}
+	// Objects that the mapping doesn't store under are left out
+	for _, foreign := range []string{"1/file-data/3/mldata", "tenant/1/file-data/3/mldata", "zzz"} {
+		if _, err := inner.Put(ctx, foreign, strings.NewReader("x"), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := inner.Head(ctx, "tenant/1!file-data!2!mldata"); err != nil {
+		t.Errorf("Head() of the stored key error = %v", err)
+	}
+	keys, more, err := store.List(ctx, "", 2)
+	if err != nil || !more || strings.Join(keys, ",") != "1/file-data/10/mldata,1/file-data/2/mldata" {
+		t.Fatalf("List() = %v, %v, %v", keys, more, err)
+	}
+	keys, more, err = store.List(ctx, keys[1], 10)
+	if err != nil || more || strings.Join(keys, ",") != "10/file-data/1/mldata,2/file-data/1/mldata" {
+		t.Fatalf("List() of the second page = %v, %v, %v", keys, more, err)
+	}
+	// Copies keep the stored key, so they need the same mapping on both sides
+	other := NewKeyMappedStore(NewMemoryStore(), KeyMapping{Prefix: "other/"})
+	if _, err := other.CopyFrom(ctx, store, "2/file-data/1/mldata"); !errors.Is(err, ErrCopyUnsupported) {
+		t.Errorf("CopyFrom() with another mapping error = %v, want ErrCopyUnsupported", err)
+	}
+	same := NewKeyMappedStore(NewMemoryStore(), mapping)
+	if info, err := same.CopyFrom(ctx, store, "2/file-data/1/mldata"); err != nil || info.Size != 20 {
+		t.Errorf("CopyFrom() = %+v, %v", info, err)
+	}
+}
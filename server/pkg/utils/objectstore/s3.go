@@ -0,0 +1,423 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// partRetryDelay is how long a failed part upload waits before its first retry.
+// Every further retry waits an additional partRetryDelay.
+const partRetryDelay = 500 * time.Millisecond
+
+// MultipartConfig decides which uploads an S3Store splits into parts.
+type MultipartConfig struct {
+	// Threshold is the size from which objects are uploaded in parts. Zero
+	// disables multipart uploads.
+	Threshold int64
+	// PartSize is the size of each part except the last. S3 requires it to
+	// be at least 5 MiB.
+	PartSize int64
+	// PartRetries is the number of times the upload of a single part is
+	// retried before the whole upload is given up.
+	PartRetries int
+}
+
+// S3Store is an ObjectStore backed by a bucket in an S3 compatible provider.
+type S3Store struct {
+	client    *s3.S3
+	bucket    string
+	multipart MultipartConfig
+	// storageClass is the storage class that objects are uploaded and copied
+	// with, the bucket's default if empty
+	storageClass string
+}
+
+func NewS3Store(client *s3.S3, bucket string, multipart MultipartConfig) *S3Store {
+	return &S3Store{
+		client:    client,
+		bucket:    bucket,
+		multipart: multipart,
+	}
+}
+
+// WithStorageClass makes the store upload and copy objects with the given S3
+// storage class (e.g. STANDARD_IA), and returns it.
+func (s *S3Store) WithStorageClass(storageClass string) *S3Store {
+	s.storageClass = storageClass
+	return s
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetVersion(ctx, key, "")
+}
+
+// GetVersion reads the current version of the object if versionID is empty.
+func (s *S3Store) GetVersion(ctx context.Context, key string, versionID string) (io.ReadCloser, error) {
+	res, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(s.bucket),
+		Key:       aws.String(key),
+		VersionId: optionalString(versionID),
+	})
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	return res.Body, nil
+}
+
+// GetRange asks for the bytes from offset onwards with a Range header. The
+// object's ETag and size are taken from the response.
+func (s *S3Store) GetRange(ctx context.Context, key string, offset int64) (io.ReadCloser, ObjectInfo, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, ObjectInfo{}, mapS3Error(err)
+	}
+	info := ObjectInfo{Size: aws.Int64Value(res.ContentLength), ETag: aws.StringValue(res.ETag)}
+	if offset > 0 {
+		size, ok := ContentRangeSize(aws.StringValue(res.ContentRange))
+		if !ok {
+			res.Body.Close()
+			return nil, ObjectInfo{}, fmt.Errorf("range request for %s returned no object size", key)
+		}
+		info.Size = size
+	}
+	return res.Body, info, nil
+}
+
+// Put uploads objects smaller than the multipart threshold with a single
+// request, and larger ones in parts.
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, size int64) (ObjectInfo, error) {
+	return s.PutWithMetadata(ctx, key, body, size, ObjectMetadata{})
+}
+
+// PutWithMetadata sets the metadata as the headers of the upload. In a
+// versioned bucket, the returned information is that of the version that the
+// upload created.
+func (s *S3Store) PutWithMetadata(ctx context.Context, key string, body io.Reader, size int64, metadata ObjectMetadata) (ObjectInfo, error) {
+	var versionID string
+	var err error
+	if s.multipart.Threshold > 0 && size >= s.multipart.Threshold {
+		versionID, err = s.putMultipart(ctx, key, body, metadata)
+	} else {
+		versionID, err = s.putSingle(ctx, key, body, size, metadata)
+	}
+	if err != nil {
+		return ObjectInfo{}, mapS3Error(err)
+	}
+	return s.headWritten(ctx, key, versionID)
+}
+
+// putSingle returns the version ID of the uploaded object, if the bucket is
+// versioned.
+func (s *S3Store) putSingle(ctx context.Context, key string, body io.Reader, size int64, metadata ObjectMetadata) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	res, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(s.bucket),
+		Key:                aws.String(key),
+		Body:               bytes.NewReader(data),
+		ContentLength:      aws.Int64(int64(len(data))),
+		ContentType:        optionalString(metadata.ContentType),
+		CacheControl:       optionalString(metadata.CacheControl),
+		ContentDisposition: optionalString(metadata.ContentDisposition),
+		ContentEncoding:    optionalString(metadata.ContentEncoding),
+		ContentLanguage:    optionalString(metadata.ContentLanguage),
+		Metadata:           toS3Metadata(metadata.User),
+		StorageClass:       optionalString(s.storageClass),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(res.VersionId), nil
+}
+
+// putMultipart uploads the object in parts of the configured size. If the
+// upload can't be completed, it is aborted so that the parts uploaded so far
+// don't linger (and get billed) in the bucket. Like putSingle, it returns the
+// version ID of the uploaded object.
+func (s *S3Store) putMultipart(ctx context.Context, key string, body io.Reader, metadata ObjectMetadata) (string, error) {
+	created, err := s.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(s.bucket),
+		Key:                aws.String(key),
+		ContentType:        optionalString(metadata.ContentType),
+		CacheControl:       optionalString(metadata.CacheControl),
+		ContentDisposition: optionalString(metadata.ContentDisposition),
+		ContentEncoding:    optionalString(metadata.ContentEncoding),
+		ContentLanguage:    optionalString(metadata.ContentLanguage),
+		Metadata:           toS3Metadata(metadata.User),
+		StorageClass:       optionalString(s.storageClass),
+	})
+	if err != nil {
+		return "", err
+	}
+	var completed *s3.CompleteMultipartUploadOutput
+	parts, err := s.uploadParts(ctx, key, created.UploadId, body)
+	if err == nil {
+		completed, err = s.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        created.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		// Abort even if ctx is done, the upload is orphaned otherwise
+		_, abortErr := s.client.AbortMultipartUploadWithContext(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		})
+		if abortErr != nil {
+			return "", fmt.Errorf("%w (aborting multipart upload %s also failed: %v)", err, aws.StringValue(created.UploadId), abortErr)
+		}
+		return "", err
+	}
+	return aws.StringValue(completed.VersionId), nil
+}
+
+func (s *S3Store) uploadParts(ctx context.Context, key string, uploadID *string, body io.Reader) ([]*s3.CompletedPart, error) {
+	var parts []*s3.CompletedPart
+	buf := make([]byte, s.multipart.PartSize)
+	for partNumber := int64(1); ; partNumber++ {
+		n, err := io.ReadFull(body, buf)
+		if errors.Is(err, io.EOF) {
+			return parts, nil
+		}
+		last := errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return nil, err
+		}
+		etag, err := s.uploadPart(ctx, key, uploadID, partNumber, buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: etag, PartNumber: aws.Int64(partNumber)})
+		if last {
+			return parts, nil
+		}
+	}
+}
+
+// uploadPart uploads a single part, retrying up to PartRetries times.
+func (s *S3Store) uploadPart(ctx context.Context, key string, uploadID *string, partNumber int64, part []byte) (*string, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := s.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int64(partNumber),
+			Body:          bytes.NewReader(part),
+			ContentLength: aws.Int64(int64(len(part))),
+		})
+		if err == nil {
+			return res.ETag, nil
+		}
+		if attempt >= s.multipart.PartRetries || ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt+1) * partRetryDelay):
+		}
+	}
+}
+
+// headWritten is HeadVersion for an object that has just been written, with the
+// version ID (if any) that the write returned, returning ErrNotVisible if it is
+// not found.
+func (s *S3Store) headWritten(ctx context.Context, key string, versionID string) (ObjectInfo, error) {
+	info, err := s.HeadVersion(ctx, key, versionID)
+	if errors.Is(err, ErrNotFound) {
+		return ObjectInfo{}, ErrNotVisible
+	}
+	return info, err
+}
+
+func (s *S3Store) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.HeadVersion(ctx, key, "")
+}
+
+// HeadVersion returns the current version of the object if versionID is empty.
+func (s *S3Store) HeadVersion(ctx context.Context, key string, versionID string) (ObjectInfo, error) {
+	res, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(s.bucket),
+		Key:       aws.String(key),
+		VersionId: optionalString(versionID),
+	})
+	if err != nil {
+		return ObjectInfo{}, mapS3Error(err)
+	}
+	return ObjectInfo{
+		Size:         aws.Int64Value(res.ContentLength),
+		ETag:         aws.StringValue(res.ETag),
+		StorageClass: aws.StringValue(res.StorageClass),
+		Metadata: ObjectMetadata{
+			ContentType:        aws.StringValue(res.ContentType),
+			CacheControl:       aws.StringValue(res.CacheControl),
+			ContentDisposition: aws.StringValue(res.ContentDisposition),
+			ContentEncoding:    aws.StringValue(res.ContentEncoding),
+			ContentLanguage:    aws.StringValue(res.ContentLanguage),
+			User:               fromS3Metadata(res.Metadata),
+		},
+		VersionID: aws.StringValue(res.VersionId),
+	}, nil
+}
+
+// CopyFrom copies the object with a CopyObject request, which requires the
+// credentials of this store to be able to read from the bucket of src.
+func (s *S3Store) CopyFrom(ctx context.Context, src ObjectStore, key string) (ObjectInfo, error) {
+	srcStore, ok := src.(*S3Store)
+	if !ok {
+		return ObjectInfo{}, ErrCopyUnsupported
+	}
+	copySource := (&url.URL{Path: srcStore.bucket + "/" + key}).EscapedPath()
+	res, err := s.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		CopySource:   aws.String(copySource),
+		StorageClass: optionalString(s.storageClass),
+	})
+	if err != nil {
+		return ObjectInfo{}, mapS3Error(err)
+	}
+	return s.headWritten(ctx, key, aws.StringValue(res.VersionId))
+}
+
+func (s *S3Store) List(ctx context.Context, startAfter string, limit int) ([]string, bool, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		MaxKeys: aws.Int64(int64(limit)),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	res, err := s.client.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, false, mapS3Error(err)
+	}
+	keys := make([]string, 0, len(res.Contents))
+	for _, obj := range res.Contents {
+		keys = append(keys, aws.StringValue(obj.Key))
+	}
+	return keys, aws.BoolValue(res.IsTruncated), nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return mapS3Error(err)
+}
+
+// optionalString returns nil for "", so that the header is not sent.
+func optionalString(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return aws.String(v)
+}
+
+func toS3Metadata(user map[string]string) map[string]*string {
+	if len(user) == 0 {
+		return nil
+	}
+	return aws.StringMap(user)
+}
+
+// fromS3Metadata lowercases the names of the user-defined metadata, which the
+// SDK returns canonicalized as HTTP header names.
+func fromS3Metadata(metadata map[string]*string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	user := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		user[strings.ToLower(name)] = aws.StringValue(value)
+	}
+	return user
+}
+
+// mapS3Error wraps errors for missing objects with ErrNotFound, and those for
+// requests that were not allowed with ErrAccessDenied, while keeping the
+// original error in the chain so that callers can still inspect it.
+func mapS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch reqErr.StatusCode() {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %w", ErrNotFound, err)
+		case http.StatusForbidden:
+			return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NoSuchVersion", "NotFound":
+			return fmt.Errorf("%w: %w", ErrNotFound, err)
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+			return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+	}
+	return err
+}
+
+func (s *S3Store) ListMultipartUploads(ctx context.Context) ([]MultipartUpload, error) {
+	var uploads []MultipartUpload
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(s.bucket)}
+	for {
+		res, err := s.client.ListMultipartUploadsWithContext(ctx, input)
+		if err != nil {
+			return nil, mapS3Error(err)
+		}
+		for _, upload := range res.Uploads {
+			uploads = append(uploads, MultipartUpload{
+				Key:       aws.StringValue(upload.Key),
+				UploadID:  aws.StringValue(upload.UploadId),
+				Initiated: aws.TimeValue(upload.Initiated),
+			})
+		}
+		if !aws.BoolValue(res.IsTruncated) {
+			return uploads, nil
+		}
+		input.KeyMarker = res.NextKeyMarker
+		input.UploadIdMarker = res.NextUploadIdMarker
+	}
+}
+
+func (s *S3Store) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	_, err := s.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchUpload {
+		return nil
+	}
+	return mapS3Error(err)
+}
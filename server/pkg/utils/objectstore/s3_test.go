@@ -0,0 +1,276 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// stallingS3 is an S3 endpoint that starts each transfer and then stalls until
+// the client goes away.
+func stallingS3(t *testing.T) *S3Store {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Length", "1048576")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(make([]byte, 1024))
+			w.(http.Flusher).Flush()
+		case http.MethodPut:
+			_, _ = io.ReadAll(r.Body)
+		}
+		<-r.Context().Done()
+	})
+	return newTestS3Store(t, h, MultipartConfig{})
+}
+
+// newTestS3Store returns an S3Store whose requests are served by h. The client
+// doesn't retry requests itself.
+func newTestS3Store(t *testing.T, h http.Handler, multipart MultipartConfig) *S3Store {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewS3Store(s3.New(sess), "bucket", multipart)
+}
+
+func TestS3StoreGetCancelledMidTransfer(t *testing.T) {
+	store := stallingS3(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body, err := store.Get(ctx, "key")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer body.Close()
+	buf := make([]byte, 1024)
+	if _, err := io.ReadFull(body, buf); err != nil {
+		t.Fatalf("could not read the start of the object: %v", err)
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("reading a cancelled download succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not stop after its context was cancelled")
+	}
+}
+
+func TestS3StorePutCancelledMidTransfer(t *testing.T) {
+	store := stallingS3(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		_, err := store.Put(ctx, "key", bytes.NewReader(make([]byte, 1024)), 1024)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("cancelled upload succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload did not stop after its context was cancelled")
+	}
+}
+
+// multipartS3 is a minimal S3 endpoint for a single object, supporting both
+// single and multipart uploads.
+type multipartS3 struct {
+	mu         sync.Mutex
+	object     []byte
+	parts      map[string][]byte
+	singlePuts int
+	aborted    bool
+	// failPart is the number of times that the upload of each part fails
+	failPart map[string]int
+}
+
+func (m *multipartS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		m.parts = map[string][]byte{}
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		data, _ := io.ReadAll(r.Body)
+		part := q.Get("partNumber")
+		if m.failPart[part] > 0 {
+			m.failPart[part]--
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.parts[part] = data
+		w.Header().Set("ETag", `"part-`+part+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		m.object = nil
+		for i := 1; i <= len(m.parts); i++ {
+			m.object = append(m.object, m.parts[fmt.Sprint(i)]...)
+		}
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"multipart-%d"</ETag></CompleteMultipartUploadResult>`, len(m.parts))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		m.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		m.object, _ = io.ReadAll(r.Body)
+		m.singlePuts++
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", fmt.Sprint(len(m.object)))
+		w.Header().Set("ETag", `"etag"`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestS3StorePutRouting(t *testing.T) {
+	data := []byte("0123456789")
+	tests := []struct {
+		name       string
+		threshold  int64
+		failPart   map[string]int
+		singlePuts int
+	}{
+		{name: "below threshold", threshold: 11, singlePuts: 1},
+		{name: "at threshold", threshold: 10},
+		{name: "part retried", threshold: 10, failPart: map[string]int{"2": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &multipartS3{failPart: tt.failPart}
+			store := newTestS3Store(t, backend, MultipartConfig{Threshold: tt.threshold, PartSize: 4, PartRetries: 1})
+			info, err := store.Put(context.Background(), "key", bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			if info.Size != int64(len(data)) {
+				t.Errorf("Put() size = %d, want %d", info.Size, len(data))
+			}
+			if !bytes.Equal(backend.object, data) {
+				t.Errorf("stored object = %q, want %q", backend.object, data)
+			}
+			if backend.singlePuts != tt.singlePuts {
+				t.Errorf("single part puts = %d, want %d", backend.singlePuts, tt.singlePuts)
+			}
+		})
+	}
+}
+
+func TestS3StorePutMultipartAbortsOnFailure(t *testing.T) {
+	backend := &multipartS3{failPart: map[string]int{"2": 2}}
+	store := newTestS3Store(t, backend, MultipartConfig{Threshold: 1, PartSize: 4, PartRetries: 1})
+	data := []byte("0123456789")
+	if _, err := store.Put(context.Background(), "key", bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatal("Put() succeeded although a part could not be uploaded")
+	}
+	if !backend.aborted {
+		t.Error("the failed multipart upload was not aborted")
+	}
+	if backend.object != nil {
+		t.Errorf("the failed multipart upload was completed")
+	}
+}
+
+func TestS3StoreAccessDenied(t *testing.T) {
+	store := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+	}), MultipartConfig{})
+	ctx := context.Background()
+	if _, err := store.Head(ctx, "key"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Head() error = %v, want ErrAccessDenied", err)
+	}
+	if _, err := store.Put(ctx, "key", bytes.NewReader([]byte("data")), 4); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Put() error = %v, want ErrAccessDenied", err)
+	}
+}
+
+func TestS3StoreStorageClass(t *testing.T) {
+	var storageClasses []string
+	store := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			_, _ = io.ReadAll(r.Body)
+			storageClasses = append(storageClasses, r.Header.Get("X-Amz-Storage-Class"))
+			if r.Header.Get("X-Amz-Copy-Source") != "" {
+				fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+			}
+		case http.MethodHead:
+			w.Header().Set("Content-Length", "4")
+			w.Header().Set("X-Amz-Storage-Class", "STANDARD_IA")
+		}
+	}), MultipartConfig{}).WithStorageClass(s3.StorageClassStandardIa)
+	ctx := context.Background()
+	info, err := store.Put(ctx, "key", bytes.NewReader([]byte("data")), 4)
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if info.StorageClass != s3.StorageClassStandardIa {
+		t.Errorf("Put() storage class = %q, want %q", info.StorageClass, s3.StorageClassStandardIa)
+	}
+	if _, err := store.CopyFrom(ctx, NewS3Store(nil, "source", MultipartConfig{}), "key"); err != nil {
+		t.Fatalf("CopyFrom() error = %v", err)
+	}
+	if len(storageClasses) != 2 || storageClasses[0] != "STANDARD_IA" || storageClasses[1] != "STANDARD_IA" {
+		t.Errorf("storage classes of the put and the copy = %v, want STANDARD_IA", storageClasses)
+	}
+}
+
+func TestS3StoreCopyFrom(t *testing.T) {
+	var copySource string
+	store := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			copySource = r.Header.Get("X-Amz-Copy-Source")
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+		case http.MethodHead:
+			w.Header().Set("Content-Length", "4")
+			w.Header().Set("ETag", `"etag"`)
+		}
+	}), MultipartConfig{})
+	ctx := context.Background()
+	info, err := store.CopyFrom(ctx, NewS3Store(nil, "source", MultipartConfig{}), "a b/c")
+	if err != nil {
+		t.Fatalf("CopyFrom() error = %v", err)
+	}
+	if copySource != "source/a%20b/c" {
+		t.Errorf("copy source = %q, want %q", copySource, "source/a%20b/c")
+	}
+	if info.Size != 4 || info.ETag != `"etag"` {
+		t.Errorf("CopyFrom() = %+v, want the info of the copy", info)
+	}
+	if _, err := store.CopyFrom(ctx, NewMemoryStore(), "key"); !errors.Is(err, ErrCopyUnsupported) {
+		t.Errorf("CopyFrom(memory store) error = %v, want ErrCopyUnsupported", err)
+	}
+}
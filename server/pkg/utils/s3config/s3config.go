@@ -9,8 +9,11 @@ import (
 	"github.com/ente-io/museum/ente"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"path/filepath"
+	"strings"
 
 	"github.com/ente-io/museum/pkg/utils/array"
+	"github.com/ente-io/museum/pkg/utils/objectstore"
 )
 
 // S3Config is the file which abstracts away s3 related configs for clients.
@@ -36,8 +39,32 @@ type S3Config struct {
 	s3Configs map[string]*aws.Config
 	// A map from data centers to pre-created S3 clients
 	s3Clients map[string]s3.S3
+	// A map from data centers to the object stores used to read and write
+	// objects in them
+	objectStores map[string]objectstore.ObjectStore
 	// Indicates if compliance is enabled for the Wasabi DC.
 	isWasabiComplianceEnabled bool
+	// Buckets in which file data metadata objects are stored compressed
+	compressedBuckets map[string]bool
+	// ID of the key that file data objects replicated to the bucket are
+	// encrypted with, if any
+	encryptionKeyIDs map[string]string
+	// S3 storage class that file data objects are replicated to the bucket
+	// with, if not the bucket's default
+	storageClasses map[string]string
+	// Buckets with S3 Object Lock, in which objects can't be overwritten
+	objectLockedBuckets map[string]bool
+	// versionedBuckets are the buckets with S3 versioning enabled
+	versionedBuckets map[string]bool
+	// A map from data centers to the mapping of the keys of the objects to
+	// the keys they are stored under in that DC, see keyMapping
+	keyMappings map[string]objectstore.KeyMapping
+	// A map from data centers to the identity of the physical store behind
+	// them, see storeIdentity
+	storeIdentities map[string]string
+	// A map from data centers (backed by S3) to the provider account they
+	// are accessed with, see providerIdentity
+	providerIdentities map[string]string
 	// Indicates if local minio buckets are being used. Enables various
 	// debugging workarounds; not tested/intended for production.
 	areLocalBuckets bool
@@ -123,6 +150,15 @@ func (config *S3Config) initialize() {
 	config.buckets = make(map[string]string)
 	config.s3Configs = make(map[string]*aws.Config)
 	config.s3Clients = make(map[string]s3.S3)
+	config.compressedBuckets = make(map[string]bool)
+	config.encryptionKeyIDs = make(map[string]string)
+	config.storageClasses = make(map[string]string)
+	config.objectLockedBuckets = make(map[string]bool)
+	config.versionedBuckets = make(map[string]bool)
+	config.keyMappings = make(map[string]objectstore.KeyMapping)
+	config.storeIdentities = make(map[string]string)
+	config.providerIdentities = make(map[string]string)
+	config.objectStores = make(map[string]objectstore.ObjectStore)
 
 	usePathStyleURLs := viper.GetBool("s3.use_path_style_urls")
 	areLocalBuckets := viper.GetBool("s3.are_local_buckets")
@@ -150,11 +186,39 @@ func (config *S3Config) initialize() {
 		s3Client := *s3.New(s3Session)
 		config.s3Configs[dc] = &s3Config
 		config.s3Clients[dc] = s3Client
+		config.compressedBuckets[dc] = viper.GetBool("s3." + dc + ".compress")
+		if keyID := viper.GetString("s3." + dc + ".encryption-key"); keyID != "" {
+			// viper lowercases the IDs of the configured keys
+			config.encryptionKeyIDs[dc] = strings.ToLower(keyID)
+		}
+		if storageClass := viper.GetString("s3." + dc + ".storage-class"); storageClass != "" {
+			config.storageClasses[dc] = parseStorageClass(dc, storageClass)
+		}
+		config.objectLockedBuckets[dc] = viper.GetBool("s3." + dc + ".object-lock")
+		config.versionedBuckets[dc] = viper.GetBool("s3." + dc + ".versioned")
+		config.objectStores[dc] = newObjectStore(dc, &s3Client, config.buckets[dc], config.storageClasses[dc])
+		if mapping := keyMapping(dc); !mapping.IsIdentity() {
+			config.keyMappings[dc] = mapping
+			config.objectStores[dc] = objectstore.NewKeyMappedStore(config.objectStores[dc], mapping)
+		}
+		if config.buckets[dc] != "" {
+			config.storeIdentities[dc] = storeIdentity(dc, &s3Config, config.buckets[dc])
+			if mapping, ok := config.keyMappings[dc]; ok {
+				// Objects stored under different keys are separate, even in
+				// the same bucket
+				config.storeIdentities[dc] += " " + mapping.String()
+			}
+			if store := viper.GetString("s3." + dc + ".store"); store == "" || store == "s3" {
+				config.providerIdentities[dc] = providerIdentity(&s3Config)
+			}
+		}
 		if dc == dcWasabiEuropeCentral_v3 {
 			config.isWasabiComplianceEnabled = viper.GetBool("s3." + dc + ".compliance")
 		}
 	}
 
+	config.warnAboutSharedBackends(dcs[:])
+
 	if err := viper.Sub("s3").Unmarshal(&config.fileDataConfig); err != nil {
 		log.Fatalf("Unable to decode into struct: %v\n", err)
 		return
@@ -162,6 +226,165 @@ func (config *S3Config) initialize() {
 
 }
 
+// newObjectStore returns the object store configured by s3.<dc>.store for the
+// data center. Unless configured otherwise, this is the S3 bucket.
+func newObjectStore(dc string, s3Client *s3.S3, bucket string, storageClass string) objectstore.ObjectStore {
+	switch store := viper.GetString("s3." + dc + ".store"); store {
+	case "", "s3":
+		multipart := multipartConfig()
+		if IsArchivalStorageClass(storageClass) {
+			// Single part uploads have a plain MD5 ETag, which is the only way
+			// to verify objects that can't be read back
+			multipart.Threshold = 0
+		}
+		return objectstore.NewS3Store(s3Client, bucket, multipart).WithStorageClass(storageClass)
+	case "fs":
+		path := viper.GetString("s3." + dc + ".path")
+		if path == "" {
+			log.Fatalf("s3.%s.path is required for the fs object store", dc)
+		}
+		if storageClass != "" {
+			log.Warnf("s3.%s.storage-class is ignored by the fs object store", dc)
+		}
+		return objectstore.NewFSStore(path)
+	case "memory":
+		if storageClass != "" {
+			log.Warnf("s3.%s.storage-class is ignored by the memory object store", dc)
+		}
+		memory := objectstore.NewMemoryStore()
+		if viper.GetBool("s3." + dc + ".versioned") {
+			memory = objectstore.NewVersionedMemoryStore()
+		}
+		latency := viper.GetDuration("s3." + dc + ".latency")
+		bytesPerSecond := viper.GetInt64("s3." + dc + ".bytes-per-second")
+		if latency > 0 || bytesPerSecond > 0 {
+			return objectstore.NewLatencyStore(memory, latency, bytesPerSecond)
+		}
+		return memory
+	default:
+		log.Fatalf("Unknown object store %q for %s", store, dc)
+		return nil
+	}
+}
+
+// keyMapping returns the mapping configured by s3.<dc>.key-prefix and
+// s3.<dc>.key-separator for the keys that the data center's objects are stored
+// under, the identity unless either is set.
+func keyMapping(dc string) objectstore.KeyMapping {
+	mapping := objectstore.KeyMapping{
+		Prefix:    viper.GetString("s3." + dc + ".key-prefix"),
+		Separator: viper.GetString("s3." + dc + ".key-separator"),
+	}
+	if mapping.IsIdentity() {
+		return objectstore.KeyMapping{}
+	}
+	if err := mapping.Validate(); err != nil {
+		log.Fatalf("Invalid key mapping for %s: %v", dc, err)
+	}
+	if viper.GetString("s3."+dc+".store") == "fs" {
+		log.Fatalf("s3.%s.key-prefix and key-separator are not supported by the fs object store", dc)
+	}
+	return mapping
+}
+
+// parseStorageClass returns the S3 storage class configured for the data
+// center, in the canonical (upper) case.
+func parseStorageClass(dc string, storageClass string) string {
+	storageClass = strings.ToUpper(storageClass)
+	if !array.StringInList(storageClass, s3.StorageClass_Values()) {
+		log.Fatalf("Unknown storage class %q for %s, expected one of %v", storageClass, dc, s3.StorageClass_Values())
+	}
+	return storageClass
+}
+
+// IsArchivalStorageClass returns true for the S3 storage classes whose objects
+// can't be read without restoring them first.
+func IsArchivalStorageClass(storageClass string) bool {
+	return storageClass == s3.StorageClassGlacier || storageClass == s3.StorageClassDeepArchive
+}
+
+// storeIdentity identifies the physical store that the data center's objects
+// end up in, so that data centers which are aliases of each other can be told
+// apart from genuine replicas. For S3 this is the endpoint along with the
+// bucket name.
+func storeIdentity(dc string, s3Config *aws.Config, bucket string) string {
+	switch viper.GetString("s3." + dc + ".store") {
+	case "fs":
+		return "fs:" + filepath.Clean(viper.GetString("s3."+dc+".path"))
+	case "memory":
+		// Each memory store is separate
+		return "memory:" + dc
+	}
+	return "s3:" + normalizedEndpoint(s3Config) + "/" + bucket
+}
+
+// providerIdentity identifies the S3 endpoint and the account that a data
+// center is accessed with. Objects can be copied server side between the
+// buckets of data centers with the same provider identity.
+func providerIdentity(s3Config *aws.Config) string {
+	accessKeyID := ""
+	if creds, err := s3Config.Credentials.Get(); err == nil {
+		accessKeyID = creds.AccessKeyID
+	}
+	return normalizedEndpoint(s3Config) + "|" + aws.StringValue(s3Config.Region) + "|" + accessKeyID
+}
+
+func normalizedEndpoint(s3Config *aws.Config) string {
+	endpoint := strings.ToLower(aws.StringValue(s3Config.Endpoint))
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if endpoint == "" {
+		endpoint = "s3." + aws.StringValue(s3Config.Region) + ".amazonaws.com"
+	}
+	return endpoint
+}
+
+// warnAboutSharedBackends logs a warning for each pair of data centers that
+// are backed by the same physical store, which is most likely a
+// misconfiguration.
+func (config *S3Config) warnAboutSharedBackends(dcs []string) {
+	for i, a := range dcs {
+		for _, b := range dcs[i+1:] {
+			if config.SharesBackend(a, b) {
+				log.Warnf("Data centers %s and %s are backed by the same store (%s), copies in one are not replicas of the other", a, b, config.storeIdentities[a])
+			}
+		}
+	}
+}
+
+const (
+	// minPartSize is the smallest part size that S3 accepts for multipart uploads.
+	minPartSize = 5 * 1024 * 1024
+
+	defaultMultipartThreshold = 64 * 1024 * 1024
+	defaultPartSize           = 16 * 1024 * 1024
+	defaultPartRetries        = 3
+)
+
+// multipartConfig returns the configuration for multipart uploads of file data
+// objects, as set in replication.file-data.multipart. A threshold of 0 disables
+// them, the default is only used if none is set.
+func multipartConfig() objectstore.MultipartConfig {
+	cfg := objectstore.MultipartConfig{
+		Threshold:   defaultMultipartThreshold,
+		PartSize:    viper.GetInt64("replication.file-data.multipart.part-size-bytes"),
+		PartRetries: defaultPartRetries,
+	}
+	if viper.IsSet("replication.file-data.multipart.threshold-bytes") {
+		cfg.Threshold = viper.GetInt64("replication.file-data.multipart.threshold-bytes")
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = defaultPartSize
+	} else if cfg.PartSize < minPartSize {
+		log.Warnf("replication.file-data.multipart.part-size-bytes is below the minimum of %d, using the minimum", minPartSize)
+		cfg.PartSize = minPartSize
+	}
+	if viper.IsSet("replication.file-data.multipart.part-retries") {
+		cfg.PartRetries = viper.GetInt("replication.file-data.multipart.part-retries")
+	}
+	return cfg
+}
+
 func (config *S3Config) GetBucket(dcOrBucketID string) *string {
 	bucket := config.buckets[dcOrBucketID]
 	return &bucket
@@ -187,6 +410,86 @@ func (config *S3Config) GetReplicatedBuckets(oType ente.ObjectType) []string {
 	panic(fmt.Sprintf("ops not supported for object type: %s", oType))
 }
 
+// IsCompressedBucket returns true if file data metadata objects replicated to
+// the bucket should be stored compressed.
+func (config *S3Config) IsCompressedBucket(bucketID string) bool {
+	return config.compressedBuckets[bucketID]
+}
+
+// GetEncryptionKeyID returns the ID of the key that file data metadata objects
+// replicated to the bucket should be encrypted with, or "" if they should be
+// stored as is.
+func (config *S3Config) GetEncryptionKeyID(bucketID string) string {
+	return config.encryptionKeyIDs[bucketID]
+}
+
+// GetStorageClass returns the S3 storage class that file data objects are
+// replicated to the bucket with, or "" for the bucket's default.
+func (config *S3Config) GetStorageClass(bucketID string) string {
+	return config.storageClasses[bucketID]
+}
+
+// IsReadable returns false for the buckets whose file data objects can't be
+// read back right away because of their storage class, see
+// IsArchivalStorageClass. Copies in them are verified by their metadata only.
+func (config *S3Config) IsReadable(bucketID string) bool {
+	return !IsArchivalStorageClass(config.storageClasses[bucketID])
+}
+
+// IsObjectLocked returns true for the buckets with S3 Object Lock (WORM), in
+// which file data objects can't be overwritten or deleted once written.
+func (config *S3Config) IsObjectLocked(bucketID string) bool {
+	return config.objectLockedBuckets[bucketID]
+}
+
+// IsVersioned returns true for the buckets with S3 versioning enabled, in which
+// every write of an object creates a new version of it.
+func (config *S3Config) IsVersioned(bucketID string) bool {
+	return config.versionedBuckets[bucketID]
+}
+
+// GetStoreIdentity returns an identifier of the physical store behind the
+// bucket, which is the same for buckets that are aliases of each other. It is
+// empty for buckets that are not configured.
+func (config *S3Config) GetStoreIdentity(bucketID string) string {
+	return config.storeIdentities[bucketID]
+}
+
+// SharesBackend returns true if the two (different) buckets are backed by the
+// same physical store, and so an object can't be replicated from one to the
+// other.
+func (config *S3Config) SharesBackend(bucketID string, otherBucketID string) bool {
+	if bucketID == otherBucketID {
+		return false
+	}
+	identity := config.storeIdentities[bucketID]
+	return identity != "" && identity == config.storeIdentities[otherBucketID]
+}
+
+// CanCopyBetween returns true if objects can be copied server side from the
+// source bucket to the destination bucket, i.e. they are different buckets at
+// the same S3 provider, accessed with the same credentials, that store objects
+// under the same keys.
+func (config *S3Config) CanCopyBetween(srcBucketID string, dstBucketID string) bool {
+	if config.SharesBackend(srcBucketID, dstBucketID) {
+		return false
+	}
+	if config.keyMappings[srcBucketID] != config.keyMappings[dstBucketID] {
+		// A copy keeps the key of the object it is copied from
+		return false
+	}
+	identity := config.providerIdentities[srcBucketID]
+	return identity != "" && identity == config.providerIdentities[dstBucketID]
+}
+
+// ObjectKey returns the key that the object with the given key is stored under
+// in the bucket, which is the same key unless the bucket maps its keys (see
+// objectstore.KeyMapping). The object store of the bucket maps the keys itself,
+// so this is only needed for the requests that bypass it.
+func (config *S3Config) ObjectKey(bucketID string, objectKey string) string {
+	return config.keyMappings[bucketID].Key(objectKey)
+}
+
 func (config *S3Config) IsBucketActive(bucketID string) bool {
 	return config.buckets[bucketID] != ""
 }
@@ -199,6 +502,11 @@ func (config *S3Config) GetS3Client(dcOrBucketID string) s3.S3 {
 	return config.s3Clients[dcOrBucketID]
 }
 
+// GetObjectStore returns the object store for the given data center / bucket ID.
+func (config *S3Config) GetObjectStore(dcOrBucketID string) objectstore.ObjectStore {
+	return config.objectStores[dcOrBucketID]
+}
+
 func (config *S3Config) GetHotDataCenter() string {
 	return config.hotDC
 }